@@ -1,15 +1,21 @@
 package chordmap
 
 import (
-	"crypto/sha1"
 	//"errors"
-	K "go_dht/constants"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"sync"
+	"time"
 )
 
+/*
+Safe for concurrent use. Methods never call each other while holding lock, as sync.RWMutex is not reentrant
+*/
 type ChordMapStruct struct {
-	start, end [K.ShaSize]byte // end is exclusive
-	table      map[string]string
+	lock       sync.RWMutex         // guards the range, the table and tombs
+	start, end ring.ID              // end is exclusive
+	table      map[string]Entry     // values with their versions, see version.go. Never Deleted
+	tombs      map[string]Tombstone // deleted keys, see tombstone.go. Never also in table
+	tree       *MerkleTree          // hashes of table and tombs. Updated with them
 }
 
 type CMInterface interface {
@@ -18,44 +24,81 @@ type CMInterface interface {
 	Delete(key string) (string, error)
 }
 
+/*
+Storage of a node. Implemented by ChordMapStruct, a single map under one lock, and ShardedMapStruct, for write heavy loads
+*/
+type Store interface {
+	CMInterface
+	CAS(key string, old string, value string, absent bool) error
+	InRange(key ring.ID) bool
+	GetKeys() []string
+	Len() int
+	Bytes() int
+	Items() map[string]string
+	Lookup(key string) (Entry, error)
+	Entries() map[string]Entry
+	Extend(start ring.ID, entries map[string]Entry) error
+	PartitionTable(key ring.ID) (Store, error)
+	Tree() *MerkleTree
+	BucketItems(buckets []uint32) map[string]Entry
+	Tombstones() map[string]Tombstone
+	Bury(key string, tomb Tombstone) error
+	Restore(key string, value string, version uint64) error
+	Compact(before time.Time) int
+	Stats() StoreStats
+}
+
+/*
+Metadata of a store, taken at once by Store.Stats
+*/
+type StoreStats struct {
+	Start      ring.ID // first key of the range
+	End        ring.ID // end of the range, exclusive. The range is the whole ring if Start == End
+	Keys       int
+	Bytes      int // bytes held by the keys and values
+	Tombstones int
+	Shards     int // 1 for a ChordMapStruct
+}
+
 /********* Helper functions **********************/
 
 /*
-Hashing function for a string
+Hashing function for a string. Uses the hash function and width of the ring config
 */
-func StrToSha(s string) [K.ShaSize]byte {
-	return sha1.Sum([]byte(s))
+func StrToSha(s string) ring.ID {
+	return ring.Hash([]byte(s))
 }
 
-/* Checks if x is within [start, end) i.e exclusive end, inclusive start. Also handles case of wrap around where end < start.
-If end == start, returns true i.e everything is in range.
+/*
+True if key is within [cms.start, cms.end). If start == end, everything is in range
 */
-func InRangeHelp(x [K.ShaSize]byte, start [K.ShaSize]byte, end [K.ShaSize]byte) bool {
-	if SSA.Cmp(start, end) == SSA.Equal {
-		return true
-	}
-	if SSA.Cmp(end, SSA.FromInt(0)) == SSA.Equal { // prevent subtract from 0 which results in compare with maxval
-		return SSA.InRange(x, start, SSA.MaxVal())
-	} else if SSA.Cmp(start, end) == SSA.Greater { // wrap around case and end != 0
-		return SSA.InRange(x, start, SSA.MaxVal()) || InRangeHelp(x, SSA.FromInt(0), end)
-		// check [start, MaxVal], [0, end)
-	}
-	// start < end
-	return SSA.InRange(x, start, SSA.Sub(end, SSA.FromInt(1)))
+func (cms *ChordMapStruct) InRange(key ring.ID) bool {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	return cms.inRange(key)
+}
+
+// same as InRange. Assumes cms.lock is held
+func (cms *ChordMapStruct) inRange(key ring.ID) bool {
+	return key.Between(cms.start, cms.end, ring.ClosedOpen)
 }
 
 /********** Interface implementations ***********/
 
 /*
 Inserts (key, value) into the cms.table if the sha sum is >= cms.start and < cms.end. Else return an erro
-If key already present, updates with the newer entry
+If key already present, updates with the newer entry. The value gets a version later than the entry it replaces
 */
 func (cms *ChordMapStruct) Put(key string, value string) error {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
 	// if >= cms.start and < cms.end
-	if !InRangeHelp(StrToSha(key), cms.start, cms.end) {
+	sha := StrToSha(key)
+	if !cms.inRange(sha) {
 		return NewCMRangeError()
 	}
-	cms.table[key] = value
+	cur, _ := current(cms.table, cms.tombs, key)
+	set(cms.table, cms.tombs, cms.tree, sha, key, Entry{Value: value, Version: nextVersion(cur.Version)})
 	return nil
 }
 
@@ -65,36 +108,63 @@ Else if no key in table, return ("", CMKeyError)
 Else returns ("", CMRangeError)
 */
 func (cms *ChordMapStruct) Get(key string) (string, error) {
-	if !InRangeHelp(StrToSha(key), cms.start, cms.end) {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	if !cms.inRange(StrToSha(key)) {
 		return "", NewCMRangeError()
 	} else if ret, present := cms.table[key]; !present { // no key in table
 		return "", NewCMKeyError()
 	} else { // valid key with value inserted
-		return ret, nil
+		return ret.Value, nil
 	}
 }
 
 /*
-Deletes key from table and returns (value, error)
+Deletes key from table, leaving a tombstone, and returns (value, error)
 If key is present return (value, nil)
 Else if key is not in range return ("", CMRangeError)
 Else if key nit present return ("", CMKeyError)
 */
 func (cms *ChordMapStruct) Delete(key string) (string, error) {
-	if !InRangeHelp(StrToSha(key), cms.start, cms.end) {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	sha := StrToSha(key)
+	if !cms.inRange(sha) {
 		return "", NewCMRangeError()
 	} else if ret, present := cms.table[key]; !present { // no key in table
 		return "", NewCMKeyError()
 	} else { // valid key with value inserted
-		delete(cms.table, key)
-		return ret, nil
+		set(cms.table, cms.tombs, cms.tree, sha, key, Entry{Version: nextVersion(ret.Version), Deleted: true})
+		return ret.Value, nil
 	}
 }
 
+/*
+Compare and swap. Sets key to value if key currently maps to old. If absent is set, key must not be present instead, a deleted key is not.
+Returns CMRangeError if key is not in range and CMCASError if the current value does not match
+*/
+func (cms *ChordMapStruct) CAS(key string, old string, value string, absent bool) error {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	sha := StrToSha(key)
+	if !cms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	cur, present := cms.table[key]
+	if (absent && present) || (!absent && (!present || cur.Value != old)) {
+		return NewCMCASError()
+	}
+	prev, _ := current(cms.table, cms.tombs, key) // the tombstone of a deleted key
+	set(cms.table, cms.tombs, cms.tree, sha, key, Entry{Value: value, Version: nextVersion(prev.Version)})
+	return nil
+}
+
 /*
 Returns all the keys in the chord map
 */
 func (cms *ChordMapStruct) GetKeys() []string {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
 	keys := make([]string, len(cms.table))
 	i := 0
 	for k := range cms.table {
@@ -105,20 +175,211 @@ func (cms *ChordMapStruct) GetKeys() []string {
 }
 
 /*
-Splits a ChorMap on key. Returned chordmap gets all keys < key. cms gets remainder i.e [key, cms.end)
+Returns the number of keys in the chord map
+*/
+func (cms *ChordMapStruct) Len() int {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	return len(cms.table)
+}
+
+/*
+Returns the number of bytes held by the keys and values of the chord map
+*/
+func (cms *ChordMapStruct) Bytes() int {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	ret := 0
+	for k, e := range cms.table {
+		ret += len(k) + len(e.Value)
+	}
+	return ret
+}
+
+/*
+Returns the range and counts of the chord map, taken while it does not change
+*/
+func (cms *ChordMapStruct) Stats() StoreStats {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	ret := StoreStats{Start: cms.start, End: cms.end, Keys: len(cms.table), Tombstones: len(cms.tombs), Shards: 1}
+	for k, e := range cms.table {
+		ret.Bytes += len(k) + len(e.Value)
+	}
+	return ret
+}
+
+/*
+Returns a copy of all the (key, value)s in the chord map
+*/
+func (cms *ChordMapStruct) Items() map[string]string {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	items := make(map[string]string, len(cms.table))
+	for k, e := range cms.table {
+		items[k] = e.Value
+	}
+	return items
+}
+
+/*
+Returns the entry of key, its value or its tombstone, with its version
+Returns CMRangeError if key is not in range and CMKeyError if key has neither
+*/
+func (cms *ChordMapStruct) Lookup(key string) (Entry, error) {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	if !cms.inRange(StrToSha(key)) {
+		return Entry{}, NewCMRangeError()
+	}
+	if ret, present := current(cms.table, cms.tombs, key); present {
+		return ret, nil
+	}
+	return Entry{}, NewCMKeyError()
+}
+
+/*
+Returns a copy of the entries of the chord map, values and tombstones with their versions
+*/
+func (cms *ChordMapStruct) Entries() map[string]Entry {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	entries := make(map[string]Entry, len(cms.table)+len(cms.tombs))
+	for k, e := range cms.table {
+		entries[k] = e
+	}
+	for k, tomb := range cms.tombs {
+		entries[k] = Entry{Version: tomb.Version, Deleted: true}
+	}
+	return entries
+}
+
+/*
+Returns the Merkle tree of the chord map, kept up to date by every write
+*/
+func (cms *ChordMapStruct) Tree() *MerkleTree {
+	return cms.tree
+}
+
+/*
+Returns a copy of the entries, values and tombstones, in the given buckets of the Merkle tree
+*/
+func (cms *ChordMapStruct) BucketItems(buckets []uint32) map[string]Entry {
+	want := bucketSet(buckets)
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	items := make(map[string]Entry)
+	for k, e := range cms.table {
+		if want[Bucket(StrToSha(k))] {
+			items[k] = e
+		}
+	}
+	for k, tomb := range cms.tombs {
+		if want[Bucket(StrToSha(k))] {
+			items[k] = Entry{Version: tomb.Version, Deleted: true}
+		}
+	}
+	return items
+}
+
+/*
+Returns a copy of the tombstones of the chord map
+*/
+func (cms *ChordMapStruct) Tombstones() map[string]Tombstone {
+	cms.lock.RLock()
+	defer cms.lock.RUnlock()
+	tombs := make(map[string]Tombstone, len(cms.tombs))
+	for k, tomb := range cms.tombs {
+		tombs[k] = tomb
+	}
+	return tombs
+}
+
+/*
+Deletes key and records tomb for it if tomb is newer than the entry of key, see version.go. Applies a delete made by another node.
+Returns CMRangeError if key is not in range and CMCASError if key has a value or tombstone at least as new
+*/
+func (cms *ChordMapStruct) Bury(key string, tomb Tombstone) error {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	sha := StrToSha(key)
+	if !cms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	return apply(cms.table, cms.tombs, cms.tree, sha, key, Entry{Version: tomb.Version, Deleted: true})
+}
+
+/*
+Sets key to value at version version if it is newer than the entry of key. Restores a key copied from another node, which must not
+undo a newer write or delete. Returns CMRangeError if key is not in range and CMCASError if key has a value or tombstone at least as new
+*/
+func (cms *ChordMapStruct) Restore(key string, value string, version uint64) error {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	sha := StrToSha(key)
+	if !cms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	return apply(cms.table, cms.tombs, cms.tree, sha, key, Entry{Value: value, Version: version})
+}
+
+/*
+Drops the tombstones of deletes made before before. Returns the number dropped
+*/
+func (cms *ChordMapStruct) Compact(before time.Time) int {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	return compact(cms.tombs, cms.tree, before)
+}
+
+/*
+Grows the range of cms to [start, cms.end) and applies entries, keeping the newer entry of a key already held. Used to take over the
+range [start, cms.start) of a leaving predecessor. Returns CMRangeError if a key of entries is not within the new range, in which
+case cms is not modified
+*/
+func (cms *ChordMapStruct) Extend(start ring.ID, entries map[string]Entry) error {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	for k := range entries {
+		if !StrToSha(k).Between(start, cms.end, ring.ClosedOpen) {
+			return NewCMRangeError()
+		}
+	}
+	cms.start = start
+	for k, e := range entries {
+		apply(cms.table, cms.tombs, cms.tree, StrToSha(k), k, e)
+	}
+	return nil
+}
+
+/*
+Splits a ChorMap on key. Returned chordmap gets all keys < key and their tombstones. cms gets remainder i.e [key, cms.end)
 If key not [start, end) raise Range error. Else modifies cms and returns the extracted left half.
 Returns 2 Chordmaps to of the correct range and entries
 */
-func (cms *ChordMapStruct) PartitionTable(key [K.ShaSize]byte) (*ChordMapStruct, error) {
-	if !InRangeHelp(key, cms.start, cms.end) {
+func (cms *ChordMapStruct) PartitionTable(key ring.ID) (Store, error) {
+	cms.lock.Lock()
+	defer cms.lock.Unlock()
+	if !cms.inRange(key) {
 		return nil, NewCMRangeError()
 	}
-	ret := New(key, cms.end)
-	cms.end = key
-	for k, v := range cms.table {
-		err := ret.Put(k, v)
-		if err != nil { // If key belongs in left table, delete key from cms
-			cms.Delete(k)
+	ret := New(cms.start, key)
+	cms.start = key
+	for k, e := range cms.table {
+		if sha := StrToSha(k); ret.inRange(sha) { // key belongs in left table, move it
+			ret.table[k] = e
+			delete(cms.table, k)
+			cms.tree.update(sha, k, e, true, Entry{}, false)
+			ret.tree.update(sha, k, Entry{}, false, e, true)
+		}
+	}
+	for k, tomb := range cms.tombs {
+		if sha := StrToSha(k); ret.inRange(sha) {
+			ret.tombs[k] = tomb
+			delete(cms.tombs, k)
+			e := Entry{Version: tomb.Version, Deleted: true}
+			cms.tree.update(sha, k, e, true, Entry{}, false)
+			ret.tree.update(sha, k, Entry{}, false, e, true)
 		}
 	}
 	return ret, nil
@@ -127,10 +388,12 @@ func (cms *ChordMapStruct) PartitionTable(key [K.ShaSize]byte) (*ChordMapStruct,
 /* initializes a new chord map struct. Inclusive start and exclusive end. If start == end, means chordmap accepts everything
 Handles wrap arounds for start and end
 */
-func New(start [K.ShaSize]byte, end [K.ShaSize]byte) *ChordMapStruct {
+func New(start ring.ID, end ring.ID) *ChordMapStruct {
 	ret := new(ChordMapStruct)
-	copy(ret.start[:], start[:]) // make copy of array
-	copy(ret.end[:], end[:])
-	ret.table = make(map[string]string)
+	ret.start = start // arrays are value types
+	ret.end = end
+	ret.table = make(map[string]Entry)
+	ret.tombs = make(map[string]Tombstone)
+	ret.tree = new(MerkleTree)
 	return ret
 }
@@ -2,9 +2,11 @@ package chordmap
 
 import (
 	"fmt"
-	K "go_dht/constants"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"math/rand"
+	"sync"
 	"testing"
+	"time"
 )
 
 /*
@@ -29,36 +31,35 @@ func TestShaSum(t *testing.T) {
 */
 
 func TestRange(t *testing.T) {
-	start := SSA.MaxVal()
-	end := SSA.FromInt(0)
-	if !InRangeHelp(start, start, end) {
+	start := ring.MaxVal()
+	end := ring.FromInt(0)
+	if !New(start, end).InRange(start) {
 		t.Error("Range test 1 failed")
 	}
-	if InRangeHelp(end, start, end) {
+	if New(start, end).InRange(end) {
 		t.Error("Range test 2 failed")
 	}
-	start = SSA.Sub(SSA.MaxVal(), SSA.FromInt(1))
-	end = SSA.FromInt(2)
-	if !InRangeHelp(SSA.FromInt(1), start, end) {
+	start = ring.MaxVal().Sub(ring.FromInt(1))
+	end = ring.FromInt(2)
+	if !New(start, end).InRange(ring.FromInt(1)) {
 		t.Error("Range test 3 failed")
 	}
-	if !InRangeHelp(SSA.MaxVal(), start, end) {
+	if !New(start, end).InRange(ring.MaxVal()) {
 		t.Error("Range test 4 failed")
 	}
-	start = SSA.FromInt(0)
-	end = SSA.Sub(SSA.MaxVal(), SSA.FromInt(1))
-	if !InRangeHelp(SSA.Pow2(159), start, end) {
+	start = ring.FromInt(0)
+	end = ring.MaxVal().Sub(ring.FromInt(1))
+	if !New(start, end).InRange(ring.Pow2(159)) {
 		t.Error("Range test 5 failed")
 	}
-	if InRangeHelp(SSA.MaxVal(), start, end) {
+	if New(start, end).InRange(ring.MaxVal()) {
 		t.Error("Range test 6 failed")
 	}
 
 }
 
 func TestHashTable(t *testing.T) {
-	cms := New([K.ShaSize]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-		[K.ShaSize]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	cms := New(ring.FromInt(0), ring.FromInt(0))
 	err := cms.Put("key", "value")
 	if err != nil {
 		t.Errorf("Should not Get %s for key = %s, value = %s\n", err.Error(), "key", "value")
@@ -79,3 +80,352 @@ func TestHashTable(t *testing.T) {
 
 	}
 }
+
+func TestExtend(t *testing.T) {
+	key := StrToSha("key")
+	cms := New(key, key.Add(ring.FromInt(10)))
+	left := map[string]Entry{"key": {Value: "value", Version: 1}, "other": {Value: "value2", Version: 1}}
+	if err := cms.Extend(key.Add(ring.FromInt(1)), left); err == nil {
+		t.Errorf("Extend should give range error when a key is left of start\n")
+	}
+	if _, err := cms.Get("key"); err == nil {
+		t.Errorf("Failed Extend should not modify the chordmap\n")
+	}
+	if err := cms.Extend(StrToSha("other"), map[string]Entry{"other": {Value: "value2", Version: 1}}); err != nil {
+		t.Errorf("Extend failed. err = %s\n", err.Error())
+	}
+	if value, err := cms.Get("other"); err != nil || value != "value2" {
+		t.Errorf("Value should be %s not %s\n", "value2", value)
+	}
+	if len(cms.Items()) != 1 {
+		t.Errorf("Items should return 1 entry not %d\n", len(cms.Items()))
+	}
+}
+
+// the returned table holds the keys left of the split point and cms keeps the rest
+func TestPartitionTable(t *testing.T) {
+	cms := New(ring.FromInt(0), ring.FromInt(0)) // entire hash space
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for _, k := range keys {
+		cms.Put(k, "value")
+	}
+	split := StrToSha("c")
+	left, err := cms.PartitionTable(split)
+	if err != nil {
+		t.Fatalf("PartitionTable failed. err = %s\n", err.Error())
+	}
+	if left.Len()+cms.Len() != len(keys) {
+		t.Errorf("Partitions hold %d and %d keys, expected %d in total\n", left.Len(), cms.Len(), len(keys))
+	}
+	for _, k := range left.GetKeys() {
+		if !StrToSha(k).Between(ring.FromInt(0), split, ring.ClosedOpen) {
+			t.Errorf("Key %s should not be in the left partition\n", k)
+		}
+	}
+	if _, err = cms.Get("c"); err != nil {
+		t.Errorf("Split key should stay in cms\n")
+	}
+	if err = cms.Put(keys[0], "value"); StrToSha(keys[0]).Between(ring.FromInt(0), split, ring.ClosedOpen) && err == nil {
+		t.Errorf("cms should not accept keys of the left partition\n")
+	}
+}
+
+func TestCAS(t *testing.T) {
+	cms := New(ring.FromInt(0), ring.FromInt(0))
+	if err := cms.CAS("key", "", "v1", false); err == nil {
+		t.Errorf("CAS on missing key without absent should fail\n")
+	}
+	if err := cms.CAS("key", "", "v1", true); err != nil {
+		t.Errorf("CAS with absent on missing key failed. err = %s\n", err.Error())
+	}
+	if _, ok := cms.CAS("key", "", "v2", true).(*CMCASError); !ok {
+		t.Errorf("CAS with absent on present key should give CMCASError\n")
+	}
+	if _, ok := cms.CAS("key", "v0", "v2", false).(*CMCASError); !ok {
+		t.Errorf("CAS with wrong old value should give CMCASError\n")
+	}
+	if err := cms.CAS("key", "v1", "v2", false); err != nil {
+		t.Errorf("CAS with matching old value failed. err = %s\n", err.Error())
+	}
+	if value, _ := cms.Get("key"); value != "v2" {
+		t.Errorf("Value should be %s not %s\n", "v2", value)
+	}
+}
+
+// concurrent writers and a split must not lose keys. Run with -race
+func TestConcurrent(t *testing.T) {
+	testConcurrent(t, New(ring.FromInt(0), ring.FromInt(0)))
+	testConcurrent(t, NewSharded(ring.FromInt(0), ring.FromInt(0), 8))
+}
+
+func testConcurrent(t *testing.T, cms Store) {
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprint("key", w, "-", i)
+				cms.Put(key, "v")
+				cms.Get(key)
+				cms.CAS(key, "v", "w", false)
+				cms.Len()
+			}
+		}(w)
+	}
+	var left Store
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		left, _ = cms.PartitionTable(ring.MaxVal().Div2())
+	}()
+	wg.Wait()
+	// puts of the left half may have failed after the split, every other key must be in exactly one table
+	left_items, right_items := left.Items(), cms.Items()
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprint("key", w, "-", i)
+			_, in_left := left_items[key]
+			_, in_right := right_items[key]
+			if in_left && in_right {
+				t.Errorf("Key %s is in both partitions\n", key)
+			} else if !in_left && !in_right && cms.InRange(StrToSha(key)) {
+				t.Errorf("Key %s is lost\n", key)
+			}
+		}
+	}
+}
+
+// random operations on a sharded map must give the same results as on a plain map
+func TestSharded(t *testing.T) {
+	if NewSharded(ring.FromInt(0), ring.FromInt(0), 5).mask != 7 {
+		t.Errorf("Shard count should round up to 8\n")
+	}
+	var plain, sharded Store = New(ring.FromInt(0), ring.FromInt(0)), NewSharded(ring.FromInt(0), ring.FromInt(0), 4)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key, value := fmt.Sprint("key", rng.Intn(100)), fmt.Sprint(rng.Intn(3))
+		var a, b error
+		var va, vb string
+		switch rng.Intn(4) {
+		case 0:
+			a, b = plain.Put(key, value), sharded.Put(key, value)
+		case 1:
+			va, a = plain.Get(key)
+			vb, b = sharded.Get(key)
+		case 2:
+			va, a = plain.Delete(key)
+			vb, b = sharded.Delete(key)
+		default:
+			old := fmt.Sprint(rng.Intn(3))
+			a, b = plain.CAS(key, old, value, old == "0"), sharded.CAS(key, old, value, old == "0")
+		}
+		if va != vb || (a == nil) != (b == nil) {
+			t.Fatalf("Operation %d on %s differs: (%q, %v) and (%q, %v)\n", i, key, va, a, vb, b)
+		}
+	}
+	if plain.Len() != sharded.Len() || plain.Bytes() != sharded.Bytes() || len(sharded.GetKeys()) != sharded.Len() {
+		t.Errorf("Sizes differ: %d keys %d bytes and %d keys %d bytes\n", plain.Len(), plain.Bytes(), sharded.Len(), sharded.Bytes())
+	}
+	ps, ss := plain.Stats(), sharded.Stats()
+	if ps.Keys != ss.Keys || ps.Bytes != ss.Bytes || ps.Tombstones != ss.Tombstones || ps.Tombstones != len(plain.Tombstones()) ||
+		ss.Shards != 4 || ss.Start != ring.FromInt(0) {
+		t.Errorf("Stats differ: %+v and %+v\n", ps, ss)
+	}
+	// split, then give the left half back
+	split := ring.MaxVal().Div2()
+	left, err := sharded.PartitionTable(split)
+	if err != nil {
+		t.Fatalf("PartitionTable failed. err = %s\n", err.Error())
+	}
+	if _, ok := left.(*ShardedMapStruct); !ok {
+		t.Errorf("Partition of a sharded map should be sharded\n")
+	}
+	if left.Len()+sharded.Len() != plain.Len() {
+		t.Errorf("Partitions hold %d and %d keys, expected %d\n", left.Len(), sharded.Len(), plain.Len())
+	}
+	for k := range left.Items() {
+		if _, err := sharded.Get(k); err == nil {
+			t.Errorf("Key %s is in both partitions\n", k)
+		}
+	}
+	if err = sharded.Extend(ring.FromInt(0), left.Entries()); err != nil {
+		t.Fatalf("Extend failed. err = %s\n", err.Error())
+	}
+	for k, v := range plain.Items() {
+		if got, err := sharded.Get(k); err != nil || got != v {
+			t.Errorf("Key %s is %q after extend, expected %q\n", k, got, v)
+		}
+	}
+}
+
+// root of a store with entries, built from scratch
+func rootOf(entries map[string]Entry) uint64 {
+	cms := New(ring.FromInt(0), ring.FromInt(0))
+	for k, e := range entries {
+		Apply(cms, k, e)
+	}
+	return cms.Tree().Hash(0, 0)
+}
+
+// trees follow every write and point to the buckets that differ
+func TestMerkle(t *testing.T) {
+	a, b := New(ring.FromInt(0), ring.FromInt(0)), NewSharded(ring.FromInt(0), ring.FromInt(0), 4)
+	if a.Tree().Hash(0, 0) != 0 {
+		t.Errorf("Empty tree should hash to 0\n")
+	}
+	for i := 0; i < 500; i++ {
+		a.Restore(fmt.Sprint("key", i), "v", uint64(i+1))
+		b.Restore(fmt.Sprint("key", 499-i), "v", uint64(500-i))
+	}
+	if a.Tree().Hash(0, 0) != b.Tree().Hash(0, 0) {
+		t.Errorf("Same entries should give the same root whatever the order and store\n")
+	}
+	b.Put("key7", "changed")
+	bucket := Bucket(StrToSha("key7"))
+	level := uint32(MerkleDepth)
+	diff := []uint32{}
+	for i := uint32(0); i < MerkleBuckets; i++ {
+		if a.Tree().Hash(level, i) != b.Tree().Hash(level, i) {
+			diff = append(diff, i)
+		}
+	}
+	if len(diff) != 1 || diff[0] != bucket || a.Tree().Hash(0, 0) == b.Tree().Hash(0, 0) {
+		t.Errorf("Only bucket %d should differ, got %v\n", bucket, diff)
+	}
+	items := b.BucketItems(diff)
+	if items["key7"].Value != "changed" || len(items) != len(a.BucketItems(diff)) {
+		t.Errorf("BucketItems should give the items of the bucket. Got %v\n", items)
+	}
+	for k, e := range items {
+		Apply(a, k, e)
+	}
+	if a.Tree().Hash(0, 0) != b.Tree().Hash(0, 0) {
+		t.Errorf("Applying the newer entries should give the same root\n")
+	}
+	root := a.Tree().Hash(0, 0)
+	a.Put("key8", "v")
+	if a.Tree().Hash(0, 0) == root {
+		t.Errorf("A write of the same value should change the root, its version differs\n")
+	}
+	b.Delete("key9")
+	bucket = Bucket(StrToSha("key9"))
+	if a.BucketItems([]uint32{bucket})["key9"].Deleted || !b.BucketItems([]uint32{bucket})["key9"].Deleted {
+		t.Errorf("BucketItems should give the tombstones of the bucket\n")
+	}
+	if a.Tree().Hash(level, bucket) == b.Tree().Hash(level, bucket) {
+		t.Errorf("A tombstone should change the hash of its bucket\n")
+	}
+	left, _ := b.PartitionTable(ring.MaxVal().Div2())
+	if b.Tree().Hash(0, 0) != rootOf(b.Entries()) || left.Tree().Hash(0, 0) != rootOf(left.Entries()) {
+		t.Errorf("Partitions should have the trees of their entries\n")
+	}
+	b.Extend(ring.FromInt(0), left.Entries())
+	if b.Tree().Hash(0, 0) != rootOf(b.Entries()) || len(b.Entries()) != 500 {
+		t.Errorf("Extend should give back the entries and their tree\n")
+	}
+}
+
+// deletes leave tombstones that block older restores, move with their keys and are compacted after the grace period
+func TestTombstones(t *testing.T) {
+	for _, cms := range []Store{New(ring.FromInt(0), ring.FromInt(0)), NewSharded(ring.FromInt(0), ring.FromInt(0), 4)} {
+		for i := 0; i < 100; i++ {
+			cms.Put(fmt.Sprint("key", i), "v")
+		}
+		before := time.Now()
+		put, _ := cms.Lookup("key1")
+		cms.Delete("key1")
+		if _, err := cms.Get("key1"); err == nil {
+			t.Errorf("Deleted key should give CMKeyError\n")
+		}
+		if e, err := cms.Lookup("key1"); err != nil || !e.Deleted || e.Version <= put.Version {
+			t.Errorf("The tombstone should be newer than the value it deletes. Got %+v\n", e)
+		}
+		if err := cms.Restore("key1", "v", put.Version); err == nil {
+			t.Errorf("Restore should not undo a delete\n")
+		}
+		if err := cms.Restore("new", "v", 1); err != nil {
+			t.Errorf("Restore of an absent key should succeed. err = %s\n", err.Error())
+		}
+		cms.Delete("new")
+		if err := cms.CAS("key1", "", "v", true); err != nil || len(cms.Tombstones()) != 1 {
+			t.Errorf("CAS over a tombstone should succeed and drop it\n")
+		}
+		cms.Delete("key1")
+		if err := cms.Bury("key2", Tombstone{Version: 1}); err == nil || cms.Len() != 99 {
+			t.Errorf("A delete older than the value should not remove it\n")
+		}
+		cms.Restore("old", "v", 1)
+		if err := cms.Bury("old", Tombstone{Version: 2}); err != nil || cms.Len() != 99 {
+			t.Errorf("Bury should delete and leave the tombstone. err = %v\n", err)
+		}
+		cms.Bury("old", Tombstone{Version: 3})
+		if err := cms.Bury("old", Tombstone{Version: 2}); err == nil || cms.Tombstones()["old"].Version != 3 {
+			t.Errorf("The later tombstone should be kept\n")
+		}
+		if err := cms.Restore("old", "v", 3); err == nil {
+			t.Errorf("A value as old as the tombstone should not undo it\n")
+		}
+		left, _ := cms.PartitionTable(ring.MaxVal().Div2())
+		if len(left.Tombstones())+len(cms.Tombstones()) != 3 {
+			t.Errorf("Tombstones should be split with their keys\n")
+		}
+		for k := range left.Tombstones() {
+			if _, present := cms.Tombstones()[k]; present || !left.InRange(StrToSha(k)) {
+				t.Errorf("Tombstone of %s is on the wrong side\n", k)
+			}
+		}
+		cms.Extend(ring.FromInt(0), left.Entries())
+		if len(cms.Tombstones()) != 3 {
+			t.Errorf("Extend should take the tombstones\n")
+		}
+		root := cms.Tree().Hash(0, 0)
+		if n := cms.Compact(before); n != 1 || cms.Tree().Hash(0, 0) == root {
+			t.Errorf("Only the tombstone made before should be compacted, and leave the tree. Got %d\n", n)
+		}
+		if n := cms.Compact(time.Now()); n != 2 || cms.Restore("key1", "v", 1) != nil {
+			t.Errorf("Compacted keys can be restored\n")
+		}
+		if cms.Tree().Hash(0, 0) != rootOf(cms.Entries()) {
+			t.Errorf("The tree should follow tombstones\n")
+		}
+	}
+}
+
+// parallel puts and gets on 1000 keys
+func benchmarkStore(b *testing.B, cms Store, write_pct int) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+		cms.Put(keys[i], "value")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			if i%100 < write_pct {
+				cms.Put(key, "value")
+			} else {
+				cms.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkStore(b *testing.B) {
+	stores := []struct {
+		name string
+		make func() Store
+	}{
+		{"map", func() Store { return New(ring.FromInt(0), ring.FromInt(0)) }},
+		{"sharded16", func() Store { return NewSharded(ring.FromInt(0), ring.FromInt(0), 16) }},
+		{"sharded256", func() Store { return NewSharded(ring.FromInt(0), ring.FromInt(0), 256) }},
+	}
+	for _, store := range stores {
+		for _, write_pct := range []int{100, 50, 0} {
+			b.Run(fmt.Sprintf("%s/put%d", store.name, write_pct), func(b *testing.B) {
+				benchmarkStore(b, store.make(), write_pct)
+			})
+		}
+	}
+}
@@ -35,3 +35,15 @@ func (r CMConvError) Error() string {
 func NewCMConvError() *CMConvError {
 	return &CMConvError{message: "ShaStr conversion error"}
 }
+
+type CMCASError struct {
+	message string
+}
+
+func (r CMCASError) Error() string {
+	return r.message
+}
+
+func NewCMCASError() *CMCASError {
+	return &CMCASError{message: "ChordMap compare and swap mismatch"}
+}
@@ -0,0 +1,121 @@
+package chordmap
+
+import (
+	"go_dht/ring"
+	"sync/atomic"
+)
+
+const (
+	MerkleDepth   = 10               // levels below the root of a MerkleTree
+	MerkleBuckets = 1 << MerkleDepth // leaves of a MerkleTree
+)
+
+/*
+Merkle tree over the entries of a store, values and tombstones with their versions. Leaf i is the bucket of the keys whose sha has
+prefix i, i.e the i'th of MerkleBuckets equal arcs of the ring, so subtrees are ranges of the ring. The hash of a leaf is the xor of
+the hashes of its entries, which stores update in place on every write without reading the rest of the bucket. Inner hashes are
+computed from the leaves when asked for. Two stores with the same entries in a range have the same hashes for the nodes of the range.
+Safe for concurrent use. Leaves are read one at a time, so hashes taken while writes are made may mix old and new leaves
+*/
+type MerkleTree struct {
+	leaves [MerkleBuckets]atomic.Uint64
+}
+
+// FNV-1a parameters
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime
+	}
+	return h
+}
+
+func fnvUint64(h uint64, x uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h = (h ^ (x & 0xff)) * fnvPrime
+		x >>= 8
+	}
+	return h
+}
+
+// hash of the entry e of key. Lengths are included so (key, value) boundaries count
+func entryHash(key string, e Entry) uint64 {
+	h := fnvUint64(fnvOffset, uint64(len(key)))
+	h = fnvString(h, key)
+	if e.Deleted {
+		h = fnvUint64(h, 1)
+	} else {
+		h = fnvUint64(h, 0)
+	}
+	h = fnvUint64(h, e.Version)
+	h = fnvUint64(h, uint64(len(e.Value)))
+	return fnvString(h, e.Value)
+}
+
+/*
+Returns the bucket i.e leaf of the key with sha sha
+*/
+func Bucket(sha ring.ID) uint32 {
+	return sha.Prefix(MerkleDepth)
+}
+
+// adds or removes the entry e of key from the bucket of sha. Both are the same xor
+func (mt *MerkleTree) toggle(sha ring.ID, key string, e Entry) {
+	leaf := &mt.leaves[Bucket(sha)]
+	h := entryHash(key, e)
+	for {
+		old := leaf.Load()
+		if leaf.CompareAndSwap(old, old^h) {
+			return
+		}
+	}
+}
+
+// records that the entry of key, with sha sha, changed from old to e. had tells if key had an entry, has tells if it has one now
+func (mt *MerkleTree) update(sha ring.ID, key string, old Entry, had bool, e Entry, has bool) {
+	if had {
+		mt.toggle(sha, key, old)
+	}
+	if has {
+		mt.toggle(sha, key, e)
+	}
+}
+
+/*
+Returns the hash of node index of level level. Level 0 is the root, level MerkleDepth the leaves. Node index of level level
+covers the leaves [index << (MerkleDepth - level), (index + 1) << (MerkleDepth - level)). Empty subtrees hash to 0
+*/
+func (mt *MerkleTree) Hash(level uint32, index uint32) uint64 {
+	if level >= MerkleDepth {
+		return mt.leaves[index%MerkleBuckets].Load()
+	}
+	left := mt.Hash(level+1, 2*index)
+	right := mt.Hash(level+1, 2*index+1)
+	if left == 0 && right == 0 {
+		return 0
+	}
+	return fnvUint64(fnvUint64(fnvOffset, left), right)
+}
+
+/*
+Returns the hashes of the nodes of level level given by indices, in the same order
+*/
+func (mt *MerkleTree) Hashes(level uint32, indices []uint32) []uint64 {
+	ret := make([]uint64, len(indices))
+	for i, index := range indices {
+		ret[i] = mt.Hash(level, index)
+	}
+	return ret
+}
+
+func bucketSet(buckets []uint32) map[uint32]bool {
+	ret := make(map[uint32]bool, len(buckets))
+	for _, b := range buckets {
+		ret[b] = true
+	}
+	return ret
+}
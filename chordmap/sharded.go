@@ -0,0 +1,434 @@
+package chordmap
+
+import (
+	"go_dht/ring"
+	"sync"
+	"time"
+)
+
+const MaxShards = 1024 // upper bound on the shards of a ShardedMapStruct
+
+/*
+Chord map split into shards picked from the low bits of the sha of a key, each shard with its own lock, so writes to different
+shards do not contend. Single key operations hold lock for reading and the lock of one shard. Operations over every key hold
+lock for writing, or lock for reading plus the lock of every shard, so they see and leave a consistent table.
+Locks of shards are always taken in index order
+*/
+type ShardedMapStruct struct {
+	lock       sync.RWMutex // guards the range. Held for writing while the range changes
+	start, end ring.ID      // end is exclusive
+	shards     []shard
+	mask       uint32      // len(shards) - 1
+	tree       *MerkleTree // hashes of every shard. Lock free, so shards do not contend on it
+}
+
+type shard struct {
+	lock  sync.RWMutex
+	table map[string]Entry     // values of the shard with their versions, see version.go
+	tombs map[string]Tombstone // deleted keys of the shard, see tombstone.go
+	_     [24]byte             // keeps the locks of neighbouring shards on different cache lines
+}
+
+// shard of the key with sha sha
+func (sms *ShardedMapStruct) shardOf(sha ring.ID) *shard {
+	low := uint32(sha[len(sha)-2])<<8 | uint32(sha[len(sha)-1])
+	return &sms.shards[low&sms.mask]
+}
+
+// same as InRange. Assumes sms.lock is held
+func (sms *ShardedMapStruct) inRange(key ring.ID) bool {
+	return key.Between(sms.start, sms.end, ring.ClosedOpen)
+}
+
+// locks every shard for reading. Assumes sms.lock is held
+func (sms *ShardedMapStruct) rlockAll() {
+	for i := range sms.shards {
+		sms.shards[i].lock.RLock()
+	}
+}
+
+func (sms *ShardedMapStruct) runlockAll() {
+	for i := range sms.shards {
+		sms.shards[i].lock.RUnlock()
+	}
+}
+
+/*
+True if key is within [sms.start, sms.end). If start == end, everything is in range
+*/
+func (sms *ShardedMapStruct) InRange(key ring.ID) bool {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	return sms.inRange(key)
+}
+
+/*
+Same as ChordMapStruct.Put
+*/
+func (sms *ShardedMapStruct) Put(key string, value string) error {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cur, _ := current(s.table, s.tombs, key)
+	set(s.table, s.tombs, sms.tree, sha, key, Entry{Value: value, Version: nextVersion(cur.Version)})
+	return nil
+}
+
+/*
+Same as ChordMapStruct.Get
+*/
+func (sms *ShardedMapStruct) Get(key string) (string, error) {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return "", NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret, present := s.table[key]
+	if !present {
+		return "", NewCMKeyError()
+	}
+	return ret.Value, nil
+}
+
+/*
+Same as ChordMapStruct.Delete
+*/
+func (sms *ShardedMapStruct) Delete(key string) (string, error) {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return "", NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret, present := s.table[key]
+	if !present {
+		return "", NewCMKeyError()
+	}
+	set(s.table, s.tombs, sms.tree, sha, key, Entry{Version: nextVersion(ret.Version), Deleted: true})
+	return ret.Value, nil
+}
+
+/*
+Same as ChordMapStruct.CAS
+*/
+func (sms *ShardedMapStruct) CAS(key string, old string, value string, absent bool) error {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cur, present := s.table[key]
+	if (absent && present) || (!absent && (!present || cur.Value != old)) {
+		return NewCMCASError()
+	}
+	prev, _ := current(s.table, s.tombs, key) // the tombstone of a deleted key
+	set(s.table, s.tombs, sms.tree, sha, key, Entry{Value: value, Version: nextVersion(prev.Version)})
+	return nil
+}
+
+/*
+Returns all the keys in the chord map
+*/
+func (sms *ShardedMapStruct) GetKeys() []string {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	var keys []string
+	for i := range sms.shards {
+		for k := range sms.shards[i].table {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+/*
+Returns the number of keys in the chord map
+*/
+func (sms *ShardedMapStruct) Len() int {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	ret := 0
+	for i := range sms.shards {
+		ret += len(sms.shards[i].table)
+	}
+	return ret
+}
+
+/*
+Returns the number of bytes held by the keys and values of the chord map
+*/
+func (sms *ShardedMapStruct) Bytes() int {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	ret := 0
+	for i := range sms.shards {
+		for k, e := range sms.shards[i].table {
+			ret += len(k) + len(e.Value)
+		}
+	}
+	return ret
+}
+
+/*
+Same as ChordMapStruct.Stats
+*/
+func (sms *ShardedMapStruct) Stats() StoreStats {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	ret := StoreStats{Start: sms.start, End: sms.end, Shards: len(sms.shards)}
+	for i := range sms.shards {
+		ret.Keys += len(sms.shards[i].table)
+		ret.Tombstones += len(sms.shards[i].tombs)
+		for k, e := range sms.shards[i].table {
+			ret.Bytes += len(k) + len(e.Value)
+		}
+	}
+	return ret
+}
+
+/*
+Returns a copy of all the (key, value)s in the chord map, taken while no shard changes
+*/
+func (sms *ShardedMapStruct) Items() map[string]string {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	items := make(map[string]string)
+	for i := range sms.shards {
+		for k, e := range sms.shards[i].table {
+			items[k] = e.Value
+		}
+	}
+	return items
+}
+
+/*
+Same as ChordMapStruct.Lookup
+*/
+func (sms *ShardedMapStruct) Lookup(key string) (Entry, error) {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return Entry{}, NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if ret, present := current(s.table, s.tombs, key); present {
+		return ret, nil
+	}
+	return Entry{}, NewCMKeyError()
+}
+
+/*
+Same as ChordMapStruct.Entries
+*/
+func (sms *ShardedMapStruct) Entries() map[string]Entry {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	entries := make(map[string]Entry)
+	for i := range sms.shards {
+		for k, e := range sms.shards[i].table {
+			entries[k] = e
+		}
+		for k, tomb := range sms.shards[i].tombs {
+			entries[k] = Entry{Version: tomb.Version, Deleted: true}
+		}
+	}
+	return entries
+}
+
+/*
+Same as ChordMapStruct.Tree
+*/
+func (sms *ShardedMapStruct) Tree() *MerkleTree {
+	return sms.tree
+}
+
+/*
+Same as ChordMapStruct.BucketItems
+*/
+func (sms *ShardedMapStruct) BucketItems(buckets []uint32) map[string]Entry {
+	want := bucketSet(buckets)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	items := make(map[string]Entry)
+	for i := range sms.shards {
+		for k, e := range sms.shards[i].table {
+			if want[Bucket(StrToSha(k))] {
+				items[k] = e
+			}
+		}
+		for k, tomb := range sms.shards[i].tombs {
+			if want[Bucket(StrToSha(k))] {
+				items[k] = Entry{Version: tomb.Version, Deleted: true}
+			}
+		}
+	}
+	return items
+}
+
+/*
+Same as ChordMapStruct.Tombstones
+*/
+func (sms *ShardedMapStruct) Tombstones() map[string]Tombstone {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	sms.rlockAll()
+	defer sms.runlockAll()
+	tombs := make(map[string]Tombstone)
+	for i := range sms.shards {
+		for k, tomb := range sms.shards[i].tombs {
+			tombs[k] = tomb
+		}
+	}
+	return tombs
+}
+
+/*
+Same as ChordMapStruct.Bury
+*/
+func (sms *ShardedMapStruct) Bury(key string, tomb Tombstone) error {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return apply(s.table, s.tombs, sms.tree, sha, key, Entry{Version: tomb.Version, Deleted: true})
+}
+
+/*
+Same as ChordMapStruct.Restore
+*/
+func (sms *ShardedMapStruct) Restore(key string, value string, version uint64) error {
+	sha := StrToSha(key)
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	if !sms.inRange(sha) {
+		return NewCMRangeError()
+	}
+	s := sms.shardOf(sha)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return apply(s.table, s.tombs, sms.tree, sha, key, Entry{Value: value, Version: version})
+}
+
+/*
+Same as ChordMapStruct.Compact. Shards are compacted one at a time
+*/
+func (sms *ShardedMapStruct) Compact(before time.Time) int {
+	sms.lock.RLock()
+	defer sms.lock.RUnlock()
+	ret := 0
+	for i := range sms.shards {
+		s := &sms.shards[i]
+		s.lock.Lock()
+		ret += compact(s.tombs, sms.tree, before)
+		s.lock.Unlock()
+	}
+	return ret
+}
+
+/*
+Same as ChordMapStruct.Extend
+*/
+func (sms *ShardedMapStruct) Extend(start ring.ID, entries map[string]Entry) error {
+	sms.lock.Lock()
+	defer sms.lock.Unlock()
+	for k := range entries {
+		if !StrToSha(k).Between(start, sms.end, ring.ClosedOpen) {
+			return NewCMRangeError()
+		}
+	}
+	sms.start = start
+	for k, e := range entries {
+		sha := StrToSha(k)
+		s := sms.shardOf(sha)
+		apply(s.table, s.tombs, sms.tree, sha, k, e)
+	}
+	return nil
+}
+
+/*
+Same as ChordMapStruct.PartitionTable. The returned map has as many shards as sms
+*/
+func (sms *ShardedMapStruct) PartitionTable(key ring.ID) (Store, error) {
+	sms.lock.Lock()
+	defer sms.lock.Unlock()
+	if !sms.inRange(key) {
+		return nil, NewCMRangeError()
+	}
+	ret := NewSharded(sms.start, key, len(sms.shards))
+	sms.start = key
+	for i := range sms.shards {
+		for k, e := range sms.shards[i].table {
+			if sha := StrToSha(k); ret.inRange(sha) { // key belongs in left table, move it
+				ret.shards[i].table[k] = e // same shard count, so the same shard
+				delete(sms.shards[i].table, k)
+				sms.tree.update(sha, k, e, true, Entry{}, false)
+				ret.tree.update(sha, k, Entry{}, false, e, true)
+			}
+		}
+		for k, tomb := range sms.shards[i].tombs {
+			if sha := StrToSha(k); ret.inRange(sha) {
+				ret.shards[i].tombs[k] = tomb
+				delete(sms.shards[i].tombs, k)
+				e := Entry{Version: tomb.Version, Deleted: true}
+				sms.tree.update(sha, k, e, true, Entry{}, false)
+				ret.tree.update(sha, k, Entry{}, false, e, true)
+			}
+		}
+	}
+	return ret, nil
+}
+
+/*
+Initializes a sharded chord map with the range of New. shards is rounded up to a power of 2 in [1, MaxShards]
+*/
+func NewSharded(start ring.ID, end ring.ID, shards int) *ShardedMapStruct {
+	n := 1
+	for n < shards && n < MaxShards {
+		n *= 2
+	}
+	ret := &ShardedMapStruct{start: start, end: end, shards: make([]shard, n), mask: uint32(n - 1), tree: new(MerkleTree)}
+	for i := range ret.shards {
+		ret.shards[i].table = make(map[string]Entry)
+		ret.shards[i].tombs = make(map[string]Tombstone)
+	}
+	return ret
+}
@@ -0,0 +1,37 @@
+package chordmap
+
+import (
+	"time"
+)
+
+/*
+Tombstones. A delete leaves a tombstone of its key instead of forgetting the key, so a copy of the key still kept by another node is
+not taken for a key this store missed and copied back, see Restore. Get reports a tombstone as CMKeyError and a Put or CAS over it
+drops it. Tombstones are hashed into the Merkle tree with their versions like values, so copies that disagree on a delete differ.
+Tombstones move with their keys through PartitionTable and Extend, and are dropped by Compact once older than a grace period. The
+grace period must exceed the time copies of a range take to converge, as a copy still holding the key after that resurrects it
+*/
+type Tombstone struct {
+	Version uint64 // version of the delete, see version.go
+}
+
+/*
+Returns a tombstone for a delete made now
+*/
+func NewTombstone() Tombstone {
+	return Tombstone{Version: nextVersion(0)}
+}
+
+// drops the tombstones of tombs older than before and their hashes from tree. Returns the number dropped
+func compact(tombs map[string]Tombstone, tree *MerkleTree, before time.Time) int {
+	ret := 0
+	cutoff := uint64(before.UnixNano())
+	for k, tomb := range tombs {
+		if tomb.Version < cutoff {
+			delete(tombs, k)
+			tree.update(StrToSha(k), k, Entry{Version: tomb.Version, Deleted: true}, true, Entry{}, false)
+			ret++
+		}
+	}
+	return ret
+}
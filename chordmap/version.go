@@ -0,0 +1,88 @@
+package chordmap
+
+import (
+	"go_dht/ring"
+	"time"
+)
+
+/*
+Versions. Every value and tombstone of a store carries the version of the write that made it, unix nanoseconds taken by the store
+that accepted the write, and always later than the version it replaces. Copies of a key kept by different nodes are reconciled by
+version, see Entry.After: Bury, Restore and Extend only apply an entry newer than the one held, so a late delete does not erase a
+newer value and a stale value does not undo a newer delete
+*/
+
+/*
+State of a key: its value, or a tombstone if Deleted, and the version of the write that made it
+*/
+type Entry struct {
+	Value   string // "" if Deleted
+	Version uint64
+	Deleted bool
+}
+
+/*
+True if e replaces o. The later version wins. Entries of the same version are ordered so copies agree whichever they hold first:
+a tombstone wins over a value and the larger value over the smaller
+*/
+func (e Entry) After(o Entry) bool {
+	if e.Version != o.Version {
+		return e.Version > o.Version
+	}
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+	return !e.Deleted && e.Value > o.Value
+}
+
+/*
+Applies e to key in s if it is newer than the entry s holds, see Bury and Restore. Returns CMRangeError if key is not in range and
+CMCASError if s holds an entry at least as new
+*/
+func Apply(s Store, key string, e Entry) error {
+	if e.Deleted {
+		return s.Bury(key, Tombstone{Version: e.Version})
+	}
+	return s.Restore(key, e.Value, e.Version)
+}
+
+// version of a write made now replacing one of version cur
+func nextVersion(cur uint64) uint64 {
+	if now := uint64(time.Now().UnixNano()); now > cur {
+		return now
+	}
+	return cur + 1
+}
+
+// entry of key in table and tombs, and whether it has one
+func current(table map[string]Entry, tombs map[string]Tombstone, key string) (Entry, bool) {
+	if e, present := table[key]; present {
+		return e, true
+	}
+	if tomb, deleted := tombs[key]; deleted {
+		return Entry{Version: tomb.Version, Deleted: true}, true
+	}
+	return Entry{}, false
+}
+
+// sets the entry of key, with sha sha, to e in table and tombs and updates tree. Assumes the lock of table is held
+func set(table map[string]Entry, tombs map[string]Tombstone, tree *MerkleTree, sha ring.ID, key string, e Entry) {
+	cur, had := current(table, tombs, key)
+	if e.Deleted {
+		delete(table, key)
+		tombs[key] = Tombstone{Version: e.Version}
+	} else {
+		table[key] = e
+		delete(tombs, key)
+	}
+	tree.update(sha, key, cur, had, e, true)
+}
+
+// same as set if e is newer than the entry of key. CMCASError otherwise
+func apply(table map[string]Entry, tombs map[string]Tombstone, tree *MerkleTree, sha ring.ID, key string, e Entry) error {
+	if cur, had := current(table, tombs, key); had && !e.After(cur) {
+		return NewCMCASError()
+	}
+	set(table, tombs, tree, sha, key, e)
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+Package client is the Go SDK for applications using the chord ring. A Client routes every request straight to the node storing the
+key using a cached snapshot of the ring membership and refreshes the snapshot when a node reports it no longer stores the key.
+*/
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	CM "go_dht/chordmap"
+	NA "go_dht/nodeapi"
+	"go_dht/ring"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxAttempts = 4                     // tries per request before giving up on stale routes or busy nodes
+const busyBackoff = 50 * time.Millisecond // wait before retrying a busy node
+
+type Client struct {
+	seeds        []NA.HostData // nodes asked for a ring snapshot when view is empty
+	view         *ringView
+	refresh_lock sync.Mutex // one snapshot fetch at a time
+}
+
+/*
+Creates a client for the ring the seed nodes ("host:port") belong to. The first seed that answers is asked for its ring config,
+which must match ring.CurConfig() as keys are hashed locally. Returns ErrConfig if it does not, ErrUnavailable if no seed answers
+*/
+func New(ctx context.Context, seeds ...string) (*Client, error) {
+	if len(seeds) == 0 {
+		return nil, ErrNoSeeds
+	}
+	ret := &Client{view: &ringView{}}
+	for _, seed := range seeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil {
+			return nil, err
+		}
+		ret.seeds = append(ret.seeds, NA.HostData{Hostname: host, Port: port})
+	}
+	var err error
+	for _, seed := range ret.seeds {
+		var ni NA.NodeInfo
+		if err = mapError(callNode(ctx, seed, "NAPI.Info", &ni)); err != nil {
+			continue
+		}
+		if ni.Config != ring.CurConfig() {
+			return nil, fmt.Errorf("ring uses %s at %d bits: %w", ni.Config.Hash, ni.Config.Bits, ErrConfig)
+		}
+		if err = ret.refresh(ctx); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return nil, err
+}
+
+// calls a NAPI method taking no args on node
+func callNode(ctx context.Context, node NA.HostData, method string, reply interface{}) error {
+	none := false
+	return NA.CallContext(ctx, node.Hostname, node.Port, method, &none, reply)
+}
+
+/*
+Fetches a new ring snapshot if the view is empty. The seeds are asked first, then the members of the dropped snapshot.
+Returns the error of the last node tried if none answers
+*/
+func (c *Client) refresh(ctx context.Context) error {
+	c.refresh_lock.Lock()
+	defer c.refresh_lock.Unlock()
+	if _, _, ok := c.view.lookup(ring.ID{}); ok { // refreshed by another request
+		return nil
+	}
+	err := ErrNoSeeds
+	for _, node := range append(append([]NA.HostData{}, c.seeds...), c.view.staleHosts()...) {
+		var members []NA.RingMember
+		if err = mapError(callNode(ctx, node, "NAPI.RingSnapshot", &members)); err != nil {
+			continue
+		}
+		c.view.set(members)
+		return nil
+	}
+	return err
+}
+
+/*
+Sends a hash table request for args.Key to its owner. A stale route or an unreachable owner drops the snapshot and a new one is
+fetched, busy owners are retried after a backoff. Returns the value of the reply
+*/
+func (c *Client) do(ctx context.Context, method string, args *NA.HTArgs) (string, error) {
+	key := CM.StrToSha(args.Key)
+	args.Direct = true // owners must not forward, so stale routes are detected
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		owner, version, ok := c.view.lookup(key)
+		if !ok {
+			if err = c.refresh(ctx); err != nil {
+				break
+			}
+			owner, version, _ = c.view.lookup(key)
+		}
+		var reply NA.HTReply
+		err = mapError(NA.CallContext(ctx, owner.Hostname, owner.Port, "NAPI."+method, args, &reply))
+		if err == nil {
+			return reply.Value, nil
+		} else if errors.Is(err, ErrWrongOwner) || errors.Is(err, ErrUnavailable) {
+			c.view.invalidate(version)
+		} else if errors.Is(err, ErrBusy) {
+			select {
+			case <-time.After(busyBackoff):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		} else {
+			break
+		}
+	}
+	return "", fmt.Errorf("%s %q: %w", method, args.Key, err)
+}
+
+/*
+Returns the value of key. ErrNotFound if key is not present
+*/
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.do(ctx, "Get", &NA.HTArgs{Key: key})
+}
+
+/*
+Same as Get, but the node leaves copies of key that lag behind alone instead of fixing them. For reads that must not add writes
+*/
+func (c *Client) GetNoRepair(ctx context.Context, key string) (string, error) {
+	return c.do(ctx, "Get", &NA.HTArgs{Key: key, NoRepair: true})
+}
+
+/*
+Sets key to value
+*/
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	_, err := c.do(ctx, "Put", &NA.HTArgs{Key: key, Value: value})
+	return err
+}
+
+/*
+Removes key and returns its value. ErrNotFound if key is not present
+*/
+func (c *Client) Delete(ctx context.Context, key string) (string, error) {
+	return c.do(ctx, "Delete", &NA.HTArgs{Key: key})
+}
+
+/*
+Sets key to value if key currently maps to old. ErrCASMismatch if it does not or key is not present
+*/
+func (c *Client) CAS(ctx context.Context, key string, old string, value string) error {
+	_, err := c.do(ctx, "CAS", &NA.HTArgs{Key: key, Old: old, Value: value})
+	return err
+}
+
+/*
+Sets key to value if key is not present. ErrCASMismatch if it is
+*/
+func (c *Client) PutIfAbsent(ctx context.Context, key string, value string) error {
+	_, err := c.do(ctx, "CAS", &NA.HTArgs{Key: key, Value: value, Absent: true})
+	return err
+}
+
+/*
+Gets keys in parallel. Keys that are not present are left out of the returned map. Returns the first error other than ErrNotFound
+*/
+func (c *Client) MultiGet(ctx context.Context, keys []string) (map[string]string, error) {
+	ret := make(map[string]string, len(keys))
+	var first_err error
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			value, err := c.Get(ctx, key)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				ret[key] = value
+			} else if !errors.Is(err, ErrNotFound) && first_err == nil {
+				first_err = err
+			}
+		}(key)
+	}
+	wg.Wait()
+	return ret, first_err
+}
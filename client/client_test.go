@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"go_dht/nodeapi"
+	"go_dht/ring"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+var ringOnce sync.Once // the node is shared by the tests of this package
+var ringAddr string    // "host:port" of the node
+
+// starts a single node ring on an ephemeral localhost port once and returns a new client for it
+func startRing(t *testing.T) *Client {
+	ringOnce.Do(func() {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Could not listen\n")
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		ln, err := nodeapi.LocalInit("localhost", port, nil, nil)
+		if err != nil {
+			t.Fatalf("Could not init local node\n")
+		}
+		nodeapi.NapiServe(ln, l)
+		ringAddr = "localhost:" + port
+	})
+	c, err := New(context.Background(), "localhost:1", ringAddr) // first seed is down
+	if err != nil {
+		t.Fatalf("Could not create client. err = %s\n", err.Error())
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	c := startRing(t)
+	ctx := context.Background()
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Errorf("Put failed. err = %s\n", err.Error())
+	}
+	if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Get should return %s not %s\n", "value", value)
+	}
+	if err := c.CAS(ctx, "key", "wrong", "value2"); !errors.Is(err, ErrCASMismatch) {
+		t.Errorf("CAS with wrong old value should give ErrCASMismatch. Got %v\n", err)
+	}
+	if err := c.CAS(ctx, "key", "value", "value2"); err != nil {
+		t.Errorf("CAS failed. err = %s\n", err.Error())
+	}
+	if err := c.PutIfAbsent(ctx, "key", "value3"); !errors.Is(err, ErrCASMismatch) {
+		t.Errorf("PutIfAbsent on present key should give ErrCASMismatch. Got %v\n", err)
+	}
+	if err := c.PutIfAbsent(ctx, "other", "value3"); err != nil {
+		t.Errorf("PutIfAbsent failed. err = %s\n", err.Error())
+	}
+	values, err := c.MultiGet(ctx, []string{"key", "other", "missing"})
+	if err != nil || len(values) != 2 || values["key"] != "value2" || values["other"] != "value3" {
+		t.Errorf("MultiGet returned %v, err = %v\n", values, err)
+	}
+	if value, err := c.Delete(ctx, "key"); err != nil || value != "value2" {
+		t.Errorf("Delete should return %s not %s\n", "value2", value)
+	}
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of deleted key should give ErrNotFound. Got %v\n", err)
+	}
+}
+
+// a stale snapshot pointing at a dead node must be dropped and a new one fetched
+func TestStaleView(t *testing.T) {
+	c := startRing(t)
+	dead := nodeapi.HostData{Hostname: "localhost", Port: "1"}
+	c.view.set([]nodeapi.RingMember{{ID: ring.FromInt(0), Host: dead}})
+	if err := c.Put(context.Background(), "key", "value"); err != nil {
+		t.Errorf("Put with stale view failed. err = %s\n", err.Error())
+	}
+	if owner, _, _ := c.view.lookup(ring.FromInt(0)); owner == dead {
+		t.Errorf("Dead node should have been dropped from the view\n")
+	}
+}
+
+// the owner of a key is the first member at or after it, wrapping around to the first member
+func TestViewLookup(t *testing.T) {
+	var rv ringView
+	if _, _, ok := rv.lookup(ring.FromInt(1)); ok {
+		t.Errorf("Empty view should need a refresh\n")
+	}
+	a := nodeapi.HostData{Hostname: "a", Port: "1"}
+	b := nodeapi.HostData{Hostname: "b", Port: "1"}
+	rv.set([]nodeapi.RingMember{{ID: ring.FromInt(10), Host: a}, {ID: ring.FromInt(50), Host: b}})
+	expected := map[uint32]nodeapi.HostData{5: a, 10: a, 11: b, 50: b, 51: a}
+	for key, host := range expected {
+		if owner, _, _ := rv.lookup(ring.FromInt(key)); owner != host {
+			t.Errorf("Owner of %d should be %v not %v\n", key, host, owner)
+		}
+	}
+	_, version, _ := rv.lookup(ring.FromInt(1))
+	rv.invalidate(version - 1) // older snapshot
+	if _, _, ok := rv.lookup(ring.FromInt(1)); !ok {
+		t.Errorf("Invalidating an older version should keep the view\n")
+	}
+	rv.invalidate(version)
+	if _, _, ok := rv.lookup(ring.FromInt(1)); ok || len(rv.staleHosts()) != 2 {
+		t.Errorf("Invalidating the current version should drop the view\n")
+	}
+}
+
+func TestMapError(t *testing.T) {
+	if !errors.Is(mapError(rpc.ServerError(nodeapi.NewNapiBusyError().Error())), ErrBusy) {
+		t.Errorf("Remote NapiBusyError should map to ErrBusy\n")
+	}
+	if !errors.Is(mapError(nodeapi.NewNapiRangeError()), ErrWrongOwner) {
+		t.Errorf("NapiRangeError should map to ErrWrongOwner\n")
+	}
+	if mapError(context.Canceled) != context.Canceled {
+		t.Errorf("Context errors should be returned unchanged\n")
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	CM "go_dht/chordmap"
+	NA "go_dht/nodeapi"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// Errors returned by Client methods, wrapped with the operation and key. Test with errors.Is
+var (
+	ErrNotFound    = errors.New("key not found")
+	ErrCASMismatch = errors.New("compare and swap mismatch")
+	ErrWrongOwner  = errors.New("node does not store key") // the client's ring view was stale. Retried internally
+	ErrBusy        = errors.New("node busy")               // node is in a join or leave. Retried internally
+	ErrCollision   = errors.New("node id collision")
+	ErrConfig      = errors.New("ring config mismatch") // ring uses a different ring.Config than this process
+	ErrUnavailable = errors.New("node unavailable")
+	ErrNoSeeds     = errors.New("no seed nodes")
+	ErrQuorum      = errors.New("too few copies answered") // a request could not reach a quorum of the copies of the key
+)
+
+/*
+Errors from a remote node arrive as rpc.ServerError holding only the message, so errors are matched on the message of the
+Napi* and CM* error types. This also covers the typed errors themselves
+*/
+var messages = map[string]error{
+	CM.NewCMKeyError().Error():         ErrNotFound,
+	CM.NewCMRangeError().Error():       ErrWrongOwner,
+	CM.NewCMCASError().Error():         ErrCASMismatch,
+	NA.NewNapiKeyError().Error():       ErrNotFound,
+	NA.NewNapiRangeError().Error():     ErrWrongOwner,
+	NA.NewNapiBusyError().Error():      ErrBusy,
+	NA.NewNapiCollisionError().Error(): ErrCollision,
+	NA.NewNapiConfigError().Error():    ErrConfig,
+	NA.NewNapiConnError().Error():      ErrUnavailable,
+	NA.NewNapiQuorumError().Error():    ErrQuorum,
+}
+
+/*
+Maps an error returned by a NAPI call to the matching exported error. Network failures map to ErrUnavailable.
+Context errors and unknown errors are returned unchanged
+*/
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if sentinel, ok := messages[err.Error()]; ok {
+		return sentinel
+	}
+	var net_err net.Error
+	if errors.As(err, &net_err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, rpc.ErrShutdown) {
+		return ErrUnavailable
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	NA "go_dht/nodeapi"
+	"go_dht/ring"
+	"sort"
+	"sync"
+)
+
+/*
+Cache of the ring membership fetched with NAPI.RingSnapshot. The owner of a key is the first member whose id is at or after the key.
+The snapshot is dropped as a whole once a node reports it no longer stores a key, and the old members are kept as extra sources for
+the next snapshot. Safe for concurrent use
+*/
+type ringView struct {
+	lock    sync.Mutex
+	members []NA.RingMember // sorted by id. Empty if the view must be refreshed
+	stale   []NA.RingMember // members of the last dropped snapshot
+	version uint64          // bumped on every new snapshot
+}
+
+/*
+Returns the owner of key and the version of the snapshot it was found in. false if the view must be refreshed
+*/
+func (rv *ringView) lookup(key ring.ID) (NA.HostData, uint64, bool) {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	if len(rv.members) == 0 {
+		return NA.HostData{}, rv.version, false
+	}
+	i := sort.Search(len(rv.members), func(i int) bool { return rv.members[i].ID.Cmp(key) != ring.Less })
+	if i == len(rv.members) { // wraps around to the first node
+		i = 0
+	}
+	return rv.members[i].Host, rv.version, true
+}
+
+/*
+Replaces the snapshot. members must be sorted by id
+*/
+func (rv *ringView) set(members []NA.RingMember) {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	rv.members = members
+	rv.stale = nil
+	rv.version++
+}
+
+/*
+Drops the snapshot if it is still the one of version. Requests that failed on the same snapshot only cause one refresh
+*/
+func (rv *ringView) invalidate(version uint64) {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	if version == rv.version && len(rv.members) > 0 {
+		rv.stale = rv.members
+		rv.members = nil
+	}
+}
+
+/*
+Returns the hosts of the last dropped snapshot
+*/
+func (rv *ringView) staleHosts() []NA.HostData {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	ret := make([]NA.HostData, len(rv.stale))
+	for i, m := range rv.stale {
+		ret[i] = m.Host
+	}
+	return ret
+}
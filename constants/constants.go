@@ -1,4 +1,4 @@
 package constants
 
-const ShaSize uint32 = 20     // size of sha byte array
-const ShaNumBits uint32 = 160 // 20 * 8
+const MaxShaSize uint32 = 32     // size of the id byte array. Fits the widest supported hash i.e sha256
+const MaxShaNumBits uint32 = 256 // 32 * 8
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go_dht/nodeapi"
+	"net"
+	"strings"
+	"testing"
+)
+
+// runs dhtctl against a single node ring on an ephemeral localhost port and checks every command
+func TestCommands(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen\n")
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := "localhost:" + port
+	ln, err := nodeapi.LocalInit("localhost", port, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node\n")
+	}
+	nodeapi.NapiServe(ln, l)
+	node := []string{"-node", addr}
+	ctl := func(args ...string) string {
+		var out bytes.Buffer
+		if err := run(append(node, args...), &out); err != nil {
+			t.Errorf("dhtctl %v failed. err = %s\n", args, err.Error())
+		}
+		return out.String()
+	}
+	ctl("put", "key", "value")
+	if out := ctl("get", "key"); !strings.Contains(out, "value") {
+		t.Errorf("get should print the value. Got:\n%s", out)
+	}
+	if out := ctl("find", "key"); !strings.Contains(out, addr) {
+		t.Errorf("find should print the owner. Got:\n%s", out)
+	}
+	if out := ctl("ring"); strings.Count(out, addr) != 1 || !strings.Contains(out, "full ring") {
+		t.Errorf("ring should print the single node once. Got:\n%s", out)
+	}
+	if out := ctl("fingers"); strings.Count(out, addr) != 160 {
+		t.Errorf("fingers should print 160 entries. Got:\n%s", out)
+	}
+	var ni nodeapi.NodeInfo
+	if err := json.Unmarshal([]byte(ctl("-json", "stats", addr)), &ni); err != nil || ni.Keys != 1 {
+		t.Errorf("stats -json should report 1 key. Got %+v\n", ni)
+	}
+	ctl("delete", "key")
+	var out bytes.Buffer
+	if err := run(append(node, "get", "key"), &out); err == nil {
+		t.Errorf("get of a deleted key should fail\n")
+	}
+	if err := run(append(node, "bogus"), &out); err == nil {
+		t.Errorf("unknown command should fail\n")
+	}
+}
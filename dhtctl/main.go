@@ -0,0 +1,227 @@
+/*
+dhtctl is a command line client for a chord ring. It talks to any node of the ring over the NAPI rpc service.
+Usage: dhtctl [-node host:port] [-json] <command> [args]
+Commands:
+
+	get <key>
+	put <key> <value>
+	delete <key>
+	find <key>      owner of key and its id
+	ring            walks the successors and prints every node with its range
+	fingers [node]  finger table of node. Defaults to -node
+	stats [node]    key count, bytes and state of node. Defaults to -node
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	CM "go_dht/chordmap"
+	"go_dht/nodeapi"
+	"go_dht/ring"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+)
+
+const maxRingWalk = 4096 // upper bound on nodes visited by the ring command in case the successors do not form a cycle
+
+// output settings shared by the commands
+type printer struct {
+	out  io.Writer
+	json bool
+}
+
+/*
+Prints v as indented json if p.json is set. Else prints rows as a tab aligned table with header as the first row
+*/
+func (p *printer) print(v interface{}, header []string, rows [][]string) error {
+	if p.json {
+		enc := json.NewEncoder(p.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, col := range row {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, col)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// splits "host:port" into HostData
+func parseNode(addr string) (*nodeapi.HostData, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeapi.HostData{Hostname: host, Port: port}, nil
+}
+
+func nodeStr(h nodeapi.HostData) string {
+	return net.JoinHostPort(h.Hostname, h.Port)
+}
+
+// returns the summary of node
+func info(node *nodeapi.HostData) (*nodeapi.NodeInfo, error) {
+	var reply nodeapi.NodeInfo
+	none := false
+	err := nodeapi.ConnectAndCall(node.Hostname, node.Port, "NAPI.Info", &none, &reply)
+	return &reply, err
+}
+
+// range of keys stored by the node described by ni, i.e (pred, id]
+func rangeStr(ni *nodeapi.NodeInfo) (string, string) {
+	if ni.Pred == nil {
+		return "full ring", ""
+	}
+	return "(" + ni.PredEnd.String(), ni.ID.String() + "]"
+}
+
+/******** Commands **********/
+
+func cmdHT(p *printer, node *nodeapi.HostData, method string, args []string) error {
+	ht_args := nodeapi.HTArgs{Key: args[0]}
+	if len(args) > 1 {
+		ht_args.Value = args[1]
+	}
+	var reply nodeapi.HTReply
+	if err := nodeapi.ConnectAndCall(node.Hostname, node.Port, "NAPI."+method, &ht_args, &reply); err != nil {
+		return err
+	}
+	if method == "Put" {
+		reply.Value = ht_args.Value
+	}
+	out := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{ht_args.Key, reply.Value}
+	return p.print(out, []string{"KEY", "VALUE"}, [][]string{{out.Key, out.Value}})
+}
+
+func cmdFind(p *printer, node *nodeapi.HostData, key string) error {
+	sha := CM.StrToSha(key)
+	var owner nodeapi.HostData
+	if err := nodeapi.ConnectAndCall(node.Hostname, node.Port, "NAPI.Find", &sha, &owner); err != nil {
+		return err
+	}
+	ni, err := info(&owner)
+	if err != nil {
+		return err
+	}
+	out := struct {
+		Key   string           `json:"key"`
+		Sha   ring.ID          `json:"sha"`
+		Owner nodeapi.HostData `json:"owner"`
+		ID    ring.ID          `json:"id"`
+	}{key, sha, owner, ni.ID}
+	return p.print(out, []string{"KEY", "SHA", "OWNER", "ID"}, [][]string{{key, sha.String(), nodeStr(owner), ni.ID.String()}})
+}
+
+func cmdRing(p *printer, node *nodeapi.HostData) error {
+	var nodes []*nodeapi.NodeInfo
+	var rows [][]string
+	next := *node
+	for len(nodes) < maxRingWalk {
+		ni, err := info(&next)
+		if err != nil {
+			return err
+		}
+		if len(nodes) > 0 && ni.Host == nodes[0].Host {
+			return p.print(nodes, []string{"NODE", "ID", "RANGE START", "RANGE END", "KEYS"}, rows)
+		}
+		start, end := rangeStr(ni)
+		rows = append(rows, []string{nodeStr(ni.Host), ni.ID.String(), start, end, fmt.Sprint(ni.Keys)})
+		nodes = append(nodes, ni)
+		next = ni.Succ
+	}
+	return fmt.Errorf("successors did not lead back to %s after %d nodes", nodeStr(*node), maxRingWalk)
+}
+
+func cmdFingers(p *printer, node *nodeapi.HostData) error {
+	var fingers []nodeapi.FingerEntry
+	none := false
+	if err := nodeapi.ConnectAndCall(node.Hostname, node.Port, "NAPI.Fingers", &none, &fingers); err != nil {
+		return err
+	}
+	rows := make([][]string, len(fingers))
+	for i, f := range fingers {
+		rows[i] = []string{fmt.Sprint(i), f.Start.String(), nodeStr(f.Host)}
+	}
+	return p.print(fingers, []string{"I", "START", "NODE"}, rows)
+}
+
+func cmdStats(p *printer, node *nodeapi.HostData) error {
+	ni, err := info(node)
+	if err != nil {
+		return err
+	}
+	start, end := rangeStr(ni)
+	return p.print(ni, []string{"NODE", "ID", "STATE", "KEYS", "BYTES", "RANGE"},
+		[][]string{{nodeStr(ni.Host), ni.ID.String(), ni.State, fmt.Sprint(ni.Keys), fmt.Sprint(ni.Bytes), start + ", " + end}})
+}
+
+/******** End Commands **********/
+
+// number of args each command takes. -1 means 0 or 1 node args
+var numArgs = map[string]int{"get": 1, "put": 2, "delete": 1, "find": 1, "ring": 0, "fingers": -1, "stats": -1}
+
+func run(argv []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dhtctl", flag.ContinueOnError)
+	flags.SetOutput(out)
+	node_addr := flags.String("node", "127.0.0.1:8080", "host:port of any node of the ring")
+	as_json := flags.Bool("json", false, "print json instead of a table")
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	args := flags.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("missing command. One of get, put, delete, find, ring, fingers, stats")
+	}
+	cmd, args := args[0], args[1:]
+	n, ok := numArgs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+	if (n >= 0 && len(args) != n) || (n < 0 && len(args) > 1) {
+		return fmt.Errorf("wrong number of args for %s", cmd)
+	}
+	if n < 0 && len(args) == 1 { // explicit node
+		*node_addr = args[0]
+	}
+	node, err := parseNode(*node_addr)
+	if err != nil {
+		return err
+	}
+	p := &printer{out: out, json: *as_json}
+	switch cmd {
+	case "get":
+		return cmdHT(p, node, "Get", args)
+	case "put":
+		return cmdHT(p, node, "Put", args)
+	case "delete":
+		return cmdHT(p, node, "Delete", args)
+	case "find":
+		return cmdFind(p, node, args[0])
+	case "ring":
+		return cmdRing(p, node)
+	case "fingers":
+		return cmdFingers(p, node)
+	default: // stats
+		return cmdStats(p, node)
+	}
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "dhtctl: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
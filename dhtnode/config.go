@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	CM "go_dht/chordmap"
+	"go_dht/nodeapi"
+	"go_dht/ring"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Settings of a dhtnode. Read from a TOML file, see dhtnode.toml for an example
+*/
+type NodeConfig struct {
+	Listen      string           // address the rpc service listens on i.e "host:port"
+	Advertise   string           // address other nodes reach this node on. Defaults to Listen
+	HttpListen  string           // address the HTTP/JSON gateway listens on. Empty disables the gateway
+	AdminListen string           // address the inspection endpoints listen on. Empty disables them
+	Protocol    nodeapi.Protocol // protocol of calls to other nodes. Nodes serve every protocol
+	Bootstrap   []string         // "host:port" of members of the ring to join. Empty means create a new ring
+	DataDir     string           // directory the node id is kept in so restarts get the same id. Optional
+	Replication int              // number of copies kept of every key
+	StoreShards int              // shards of the local store. 1 keeps every key under one lock
+	ID          nodeapi.IDConfig
+	Ring        ring.Config
+	DialTimeout time.Duration
+	CallTimeout time.Duration
+	Refresh     time.Duration // interval between finger table refreshes
+	JoinTimeout time.Duration // time a join may go without progress before it is aborted
+	AntiEntropy time.Duration // interval between anti-entropy rounds with the replicas of the node
+	GCGrace     time.Duration // age at which tombstones of deleted keys are dropped
+	Hints       time.Duration // interval between attempts to deliver hints to their replicas
+	MaxHints    int           // hints kept for unreachable replicas
+	MaxHintSize int           // bytes of keys and values of the hints kept
+	MaxHintAge  time.Duration // hints older than this are dropped
+	LogLevel    slog.Level    // lines below this level are dropped
+	LogJSON     bool          // logs JSON lines instead of key=value text
+	TraceTo     string        // where spans are written: "" for nowhere, "stdout" or the path of a file
+	TraceSample int           // percentage of the requests entering the ring at the node that are traced
+}
+
+/*
+Parses the TOML subset used by dhtnode configs: [section] headers, key = value pairs and # comments.
+Values are double quoted strings, integers, booleans or single line arrays of strings.
+Returns a map from "section.key" (or "key" before any section) to the raw value
+*/
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad section header", line_no)
+			}
+			section = strings.TrimSpace(line[1:len(line)-1]) + "."
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line_no)
+		}
+		key := section + strings.TrimSpace(line[:eq])
+		val, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line_no, err.Error())
+		}
+		if _, dup := ret[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line_no, key)
+		}
+		ret[key] = val
+	}
+	return ret, scanner.Err()
+}
+
+// removes a trailing # comment that is not inside a string
+func stripComment(line string) string {
+	in_str := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && in_str:
+			i++ // skip escaped char
+		case line[i] == '"':
+			in_str = !in_str
+		case line[i] == '#' && !in_str:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parses a single TOML value into a string, int64, bool or []string
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		ret := []string{}
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue // allows trailing commas and empty arrays
+			}
+			str, err := strconv.Unquote(item)
+			if err != nil {
+				return nil, fmt.Errorf("arrays may only hold strings")
+			}
+			ret = append(ret, str)
+		}
+		return ret, nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+/*
+Reads the config file at path and fills in defaults. Returns an error naming the bad setting if the config is invalid
+*/
+func loadConfig(path string) (*NodeConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readConfig(f)
+}
+
+func readConfig(r io.Reader) (*NodeConfig, error) {
+	kv, err := parseTOML(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &NodeConfig{
+		Replication: 1,
+		StoreShards: 1,
+		Ring:        ring.CurConfig(),
+		DialTimeout: 5 * time.Second,
+		CallTimeout: 10 * time.Second,
+		Refresh:     30 * time.Second,
+		JoinTimeout: 30 * time.Second,
+		AntiEntropy: time.Minute,
+		GCGrace:     24 * time.Hour,
+		Hints:       10 * time.Second,
+		MaxHints:    100000,
+		MaxHintSize: 64 << 20,
+		MaxHintAge:  3 * time.Hour}
+	policy := "hostport"
+	explicit := ""
+	hash := cfg.Ring.Hash.String()
+	bits := int64(cfg.Ring.Bits)
+	replication := int64(cfg.Replication)
+	shards := int64(cfg.StoreShards)
+	vindex := int64(0)
+	dial := ""
+	protocol := "netrpc"
+	call := ""
+	refresh := ""
+	join := ""
+	antientropy := ""
+	hints := ""
+	gc_grace := ""
+	max_hints := int64(cfg.MaxHints)
+	max_hint_size := int64(cfg.MaxHintSize)
+	max_hint_age := ""
+	log_level := "info"
+	log_format := "text"
+	trace_exporter := ""
+	trace_file := ""
+	trace_sample := int64(100)
+	for key, val := range kv {
+		switch key {
+		case "listen":
+			err = setString(&cfg.Listen, key, val)
+		case "advertise":
+			err = setString(&cfg.Advertise, key, val)
+		case "http_listen":
+			err = setString(&cfg.HttpListen, key, val)
+		case "admin_listen":
+			err = setString(&cfg.AdminListen, key, val)
+		case "protocol":
+			err = setString(&protocol, key, val)
+		case "data_dir":
+			err = setString(&cfg.DataDir, key, val)
+		case "replication":
+			err = setInt(&replication, key, val)
+		case "store_shards":
+			err = setInt(&shards, key, val)
+		case "bootstrap":
+			peers, ok := val.([]string)
+			if !ok {
+				err = fmt.Errorf("%s must be an array of strings", key)
+			}
+			cfg.Bootstrap = peers
+		case "id.policy":
+			err = setString(&policy, key, val)
+		case "id.vindex":
+			err = setInt(&vindex, key, val)
+		case "id.explicit":
+			err = setString(&explicit, key, val)
+		case "ring.hash":
+			err = setString(&hash, key, val)
+		case "ring.bits":
+			err = setInt(&bits, key, val)
+		case "timeouts.dial":
+			err = setString(&dial, key, val)
+		case "timeouts.call":
+			err = setString(&call, key, val)
+		case "timeouts.refresh":
+			err = setString(&refresh, key, val)
+		case "timeouts.join":
+			err = setString(&join, key, val)
+		case "timeouts.antientropy":
+			err = setString(&antientropy, key, val)
+		case "timeouts.gc_grace":
+			err = setString(&gc_grace, key, val)
+		case "timeouts.hints":
+			err = setString(&hints, key, val)
+		case "hints.max_hints":
+			err = setInt(&max_hints, key, val)
+		case "hints.max_bytes":
+			err = setInt(&max_hint_size, key, val)
+		case "hints.max_age":
+			err = setString(&max_hint_age, key, val)
+		case "log.level":
+			err = setString(&log_level, key, val)
+		case "log.format":
+			err = setString(&log_format, key, val)
+		case "tracing.exporter":
+			err = setString(&trace_exporter, key, val)
+		case "tracing.file":
+			err = setString(&trace_file, key, val)
+		case "tracing.sample_percent":
+			err = setInt(&trace_sample, key, val)
+		default:
+			err = fmt.Errorf("unknown setting %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Listen == "" {
+		return nil, fmt.Errorf("listen must be set")
+	}
+	if cfg.Advertise == "" {
+		cfg.Advertise = cfg.Listen
+	}
+	if replication < 1 {
+		return nil, fmt.Errorf("replication must be at least 1")
+	}
+	cfg.Replication = int(replication)
+	if shards < 1 || shards > CM.MaxShards || shards&(shards-1) != 0 {
+		return nil, fmt.Errorf("store_shards must be a power of 2 in [1, %d]", CM.MaxShards)
+	}
+	cfg.StoreShards = int(shards)
+	if cfg.Ring.Hash, err = ring.ParseHash(hash); err != nil {
+		return nil, fmt.Errorf("ring.hash must be sha1 or sha256")
+	}
+	if bits <= 0 || bits > int64(cfg.Ring.Hash.Size()) {
+		return nil, fmt.Errorf("ring.bits must be in [1, %d] for %s", cfg.Ring.Hash.Size(), hash)
+	}
+	cfg.Ring.Bits = uint32(bits)
+	if vindex < 0 || vindex > int64(^uint32(0)) {
+		return nil, fmt.Errorf("id.vindex out of range")
+	}
+	cfg.ID.VIndex = uint32(vindex)
+	switch policy {
+	case "hostport":
+		cfg.ID.Policy = nodeapi.IDHostPort
+	case "virtual":
+		cfg.ID.Policy = nodeapi.IDVirtual
+	case "random":
+		cfg.ID.Policy = nodeapi.IDRandom
+	case "explicit":
+		cfg.ID.Policy = nodeapi.IDExplicit
+		// hex width depends on the ring config, which is not applied yet
+		if cfg.ID.Explicit, err = cfg.Ring.FromHex(explicit); err != nil {
+			return nil, fmt.Errorf("id.explicit must be %d hex chars", 2*((cfg.Ring.Bits+7)/8))
+		}
+	default:
+		return nil, fmt.Errorf("id.policy must be hostport, virtual, random or explicit")
+	}
+	if cfg.Protocol, err = nodeapi.ParseProtocol(protocol); err != nil {
+		return nil, fmt.Errorf("protocol must be netrpc or grpc")
+	}
+	if cfg.DialTimeout, err = parseTimeout(dial, cfg.DialTimeout); err != nil {
+		return nil, fmt.Errorf("timeouts.dial: %s", err.Error())
+	}
+	if cfg.CallTimeout, err = parseTimeout(call, cfg.CallTimeout); err != nil {
+		return nil, fmt.Errorf("timeouts.call: %s", err.Error())
+	}
+	if cfg.Refresh, err = parseTimeout(refresh, cfg.Refresh); err != nil {
+		return nil, fmt.Errorf("timeouts.refresh: %s", err.Error())
+	}
+	if cfg.JoinTimeout, err = parseTimeout(join, cfg.JoinTimeout); err != nil {
+		return nil, fmt.Errorf("timeouts.join: %s", err.Error())
+	}
+	if cfg.AntiEntropy, err = parseTimeout(antientropy, cfg.AntiEntropy); err != nil {
+		return nil, fmt.Errorf("timeouts.antientropy: %s", err.Error())
+	}
+	if cfg.GCGrace, err = parseTimeout(gc_grace, cfg.GCGrace); err != nil {
+		return nil, fmt.Errorf("timeouts.gc_grace: %s", err.Error())
+	}
+	if cfg.GCGrace <= cfg.AntiEntropy {
+		return nil, fmt.Errorf("timeouts.gc_grace must exceed timeouts.antientropy, or deleted keys come back")
+	}
+	if cfg.Hints, err = parseTimeout(hints, cfg.Hints); err != nil {
+		return nil, fmt.Errorf("timeouts.hints: %s", err.Error())
+	}
+	if max_hints < 1 || max_hints > 1<<31-1 {
+		return nil, fmt.Errorf("hints.max_hints must be in [1, %d]", 1<<31-1)
+	}
+	cfg.MaxHints = int(max_hints)
+	if max_hint_size < 1 || max_hint_size > 1<<31-1 {
+		return nil, fmt.Errorf("hints.max_bytes must be in [1, %d]", 1<<31-1)
+	}
+	cfg.MaxHintSize = int(max_hint_size)
+	if cfg.MaxHintAge, err = parseTimeout(max_hint_age, cfg.MaxHintAge); err != nil {
+		return nil, fmt.Errorf("hints.max_age: %s", err.Error())
+	}
+	if err = cfg.LogLevel.UnmarshalText([]byte(log_level)); err != nil {
+		return nil, fmt.Errorf("log.level must be debug, info, warn or error")
+	}
+	if log_format != "text" && log_format != "json" {
+		return nil, fmt.Errorf("log.format must be text or json")
+	}
+	cfg.LogJSON = log_format == "json"
+	switch trace_exporter {
+	case "", "stdout":
+		cfg.TraceTo = trace_exporter
+	case "file":
+		if trace_file == "" {
+			return nil, fmt.Errorf("tracing.file must be set for the file exporter")
+		}
+		cfg.TraceTo = trace_file
+	default:
+		return nil, fmt.Errorf("tracing.exporter must be empty, stdout or file")
+	}
+	if trace_sample < 0 || trace_sample > 100 {
+		return nil, fmt.Errorf("tracing.sample_percent must be in [0, 100]")
+	}
+	cfg.TraceSample = int(trace_sample)
+	return cfg, nil
+}
+
+func setString(dst *string, key string, val interface{}) error {
+	str, ok := val.(string)
+	if !ok {
+		return fmt.Errorf("%s must be a string", key)
+	}
+	*dst = str
+	return nil
+}
+
+func setInt(dst *int64, key string, val interface{}) error {
+	n, ok := val.(int64)
+	if !ok {
+		return fmt.Errorf("%s must be an integer", key)
+	}
+	*dst = n
+	return nil
+}
+
+// parses a duration like "5s". Returns def if s is empty
+func parseTimeout(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"go_dht/nodeapi"
+	"go_dht/ring"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	f, err := os.Open("dhtnode.toml")
+	if err != nil {
+		t.Fatalf("Could not open example config. err = %s\n", err.Error())
+	}
+	defer f.Close()
+	cfg, err := readConfig(f)
+	if err != nil {
+		t.Fatalf("Example config should parse. err = %s\n", err.Error())
+	}
+	if cfg.Listen != "127.0.0.1:8080" || cfg.Advertise != cfg.Listen || len(cfg.Bootstrap) != 0 || cfg.AdminListen != "" {
+		t.Errorf("Wrong addresses in %+v\n", cfg)
+	}
+	if cfg.Ring != (ring.Config{Hash: ring.SHA1, Bits: 160}) || cfg.ID.Policy != nodeapi.IDHostPort {
+		t.Errorf("Wrong ring or id settings in %+v\n", cfg)
+	}
+	if cfg.DialTimeout != 5*time.Second || cfg.CallTimeout != 10*time.Second {
+		t.Errorf("Wrong timeouts in %+v\n", cfg)
+	}
+}
+
+func TestReadConfigSettings(t *testing.T) {
+	text := `
+listen = "0.0.0.0:9000" # all interfaces
+admin_listen = "127.0.0.1:9100"
+protocol = "grpc"
+store_shards = 16
+replication = 3
+advertise = "10.0.0.5:9000"
+bootstrap = ["10.0.0.1:9000", "10.0.0.2:9000",]
+[id]
+policy = "explicit"
+explicit = "2a"
+[ring]
+hash = "sha256"
+bits = 8
+[timeouts]
+call = "250ms"
+join = "1m"
+[hints]
+max_hints = 10
+max_age = "1h"
+[log]
+level = "debug"
+format = "json"
+[tracing]
+exporter = "file"
+file = "/tmp/spans.jsonl"
+sample_percent = 5
+`
+	cfg, err := readConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Config should parse. err = %s\n", err.Error())
+	}
+	if cfg.Advertise != "10.0.0.5:9000" || len(cfg.Bootstrap) != 2 || cfg.Bootstrap[1] != "10.0.0.2:9000" || cfg.AdminListen != "127.0.0.1:9100" {
+		t.Errorf("Wrong addresses in %+v\n", cfg)
+	}
+	if cfg.Ring != (ring.Config{Hash: ring.SHA256, Bits: 8}) || cfg.CallTimeout != 250*time.Millisecond || cfg.JoinTimeout != time.Minute || cfg.Protocol != nodeapi.ProtoGRPC || cfg.StoreShards != 16 || cfg.Replication != 3 ||
+		cfg.MaxHints != 10 || cfg.MaxHintAge != time.Hour || cfg.LogLevel != slog.LevelDebug || !cfg.LogJSON ||
+		cfg.TraceTo != "/tmp/spans.jsonl" || cfg.TraceSample != 5 {
+		t.Errorf("Wrong ring or timeout settings in %+v\n", cfg)
+	}
+	ring.SetConfig(cfg.Ring)
+	defer ring.SetConfig(ring.Config{Hash: ring.SHA1, Bits: 160})
+	if cfg.ID.Policy != nodeapi.IDExplicit || cfg.ID.Explicit != ring.FromInt(0x2a) {
+		t.Errorf("Wrong explicit id %s\n", cfg.ID.Explicit)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	bad := []string{
+		`advertise = "10.0.0.5:9000"`,                      // no listen
+		"listen = \"a:1\"\nlisten = \"b:1\"",               // duplicate
+		"listen = \"a:1\"\nport = 1",                       // unknown key
+		"listen = \"a:1\"\n[ring]\nbits = 161",             // too wide for sha1
+		"listen = \"a:1\"\n[id]\npolicy = \"foo\"",         // unknown policy
+		"listen = \"a:1\"\nreplication = 0",                // no copy kept
+		"listen = \"a:1\"\nstore_shards = 3",               // not a power of 2
+		"listen = 1",                                       // wrong type
+		"listen = \"a:1\"\n[hints]\nmax_hints = 0",         // no hints kept
+		"listen = \"a:1\"\n[timeouts]\ngc_grace = \"1m\"",  // tombstones dropped before copies converge
+		"listen = \"a:1\"\n[log]\nlevel = \"loud\"",        // unknown level
+		"listen = \"a:1\"\n[tracing]\nexporter = \"file\"", // no file
+	}
+	for _, text := range bad {
+		if _, err := readConfig(strings.NewReader(text)); err == nil {
+			t.Errorf("Config should be rejected:\n%s\n", text)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+dhtnode runs a single chord node. It either creates a new ring or joins the ring of one of the bootstrap peers, then serves
+NAPI requests, HTTP/JSON requests if http_listen is set and the inspection endpoints if admin_listen is set, until SIGTERM/SIGINT, on
+which it hands its keys to its successor and leaves the ring.
+Usage: dhtnode -config dhtnode.toml
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go_dht/nodeapi"
+	"go_dht/ring"
+	"go_dht/tracing"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const idFile = "node.id" // file in DataDir holding the hex id of the node
+
+/*
+Returns the id config the node should use. If cfg.DataDir is set the id derived on the first start is saved there
+and reused as an explicit id afterwards, so nodes with random ids keep their place in the ring across restarts
+*/
+func nodeID(cfg *NodeConfig, hostname string, port string) (*nodeapi.IDConfig, error) {
+	if cfg.DataDir == "" {
+		return &cfg.ID, nil
+	}
+	path := filepath.Join(cfg.DataDir, idFile)
+	data, err := os.ReadFile(path)
+	if err == nil { // id saved by an earlier run
+		id, err := ring.FromHex(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s does not hold an id for this ring config", path)
+		}
+		return &nodeapi.IDConfig{Policy: nodeapi.IDExplicit, Explicit: id}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	id, err := cfg.ID.DeriveID(hostname, port)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, []byte(id.String()+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return &nodeapi.IDConfig{Policy: nodeapi.IDExplicit, Explicit: id}, nil
+}
+
+/*
+Creates a new ring if cfg has no bootstrap peers. Else joins through the first peer that accepts the join
+*/
+func startNode(cfg *NodeConfig, idcfg *nodeapi.IDConfig, hostname string, port string) (*nodeapi.LocNodeStruct, error) {
+	if len(cfg.Bootstrap) == 0 {
+		slog.Info("no bootstrap peers, creating a new ring")
+		return nodeapi.LocalInit(hostname, port, idcfg, nil)
+	}
+	var err error
+	for _, peer := range cfg.Bootstrap {
+		boot_host, boot_port, serr := net.SplitHostPort(peer)
+		if serr != nil {
+			err = serr
+			continue
+		}
+		ln, jerr := nodeapi.Join(hostname, port, idcfg, &nodeapi.HostData{Hostname: boot_host, Port: boot_port})
+		if jerr == nil {
+			slog.Info("joined ring", "bootstrap", peer)
+			return ln, nil
+		}
+		slog.Warn("could not join", "bootstrap", peer, "err", jerr)
+		err = jerr
+	}
+	return nil, err
+}
+
+func run(cfg_path string) error {
+	cfg, err := loadConfig(cfg_path)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if cfg.LogJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+	nodeapi.SetLogger(slog.Default())
+	if cfg.TraceTo != "" {
+		exporter := tracing.NewWriterExporter(os.Stdout)
+		if cfg.TraceTo != "stdout" {
+			if exporter, err = tracing.OpenFileExporter(cfg.TraceTo); err != nil {
+				return err
+			}
+			defer exporter.Close()
+		}
+		nodeapi.SetTracer(tracing.NewTracer("dhtnode", exporter, float64(cfg.TraceSample)/100))
+	}
+	if err = ring.SetConfig(cfg.Ring); err != nil {
+		return err
+	}
+	nodeapi.SetTimeouts(cfg.DialTimeout, cfg.CallTimeout)
+	nodeapi.SetJoinTimeout(cfg.JoinTimeout)
+	nodeapi.SetProtocol(cfg.Protocol)
+	nodeapi.SetStoreShards(cfg.StoreShards)
+	nodeapi.SetReplication(cfg.Replication)
+	nodeapi.SetTombstoneGrace(cfg.GCGrace)
+	nodeapi.SetHintLimits(cfg.MaxHints, cfg.MaxHintSize, cfg.MaxHintAge)
+	hostname, port, err := net.SplitHostPort(cfg.Advertise)
+	if err != nil {
+		return err
+	}
+	idcfg, err := nodeID(cfg, hostname, port)
+	if err != nil {
+		return err
+	}
+	ln, err := startNode(cfg, idcfg, hostname, port)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(ln.Logger()) // lines of the node carry its id from now on
+	listener, err := nodeapi.NapiStartOn(ln, cfg.Listen)
+	if err != nil {
+		return err
+	}
+	if cfg.HttpListen != "" {
+		http_listener, err := nodeapi.HttpStartOn(ln, cfg.HttpListen)
+		if err != nil {
+			nodeapi.NapiStop(listener)
+			return err
+		}
+		defer http_listener.Close()
+	}
+	if cfg.AdminListen != "" {
+		admin_listener, err := nodeapi.AdminStartOn(ln, cfg.AdminListen)
+		if err != nil {
+			nodeapi.NapiStop(listener)
+			return err
+		}
+		defer admin_listener.Close()
+	}
+	if err = ln.Start(nodeapi.Background{Fingers: cfg.Refresh, AntiEntropy: cfg.AntiEntropy, Hints: cfg.Hints}); err != nil {
+		nodeapi.NapiStop(listener)
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	ln.Stop()
+	slog.Info("leaving the ring", "signal", sig.String())
+	if err = nodeapi.Leave(ln); err != nil {
+		slog.Error("could not leave the ring gracefully", "err", err)
+	}
+	nodeapi.NapiStop(listener)
+	return err
+}
+
+func main() {
+	cfg_path := flag.String("config", "dhtnode.toml", "path to the node config file")
+	flag.Parse()
+	if err := run(*cfg_path); err != nil {
+		fmt.Printf("dhtnode: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
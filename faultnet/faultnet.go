@@ -0,0 +1,226 @@
+/*
+Package faultnet injects network faults into the calls between nodes. A Network wraps the transport of every node and applies
+per-link rules for dropped calls, dropped replies, latency and duplicated calls, plus partitions. Every link draws from its
+own random generator seeded from the seed of the Network and the link, so the faults on a link only depend on the calls made
+over it and a test making the same calls sees the same faults. Concurrent calls with random latency arrive out of order.
+*/
+package faultnet
+
+import (
+	"context"
+	NA "go_dht/nodeapi"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// uniform latency in [Min, Max]
+type Latency struct {
+	Min, Max time.Duration
+}
+
+/*
+Faults of a link. Probabilities are in [0, 1]
+*/
+type Rule struct {
+	Drop      float64 // the call never reaches the peer
+	DropReply float64 // the peer handles the call but the reply is lost
+	Duplicate float64 // the peer handles the call twice. The caller gets the reply of the first
+	Latency   Latency // added before the call reaches the peer
+}
+
+// calls from From to To
+type link struct {
+	from, to NA.HostData
+}
+
+// counts of injected faults
+type Stats struct {
+	Calls, Dropped, DroppedReplies, Duplicated, Partitioned int
+}
+
+type Network struct {
+	lock   sync.Mutex
+	seed   int64
+	def    Rule
+	rules  map[link]Rule
+	rngs   map[link]*rand.Rand
+	groups map[NA.HostData]int // partition group of each node. nil if the network is not partitioned
+	stats  Stats
+}
+
+/*
+Creates a network without faults. seed drives every random choice
+*/
+func New(seed int64) *Network {
+	return &Network{seed: seed, rules: make(map[link]Rule), rngs: make(map[link]*rand.Rand)}
+}
+
+/*
+Sets the rule of links without a rule of their own
+*/
+func (n *Network) SetDefault(rule Rule) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.def = rule
+}
+
+/*
+Sets the rule of calls from from to to. The other direction is not changed
+*/
+func (n *Network) SetLink(from NA.HostData, to NA.HostData, rule Rule) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.rules[link{from, to}] = rule
+}
+
+/*
+Removes the rules of every link and the default rule
+*/
+func (n *Network) Reset() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.def = Rule{}
+	n.rules = make(map[link]Rule)
+}
+
+/*
+Splits the network into groups. Calls between groups are dropped. Nodes in no group form one more group
+*/
+func (n *Network) Partition(groups ...[]NA.HostData) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = make(map[NA.HostData]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.groups[node] = i + 1
+		}
+	}
+}
+
+/*
+Removes the partition
+*/
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = nil
+}
+
+/*
+Returns the counts of injected faults so far
+*/
+func (n *Network) Stats() Stats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stats
+}
+
+// the faults of a single call
+type plan struct {
+	partitioned, drop, drop_reply, duplicate bool
+	delay                                    time.Duration
+}
+
+// draws the faults of the next call over l
+func (n *Network) plan(l link) plan {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.stats.Calls++
+	if n.groups != nil && n.groups[l.from] != n.groups[l.to] {
+		n.stats.Partitioned++
+		return plan{partitioned: true}
+	}
+	rule, ok := n.rules[l]
+	if !ok {
+		rule = n.def
+	}
+	rng := n.rngs[l]
+	if rng == nil {
+		h := fnv.New64a()
+		io.WriteString(h, l.from.Hostname+":"+l.from.Port+">"+l.to.Hostname+":"+l.to.Port)
+		rng = rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))
+		n.rngs[l] = rng
+	}
+	// always draw every value so a rule change does not shift later draws
+	p := plan{
+		drop:       rng.Float64() < rule.Drop,
+		drop_reply: rng.Float64() < rule.DropReply,
+		duplicate:  rng.Float64() < rule.Duplicate,
+		delay:      rule.Latency.Min}
+	if spread := rule.Latency.Max - rule.Latency.Min; spread > 0 {
+		p.delay += time.Duration(rng.Int63n(int64(spread) + 1))
+	} else {
+		rng.Int63()
+	}
+	switch {
+	case p.drop:
+		n.stats.Dropped++
+	case p.drop_reply:
+		n.stats.DroppedReplies++
+	}
+	if p.duplicate && !p.drop {
+		n.stats.Duplicated++
+	}
+	return p
+}
+
+/*
+Returns the transport of the node at self. Its calls go through inner after the faults of their link are applied
+*/
+func (n *Network) Wrap(self NA.HostData, inner NA.Transport) NA.Transport {
+	return &faultTransport{net: n, self: self, inner: inner}
+}
+
+type faultTransport struct {
+	net   *Network
+	self  NA.HostData
+	inner NA.Transport
+}
+
+// waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Lost calls and replies fail with NapiConnError like a peer that cannot be reached
+*/
+func (ft *faultTransport) Call(ctx context.Context, peer NA.HostData, method string, args interface{}, reply interface{}) error {
+	p := ft.net.plan(link{ft.self, peer})
+	if p.partitioned {
+		return NA.NewNapiConnError()
+	}
+	if err := sleep(ctx, p.delay); err != nil {
+		return err
+	}
+	if p.drop {
+		return NA.NewNapiConnError()
+	}
+	err := ft.inner.Call(ctx, peer, method, args, reply)
+	if p.duplicate { // the copy arrives after the original, its reply is thrown away
+		dup_reply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		ft.inner.Call(ctx, peer, method, args, dup_reply)
+	}
+	if p.drop_reply {
+		return NA.NewNapiConnError()
+	}
+	return err
+}
+
+func (ft *faultTransport) Serve(ln *NA.LocNodeStruct, listen_addr string) (io.Closer, error) {
+	return ft.inner.Serve(ln, listen_addr)
+}
@@ -0,0 +1,113 @@
+package faultnet
+
+import (
+	"context"
+	"fmt"
+	NA "go_dht/nodeapi"
+	"testing"
+	"time"
+)
+
+var client = NA.HostData{Hostname: "client", Port: "0"}
+
+// serves a single node ring on an in-memory transport and returns its address
+func startNode(t *testing.T, tr *NA.ChanTransport) NA.HostData {
+	ln, err := NA.LocalInitWith(tr, "node", "1", nil, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node\n")
+	}
+	closer, err := ln.Serve("")
+	if err != nil {
+		t.Fatalf("Could not serve node. err = %s\n", err.Error())
+	}
+	t.Cleanup(func() { closer.Close() })
+	return NA.HostData{Hostname: "node", Port: "1"}
+}
+
+// makes n puts and returns which of them failed as a string of 0s and 1s
+func outcomes(tr NA.Transport, node NA.HostData, n int) string {
+	ret := ""
+	for i := 0; i < n; i++ {
+		var reply NA.HTReply
+		if tr.Call(context.Background(), node, "NAPI.Put", &NA.HTArgs{Key: fmt.Sprint(i), Value: "v"}, &reply) != nil {
+			ret += "1"
+		} else {
+			ret += "0"
+		}
+	}
+	return ret
+}
+
+// the same seed must give the same faults
+func TestDeterministic(t *testing.T) {
+	chans := NA.NewChanTransport()
+	node := startNode(t, chans)
+	var runs []string
+	for _, seed := range []int64{7, 7, 8} {
+		net := New(seed)
+		net.SetDefault(Rule{Drop: 0.3, DropReply: 0.2})
+		runs = append(runs, outcomes(net.Wrap(client, chans), node, 64))
+	}
+	if runs[0] != runs[1] {
+		t.Errorf("Same seed gave different faults\n%s\n%s\n", runs[0], runs[1])
+	}
+	if runs[0] == runs[2] {
+		t.Errorf("Different seeds should give different faults\n")
+	}
+}
+
+func TestRules(t *testing.T) {
+	chans := NA.NewChanTransport()
+	node := startNode(t, chans)
+	net := New(1)
+	tr := net.Wrap(client, chans)
+	ctx := context.Background()
+	var reply NA.HTReply
+
+	net.SetLink(client, node, Rule{Drop: 1})
+	if err := tr.Call(ctx, node, "NAPI.Put", &NA.HTArgs{Key: "dropped", Value: "v"}, &reply); err == nil {
+		t.Errorf("Dropped call should fail\n")
+	}
+	if err := chans.Call(ctx, node, "NAPI.Get", &NA.HTArgs{Key: "dropped"}, &reply); err == nil {
+		t.Errorf("Dropped call should not reach the node\n")
+	}
+
+	net.SetLink(client, node, Rule{DropReply: 1})
+	if err := tr.Call(ctx, node, "NAPI.Put", &NA.HTArgs{Key: "lost reply", Value: "v"}, &reply); err == nil {
+		t.Errorf("Call with a lost reply should fail\n")
+	}
+	if err := chans.Call(ctx, node, "NAPI.Get", &NA.HTArgs{Key: "lost reply"}, &reply); err != nil {
+		t.Errorf("Call with a lost reply should reach the node\n")
+	}
+
+	// the duplicate of a put if absent fails but the caller sees the first reply
+	net.SetLink(client, node, Rule{Duplicate: 1})
+	if err := tr.Call(ctx, node, "NAPI.CAS", &NA.HTArgs{Key: "dup", Value: "v", Absent: true}, &reply); err != nil {
+		t.Errorf("Duplicated call should give the first reply. err = %s\n", err.Error())
+	}
+	if net.Stats().Duplicated != 1 {
+		t.Errorf("Expected 1 duplicate, stats = %+v\n", net.Stats())
+	}
+
+	net.SetLink(client, node, Rule{Latency: Latency{Min: 20 * time.Millisecond, Max: 30 * time.Millisecond}})
+	start := time.Now()
+	tr.Call(ctx, node, "NAPI.Get", &NA.HTArgs{Key: "dup"}, &reply)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Call took %s, expected at least 20ms of latency\n", elapsed)
+	}
+	short, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if err := tr.Call(short, node, "NAPI.Get", &NA.HTArgs{Key: "dup"}, &reply); err != context.DeadlineExceeded {
+		t.Errorf("Latency longer than the deadline should give DeadlineExceeded. Got %v\n", err)
+	}
+
+	net.Reset()
+	net.Partition([]NA.HostData{node})
+	if err := tr.Call(ctx, node, "NAPI.Get", &NA.HTArgs{Key: "dup"}, &reply); err == nil {
+		t.Errorf("Call across a partition should fail\n")
+	}
+	net.Heal()
+	if err := tr.Call(ctx, node, "NAPI.Get", &NA.HTArgs{Key: "dup"}, &reply); err != nil {
+		t.Errorf("Call after heal failed. err = %s\n", err.Error())
+	}
+}
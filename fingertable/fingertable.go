@@ -1,54 +1,44 @@
 package fingertable
 
 import (
-	"go_dht/constants"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"sync"
+	"sync/atomic"
 )
 
 type HostStruct struct {
 	Hostname, Port string
 }
 
-type FTStruct struct {
-	n     [constants.ShaSize]byte          // the ending key for the finger table and this node
-	table [constants.ShaNumBits]HostStruct // maps i -> (host, port). Each entry stores succ(n + 2^i)
-}
-
-type UpdateFn func([constants.ShaSize]byte) (string, string)
-
-/************ Helper Functions ***************/
-
-/* Checks if x is within [start, end) i.e exclusive end, inclusive start. Also handles case of wrap around where end < start.
-If end == start, returns false.
+/*
+Safe for concurrent use. The table is never modified in place, writers build a copy and swap it in, so lookups take no lock
+and always see a whole table
 */
-func InRangeHelp(x [constants.ShaSize]byte, start [constants.ShaSize]byte, end [constants.ShaSize]byte) bool {
-	if SSA.Cmp(start, end) == SSA.Equal {
-		return false
-	}
-	if SSA.Cmp(start, end) == SSA.Greater { // wrap around case
-		return SSA.InRange(x, start, SSA.MaxVal()) || InRangeHelp(x, SSA.FromInt(0), end)
-		// check [start, MaxVal], [0, end)
-	}
-	// start < end
-	return SSA.InRange(x, start, SSA.Sub(end, SSA.FromInt(1)))
+type FTStruct struct {
+	n       ring.ID                      // the ending key for the finger table and this node
+	table   atomic.Pointer[[]HostStruct] // maps i -> (host, port). Each entry stores succ(n + 2^i). Has ring.Bits() entries
+	lock    sync.Mutex                   // serializes writers so no update is lost
+	changes atomic.Uint64                // entries whose host changed, see Changes
 }
 
-/************** End Helper *********************/
+type UpdateFn func(ring.ID) (string, string)
 
 /*
 Given a sha key, returns the host and port of the node responsible for it
 */
-func (fts *FTStruct) Find(key [constants.ShaSize]byte) (string, string, error) {
-	start := SSA.Add(fts.n, SSA.Pow2(0)) // n + 2^0
-	var end [constants.ShaSize]byte
-	for i := uint32(0); i < constants.ShaNumBits; i++ {
-		if i == constants.ShaNumBits-1 { // wrap around
-			end = SSA.Add(fts.n, SSA.Pow2(0)) // n + 2^0
+func (fts *FTStruct) Find(key ring.ID) (string, string, error) {
+	table := fts.entries()
+	start := fts.n.Add(ring.Pow2(0)) // n + 2^0
+	var end ring.ID
+	num_bits := uint32(len(table))
+	for i := uint32(0); i < num_bits; i++ {
+		if i == num_bits-1 { // wrap around
+			end = fts.n.Add(ring.Pow2(0)) // n + 2^0
 		} else {
-			end = SSA.Add(fts.n, SSA.Pow2(i+1)) // n + s^(i+1)
+			end = fts.n.Add(ring.Pow2(i + 1)) // n + s^(i+1)
 		}
-		if InRangeHelp(key, start, end) {
-			return fts.table[i].Hostname, fts.table[i].Port, nil
+		if key.Between(start, end, ring.ClosedOpen) {
+			return table[i].Hostname, table[i].Port, nil
 			// return start/more-left node as the predecessor is better candidate since search is done clockwise
 		}
 		start = end // update start
@@ -59,16 +49,17 @@ func (fts *FTStruct) Find(key [constants.ShaSize]byte) (string, string, error) {
 /*
 Given a sha key, returns the corresponding index of the finger table
 */
-func (fts *FTStruct) FindIndex(key [constants.ShaSize]byte) (uint32, error) {
-	start := SSA.Add(fts.n, SSA.Pow2(0)) // n + 2^0
-	var end [constants.ShaSize]byte
-	for i := uint32(0); i < constants.ShaNumBits; i++ {
-		if i == constants.ShaNumBits-1 { // wrap around
-			end = SSA.Add(fts.n, SSA.Pow2(0)) // n + 2^0
+func (fts *FTStruct) FindIndex(key ring.ID) (uint32, error) {
+	start := fts.n.Add(ring.Pow2(0)) // n + 2^0
+	var end ring.ID
+	num_bits := uint32(len(fts.entries()))
+	for i := uint32(0); i < num_bits; i++ {
+		if i == num_bits-1 { // wrap around
+			end = fts.n.Add(ring.Pow2(0)) // n + 2^0
 		} else {
-			end = SSA.Add(fts.n, SSA.Pow2(i+1)) // n + s^(i+1)
+			end = fts.n.Add(ring.Pow2(i + 1)) // n + s^(i+1)
 		}
-		if InRangeHelp(key, start, end) {
+		if key.Between(start, end, ring.ClosedOpen) {
 			return i, nil
 		}
 		start = end // update start, less calculation
@@ -76,27 +67,80 @@ func (fts *FTStruct) FindIndex(key [constants.ShaSize]byte) (uint32, error) {
 	return 0, NewFTFindError()
 }
 
-// updatesthe entire fingertable using u_fn
+// the current table. Must not be modified
+func (fts *FTStruct) entries() []HostStruct {
+	if table := fts.table.Load(); table != nil {
+		return *table
+	}
+	return nil
+}
+
+// updatesthe entire fingertable using u_fn. u_fn runs without the lock, so updates made meanwhile are replaced by its result
 func (fts *FTStruct) Update(u_fn UpdateFn) {
-	var new_tab [constants.ShaNumBits]HostStruct // required in case u_fn uses functions that reads/writes to fts.table
-	for i := range fts.table {
-		name, port := u_fn(SSA.Add(fts.n, SSA.Pow2(uint32(i))))
+	new_tab := make([]HostStruct, ring.Bits()) // required in case u_fn uses functions that reads/writes to fts.table
+	for i := range new_tab {
+		name, port := u_fn(fts.n.Add(ring.Pow2(uint32(i))))
 		new_tab[i] = HostStruct{Hostname: name, Port: port}
 	}
-	// copy to fts.table. Arrays are value types
-	fts.table = new_tab
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	fts.count(new_tab)
+	fts.table.Store(&new_tab)
 }
 
 /* updates finger table to reflect new node i.e succ( [lo, hi) ) -> new_succ. Wrap arounds handled
 Inclusive lo, exclusive hi
 */
-func (fts *FTStruct) UpdateRange(lo [constants.ShaSize]byte, hi [constants.ShaSize]byte, new_succ *HostStruct) {
-	for i := 0; i < len(fts.table); i++ {
-		key := SSA.Add(fts.n, SSA.Pow2(uint32(i)))
-		if InRangeHelp(key, lo, hi) {
-			fts.table[i] = *new_succ // copy struct into array slot
+func (fts *FTStruct) UpdateRange(lo ring.ID, hi ring.ID, new_succ *HostStruct) {
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	new_tab := append([]HostStruct{}, fts.entries()...)
+	for i := 0; i < len(new_tab); i++ {
+		key := fts.n.Add(ring.Pow2(uint32(i)))
+		if key.Between(lo, hi, ring.ClosedOpen) {
+			new_tab[i] = *new_succ // copy struct into array slot
 		}
 	}
+	fts.count(new_tab)
+	fts.table.Store(&new_tab)
+}
+
+// adds the entries of new_tab that differ from the current table to the changes. Assumes lock is held
+func (fts *FTStruct) count(new_tab []HostStruct) {
+	old_tab := fts.entries()
+	if len(old_tab) != len(new_tab) { // first table
+		return
+	}
+	changed := uint64(0)
+	for i := range new_tab {
+		if new_tab[i] != old_tab[i] {
+			changed++
+		}
+	}
+	fts.changes.Add(changed)
+}
+
+/*
+Returns the number of entries whose host changed since the table was created
+*/
+func (fts *FTStruct) Changes() uint64 {
+	return fts.changes.Load()
+}
+
+/*
+Returns a copy of the finger table. Entry i is succ(n + 2^i)
+*/
+func (fts *FTStruct) Entries() []HostStruct {
+	return append([]HostStruct{}, fts.entries()...)
+}
+
+/*
+Returns a copy of the finger table and the number of changes made to it, taken while no writer updates it
+*/
+func (fts *FTStruct) Snapshot() ([]HostStruct, uint64) {
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	return append([]HostStruct{}, fts.entries()...), fts.changes.Load()
 }
 
 /*
@@ -104,7 +148,7 @@ Initializer for a new FingerTable
 n = the key/id for the local node
 u_fn = function that maps key to a machine
 */
-func New(n [constants.ShaSize]byte, u_fn UpdateFn) *FTStruct {
+func New(n ring.ID, u_fn UpdateFn) *FTStruct {
 	ret := new(FTStruct)
 	ret.n = n
 	ret.Update(u_fn)
@@ -2,33 +2,102 @@ package fingertable
 
 import (
 	"fmt"
-	K "go_dht/constants"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"sync"
 	"testing"
 )
 
-func succFn(key [K.ShaSize]byte) (string, string) {
+func succFn(key ring.ID) (string, string) {
 	return "localhost", "8080"
 }
 
 func TestFT(t *testing.T) {
-	ft := New(SSA.FromInt(0), succFn)
-	for i := uint32(0); i < K.ShaNumBits; i++ {
-		fmt.Printf("i = %d, host = %s\n", i, ft.table[i].hostname)
+	ft := New(ring.FromInt(0), succFn)
+	for i := uint32(0); i < ring.Bits(); i++ {
+		fmt.Printf("i = %d, host = %s\n", i, ft.entries()[i].Hostname)
 	}
-	for i := uint32(0); i < uint32(K.ShaNumBits); i++ {
-		host, port, err := ft.Find(SSA.Pow2(i))
+	for i := uint32(0); i < ring.Bits(); i++ {
+		host, port, err := ft.Find(ring.Pow2(i))
 		if err != nil {
-			t.Errorf("Got wrong error on i = %d, key = %v , host = %s, port = %s\n", i, SSA.Pow2(i), host, port)
+			t.Errorf("Got wrong error on i = %d, key = %v , host = %s, port = %s\n", i, ring.Pow2(i), host, port)
 		} else {
-			fmt.Printf("i = %d, key = %v , host = %s, port = %s\n", i, SSA.Pow2(i), host, port)
+			fmt.Printf("i = %d, key = %v , host = %s, port = %s\n", i, ring.Pow2(i), host, port)
 		}
 
 	}
-	host, port, err := ft.Find(SSA.FromInt(0))
+	host, port, err := ft.Find(ring.FromInt(0))
 	if err != nil {
-		t.Errorf("Got wrong error on key = %v , host = %s, port = %s\n", SSA.FromInt(0), host, port)
+		t.Errorf("Got wrong error on key = %v , host = %s, port = %s\n", ring.FromInt(0), host, port)
 	} else {
-		fmt.Printf("key = %v , host = %s, port = %s\n", SSA.FromInt(0), host, port)
+		fmt.Printf("key = %v , host = %s, port = %s\n", ring.FromInt(0), host, port)
+	}
+}
+
+// 8 bit ring with nodes 10, 50 and 200 so every finger can be checked by hand
+func TestFTSmallRing(t *testing.T) {
+	if err := ring.SetConfig(ring.Config{Hash: ring.SHA1, Bits: 8}); err != nil {
+		t.Fatalf("Could not set 8 bit ring config\n")
+	}
+	defer ring.SetConfig(ring.Config{Hash: ring.SHA1, Bits: 160})
+	succ := func(key ring.ID) (string, string) {
+		for _, n := range []uint32{10, 50, 200} {
+			if key.Cmp(ring.FromInt(n)) != ring.Greater {
+				return "localhost", fmt.Sprint(n)
+			}
+		}
+		return "localhost", "10" // wrap around
+	}
+	ft := New(ring.FromInt(10), succ)
+	if len(ft.entries()) != 8 {
+		t.Errorf("8 bit ring should have 8 fingers, got %d\n", len(ft.entries()))
+	}
+	// key -> expected port. key 60 is in [10+32, 10+64) so uses finger 5 = succ(42) = 50
+	expected := map[uint32]string{11: "50", 60: "50", 140: "200", 5: "200", 9: "200"}
+	for key, port := range expected {
+		_, got, err := ft.Find(ring.FromInt(key))
+		if err != nil || got != port {
+			t.Errorf("Find(%d) = %s, expected %s\n", key, got, port)
+		}
+	}
+	// fingers 0 to 5 start in (10, 50], moving 50 to 40 changes them
+	ft.UpdateRange(ring.FromInt(11), ring.FromInt(51), &HostStruct{Hostname: "localhost", Port: "40"})
+	ft.UpdateRange(ring.FromInt(11), ring.FromInt(51), &HostStruct{Hostname: "localhost", Port: "40"})
+	if ft.Changes() != 6 {
+		t.Errorf("Expected 6 finger changes, got %d\n", ft.Changes())
+	}
+	if entries, changes := ft.Snapshot(); changes != 6 || entries[0].Port != "40" || len(entries) != int(ring.Bits()) {
+		t.Errorf("Snapshot gave %d changes and %v\n", changes, entries)
+	}
+}
+
+// lookups during updates see a whole table, and concurrent range updates are all kept. Run with -race
+func TestConcurrentUpdate(t *testing.T) {
+	ft := New(ring.FromInt(0), succFn)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if _, _, err := ft.Find(ring.Pow2(uint32(i) % ring.Bits())); err != nil {
+					t.Errorf("Find failed during updates. err = %s\n", err.Error())
+					return
+				}
+			}
+		}()
+	}
+	// each writer moves one finger, no move may be lost
+	for i := uint32(0); i < 8; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			ft.UpdateRange(ring.Pow2(i), ring.Pow2(i).Add(ring.FromInt(1)), &HostStruct{Hostname: "moved", Port: fmt.Sprint(i)})
+		}(i)
+	}
+	wg.Wait()
+	for i, e := range ft.Entries()[:8] {
+		if e.Hostname != "moved" || e.Port != fmt.Sprint(i) {
+			t.Errorf("Finger %d is %s:%s, update was lost\n", i, e.Hostname, e.Port)
+		}
 	}
 }
@@ -0,0 +1,267 @@
+package lincheck
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Checker of the Wing & Gong algorithm with the state cache of Lowe, as used by Porcupine. Each key is checked on its own,
+since operations on different keys commute. The search walks the events in time order and linearizes a pending call if the
+model accepts it, backtracking when it reaches a return whose call is not linearized yet. (linearized set, state) pairs
+already explored are cached, which keeps the search polynomial on most real histories
+*/
+
+// Check gave up before deciding
+var ErrTimeout = errors.New("linearizability check timed out")
+
+// value of a key as seen by the model
+type state struct {
+	value   string
+	present bool
+}
+
+/*
+Applies op to s. Returns false if op could not have returned its result in state s. Unknown results accept every outcome
+*/
+func step(s state, op *Operation) (bool, state) {
+	switch op.Kind {
+	case KindGet:
+		switch op.Result {
+		case ResultOK:
+			return s.present && s.value == op.Output, s
+		case ResultNotFound:
+			return !s.present, s
+		}
+		return true, s
+	case KindPut:
+		return true, state{op.Value, true}
+	case KindDelete:
+		switch op.Result {
+		case ResultOK:
+			return s.present && s.value == op.Output, state{}
+		case ResultNotFound:
+			return !s.present, s
+		}
+		return true, state{}
+	case KindCAS, KindPutIfAbsent:
+		matches := s.present && s.value == op.Old
+		if op.Kind == KindPutIfAbsent {
+			matches = !s.present
+		}
+		switch op.Result {
+		case ResultOK:
+			return matches, state{op.Value, true}
+		case ResultMismatch:
+			return !matches, s
+		}
+		if matches {
+			return true, state{op.Value, true}
+		}
+		return true, s
+	}
+	return false, s
+}
+
+// call or return of an operation in the doubly linked list of events
+type event struct {
+	op         int // index in the history of the key
+	call       bool
+	time       time.Duration
+	match      *event // return of a call
+	prev, next *event
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) hash() uint64 {
+	h := fnv.New64a()
+	for _, w := range b {
+		var buf [8]byte
+		for i := range buf {
+			buf[i] = byte(w >> (8 * uint(i)))
+		}
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+func (b bitset) equal(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheEntry struct {
+	linearized bitset
+	s          state
+}
+
+// builds the event list of ops and returns its sentinel head
+func events(ops []Operation) *event {
+	var list []*event
+	for i, op := range ops {
+		call := &event{op: i, call: true, time: op.Call}
+		ret := &event{op: i, time: op.Return}
+		call.match = ret
+		list = append(list, call, ret)
+	}
+	// times are unique except for the returns at Never, which go last
+	sort.SliceStable(list, func(i, j int) bool { return list[i].time < list[j].time })
+	head := &event{}
+	prev := head
+	for _, e := range list {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+	return head
+}
+
+// removes a call and its return from the list
+func lift(call *event) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// puts back a call and its return removed by lift. Must undo lifts in reverse order
+func unlift(call *event) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
+
+/*
+Returns true if the operations on one key are linearizable from an absent key. Returns ErrTimeout if the search passes
+deadline. A zero deadline never passes
+*/
+func checkKey(ops []Operation, deadline time.Time) (bool, error) {
+	head := events(ops)
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[uint64][]cacheEntry)
+	type frame struct {
+		call *event
+		s    state
+	}
+	var stack []frame
+	var s state
+	for e, steps := head.next, 0; head.next != nil; steps++ {
+		if !deadline.IsZero() && steps%1024 == 0 && time.Now().After(deadline) {
+			return false, ErrTimeout
+		}
+		if e.call {
+			if ok, next := step(s, &ops[e.op]); ok {
+				linearized.set(e.op)
+				h := linearized.hash()
+				seen := false
+				for _, c := range cache[h] {
+					if c.s == next && c.linearized.equal(linearized) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					cache[h] = append(cache[h], cacheEntry{append(bitset{}, linearized...), next})
+					stack = append(stack, frame{e, s})
+					s = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op)
+			}
+			e = e.next
+		} else { // an operation returned before being linearized, undo the last choice
+			if len(stack) == 0 {
+				return false, nil
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			s = top.s
+			linearized.clear(top.call.op)
+			unlift(top.call)
+			e = top.call.next
+		}
+	}
+	return true, nil
+}
+
+func (op *Operation) String() string {
+	ret := fmt.Sprintf("client %d %s(%q", op.Client, op.Kind, op.Key)
+	switch op.Kind {
+	case KindPut, KindPutIfAbsent:
+		ret += fmt.Sprintf(", %q", op.Value)
+	case KindCAS:
+		ret += fmt.Sprintf(", %q, %q", op.Old, op.Value)
+	}
+	ret += ") " + op.Result.String()
+	if op.Result == ResultOK && (op.Kind == KindGet || op.Kind == KindDelete) {
+		ret += fmt.Sprintf(" %q", op.Output)
+	}
+	ret += fmt.Sprintf(" [%s, ", op.Call)
+	if op.Return == Never {
+		return ret + "never]"
+	}
+	return ret + op.Return.String() + "]"
+}
+
+/*
+Checks that every key of history behaves as a linearizable register that starts absent. Returns an error listing the
+operations of the first key that is not linearizable. Gives up with ErrTimeout after timeout, or never if timeout <= 0
+*/
+func Check(history []Operation, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	by_key := make(map[string][]Operation)
+	for _, op := range history {
+		if op.Kind == KindGet && op.Result == ResultUnknown { // reads with unknown results constrain nothing
+			continue
+		}
+		by_key[op.Key] = append(by_key[op.Key], op)
+	}
+	keys := make([]string, 0, len(by_key))
+	for key := range by_key {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ok, err := checkKey(by_key[key], deadline)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			ops := by_key[key]
+			sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+			lines := make([]string, len(ops))
+			for i := range ops {
+				lines[i] = "\t" + ops[i].String()
+			}
+			return fmt.Errorf("history of key %q is not linearizable:\n%s", key, strings.Join(lines, "\n"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+Package lincheck records histories of concurrent key-value operations and checks that every key behaves as a linearizable
+register. Clients run their operations through a Session, which records when each operation was invoked and when it returned,
+with its arguments and outcome. Check then searches for an order of the operations that respects real time and the
+sequential semantics of Get, Put, Delete and CAS, in the style of Porcupine and Knossos.
+*/
+package lincheck
+
+import (
+	"context"
+	"errors"
+	CM "go_dht/chordmap"
+	"go_dht/client"
+	NA "go_dht/nodeapi"
+	"sync"
+	"time"
+)
+
+type Kind int
+
+const (
+	KindGet         Kind = 0
+	KindPut         Kind = 1
+	KindDelete      Kind = 2
+	KindCAS         Kind = 3
+	KindPutIfAbsent Kind = 4
+)
+
+var kind_names = map[Kind]string{KindGet: "get", KindPut: "put", KindDelete: "delete", KindCAS: "cas", KindPutIfAbsent: "put-if-absent"}
+
+func (k Kind) String() string {
+	return kind_names[k]
+}
+
+// outcome of an operation
+type Result int
+
+const (
+	ResultOK       Result = 0
+	ResultNotFound Result = 1 // Get or Delete of a key that is not present
+	ResultMismatch Result = 2 // CAS or PutIfAbsent did not match the current value
+	ResultUnknown  Result = 3 // the call failed in a way that does not tell if it took effect, e.g. a lost reply
+)
+
+var result_names = map[Result]string{ResultOK: "ok", ResultNotFound: "not found", ResultMismatch: "mismatch", ResultUnknown: "unknown"}
+
+func (r Result) String() string {
+	return result_names[r]
+}
+
+// Return of an operation that never returned, or whose outcome is unknown. It may take effect at any point after its call
+const Never = time.Duration(1<<63 - 1)
+
+type Operation struct {
+	Client int
+	Kind   Kind
+	Key    string
+	Value  string // value written by Put, CAS and PutIfAbsent
+	Old    string // expected value of CAS
+	Output string // value returned by Get and Delete
+	Result Result
+	Call   time.Duration // time of the invocation since the recorder was created
+	Return time.Duration // time of the return since the recorder was created. Never for ResultUnknown
+}
+
+/*
+Key-value store under test. Implemented by client.Client and NodeKV
+*/
+type KV interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(ctx context.Context, key string, value string) error
+	Delete(ctx context.Context, key string) (string, error)
+	CAS(ctx context.Context, key string, old string, value string) error
+	PutIfAbsent(ctx context.Context, key string, value string) error
+}
+
+/*
+Records the operations of many clients. Safe for concurrent use
+*/
+type Recorder struct {
+	lock    sync.Mutex
+	start   time.Time
+	last    time.Duration
+	ops     []Operation
+	clients int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// strictly increasing, so no invocation and return share a time. Assumes r.lock is held
+func (r *Recorder) now() time.Duration {
+	now := time.Since(r.start)
+	if now <= r.last {
+		now = r.last + 1
+	}
+	r.last = now
+	return now
+}
+
+func (r *Recorder) invoke(op Operation) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	op.Call = r.now()
+	op.Return = Never
+	r.ops = append(r.ops, op)
+	return len(r.ops) - 1
+}
+
+func (r *Recorder) complete(i int, output string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	op := &r.ops[i]
+	op.Output = output
+	if op.Result = classify(err); op.Result != ResultUnknown {
+		op.Return = now
+	}
+}
+
+/*
+Returns a copy of the operations recorded so far. Operations still running have an unknown result
+*/
+func (r *Recorder) History() []Operation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := append([]Operation{}, r.ops...)
+	for i := range ret {
+		if ret[i].Return == Never {
+			ret[i].Result = ResultUnknown
+		}
+	}
+	return ret
+}
+
+/*
+Returns a session recording the operations of one client on kv. A session must not be used concurrently, give every
+goroutine its own
+*/
+func (r *Recorder) Session(kv KV) *Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clients++
+	return &Session{r: r, kv: kv, id: r.clients}
+}
+
+// definite outcomes by error message. Remote errors arrive as rpc.ServerError holding only the message
+var outcomes = map[string]Result{
+	CM.NewCMKeyError().Error():   ResultNotFound,
+	NA.NewNapiKeyError().Error(): ResultNotFound,
+	CM.NewCMCASError().Error():   ResultMismatch,
+}
+
+/*
+Maps the error of an operation to its outcome. Every error that is not a definite answer of the owner is unknown, since a
+request may be applied before its reply is lost
+*/
+func classify(err error) Result {
+	switch {
+	case err == nil:
+		return ResultOK
+	case errors.Is(err, client.ErrNotFound):
+		return ResultNotFound
+	case errors.Is(err, client.ErrCASMismatch):
+		return ResultMismatch
+	}
+	if result, ok := outcomes[err.Error()]; ok {
+		return result
+	}
+	return ResultUnknown
+}
+
+type Session struct {
+	r  *Recorder
+	kv KV
+	id int
+}
+
+func (s *Session) Get(ctx context.Context, key string) (string, error) {
+	i := s.r.invoke(Operation{Client: s.id, Kind: KindGet, Key: key})
+	value, err := s.kv.Get(ctx, key)
+	s.r.complete(i, value, err)
+	return value, err
+}
+
+func (s *Session) Put(ctx context.Context, key string, value string) error {
+	i := s.r.invoke(Operation{Client: s.id, Kind: KindPut, Key: key, Value: value})
+	err := s.kv.Put(ctx, key, value)
+	s.r.complete(i, "", err)
+	return err
+}
+
+func (s *Session) Delete(ctx context.Context, key string) (string, error) {
+	i := s.r.invoke(Operation{Client: s.id, Kind: KindDelete, Key: key})
+	value, err := s.kv.Delete(ctx, key)
+	s.r.complete(i, value, err)
+	return value, err
+}
+
+func (s *Session) CAS(ctx context.Context, key string, old string, value string) error {
+	i := s.r.invoke(Operation{Client: s.id, Kind: KindCAS, Key: key, Old: old, Value: value})
+	err := s.kv.CAS(ctx, key, old, value)
+	s.r.complete(i, "", err)
+	return err
+}
+
+func (s *Session) PutIfAbsent(ctx context.Context, key string, value string) error {
+	i := s.r.invoke(Operation{Client: s.id, Kind: KindPutIfAbsent, Key: key, Value: value})
+	err := s.kv.PutIfAbsent(ctx, key, value)
+	s.r.complete(i, "", err)
+	return err
+}
+
+/*
+KV sending NAPI calls to Node through Tr. The node forwards them to the owner of the key
+*/
+type NodeKV struct {
+	Tr   NA.Transport
+	Node NA.HostData
+}
+
+func (n NodeKV) call(ctx context.Context, method string, args *NA.HTArgs) (string, error) {
+	var reply NA.HTReply
+	err := n.Tr.Call(ctx, n.Node, method, args, &reply)
+	return reply.Value, err
+}
+
+func (n NodeKV) Get(ctx context.Context, key string) (string, error) {
+	return n.call(ctx, "NAPI.Get", &NA.HTArgs{Key: key})
+}
+
+func (n NodeKV) Put(ctx context.Context, key string, value string) error {
+	_, err := n.call(ctx, "NAPI.Put", &NA.HTArgs{Key: key, Value: value})
+	return err
+}
+
+func (n NodeKV) Delete(ctx context.Context, key string) (string, error) {
+	return n.call(ctx, "NAPI.Delete", &NA.HTArgs{Key: key})
+}
+
+func (n NodeKV) CAS(ctx context.Context, key string, old string, value string) error {
+	_, err := n.call(ctx, "NAPI.CAS", &NA.HTArgs{Key: key, Old: old, Value: value})
+	return err
+}
+
+func (n NodeKV) PutIfAbsent(ctx context.Context, key string, value string) error {
+	_, err := n.call(ctx, "NAPI.CAS", &NA.HTArgs{Key: key, Value: value, Absent: true})
+	return err
+}
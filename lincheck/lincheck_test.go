@@ -0,0 +1,251 @@
+package lincheck
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go_dht/client"
+	"go_dht/faultnet"
+	NA "go_dht/nodeapi"
+	"go_dht/simring"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+var long = flag.Bool("long", false, "run the long suite against a simulated ring with fault injection")
+var seed = flag.Int64("seed", 1, "seed of the faults and operations of the long suite")
+
+// gives every operation a client of its own and the key k unless set
+func hist(ops ...Operation) []Operation {
+	for i := range ops {
+		ops[i].Client = i + 1
+		if ops[i].Key == "" {
+			ops[i].Key = "k"
+		}
+	}
+	return ops
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		history []Operation
+		ok      bool
+	}{
+		{"sequential", hist(
+			Operation{Kind: KindGet, Result: ResultNotFound, Call: 1, Return: 2},
+			Operation{Kind: KindPut, Value: "a", Call: 3, Return: 4},
+			Operation{Kind: KindGet, Output: "a", Call: 5, Return: 6},
+			Operation{Kind: KindCAS, Old: "a", Value: "b", Call: 7, Return: 8},
+			Operation{Kind: KindDelete, Output: "b", Call: 9, Return: 10},
+			Operation{Kind: KindPutIfAbsent, Value: "c", Call: 11, Return: 12}), true},
+		{"stale read", hist(
+			Operation{Kind: KindPut, Value: "a", Call: 1, Return: 2},
+			Operation{Kind: KindPut, Value: "b", Call: 3, Return: 4},
+			Operation{Kind: KindGet, Output: "a", Call: 5, Return: 6}), false},
+		{"concurrent read sees either", hist(
+			Operation{Kind: KindPut, Value: "a", Call: 1, Return: 2},
+			Operation{Kind: KindPut, Value: "b", Call: 3, Return: 8},
+			Operation{Kind: KindGet, Output: "a", Call: 4, Return: 5},
+			Operation{Kind: KindGet, Output: "b", Call: 6, Return: 7}), true},
+		{"read goes back in time", hist(
+			Operation{Kind: KindPut, Value: "a", Call: 1, Return: 2},
+			Operation{Kind: KindPut, Value: "b", Call: 3, Return: 10},
+			Operation{Kind: KindGet, Output: "b", Call: 4, Return: 5},
+			Operation{Kind: KindGet, Output: "a", Call: 6, Return: 7}), false},
+		{"two cas win", hist(
+			Operation{Kind: KindPutIfAbsent, Value: "a", Call: 1, Return: 4},
+			Operation{Kind: KindPutIfAbsent, Value: "b", Call: 2, Return: 3}), false},
+		{"unknown write may apply late", hist(
+			Operation{Kind: KindPut, Value: "a", Result: ResultUnknown, Call: 1, Return: Never},
+			Operation{Kind: KindGet, Result: ResultNotFound, Call: 2, Return: 3},
+			Operation{Kind: KindGet, Output: "a", Call: 4, Return: 5}), true},
+		{"unknown write may never apply", hist(
+			Operation{Kind: KindPut, Value: "a", Result: ResultUnknown, Call: 1, Return: Never},
+			Operation{Kind: KindGet, Result: ResultNotFound, Call: 2, Return: 3}), true},
+		{"unknown write applies once", hist(
+			Operation{Kind: KindPut, Value: "a", Result: ResultUnknown, Call: 1, Return: Never},
+			Operation{Kind: KindGet, Output: "a", Call: 2, Return: 3},
+			Operation{Kind: KindPut, Value: "b", Call: 4, Return: 5},
+			Operation{Kind: KindGet, Output: "a", Call: 6, Return: 7}), false},
+		{"keys are independent", hist(
+			Operation{Key: "x", Kind: KindPut, Value: "a", Call: 1, Return: 2},
+			Operation{Key: "y", Kind: KindGet, Result: ResultNotFound, Call: 3, Return: 4}), true},
+	}
+	for _, c := range cases {
+		err := Check(c.history, 0)
+		if c.ok && err != nil {
+			t.Errorf("%s: expected linearizable. %s\n", c.name, err.Error())
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected not linearizable\n", c.name)
+		}
+	}
+}
+
+// many overlapping writes blow up the search, which must give up at the timeout
+func TestCheckTimeout(t *testing.T) {
+	var ops []Operation
+	for i := 0; i < 200; i++ {
+		ops = append(ops, Operation{Kind: KindPut, Value: fmt.Sprint(i), Call: time.Duration(2*i + 1), Return: time.Duration(1000 + 2*i)})
+	}
+	ops = append(ops, Operation{Kind: KindGet, Output: "7", Call: 2000, Return: 2001})
+	start := time.Now()
+	if err := Check(hist(ops...), 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v\n", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Check took %s with a timeout of 100ms\n", elapsed)
+	}
+}
+
+// key-value map guarded by a lock. Linearizable by construction
+type lockedKV struct {
+	lock  sync.Mutex
+	table map[string]string
+}
+
+func (l *lockedKV) Get(ctx context.Context, key string) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if value, ok := l.table[key]; ok {
+		return value, nil
+	}
+	return "", client.ErrNotFound
+}
+
+func (l *lockedKV) Put(ctx context.Context, key string, value string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.table[key] = value
+	return nil
+}
+
+func (l *lockedKV) Delete(ctx context.Context, key string) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	value, ok := l.table[key]
+	if !ok {
+		return "", client.ErrNotFound
+	}
+	delete(l.table, key)
+	return value, nil
+}
+
+func (l *lockedKV) CAS(ctx context.Context, key string, old string, value string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if cur, ok := l.table[key]; !ok || cur != old {
+		return client.ErrCASMismatch
+	}
+	l.table[key] = value
+	return nil
+}
+
+func (l *lockedKV) PutIfAbsent(ctx context.Context, key string, value string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.table[key]; ok {
+		return client.ErrCASMismatch
+	}
+	l.table[key] = value
+	return nil
+}
+
+// KV that acknowledges puts before applying them
+type laggyKV struct {
+	lockedKV
+}
+
+func (l *laggyKV) Put(ctx context.Context, key string, value string) error {
+	go func() {
+		time.Sleep(time.Millisecond)
+		l.lockedKV.Put(ctx, key, value)
+	}()
+	return nil
+}
+
+// runs n random operations on 3 keys from each of clients goroutines
+func workload(r *Recorder, kvs []KV, n int, seed int64) {
+	var wg sync.WaitGroup
+	for c, kv := range kvs {
+		wg.Add(1)
+		go func(s *Session, rng *rand.Rand) {
+			defer wg.Done()
+			ctx := context.Background()
+			for i := 0; i < n; i++ {
+				key, value := fmt.Sprint("key", rng.Intn(3)), fmt.Sprint(rng.Intn(5))
+				switch rng.Intn(5) {
+				case 0:
+					s.Put(ctx, key, value)
+				case 1:
+					s.Delete(ctx, key)
+				case 2:
+					s.CAS(ctx, key, fmt.Sprint(rng.Intn(5)), value)
+				case 3:
+					s.PutIfAbsent(ctx, key, value)
+				default:
+					s.Get(ctx, key)
+				}
+			}
+		}(r.Session(kv), rand.New(rand.NewSource(seed+int64(c))))
+	}
+	wg.Wait()
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	kv := &lockedKV{table: make(map[string]string)}
+	workload(r, []KV{kv, kv, kv, kv}, 200, 1)
+	history := r.History()
+	if len(history) != 800 {
+		t.Fatalf("Expected 800 operations, got %d\n", len(history))
+	}
+	for _, op := range history {
+		if op.Return <= op.Call || op.Result == ResultUnknown {
+			t.Fatalf("Bad operation %s\n", op.String())
+		}
+	}
+	if err := Check(history, time.Minute); err != nil {
+		t.Errorf("Locked map should be linearizable. %s\n", err.Error())
+	}
+
+	// a put acknowledged before it is applied is missed by the next get of the same client
+	r = NewRecorder()
+	laggy := &laggyKV{lockedKV{table: make(map[string]string)}}
+	s := r.Session(laggy)
+	ctx := context.Background()
+	s.Put(ctx, "k", "a")
+	s.Get(ctx, "k")
+	if err := Check(r.History(), time.Minute); err == nil {
+		t.Errorf("Late put should not be linearizable\n")
+	}
+}
+
+/*
+Long suite. Clients send operations through random nodes of a simulated ring whose links drop calls and replies and add
+latency. Run with -long, and -seed to change the faults. Links do not duplicate calls: NAPI calls carry no request id, so a
+duplicated Put or CAS applied after a write of another client is not linearizable
+*/
+func TestRing(t *testing.T) {
+	if !*long {
+		t.Skip("long suite, run with -long")
+	}
+	net := faultnet.New(*seed)
+	r := simring.New(t, simring.Options{Faults: net})
+	nodes := r.Grow(6)
+	rule := faultnet.Rule{Drop: 0.02, DropReply: 0.02, Latency: faultnet.Latency{Max: 2 * time.Millisecond}}
+	net.SetDefault(rule)
+	rec := NewRecorder()
+	var kvs []KV
+	for i := 0; i < 8; i++ {
+		addr := NA.HostData{Hostname: "client", Port: fmt.Sprint(i)}
+		kvs = append(kvs, NodeKV{Tr: net.Wrap(addr, r.Transport()), Node: nodes[i%len(nodes)].Addr})
+	}
+	workload(rec, kvs, 500, *seed)
+	if err := Check(rec.History(), 5*time.Minute); err != nil {
+		t.Errorf("seed %d: %s\n", *seed, err.Error())
+	}
+	t.Logf("seed %d: %+v\n", *seed, net.Stats())
+}
@@ -0,0 +1,328 @@
+/*
+Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text exposition format, so a node can be
+scraped by Prometheus or read with curl without linking a Prometheus client. Metrics are registered on a Registry, usually one
+per node so nodes sharing a process keep apart, and are safe for concurrent use. Updates take no lock once the series of a set of
+label values exists.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// default buckets of latency histograms, in seconds
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// float64 updated with compare and swap on its bits
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+/*
+Value that only goes up
+*/
+type Counter struct {
+	v atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+/*
+Adds v, which must not be negative
+*/
+func (c *Counter) Add(v float64) {
+	if v >= 0 {
+		c.v.add(v)
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+/*
+Value that goes up and down
+*/
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(v float64) {
+	g.v.add(v)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.load()
+}
+
+/*
+Counts of observations in cumulative buckets, with their sum
+*/
+type Histogram struct {
+	bounds []float64       // upper bounds of the buckets, increasing. +Inf is implied
+	counts []atomic.Uint64 // observations per bucket, not cumulative. The last one is +Inf
+	sum    atomicFloat
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.sum.add(v)
+}
+
+/*
+Returns the number of observations
+*/
+func (h *Histogram) Count() uint64 {
+	ret := uint64(0)
+	for i := range h.counts {
+		ret += h.counts[i].Load()
+	}
+	return ret
+}
+
+/******** Families **********/
+
+// metrics of one name, one series per set of label values
+type family struct {
+	name, help, kind string
+	labels           []string
+	lock             sync.RWMutex
+	series           map[string]interface{} // *Counter, *Gauge or *Histogram by joined label values
+	bounds           []float64              // histograms only
+	fn               func() float64         // set for metrics read when scraped
+}
+
+// series of the label values, created on first use
+func (f *family) with(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.lock.RLock()
+	s, present := f.series[key]
+	f.lock.RUnlock()
+	if present {
+		return s
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if s, present = f.series[key]; !present {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counters of one name, told apart by label values
+type CounterVec struct {
+	f *family
+}
+
+/*
+Returns the counter of the label values, in the order of the label names. Panics on a wrong number of values
+*/
+func (v CounterVec) With(values ...string) *Counter {
+	return v.f.with(values, func() interface{} { return new(Counter) }).(*Counter)
+}
+
+// Gauges of one name, told apart by label values
+type GaugeVec struct {
+	f *family
+}
+
+func (v GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values, func() interface{} { return new(Gauge) }).(*Gauge)
+}
+
+// Histograms of one name, told apart by label values
+type HistogramVec struct {
+	f *family
+}
+
+func (v HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values, func() interface{} { return newHistogram(v.f.bounds) }).(*Histogram)
+}
+
+/******** Registry **********/
+
+/*
+Set of metrics written together. Names must be unique, registering a name twice panics
+*/
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) add(name string, help string, kind string, labels []string) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, dup := r.families[name]; dup {
+		panic("metric " + name + " registered twice")
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]interface{})}
+	r.families[name] = f
+	return f
+}
+
+func (r *Registry) Counter(name string, help string, labels ...string) CounterVec {
+	return CounterVec{r.add(name, help, "counter", labels)}
+}
+
+func (r *Registry) Gauge(name string, help string, labels ...string) GaugeVec {
+	return GaugeVec{r.add(name, help, "gauge", labels)}
+}
+
+/*
+Registers histograms with the upper bounds bounds, which must be increasing
+*/
+func (r *Registry) Histogram(name string, help string, bounds []float64, labels ...string) HistogramVec {
+	f := r.add(name, help, "histogram", labels)
+	f.bounds = bounds
+	return HistogramVec{f}
+}
+
+/*
+Registers a counter read from fn when scraped, for counts kept elsewhere
+*/
+func (r *Registry) CounterFunc(name string, help string, fn func() float64) {
+	r.add(name, help, "counter", nil).fn = fn
+}
+
+/*
+Registers a gauge read from fn when scraped
+*/
+func (r *Registry) GaugeFunc(name string, help string, fn func() float64) {
+	r.add(name, help, "gauge", nil).fn = fn
+}
+
+/******** Exposition **********/
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// {a="x",b="y"} of names and values, plus extra already formatted pairs. Empty if there are none
+func labelString(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra))
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, strings.ReplaceAll(f.help, "\n", " "), f.name, f.kind)
+	if f.fn != nil {
+		fmt.Fprintf(&b, "%s %s\n", f.name, formatFloat(f.fn()))
+	}
+	f.lock.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		switch s := f.series[k].(type) {
+		case *Counter:
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labelString(f.labels, values), formatFloat(s.Value()))
+		case *Gauge:
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labelString(f.labels, values), formatFloat(s.Value()))
+		case *Histogram:
+			cumulative := uint64(0)
+			for i := range s.counts {
+				cumulative += s.counts[i].Load()
+				le := math.Inf(1)
+				if i < len(s.bounds) {
+					le = s.bounds[i]
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, labelString(f.labels, values, `le="`+formatFloat(le)+`"`), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labelString(f.labels, values), formatFloat(s.sum.load()))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labelString(f.labels, values), cumulative)
+		}
+	}
+	f.lock.RUnlock()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+/*
+Writes every metric in the Prometheus text format, sorted by name then label values
+*/
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Returns a handler serving the metrics of r, e.g on /metrics
+*/
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
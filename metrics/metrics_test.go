@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	calls := r.Counter("calls_total", "calls made", "method", "outcome")
+	calls.With("Get", "ok").Inc()
+	calls.With("Get", "ok").Add(2)
+	calls.With("Put", `a"b`).Inc()
+	r.Gauge("open", "open things").With().Set(-2.5)
+	r.GaugeFunc("keys", "keys stored", func() float64 { return 7 })
+	latency := r.Histogram("latency_seconds", "call latency", []float64{0.1, 1}, "method")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.With("Get").Observe(v)
+	}
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText failed. err = %s\n", err.Error())
+	}
+	expected := `# HELP calls_total calls made
+# TYPE calls_total counter
+calls_total{method="Get",outcome="ok"} 3
+calls_total{method="Put",outcome="a\"b"} 1
+# HELP keys keys stored
+# TYPE keys gauge
+keys 7
+# HELP latency_seconds call latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="Get",le="0.1"} 2
+latency_seconds_bucket{method="Get",le="1"} 3
+latency_seconds_bucket{method="Get",le="+Inf"} 4
+latency_seconds_sum{method="Get"} 3.65
+latency_seconds_count{method="Get"} 4
+# HELP open open things
+# TYPE open gauge
+open -2.5
+`
+	if b.String() != expected {
+		t.Errorf("Wrong exposition. Got\n%s\nexpected\n%s\n", b.String(), expected)
+	}
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Body.String() != expected || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Handler should serve the text format\n")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "c", "k")
+	h := r.Histogram("h", "h", LatencyBuckets)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("x").Inc()
+				h.With().Observe(0.001)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.With("x").Value() != 8000 || h.With().Count() != 8000 {
+		t.Errorf("Concurrent updates were lost: %v, %d\n", c.With("x").Value(), h.With().Count())
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a name twice should panic\n")
+		}
+	}()
+	r.Counter("c", "again")
+}
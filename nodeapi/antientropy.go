@@ -0,0 +1,213 @@
+package nodeapi
+
+import (
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"sort"
+)
+
+/*
+Anti-entropy between copies of a range. A node compares the Merkle tree of its store with the tree a peer keeps for the same range,
+from the root down, asking only for the children of the nodes that differ. The entries of the differing leaves, values and
+tombstones with their versions, are then exchanged and each side keeps the newer entry of every key, see CM.Entry.After.
+Entries are applied by version, so neither a write nor a delete made meanwhile is undone, see CM.Apply. A key deleted on one copy is
+copied back from the other only if its tombstone was compacted there first, so the gc grace period must exceed the time copies
+take to converge.
+
+Copies of a range are kept by the replicas of its owner, see Successors, in replica stores of their own, see replicas.go. A replica
+missing its copy starts with an empty one and is sent every entry. With a replication factor of 1 there are no copies and
+anti-entropy has nothing to do
+*/
+
+const maxMerkleIndices = CM.MerkleBuckets // bound on the nodes asked for by one MerkleHashes call
+
+// args struct for NAPI.MerkleHashes
+type MerkleRequest struct {
+	Owner   ring.ID  // id of the node whose range is compared
+	Level   uint32   // 0 is the root, CM.MerkleDepth the leaves
+	Indices []uint32 // nodes of Level to hash
+	Start   ring.ID  // first key of the range of Owner
+}
+
+// args struct for NAPI.BucketItems
+type BucketRequest struct {
+	Owner   ring.ID
+	Buckets []uint32 // leaves of the Merkle tree
+	Start   ring.ID
+}
+
+// outcome of a SyncRange
+type SyncStats struct {
+	Buckets   int // leaves that differed
+	Pulled    int // entries copied from the peer
+	Pushed    int // entries copied to the peer
+	Conflicts int // keys with different entries on both sides, of which the newer was copied
+}
+
+// entries of store in buckets, values and tombstones, sorted by key
+func bucketItems(store CM.Store, buckets []uint32) []TransferItem {
+	entries := store.BucketItems(buckets)
+	ret := make([]TransferItem, 0, len(entries))
+	for k, e := range entries {
+		if store.InRange(CM.StrToSha(k)) {
+			ret = append(ret, itemOf(k, e))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+/*
+Stores every item newer than the entry store holds of its key, recording the writes for a joiner. Returns the number of items stored
+and the first error other than a stale item
+*/
+func (lns *LocNodeStruct) repair(store CM.Store, items []TransferItem) (int, error) {
+	ret := 0
+	var first error
+	for _, item := range items {
+		applied := false
+		err := lns.write(item.Key, CM.StrToSha(item.Key), func() (err error) {
+			applied, err = applyItem(store, item)
+			return err
+		})
+		if applied {
+			ret++
+		} else if err != nil && first == nil {
+			first = err
+		}
+	}
+	return ret, first
+}
+
+/*
+Returns the hashes of the nodes request.Indices of level request.Level of the Merkle tree of the copy of the range of request.Owner.
+Fails with NapiRangeError if the local node keeps no such copy
+*/
+func (napi *NAPI) MerkleHashes(request *MerkleRequest, reply *[]uint64) error {
+	store, err := napi.ln.storeOf(request.Owner, request.Start)
+	if err != nil {
+		return err
+	}
+	if len(request.Indices) > maxMerkleIndices {
+		return NewNapiRangeError()
+	}
+	*reply = store.Tree().Hashes(request.Level, request.Indices)
+	return nil
+}
+
+/*
+Returns the entries in the leaves request.Buckets of the copy of the range of request.Owner, sorted by key
+*/
+func (napi *NAPI) BucketItems(request *BucketRequest, reply *[]TransferItem) error {
+	store, err := napi.ln.storeOf(request.Owner, request.Start)
+	if err != nil {
+		return err
+	}
+	*reply = bucketItems(store, request.Buckets)
+	return nil
+}
+
+/*
+Returns the leaves of the Merkle tree that differ between the local range and the copy of peer, walking down from the root
+*/
+func (lns *LocNodeStruct) diffBuckets(peer HostData, start ring.ID) ([]uint32, error) {
+	tree := lns.cm.Tree()
+	diff := []uint32{0}
+	for level := uint32(0); len(diff) > 0; level++ {
+		var theirs []uint64
+		request := MerkleRequest{Owner: lns.end, Level: level, Indices: diff, Start: start}
+		if err := lns.call(peer, "NAPI.MerkleHashes", &request, &theirs); err != nil {
+			return nil, err
+		}
+		if len(theirs) != len(diff) {
+			return nil, NewNapiChecksumError()
+		}
+		ours := tree.Hashes(level, diff)
+		var next []uint32
+		for i, index := range diff {
+			if ours[i] == theirs[i] {
+				continue
+			}
+			if level == CM.MerkleDepth {
+				next = append(next, index)
+			} else {
+				next = append(next, 2*index, 2*index+1)
+			}
+		}
+		if level == CM.MerkleDepth {
+			return next, nil
+		}
+		diff = next
+	}
+	return nil, nil
+}
+
+/*
+Brings the range of the local node and the copy of it kept by peer in line. Only the entries of the leaves of the Merkle tree
+that differ are exchanged, and the newer entry of every key is kept on both sides
+*/
+func (lns *LocNodeStruct) SyncRange(peer HostData) (SyncStats, error) {
+	var stats SyncStats
+	start := lns.rangeStart()
+	buckets, err := lns.diffBuckets(peer, start)
+	if err != nil || len(buckets) == 0 {
+		return stats, err
+	}
+	stats.Buckets = len(buckets)
+	var theirs []TransferItem
+	if err = lns.call(peer, "NAPI.BucketItems", &BucketRequest{Owner: lns.end, Buckets: buckets, Start: start}, &theirs); err != nil {
+		return stats, err
+	}
+	ours := make(map[string]CM.Entry)
+	for _, item := range bucketItems(lns.cm, buckets) {
+		ours[item.Key] = entryOf(item)
+	}
+	var pull []TransferItem
+	push := RepairRequest{Owner: lns.end, Start: start}
+	for _, item := range theirs {
+		mine, present := ours[item.Key]
+		delete(ours, item.Key)
+		if e := entryOf(item); !present || e.After(mine) {
+			pull = append(pull, item)
+		} else if mine.After(e) {
+			push.Items = append(push.Items, itemOf(item.Key, mine))
+		}
+		if present && mine != entryOf(item) {
+			stats.Conflicts++
+		}
+	}
+	if stats.Pulled, err = lns.repair(lns.cm, pull); err != nil {
+		return stats, err
+	}
+	for k, e := range ours {
+		push.Items = append(push.Items, itemOf(k, e))
+	}
+	if len(push.Items) == 0 {
+		return stats, nil
+	}
+	ok := false
+	if err = lns.call(peer, "NAPI.Repair", &push, &ok); err != nil {
+		return stats, err
+	}
+	stats.Pushed = len(push.Items)
+	return stats, nil
+}
+
+/*
+Runs SyncRange with every peer. Returns the sum of the stats and the first error, after trying every peer
+*/
+func (lns *LocNodeStruct) AntiEntropy(peers []HostData) (SyncStats, error) {
+	var total SyncStats
+	var first error
+	for _, peer := range peers {
+		stats, err := lns.SyncRange(peer)
+		if err != nil && first == nil {
+			first = err
+		}
+		total.Buckets += stats.Buckets
+		total.Pulled += stats.Pulled
+		total.Pushed += stats.Pushed
+		total.Conflicts += stats.Conflicts
+	}
+	return total, first
+}
@@ -0,0 +1,134 @@
+package nodeapi
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Background upkeep of a node. Start runs every task of a Background on its own interval until Stop, each in its own goroutine so a
+slow round of one task never delays the others:
+
+	fingers       RefreshFingers, as joins and leaves only fix the fingers of the nodes next to them
+	anti-entropy  drops the copies of other ranges no longer synced, syncs the range of the node with its replicas, see
+	              antientropy.go, then drops old tombstones, as copies drift after failures
+	hints         DeliverHints to the replicas that answer again, see hints.go
+
+Tasks log their outcome, a failed round is tried again on the next tick
+*/
+
+// intervals of the background tasks of a node. A task with an interval <= 0 is not run
+type Background struct {
+	Fingers     time.Duration // between finger refreshes
+	AntiEntropy time.Duration // between anti-entropy rounds
+	Hints       time.Duration // between hint delivery rounds. Replicas that do not answer are backed off on top
+}
+
+// anti-entropy rounds a copy of the range of another node may go unsynced before it is dropped
+const replicaRounds = 10
+
+// stop is closed by Stop. nil while the loop is not running
+type upkeep struct {
+	lock sync.Mutex
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+/*
+Starts the background tasks of the node with the intervals of bg. NapiCallerError if they are already running
+*/
+func (lns *LocNodeStruct) Start(bg Background) error {
+	u := &lns.upkeep
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.stop != nil {
+		return NewNapiCallerError()
+	}
+	u.stop = make(chan struct{})
+	u.every(bg.Fingers, func() {
+		if err := lns.RefreshFingers(); err != nil {
+			lns.log.Warn("could not refresh fingers", "err", err)
+		}
+	})
+	u.every(bg.AntiEntropy, func() { lns.antiEntropyRound(bg.AntiEntropy) })
+	u.every(bg.Hints, lns.hintRound)
+	return nil
+}
+
+/*
+Stops the background tasks of the node and waits for the rounds under way to end. Does nothing if they are not running
+*/
+func (lns *LocNodeStruct) Stop() {
+	u := &lns.upkeep
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.stop == nil {
+		return
+	}
+	close(u.stop)
+	u.done.Wait()
+	u.stop = nil
+}
+
+// runs task every interval until stop is closed. Assumes lock is held
+func (u *upkeep) every(interval time.Duration, task func()) {
+	if interval <= 0 {
+		return
+	}
+	stop := u.stop
+	u.done.Add(1)
+	go func() {
+		defer u.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+}
+
+/*
+Drops the copies of other ranges no longer synced, syncs the range of the node with the replicas keeping copies of it and drops the
+tombstones past the gc grace period. Rounds are interval apart
+*/
+func (lns *LocNodeStruct) antiEntropyRound(interval time.Duration) {
+	if n := lns.ExpireReplicas(replicaRounds * interval); n > 0 {
+		lns.log.Info("dropped copies of other ranges", "count", n)
+	}
+	if lns.replication > 1 {
+		replicas, err := lns.Successors(lns.replication - 1)
+		if err != nil {
+			lns.log.Warn("could not find the replicas", "err", err)
+		} else {
+			stats, err := lns.AntiEntropy(replicas)
+			if err != nil {
+				lns.log.Warn("anti-entropy failed", "err", err)
+			}
+			if stats.Buckets > 0 {
+				lns.log.Info("anti-entropy", "buckets", stats.Buckets, "pulled", stats.Pulled, "pushed", stats.Pushed,
+					"conflicts", stats.Conflicts)
+			}
+		}
+	}
+	if n := lns.CompactTombstones(); n > 0 {
+		lns.log.Info("dropped tombstones", "count", n)
+	}
+}
+
+// delivers the hints of the replicas that answer again
+func (lns *LocNodeStruct) hintRound() {
+	delivered, err := lns.DeliverHints()
+	if err != nil {
+		lns.log.Warn("hint delivery failed", "err", err)
+	}
+	if delivered > 0 {
+		stats := lns.HintStats()
+		lns.log.Info("hints delivered", "delivered", delivered, "pending", stats.Pending, "expired", stats.Expired,
+			"suspected", stats.Suspected)
+	}
+}
@@ -0,0 +1,265 @@
+package nodeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	CM "go_dht/chordmap"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+gRPC transport for the NAPI service. Messages are protobuf encoded by protocodec.go following napi.proto, and calls use the
+gRPC wire protocol over unencrypted HTTP/2, so clients generated from napi.proto by protoc can call nodes directly.
+Every node serves gRPC on the same port as net/rpc. The protocol a node uses for its own calls is set with SetProtocol,
+so a ring can move to gRPC one node at a time.
+*/
+
+type Protocol int
+
+const (
+	ProtoNetRPC Protocol = 0 // Go net/rpc with gob over HTTP CONNECT
+	ProtoGRPC   Protocol = 1
+)
+
+const grpcService = "napi.NAPI" // package and service name in napi.proto
+const maxMessageSize = 128 << 20
+
+var protocol Protocol = ProtoNetRPC // used by ConnectAndCall and CallContext. Changed with SetProtocol
+
+func (p Protocol) String() string {
+	if p == ProtoGRPC {
+		return "grpc"
+	}
+	return "netrpc"
+}
+
+/*
+Parses a protocol name, "netrpc" or "grpc"
+*/
+func ParseProtocol(s string) (Protocol, error) {
+	switch s {
+	case "netrpc":
+		return ProtoNetRPC, nil
+	case "grpc":
+		return ProtoGRPC, nil
+	}
+	return ProtoNetRPC, fmt.Errorf("unknown protocol %s", s)
+}
+
+/*
+Sets the protocol used for calls to other nodes. Must be called before the node starts
+*/
+func SetProtocol(p Protocol) {
+	protocol = p
+}
+
+// gRPC status codes sent for the Napi* and CM* errors. Other errors are sent as Unknown
+var grpcCodes = map[string]int{
+	CM.NewCMKeyError().Error():      5,  // NotFound
+	NewNapiKeyError().Error():       5,  // NotFound
+	CM.NewCMCASError().Error():      9,  // FailedPrecondition
+	NewNapiRangeError().Error():     9,  // FailedPrecondition
+	CM.NewCMRangeError().Error():    9,  // FailedPrecondition
+	NewNapiCollisionError().Error(): 6,  // AlreadyExists
+	NewNapiConfigError().Error():    9,  // FailedPrecondition
+	NewNapiBusyError().Error():      14, // Unavailable
+	NewNapiConnError().Error():      14, // Unavailable
+	NewNapiChecksumError().Error():  10, // Aborted
+	NewNapiQuorumError().Error():    14, // Unavailable
+	NewNapiHintError().Error():      8,  // ResourceExhausted
+}
+
+const grpcUnknown = 2
+
+// appends the gRPC length prefix to msg. Messages are never compressed
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// reads a single length prefixed message
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// percent encodes a grpc-message value as required by the gRPC spec
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e || s[i] == '%' {
+			fmt.Fprintf(&b, "%%%02X", s[i])
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// true if r is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+/*
+Serves a gRPC call to /napi.NAPI/<Method> by calling the NAPI method of the same name. Only the methods net/rpc would export
+are callable
+*/
+func (napi *NAPI) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	fail := func(code int, msg string) {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+grpcService+"/")
+	method, found := napiMethod(name)
+	if !ok || !found {
+		fail(12, "unknown method "+r.URL.Path) // Unimplemented
+		return
+	}
+	msg, err := readFrame(r.Body)
+	if err != nil {
+		fail(3, err.Error()) // InvalidArgument
+		return
+	}
+	args := reflect.New(method.Type.In(1).Elem())
+	if err = protoUnmarshal(msg, args.Interface()); err != nil {
+		fail(3, err.Error())
+		return
+	}
+	ctx := withTraceparent(WithRequestID(context.Background(), r.Header.Get(requestIDHeader)), r.Header.Get(traceparentHeader))
+	reply, err := napi.invoke(ctx, method, args)
+	if err != nil {
+		code, ok := grpcCodes[err.Error()]
+		if !ok {
+			code = grpcUnknown
+		}
+		fail(code, err.Error())
+		return
+	}
+	if msg, err = protoMarshal(reply.Interface()); err != nil {
+		fail(13, err.Error()) // Internal
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(grpcFrame(msg))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// client for gRPC calls. Dials with the current dial timeout
+var grpc_client = &http.Client{Transport: newGRPCTransport()}
+
+func newGRPCTransport() *http.Transport {
+	var protos http.Protocols
+	protos.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		Protocols: &protos,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: dial_timeout}
+			return countedDial(func() (net.Conn, error) { return dialer.DialContext(ctx, network, addr) })
+		}}
+}
+
+/*
+gRPC version of CallContext. method is the net/rpc name of the method, e.g "NAPI.Get". Errors sent by the node are returned
+as rpc.ServerError holding the error message, the same as net/rpc, so callers can match them the same way
+*/
+func grpcCall(ctx context.Context, srv_addr string, srv_port string, method string, args interface{}, reply interface{}) error {
+	msg, err := protoMarshal(args)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, call_timeout)
+	defer cancel()
+	path := "/" + grpcService + "/" + strings.TrimPrefix(method, "NAPI.")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+net.JoinHostPort(srv_addr, srv_port)+path, bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if tp := traceparent(ctx); tp != "" {
+		req.Header.Set(traceparentHeader, tp)
+	}
+	resp, err := grpc_client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewNapiConnError()
+	}
+	msg, frame_err := readFrame(resp.Body)
+	io.Copy(io.Discard, resp.Body) // trailers are read with the end of the body
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" { // trailers only response
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		text := resp.Trailer.Get("Grpc-Message") + resp.Header.Get("Grpc-Message")
+		if unescaped, err := url.PathUnescape(text); err == nil {
+			text = unescaped
+		}
+		return rpc.ServerError(text)
+	}
+	if frame_err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return frame_err
+	}
+	return protoUnmarshal(msg, reply)
+}
+
+/*
+Returns the server NapiStartOn runs for napi. gRPC calls go to serveGRPC, net/rpc connections to rpcHandler and /metrics to the
+metrics of the node. Servers keep nothing global, so several nodes can be served by the same process
+*/
+func napiServer(napi *NAPI) *http.Server {
+	var protos http.Protocols
+	protos.SetHTTP1(true)
+	protos.SetUnencryptedHTTP2(true)
+	rpcs := napi.rpcHandler()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) {
+			napi.serveGRPC(w, r)
+		} else if r.URL.Path == rpc.DefaultRPCPath {
+			rpcs.ServeHTTP(w, r)
+		} else if r.URL.Path == "/metrics" {
+			napi.ln.metrics.registry.Handler().ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+	})
+	return &http.Server{Handler: handler, Protocols: &protos}
+}
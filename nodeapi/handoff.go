@@ -0,0 +1,242 @@
+package nodeapi
+
+import (
+	FT "go_dht/fingertable"
+	"go_dht/ring"
+	"net"
+	"time"
+)
+
+/*
+Ownership handoff of a join. The successor of a joiner stays in charge of the range of the joiner until the join commits, so no write
+is ever rejected or lost while keys move:
+
+	transfer    RegisterJoinSucc. The joiner pulls the range with TransferRange. Writes to the range are applied locally and recorded
+	prepared    final TransferRange. The joiner holds the range as of the final chunk. Writes are still applied locally and recorded
+	committing  JoinedSucc. No abort is accepted. If the joiner does not hold the range as the local node does, the writes recorded
+	            since the join was registered are sent to the joiner and the join goes back to prepared, with writes to the range
+	            held back until the join commits or aborts so the next JoinedSucc finds the joiner caught up
+	committed   the range is moved out of the local store and the predecessor of the local node becomes the joiner, atomically
+	            with respect to writes
+	aborted     AbortJoin or a timeout in transfer or prepared. The local node never gave up the range so nothing is rolled back
+	            but the join state
+
+Node states are leases. The successor is BusyJoin and the predecessor Busy for at most the join timeout, pushed back on every
+TransferRange, after which the join is aborted. A lease that expires on the predecessor only frees it: the predecessor holds no
+state of the join
+*/
+
+type joinphase int
+
+const (
+	phaseTransfer   joinphase = 0
+	phasePrepared   joinphase = 1
+	phaseCommitting joinphase = 2
+	phaseCommitted  joinphase = 3
+	phaseAborted    joinphase = 4
+)
+
+// time a join may go without progress before it is aborted. Changed with SetJoinTimeout
+var join_timeout time.Duration = 30 * time.Second
+
+/*
+Sets the time a join may go without progress before its successor aborts it. The predecessor of the joiner frees itself after twice
+as long. A value <= 0 leaves the timeout unchanged. Must be called before the node starts
+*/
+func SetJoinTimeout(d time.Duration) {
+	if d > 0 {
+		join_timeout = d
+	}
+}
+
+/*
+Moves the local node from Free to the busy state new_state for up to timeout and returns the epoch of the lease. If the lease is still
+held when timeout expires, expire is called with its epoch, or the node is set Free if expire is nil. NapiBusyError if the node is not Free
+*/
+func (lns *LocNodeStruct) lockState(new_state nodestate, timeout time.Duration, expire func(epoch uint64)) (uint64, error) {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	if lns.state != Free {
+		return 0, NewNapiBusyError()
+	}
+	lns.state = new_state
+	lns.state_epoch++
+	epoch := lns.state_epoch
+	lns.state_timer = time.AfterFunc(timeout, func() {
+		if expire == nil {
+			lns.releaseState(epoch)
+		} else if lns.holdsState(epoch) {
+			expire(epoch)
+		}
+	})
+	return epoch, nil
+}
+
+/*
+Makes the local node Busy while the node with id key joins at its successor, for up to timeout. NapiBusyError if the node is not Free
+*/
+func (lns *LocNodeStruct) leaseJoin(key ring.ID, timeout time.Duration) error {
+	epoch, err := lns.lockState(Busy, timeout, func(epoch uint64) { lns.releaseJoin(key) })
+	if err != nil {
+		return err
+	}
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	if lns.state != Free && lns.state_epoch == epoch { // not expired yet
+		lns.join_leases[key] = epoch
+	}
+	return nil
+}
+
+/*
+Frees the local node from the Busy lease taken by leaseJoin for the joiner with id key. Leaves the node as it is if that lease was
+not taken or expired, even if the node is Busy again for another join
+*/
+func (lns *LocNodeStruct) releaseJoin(key ring.ID) {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	epoch, ok := lns.join_leases[key]
+	delete(lns.join_leases, key)
+	if ok && lns.state != Free && lns.state_epoch == epoch {
+		lns.freeState()
+	}
+}
+
+// True if the lease epoch is still held
+func (lns *LocNodeStruct) holdsState(epoch uint64) bool {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	return lns.state != Free && lns.state_epoch == epoch
+}
+
+// Pushes the expiry of lease epoch back to timeout from now. Does nothing if the lease is no longer held
+func (lns *LocNodeStruct) extendState(epoch uint64, timeout time.Duration) {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	if lns.state != Free && lns.state_epoch == epoch {
+		lns.state_timer.Reset(timeout)
+	}
+}
+
+// Sets the node Free if lease epoch is still held, so a late release never frees the lease of a later join
+func (lns *LocNodeStruct) releaseState(epoch uint64) {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
+	if lns.state != Free && lns.state_epoch == epoch {
+		lns.freeState()
+	}
+}
+
+// Assumes state_lock is held
+func (lns *LocNodeStruct) freeState() {
+	lns.state = Free
+	lns.state_epoch++
+	if lns.state_timer != nil {
+		lns.state_timer.Stop()
+		lns.state_timer = nil
+	}
+}
+
+// Moves the join of j from phase from to phase to. NapiCallerError if the join is not in phase from
+func (j *Joiner) setPhase(from joinphase, to joinphase) error {
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	if j.xfer.phase != from {
+		return NewNapiCallerError()
+	}
+	j.xfer.phase = to
+	return nil
+}
+
+/*
+Aborts the join of j unless it is committing or committed, then tells the predecessor and frees lease epoch, held by the join.
+Returns false if the join could not be aborted
+*/
+func (lns *LocNodeStruct) abortJoin(j *Joiner, epoch uint64) bool {
+	lns.lock.Lock()
+	if lns.joiner != nil && lns.joiner != j { // lease expired on a join that was already replaced
+		lns.lock.Unlock()
+		return false
+	}
+	j.xfer.lock.Lock()
+	if j.xfer.phase == phaseCommitting || j.xfer.phase == phaseCommitted {
+		j.xfer.lock.Unlock()
+		lns.lock.Unlock()
+		return false
+	}
+	j.xfer.phase = phaseAborted
+	j.xfer.thaw()
+	j.xfer.lock.Unlock()
+	lns.joiner = nil
+	lns.lock.Unlock()
+	if pred, _ := lns.predecessor(); pred != nil { // best effort, the lease of the predecessor expires anyway
+		args := JoinNotice{Event: jeventAborted, Caller: HostData{Hostname: lns.hostname, Port: lns.port}, Joiner: *j.Conn, Key: j.N}
+		ok := false
+		if err := lns.call(*pred, "NAPI.NotifyPred", &args, &ok); err != nil {
+			lns.log.Warn("predecessor not told of the abort, its lease expires instead", "joiner", j.N.String(), "err", err)
+		}
+	}
+	lns.releaseState(epoch)
+	lns.metrics.event("join_aborted")
+	lns.log.Info("join aborted", "joiner", j.N.String())
+	return true
+}
+
+/*
+Fills reply with the writes recorded since the join was registered and the checksum of the range of joiner j, then switches
+ownership of the range to j if the checksum and count of request match, i.e j holds the range as the local node does, else
+freezes writes to the range so j catches up with reply. Returns whether it switched. Holds lock for writing, so every write is
+either in the moved range or made after the switch.
+Assumes the join of j is committing
+*/
+func (lns *LocNodeStruct) commitJoin(j *Joiner, request *JoinRequest, reply *TransferChunk) (bool, error) {
+	lns.lock.Lock()
+	defer lns.lock.Unlock()
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	j.finalChunk(j.entries(lns.cm), reply)
+	if reply.RangeSum != request.RangeSum || reply.Count != request.Count {
+		if j.xfer.frozen == nil {
+			j.xfer.frozen = make(chan struct{})
+		}
+		return false, nil
+	}
+	old_pred_end := lns.end // single node chord ring
+	if lns.pred != nil {
+		old_pred_end = lns.pred_end
+	}
+	table, err := lns.cm.PartitionTable(j.N.Add(ring.FromInt(1)))
+	if err != nil {
+		return false, err
+	}
+	j.Table = table
+	reply.Committed = true
+	j.xfer.commit = reply
+	j.xfer.phase = phaseCommitted
+	j.xfer.thaw()
+	lns.ft.UpdateRange(old_pred_end.Add(ring.FromInt(1)), j.N.Add(ring.FromInt(1)), &FT.HostStruct{Hostname: j.Conn.Hostname,
+		Port: j.Conn.Port})
+	lns.pred = &HostData{Hostname: j.Conn.Hostname, Port: j.Conn.Port}
+	lns.pred_end = j.N
+	lns.joiner = nil
+	lns.committed = j
+	lns.metrics.event("joiner_committed")
+	lns.log.Info("handed range to joiner", "joiner", j.N.String(), "addr", net.JoinHostPort(j.Conn.Hostname, j.Conn.Port),
+		"keys", table.Len())
+	return true, nil
+}
+
+/*
+Aborts the join of request.Key registered on the local node, which must be its successor. Called by a joiner that gives up. The local
+node keeps the range. NapiCallerError if no such join is registered or it already committed. reply is unused
+*/
+func (napi *NAPI) AbortJoin(request *JoinRequest, reply *bool) error {
+	ln := napi.ln
+	ln.lock.RLock()
+	j := ln.joiner
+	ln.lock.RUnlock()
+	if j == nil || j.N != request.Key || !ln.abortJoin(j, j.epoch) {
+		return NewNapiCallerError()
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package nodeapi
+
+import (
+	"go_dht/ring"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Hinted handoff. A write meant for a replica that cannot be reached is stored on a stand-in node as a hint, tagged with the replica
+and the range of the owner of the key, see replicate. The stand-in keeps hints apart from its own keys and delivers them with
+NAPI.Repair once the replica answers again, then deletes them. The replica applies them to its copy of the range of the owner. A
+replica that came back with another id than the hints were made for is a different node and its hints are dropped.
+
+Hints carry the version of their write and are applied by version, so a hint delivered after a newer write reached the replica
+is dropped by the replica.
+The stand-in tells the replicas that answer from those that do not with a failure detector: a replica that cannot be reached is
+suspected and tried again only after a backoff, doubled on every failed attempt up to maxHintBackoff, so a replica down for long is
+not called on every round. It is cleared as soon as it answers.
+Hints are bounded in number, bytes and age. A stand-in that is full refuses new hints with NapiHintError, so the writer picks
+another stand-in. Expired hints are dropped, and the copy of the replica is then fixed by anti-entropy
+*/
+
+/*
+A write a replica missed, held by a stand-in until the replica answers again. Sent with NAPI.StoreHint by the owner of the key
+*/
+type Hint struct {
+	Target   HostData     // replica the write is meant for
+	TargetID ring.ID      // id of the replica when the write was made. Zero if not known, then any node at Target takes the hint
+	Owner    ring.ID      // id of the node owning the key i.e the range the write belongs to
+	Item     TransferItem // the write. Deleted for a delete
+	Start    ring.ID      // first key of the range of Owner
+}
+
+// counters of a hint store
+type HintStats struct {
+	Stored    int // hints accepted
+	Delivered int // hints delivered to their replica
+	Refused   int // hints refused as the store was full
+	Expired   int // hints dropped for their age or as their replica changed id
+	Pending   int // hints waiting for delivery
+	Bytes     int // bytes of the pending hints
+	Suspected int // replicas not answering, whose hints wait for their backoff
+}
+
+type hintEntry struct {
+	hint  Hint
+	added time.Time
+}
+
+// key of the hints of one replica for one range. Hints are kept per key, the newest write to a key replaces older ones
+type hintTarget struct {
+	target HostData
+	id     ring.ID
+	owner  ring.ID
+}
+
+/*
+Hints kept by a stand-in node. Safe for concurrent use
+*/
+type HintStore struct {
+	lock      sync.Mutex
+	hints     map[hintTarget]map[string]hintEntry
+	max_hints int
+	max_bytes int
+	max_age   time.Duration
+	stats     HintStats
+}
+
+// limits of the hint stores of new nodes. Changed with SetHintLimits
+var hint_max_hints = 100000
+var hint_max_bytes = 64 << 20
+var hint_max_age = 3 * time.Hour
+
+/*
+Sets the limits of the hint stores of nodes created afterwards. A value <= 0 leaves the limit unchanged. Must be called before
+the node starts
+*/
+func SetHintLimits(max_hints int, max_bytes int, max_age time.Duration) {
+	if max_hints > 0 {
+		hint_max_hints = max_hints
+	}
+	if max_bytes > 0 {
+		hint_max_bytes = max_bytes
+	}
+	if max_age > 0 {
+		hint_max_age = max_age
+	}
+}
+
+/*
+Returns an empty hint store with the given limits
+*/
+func NewHintStore(max_hints int, max_bytes int, max_age time.Duration) *HintStore {
+	return &HintStore{hints: make(map[hintTarget]map[string]hintEntry), max_hints: max_hints, max_bytes: max_bytes, max_age: max_age}
+}
+
+func hintSize(h *Hint) int {
+	return len(h.Item.Key) + len(h.Item.Value)
+}
+
+/*
+Stores h, replacing a hint for the same replica, range and key unless that one holds a newer write. NapiHintError if the store
+would go over its limits
+*/
+func (hs *HintStore) Add(h Hint, now time.Time) error {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	t := hintTarget{target: h.Target, id: h.TargetID, owner: h.Owner}
+	entries := hs.hints[t]
+	old, replaced := entries[h.Item.Key]
+	if replaced && entryOf(old.hint.Item).After(entryOf(h.Item)) {
+		return nil
+	}
+	count, bytes := hs.stats.Pending+1, hs.stats.Bytes+hintSize(&h)
+	if replaced {
+		count, bytes = count-1, bytes-hintSize(&old.hint)
+	}
+	if count > hs.max_hints || bytes > hs.max_bytes {
+		hs.stats.Refused++
+		return NewNapiHintError()
+	}
+	if entries == nil {
+		entries = make(map[string]hintEntry)
+		hs.hints[t] = entries
+	}
+	entries[h.Item.Key] = hintEntry{hint: h, added: now}
+	hs.stats.Pending, hs.stats.Bytes = count, bytes
+	hs.stats.Stored++
+	return nil
+}
+
+// removes the hint of t for key if it was added at added. Assumes lock is held
+func (hs *HintStore) remove(t hintTarget, key string, added time.Time) bool {
+	entry, present := hs.hints[t][key]
+	if !present || !entry.added.Equal(added) { // replaced meanwhile
+		return false
+	}
+	delete(hs.hints[t], key)
+	if len(hs.hints[t]) == 0 {
+		delete(hs.hints, t)
+	}
+	hs.stats.Pending--
+	hs.stats.Bytes -= hintSize(&entry.hint)
+	return true
+}
+
+/*
+Drops the hints older than the max age. Returns the number dropped
+*/
+func (hs *HintStore) Expire(now time.Time) int {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	ret := 0
+	for t, entries := range hs.hints {
+		for key, entry := range entries {
+			if now.Sub(entry.added) > hs.max_age && hs.remove(t, key, entry.added) {
+				ret++
+			}
+		}
+	}
+	hs.stats.Expired += ret
+	return ret
+}
+
+/*
+Returns a copy of the counters of the store
+*/
+func (hs *HintStore) Stats() HintStats {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return hs.stats
+}
+
+// replicas with pending hints, and a snapshot of their hints sorted by key
+func (hs *HintStore) pending() map[hintTarget][]hintEntry {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	ret := make(map[hintTarget][]hintEntry, len(hs.hints))
+	for t, entries := range hs.hints {
+		list := make([]hintEntry, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, entry)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].hint.Item.Key < list[j].hint.Item.Key })
+		ret[t] = list
+	}
+	return ret
+}
+
+// removes delivered hints, unless they were replaced meanwhile. expired is set if they were dropped rather than delivered
+func (hs *HintStore) done(t hintTarget, entries []hintEntry, expired bool) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for _, entry := range entries {
+		if hs.remove(t, entry.hint.Item.Key, entry.added) {
+			if expired {
+				hs.stats.Expired++
+			} else {
+				hs.stats.Delivered++
+			}
+		}
+	}
+}
+
+// backoff of the delivery of hints to a replica that cannot be reached, doubled on every failed attempt
+const (
+	hintBackoff    = time.Second
+	maxHintBackoff = 5 * time.Minute
+)
+
+type suspect struct {
+	failures int       // failed attempts in a row
+	retry    time.Time // next attempt
+}
+
+/*
+Failure detector of the replicas hints are kept for. Safe for concurrent use
+*/
+type failureDetector struct {
+	lock     sync.Mutex
+	suspects map[HostData]*suspect
+}
+
+func newFailureDetector() *failureDetector {
+	return &failureDetector{suspects: make(map[HostData]*suspect)}
+}
+
+// True if peer is not suspected or its backoff is over at now
+func (fd *failureDetector) due(peer HostData, now time.Time) bool {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	s := fd.suspects[peer]
+	return s == nil || !now.Before(s.retry)
+}
+
+// suspects peer, which could not be reached at now, and backs off
+func (fd *failureDetector) failed(peer HostData, now time.Time) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	s := fd.suspects[peer]
+	if s == nil {
+		s = &suspect{}
+		fd.suspects[peer] = s
+	}
+	backoff := maxHintBackoff
+	if s.failures < 16 && hintBackoff<<s.failures < maxHintBackoff {
+		backoff = hintBackoff << s.failures
+	}
+	s.failures++
+	s.retry = now.Add(backoff)
+}
+
+// clears peer, which answered
+func (fd *failureDetector) answered(peer HostData) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	delete(fd.suspects, peer)
+}
+
+// forgets the suspects not in peers, which have no hints left
+func (fd *failureDetector) retain(peers map[HostData]bool) {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	for peer := range fd.suspects {
+		if !peers[peer] {
+			delete(fd.suspects, peer)
+		}
+	}
+}
+
+// number of suspected peers
+func (fd *failureDetector) count() int {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return len(fd.suspects)
+}
+
+/*
+Stores a hint for a replica that could not be reached. Called by the node coordinating the write. reply is unused.
+NapiHintError if the hint store of the local node is full
+*/
+func (napi *NAPI) StoreHint(hint *Hint, reply *bool) error {
+	return napi.ln.hints.Add(*hint, time.Now())
+}
+
+/*
+Delivers the pending hints of every replica that answers, and drops expired ones. Suspected replicas are skipped until their backoff
+is over. A replica answers if NAPI.GetN succeeds, which also tells if it still has the id the hints were made for. Returns the
+number of hints delivered and the first error of a replica that answered but refused its hints
+*/
+func (lns *LocNodeStruct) DeliverHints() (int, error) {
+	return lns.deliverHints(time.Now())
+}
+
+func (lns *LocNodeStruct) deliverHints(now time.Time) (int, error) {
+	hs, fd := lns.hints, lns.detector
+	hs.Expire(now)
+	delivered := 0
+	var first error
+	pending := hs.pending()
+	targets := make(map[HostData]bool, len(pending))
+	for t := range pending {
+		targets[t.target] = true
+	}
+	fd.retain(targets)
+	for t, entries := range pending {
+		if !fd.due(t.target, now) { // suspected, also right after a failed call for another range
+			continue
+		}
+		var id, none ring.ID
+		if err := lns.call(t.target, "NAPI.GetN", &none, &id); err != nil {
+			fd.failed(t.target, now)
+			continue
+		}
+		fd.answered(t.target)
+		if id != t.id && t.id != none { // another node took the address
+			hs.done(t, entries, true)
+			continue
+		}
+		request := RepairRequest{Owner: t.owner, Items: make([]TransferItem, len(entries))}
+		latest := entries[0].added
+		for i, entry := range entries {
+			request.Items[i] = entry.hint.Item
+			if !entry.added.Before(latest) { // the range of the owner as last known
+				latest, request.Start = entry.added, entry.hint.Start
+			}
+		}
+		ok := false
+		if err := lns.call(t.target, "NAPI.Repair", &request, &ok); err != nil {
+			if _, answered := err.(rpc.ServerError); !answered {
+				fd.failed(t.target, now)
+			} else if first == nil {
+				first = err
+			}
+			continue
+		}
+		hs.done(t, entries, false)
+		delivered += len(entries)
+	}
+	return delivered, first
+}
+
+/*
+Returns the counters of the hint store of the node, and the number of replicas it suspects
+*/
+func (lns *LocNodeStruct) HintStats() HintStats {
+	ret := lns.hints.Stats()
+	ret.Suspected = lns.detector.count()
+	return ret
+}
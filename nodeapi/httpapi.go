@@ -0,0 +1,232 @@
+package nodeapi
+
+import (
+	"context"
+	"encoding/json"
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+HTTP/JSON gateway to the NAPI service for clients that cannot speak net/rpc with gob. Every handler calls the matching
+NAPI method, so requests for keys stored by other nodes are forwarded through the finger table like rpc requests.
+
+	GET    /kv/{key}   value of key. ?repair=false leaves lagging copies of key alone
+	PUT    /kv/{key}   sets key to the request body
+	DELETE /kv/{key}   removes key and returns its value
+	GET    /find/{key} owner of key
+	GET    /ring       every node of the ring sorted by id
+	GET    /node       summary of this node
+	GET    /metrics    metrics of this node in the Prometheus text format, see metrics.go
+
+Values are sent as {"key": ..., "value": ...}. Binary values are passed through unchanged instead when a PUT body is not
+application/json, and when a GET or DELETE sends "Accept: application/octet-stream".
+Errors are sent as {"error": message}. The inspection endpoints are not served here but on the admin listener, see inspect.go
+*/
+
+const maxValueSize = 64 << 20 // largest PUT body accepted
+
+type kvJSON struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type findJSON struct {
+	Key   string   `json:"key"`
+	Sha   ring.ID  `json:"sha"`
+	Owner HostData `json:"owner"`
+}
+
+/*
+Status codes of the errors returned by NAPI methods. Errors of remote nodes arrive as rpc.ServerError holding only the message,
+so errors are matched on their message
+*/
+var httpStatus = map[string]int{
+	CM.NewCMKeyError().Error():      http.StatusNotFound,
+	NewNapiKeyError().Error():       http.StatusNotFound,
+	CM.NewCMCASError().Error():      http.StatusConflict,
+	NewNapiBusyError().Error():      http.StatusServiceUnavailable,
+	NewNapiRangeError().Error():     http.StatusMisdirectedRequest,
+	CM.NewCMRangeError().Error():    http.StatusMisdirectedRequest,
+	NewNapiCollisionError().Error(): http.StatusConflict,
+	NewNapiConnError().Error():      http.StatusBadGateway,
+	NewNapiQuorumError().Error():    http.StatusServiceUnavailable,
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+/*
+Sends err with the status mapped from its message. Network errors while forwarding are sent as 502, others as 500
+*/
+func writeError(w http.ResponseWriter, err error) {
+	status, ok := httpStatus[err.Error()]
+	if !ok {
+		if _, is_net := err.(net.Error); is_net {
+			status = http.StatusBadGateway
+		} else {
+			status = http.StatusInternalServerError
+		}
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// true if the request asks for the raw value
+func wantsRaw(r *http.Request) bool {
+	media, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	return media == "application/octet-stream"
+}
+
+func writeValue(w http.ResponseWriter, r *http.Request, key string, value string) {
+	if wantsRaw(r) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, value)
+		return
+	}
+	writeJSON(w, http.StatusOK, kvJSON{Key: key, Value: value})
+}
+
+// handler of the gateway, called on a NAPI carrying the request id of the request
+type napiHandler func(*NAPI, http.ResponseWriter, *http.Request)
+
+/*
+Dispatches on the request method. Other methods get 405. The request id sent in X-Request-Id, or a new one, is passed on to the
+calls made for the request and sent back. So is the span sent in traceparent, if any
+*/
+func (napi *NAPI) methods(handlers map[string]napiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": r.Method + " not allowed"})
+			return
+		}
+		ctx := ensureRequestID(WithRequestID(context.Background(), r.Header.Get(requestIDHeader)))
+		ctx = withTraceparent(ctx, r.Header.Get(traceparentHeader))
+		w.Header().Set(requestIDHeader, RequestID(ctx))
+		handler(napi.with(ctx), w, r)
+	}
+}
+
+// key in the path after prefix, e.g the key of /kv/{key}
+func pathKey(r *http.Request, prefix string) string {
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+/******** Handlers **********/
+
+func (napi *NAPI) httpGet(w http.ResponseWriter, r *http.Request) {
+	args := HTArgs{Key: pathKey(r, "/kv/"), NoRepair: r.URL.Query().Get("repair") == "false"}
+	var reply HTReply
+	if err := napi.Get(&args, &reply); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeValue(w, r, args.Key, reply.Value)
+}
+
+func (napi *NAPI) httpPut(w http.ResponseWriter, r *http.Request) {
+	args := HTArgs{Key: pathKey(r, "/kv/")}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	}
+	if media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); media == "application/json" {
+		var kv kvJSON
+		if err = json.Unmarshal(body, &kv); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		args.Value = kv.Value
+	} else { // raw value
+		args.Value = string(body)
+	}
+	var reply HTReply
+	if err = napi.Put(&args, &reply); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (napi *NAPI) httpDelete(w http.ResponseWriter, r *http.Request) {
+	args := HTArgs{Key: pathKey(r, "/kv/")}
+	var reply HTReply
+	if err := napi.Delete(&args, &reply); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeValue(w, r, args.Key, reply.Value)
+}
+
+func (napi *NAPI) httpFind(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(r, "/find/")
+	sha := CM.StrToSha(key)
+	var owner HostData
+	if err := napi.Find(&sha, &owner); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, findJSON{Key: key, Sha: sha, Owner: owner})
+}
+
+func (napi *NAPI) httpRing(w http.ResponseWriter, r *http.Request) {
+	var members []RingMember
+	none := false
+	if err := napi.RingSnapshot(&none, &members); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (napi *NAPI) httpNode(w http.ResponseWriter, r *http.Request) {
+	var ni NodeInfo
+	none := false
+	if err := napi.Info(&none, &ni); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ni)
+}
+
+/******** Handlers end **********/
+
+/*
+Returns the handler of the HTTP gateway of loc_node
+*/
+func HttpHandler(loc_node *LocNodeStruct) http.Handler {
+	napi := &NAPI{ln: loc_node}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", napi.methods(map[string]napiHandler{
+		http.MethodGet:    (*NAPI).httpGet,
+		http.MethodPut:    (*NAPI).httpPut,
+		http.MethodDelete: (*NAPI).httpDelete}))
+	mux.HandleFunc("/find/", napi.methods(map[string]napiHandler{http.MethodGet: (*NAPI).httpFind}))
+	mux.HandleFunc("/ring", napi.methods(map[string]napiHandler{http.MethodGet: (*NAPI).httpRing}))
+	mux.HandleFunc("/node", napi.methods(map[string]napiHandler{http.MethodGet: (*NAPI).httpNode}))
+	mux.Handle("/metrics", loc_node.metrics.registry.Handler())
+	return mux
+}
+
+/*
+Starts the HTTP gateway of loc_node on listen_addr. Runs alongside the rpc service started by NapiStartOn
+*/
+func HttpStartOn(loc_node *LocNodeStruct, listen_addr string) (net.Listener, error) {
+	l, e := net.Listen("tcp", listen_addr)
+	if e != nil {
+		loc_node.log.Error("cannot start HTTP gateway", "listen", listen_addr, "err", e)
+		return l, e
+	}
+	go http.Serve(l, HttpHandler(loc_node))
+	loc_node.log.Info("HTTP gateway started", "listen", l.Addr().String())
+	return l, nil
+}
@@ -0,0 +1,55 @@
+package nodeapi
+
+import (
+	"crypto/rand"
+	"fmt"
+	"go_dht/ring"
+)
+
+// policy used to derive the id/end of a local node
+type IDPolicy int
+
+const (
+	IDHostPort IDPolicy = 0 // hash("host:port") using the ring's hash function
+	IDVirtual  IDPolicy = 1 // hash("host:port#vindex"). Allows several virtual nodes per machine
+	IDRandom   IDPolicy = 2 // random id from crypto/rand
+	IDExplicit IDPolicy = 3 // id given in IDConfig.Explicit
+)
+
+// struct containing the id policy and the values the policy needs. Zero value is IDHostPort
+type IDConfig struct {
+	Policy   IDPolicy
+	VIndex   uint32  // virtual index. Only used by IDVirtual
+	Explicit ring.ID // only used by IDExplicit
+}
+
+/*
+Derives the id of a node listening on hostname:port according to the policy in idcfg.
+A nil idcfg is treated as IDHostPort. Returns NapiPolicyError on an unknown policy
+*/
+func (idcfg *IDConfig) DeriveID(hostname string, port string) (ring.ID, error) {
+	var ret ring.ID
+	if idcfg == nil {
+		return ring.Hash([]byte(hostname + ":" + port)), nil
+	}
+	switch idcfg.Policy {
+	case IDHostPort:
+		ret = ring.Hash([]byte(hostname + ":" + port))
+	case IDVirtual:
+		ret = ring.Hash([]byte(fmt.Sprintf("%s:%s#%d", hostname, port, idcfg.VIndex)))
+	case IDRandom:
+		buf := make([]byte, len(ret))
+		if _, err := rand.Read(buf); err != nil {
+			return ret, err
+		}
+		ret = ring.FromBytes(buf) // drop bits above the ring width
+	case IDExplicit:
+		if idcfg.Explicit.Cmp(ring.MaxVal()) == ring.Greater { // wider than the ring
+			return ret, NewNapiPolicyError()
+		}
+		ret = idcfg.Explicit
+	default:
+		return ret, NewNapiPolicyError()
+	}
+	return ret, nil
+}
@@ -0,0 +1,236 @@
+package nodeapi
+
+import (
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+/*
+Inspection of a live node. Inspect returns a snapshot of the node, its finger table and its store, taken at once so the parts agree
+with each other: no write, join or leave is applied while it is taken. KeysIn lists the keys the node stores in a sub-range of its
+range. Both are served as JSON on the admin listener of the node, see AdminStartOn:
+
+	GET /admin/node   snapshot of the node, as returned by Inspect
+	GET /debug/keys   keys stored in [start, end), sorted clockwise from start. ?start=<hex id>&end=<hex id>&limit=<n>,
+	                  start and end default to the range of the store
+
+Keys stored by other nodes are never listed, requests are not forwarded. The admin listener has no authentication and is off
+unless started, it is meant for a loopback or private address. Neither is a NAPI method, so the rpc port, gRPC included, and the
+HTTP gateway do not serve them
+*/
+
+const (
+	defaultKeysLimit = 1000   // keys listed by /debug/keys if no limit is given
+	maxKeysLimit     = 100000 // cap on the limit of /debug/keys
+)
+
+// state of the join registered at or last committed by a node
+type JoinerInfo struct {
+	ID    ring.ID
+	Host  HostData
+	Start ring.ID // first key of the range of the joiner
+	Phase string  // see handoff.go
+	Keys  int     // keys of the range when the join was registered
+	Dirty int     // keys of the range written since
+}
+
+// snapshot of a node returned by Inspect
+type NodeSnapshot struct {
+	Host          HostData
+	ID            ring.ID
+	Pred          *HostData // nil for a single node chord ring
+	PredEnd       ring.ID   // only set if Pred != nil
+	Succ          HostData
+	Config        ring.Config
+	State         string
+	StateEpoch    uint64 // incremented on every change of State
+	Fingers       []FingerEntry
+	FingerChanges uint64 // entries whose host changed since the table was created
+	Store         CM.StoreStats
+	Joiner        *JoinerInfo // join in progress. nil if none
+	Committed     *JoinerInfo // last join that committed. nil if none
+	Replication   int         // copies kept of every key
+	Hints         HintStats
+	ReadRepair    ReadRepairStats
+	Replicas      []ReplicaInfo // copies kept for other nodes, by id of the owner
+}
+
+// copy of the range of another node kept by a replica, see replicas.go
+type ReplicaInfo struct {
+	Owner ring.ID
+	Store CM.StoreStats
+}
+
+type KeyEntry struct {
+	Key string
+	Sha ring.ID
+}
+
+// keys of a sub-range returned by KeysIn
+type KeyRange struct {
+	Keys      []KeyEntry // sorted clockwise from the start of the range
+	Truncated bool       // more keys of the range were left out
+}
+
+func (p joinphase) String() string {
+	switch p {
+	case phaseTransfer:
+		return "transfer"
+	case phasePrepared:
+		return "prepared"
+	case phaseCommitting:
+		return "committing"
+	case phaseCommitted:
+		return "committed"
+	case phaseAborted:
+		return "aborted"
+	}
+	return "unknown"
+}
+
+// state of the join of j. nil if j is nil
+func joinerInfo(j *Joiner) *JoinerInfo {
+	if j == nil {
+		return nil
+	}
+	ret := &JoinerInfo{ID: j.N}
+	if j.Conn != nil {
+		ret.Host = *j.Conn
+	}
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	ret.Start = j.xfer.start
+	ret.Phase = j.xfer.phase.String()
+	ret.Keys = len(j.xfer.keys)
+	ret.Dirty = len(j.xfer.dirty)
+	return ret
+}
+
+/*
+Returns a snapshot of the node. lock is held for writing while it is taken, so every write, which holds it for reading, is either
+fully in the snapshot or not at all, and the range, the predecessor and the join state cannot change
+*/
+func (lns *LocNodeStruct) Inspect() NodeSnapshot {
+	lns.lock.Lock()
+	defer lns.lock.Unlock()
+	ret := NodeSnapshot{Host: HostData{Hostname: lns.hostname, Port: lns.port}, ID: lns.end, Config: ring.CurConfig(),
+		Replication: lns.replication}
+	if lns.pred != nil {
+		pred := *lns.pred
+		ret.Pred, ret.PredEnd = &pred, lns.pred_end
+	}
+	lns.state_lock.Lock()
+	ret.State, ret.StateEpoch = lns.state.String(), lns.state_epoch
+	lns.state_lock.Unlock()
+	entries, changes := lns.ft.Snapshot()
+	ret.Fingers = make([]FingerEntry, len(entries))
+	for i, e := range entries {
+		ret.Fingers[i] = FingerEntry{Start: lns.end.Add(ring.Pow2(uint32(i))), Host: HostData{Hostname: e.Hostname, Port: e.Port}}
+	}
+	if len(entries) > 0 { // entry 0 is succ(end + 1)
+		ret.Succ = ret.Fingers[0].Host
+	}
+	ret.FingerChanges = changes
+	ret.Store = lns.cm.Stats()
+	ret.Joiner = joinerInfo(lns.joiner)
+	ret.Committed = joinerInfo(lns.committed)
+	ret.Hints = lns.hints.Stats()
+	ret.ReadRepair = lns.ReadRepairStats()
+	ret.Replicas = lns.replicas.stats()
+	return ret
+}
+
+/*
+Returns up to limit of the keys stored by the node in [start, end), sorted clockwise from start, and whether keys were left out.
+The whole ring if end == start
+*/
+func (lns *LocNodeStruct) KeysIn(start ring.ID, end ring.ID, limit int) KeyRange {
+	entries := make([]KeyEntry, 0)
+	for _, k := range lns.cm.GetKeys() {
+		if sha := CM.StrToSha(k); sha.Between(start, end, ring.ClosedOpen) {
+			entries = append(entries, KeyEntry{Key: k, Sha: sha})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if ord := entries[i].Sha.Sub(start).Cmp(entries[j].Sha.Sub(start)); ord != ring.Equal {
+			return ord == ring.Less
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	ret := KeyRange{Keys: entries}
+	if len(entries) > limit {
+		ret.Keys, ret.Truncated = entries[:limit], true
+	}
+	return ret
+}
+
+/******** Handlers **********/
+
+func (napi *NAPI) httpInspect(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, napi.ln.Inspect())
+}
+
+// id of query parameter name, def if it is absent
+func queryID(r *http.Request, name string, def ring.ID) (ring.ID, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	return ring.FromHex(s)
+}
+
+func (napi *NAPI) httpKeys(w http.ResponseWriter, r *http.Request) {
+	stats := napi.ln.cm.Stats()
+	start, end, limit := stats.Start, stats.End, defaultKeysLimit
+	var err error
+	if start, err = queryID(r, "start", stats.Start); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad start: " + err.Error()})
+		return
+	}
+	if end, err = queryID(r, "end", stats.End); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad end: " + err.Error()})
+		return
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad limit " + s})
+			return
+		}
+		if limit > maxKeysLimit {
+			limit = maxKeysLimit
+		}
+	}
+	writeJSON(w, http.StatusOK, napi.ln.KeysIn(start, end, limit))
+}
+
+/******** Handlers end **********/
+
+/*
+Returns the handler of the inspection endpoints of loc_node
+*/
+func AdminHandler(loc_node *LocNodeStruct) http.Handler {
+	napi := &NAPI{ln: loc_node}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/node", napi.methods(map[string]napiHandler{http.MethodGet: (*NAPI).httpInspect}))
+	mux.HandleFunc("/debug/keys", napi.methods(map[string]napiHandler{http.MethodGet: (*NAPI).httpKeys}))
+	return mux
+}
+
+/*
+Starts the admin listener of loc_node on listen_addr, serving the inspection endpoints. Runs alongside the rpc service started by
+NapiStartOn
+*/
+func AdminStartOn(loc_node *LocNodeStruct, listen_addr string) (net.Listener, error) {
+	l, e := net.Listen("tcp", listen_addr)
+	if e != nil {
+		loc_node.log.Error("cannot start admin listener", "listen", listen_addr, "err", e)
+		return l, e
+	}
+	go http.Serve(l, AdminHandler(loc_node))
+	loc_node.log.Info("admin listener started", "listen", l.Addr().String())
+	return l, nil
+}
@@ -1,11 +1,14 @@
 package nodeapi
 
 import (
+	"context"
 	CM "go_dht/chordmap"
-	K "go_dht/constants"
 	FT "go_dht/fingertable"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"io"
+	"log/slog"
 	"sync"
+	"time"
 )
 
 type nodestate int
@@ -18,41 +21,76 @@ const (
 
 // struct used as data storage container for the joining processs
 type Joiner struct {
-	//Pred, Succ [K.ShaSize]byte    // the id/key of the successor and predecessor of the Joined node
-	Table *CM.ChordMapStruct // the table filled with the (key,values) tha joiner will take ownership
-	N     [K.ShaSize]byte
+	//Pred, Succ ring.ID    // the id/key of the successor and predecessor of the Joined node
+	Table CM.Store // the table filled with the (key,values) tha joiner will take ownership. nil until the join commits
+	N     ring.ID
 	Conn  *HostData
+	xfer  *transfer // state of the transfer of the range to the joiner. See transfer.go
+	epoch uint64    // lease of the BusyJoin state held by the join. See handoff.go
 }
 
 /* class containing data for a local node
 Note: Only do ft lookups after check on local node storage. Ft must also be updated if successor changes. To be safe both pred/succ change should update
 ft.
+Locking: lock guards pred, pred_end, joiner and committed, state_lock guards state, state_epoch, state_timer and join_leases. hostname, port, end, transport and replication never change. cm, ft, replicas, hints, detector, metrics, rpc_calls and upkeep lock themselves, read_repair is atomic.
+Locks are taken in the order lock, state_lock, then the locks of cm and ft, and none is held while calling another node since the call may come back
 */
 type LocNodeStruct struct {
 	hostname, port string
-	end            [K.ShaSize]byte    // id for this node. Inclusive
-	pred           *HostData          // nil if chord ring has only this node in it. HostData defined in rmiapi.go
-	pred_end       [K.ShaSize]byte    // the id/end of the predecessor node i.e the last key the predecessor is in charge of. Must be set if pred != nil
-	ft             *FT.FTStruct       // fingertable. Is set correctly even for single node chord ring to ensure successor lookups are correct
-	cm             *CM.ChordMapStruct // local hash table
-	state          nodestate          // TODO: current state of the local node
+	end            ring.ID      // id for this node. Inclusive
+	pred           *HostData    // nil if chord ring has only this node in it. HostData defined in rmiapi.go
+	pred_end       ring.ID      // the id/end of the predecessor node i.e the last key the predecessor is in charge of. Must be set if pred != nil
+	ft             *FT.FTStruct // fingertable. Is set correctly even for single node chord ring to ensure successor lookups are correct
+	cm             CM.Store     // local hash table
+	state          nodestate    // current state of the local node. Busy states are leases, see handoff.go
+	state_epoch    uint64       // incremented on every change of state
+	state_timer    *time.Timer  // expiry of the lease of a busy state. nil if Free
 	state_lock     *sync.Mutex
-	joiner         *Joiner // Set to a Joiner struct if state == BusyJoin else should be nil
+	join_leases    map[ring.ID]uint64 // epoch of the Busy lease taken for a join at the successor, by id of the joiner
+	joiner         *Joiner            // Set to a Joiner struct if state == BusyJoin else should be nil
+	committed      *Joiner            // last joiner that committed, so a repeated JoinedSucc gets the same reply
+	transport      Transport          // carries every call to other nodes
+	replicas       *replicaSet        // copies of the ranges of other nodes. See replicas.go
+	hints          *HintStore         // writes held for replicas that were down. See hints.go
+	detector       *failureDetector   // replicas the hints are held for that do not answer. See hints.go
+	read_repair    readRepairCounters // see readrepair.go
+	metrics        *nodeMetrics       // see metrics.go
+	replication    int                // copies kept of every key, the owner's included. See replication.go
+	rpc_calls      sync.Map           // *serverCall of the net/rpc calls being served, by args. See rpcserver.go
+	upkeep         upkeep             // background tasks, see background.go
+	log            *slog.Logger       // tags lines with the id and address of the node, see logging.go
+	lock           sync.RWMutex       // see Locking above
 }
 
-/********* Helper functions **********************/
+// number of shards of the store of new nodes. 1 keeps every key under one lock. Changed with SetStoreShards
+var store_shards = 1
 
-/* Checks if x is within (start, end] i.e exclusive start, inclusive end. Also handles case of wrap around where end < start.
-If end == start, returns false.
+/*
+Sets the number of shards of the store of nodes created afterwards. Values <= 1 use a single map. Sharding pays off for write heavy
+loads on many cores. Must be called before the node starts
+*/
+func SetStoreShards(n int) {
+	store_shards = n
+}
+
+// store for keys in [start, end)
+func newStore(start ring.ID, end ring.ID) CM.Store {
+	if store_shards > 1 {
+		return CM.NewSharded(start, end, store_shards)
+	}
+	return CM.New(start, end)
+}
+
+// age at which tombstones are dropped by CompactTombstones. Changed with SetTombstoneGrace
+var tomb_grace = 24 * time.Hour
+
+/*
+Sets the gc grace period of tombstones, see chordmap/tombstone.go. Values <= 0 leave it unchanged. Must exceed the time copies of a
+range take to converge, or deleted keys come back
 */
-func InRangeHelp(x [K.ShaSize]byte, start [K.ShaSize]byte, end [K.ShaSize]byte) bool {
-	if SSA.Cmp(start, end) == SSA.Equal {
-		return false
-	} else if SSA.Cmp(start, end) == SSA.Less { // no wrap around
-		return SSA.InRange(x, SSA.Add(start, SSA.FromInt(1)), end) // start+1 <= x <= end
-	} else { // wrap around case
-		return InRangeHelp(x, start, SSA.MaxVal()) || SSA.InRange(x, SSA.FromInt(0), end)
-		// x in (start, MaxVal] || x == 0 || x in [0,end]
+func SetTombstoneGrace(d time.Duration) {
+	if d > 0 {
+		tomb_grace = d
 	}
 }
 
@@ -61,86 +99,211 @@ func InRangeHelp(x [K.ShaSize]byte, start [K.ShaSize]byte, end [K.ShaSize]byte)
 /*
 True if key is under charge of this node. i.e within range of (pred_end, end] if pred != nil. Else return true
 */
-func (lns *LocNodeStruct) StoresKey(key [K.ShaSize]byte) bool {
+func (lns *LocNodeStruct) StoresKey(key ring.ID) bool {
+	lns.lock.RLock()
+	defer lns.lock.RUnlock()
 	if lns.pred == nil {
 		return true // only 1 node in chord ring so Loc Node stores key
 	}
-	return InRangeHelp(key, lns.pred_end, lns.end)
+	return key.Between(lns.pred_end, lns.end, ring.OpenClosed)
 }
 
 /*
 True if has predecessor. Checks if pred == nil. No predecessor implies a single node chord ring.
 */
 func (lns *LocNodeStruct) HasPred() bool {
+	lns.lock.RLock()
+	defer lns.lock.RUnlock()
 	return lns.pred != nil
 }
 
+/*
+Returns a copy of the predecessor and its id. nil for a single node chord ring
+*/
+func (lns *LocNodeStruct) predecessor() (*HostData, ring.ID) {
+	lns.lock.RLock()
+	defer lns.lock.RUnlock()
+	if lns.pred == nil {
+		return nil, ring.ID{}
+	}
+	pred := *lns.pred
+	return &pred, lns.pred_end
+}
+
 /*
 Checks if the local node can accept a join request with the given key.
 Returns true if the local node is in currently in charge of key and is not undergoing another join process
 */
-func (lns *LocNodeStruct) CanJoin(key [K.ShaSize]byte) bool {
-	return (lns.state != BusyJoin) && lns.StoresKey(key)
+func (lns *LocNodeStruct) CanJoin(key ring.ID) bool {
+	return (lns.GetState() != BusyJoin) && lns.StoresKey(key)
 }
 
 /*
 Call is synchronized
 Tries to set lns.state to new_state. If node busy and new_state != Free then return Busy error.
-Else if new_state is free and node is busy || node is free then OK
+Else if new_state is free and node is busy || node is free then OK. A busy state set this way never expires
 */
 func (lns *LocNodeStruct) SetState(new_state nodestate) error {
 	lns.state_lock.Lock() // synchronize as rmi's are concurrent
-	if new_state == Free || lns.state == Free {
+	defer lns.state_lock.Unlock()
+	if new_state == Free {
+		lns.freeState()
+		return nil
+	}
+	if lns.state == Free {
 		lns.state = new_state
+		lns.state_epoch++
 		return nil
-	} else { // lns.state andnew_state are both busy types
-		return NewNapiBusyError()
 	}
-	lns.state_lock.Unlock()
-	return nil
+	// lns.state and new_state are both busy types
+	return NewNapiBusyError()
+}
+
+/*
+Calls method of the node at peer through the transport of the node
+*/
+func (lns *LocNodeStruct) call(peer HostData, method string, args interface{}, reply interface{}) error {
+	return lns.callContext(context.Background(), peer, method, args, reply)
+}
+
+/*
+Starts serving the NAPI methods of the node through its transport. listen_addr is used by transports binding to an address
+*/
+func (lns *LocNodeStruct) Serve(listen_addr string) (io.Closer, error) {
+	return lns.transport.Serve(lns, listen_addr)
+}
+
+/*
+Returns a summary of the node, as sent by NAPI.Info
+*/
+func (lns *LocNodeStruct) Info() (NodeInfo, error) {
+	var ret NodeInfo
+	succ_ip, succ_port, err := lns.ft.Find(lns.end.Add(ring.FromInt(1))) // get successor
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	ret.Host = HostData{Hostname: lns.hostname, Port: lns.port}
+	ret.ID = lns.end
+	ret.Pred, ret.PredEnd = lns.predecessor()
+	ret.Succ = HostData{Hostname: succ_ip, Port: succ_port}
+	ret.Config = ring.CurConfig()
+	ret.State = lns.GetState().String()
+	ret.Keys = lns.cm.Len()
+	ret.Bytes = lns.cm.Bytes()
+	ret.ReadRepair = lns.ReadRepairStats()
+	return ret, nil
+}
+
+/*
+Returns a copy of the (key, value)s stored by the node
+*/
+func (lns *LocNodeStruct) Items() map[string]string {
+	return lns.cm.Items()
+}
+
+/*
+Drops the tombstones older than the gc grace period, from the store of the local node and the copies it keeps as a replica. Returns
+the number dropped
+*/
+func (lns *LocNodeStruct) CompactTombstones() int {
+	before := time.Now().Add(-tomb_grace)
+	ret := lns.cm.Compact(before)
+	for _, store := range lns.replicas.all() {
+		ret += store.Compact(before)
+	}
+	return ret
 }
 
 /*
 Getter method for node state
 */
 func (lns *LocNodeStruct) GetState() nodestate {
+	lns.state_lock.Lock()
+	defer lns.state_lock.Unlock()
 	return lns.state
 }
 
+func (s nodestate) String() string {
+	switch s {
+	case Free:
+		return "free"
+	case BusyJoin:
+		return "busyjoin"
+	case Busy:
+		return "busy"
+	}
+	return "unknown"
+}
+
 /*
-TODO: ELse case i.e more than 1 node in ring
 Initializes the local node by creating the local node struct. ChordMap is empty on init. FingerTable is filled using Napi.Find() i.e reflects
 the current state of the DHT
 hostname: the public ip of the local node on which RPC is run
 port:  the port on which rpc is run
-end = id or last key for the local node. If pred == nil, does not matter
+idcfg = policy used to derive the id or last key for the local node. nil means IDHostPort
 pred = Info of the predecessor machine. If != nil then LocalInit will contact the machine for pred_end info. If == nil then function assumed there
 must be only 1 machine in the chord ring
+Returns NapiCollisionError if the derived id is the id of pred
+*/
+func LocalInit(hostname string, port string, idcfg *IDConfig, pred *HostData) (*LocNodeStruct, error) {
+	return LocalInitWith(DefaultTransport, hostname, port, idcfg, pred)
+}
+
+/*
+Same as LocalInit but the node makes its calls to other nodes through tr
 */
-func LocalInit(hostname string, port string, end [K.ShaSize]byte, pred *HostData) (*LocNodeStruct, error) {
+func LocalInitWith(tr Transport, hostname string, port string, idcfg *IDConfig, pred *HostData) (*LocNodeStruct, error) {
+	end, err := idcfg.DeriveID(hostname, port)
+	if err != nil {
+		return nil, err
+	}
+	return localInit(tr, hostname, port, end, pred)
+}
+
+/*
+Unexposed
+Does the work of LocalInit with an already derived id end. Used directly by a successor registering a joiner as the joiner's id
+was derived by the joiner itself
+*/
+func localInit(tr Transport, hostname string, port string, end ring.ID, pred *HostData) (*LocNodeStruct, error) {
 	ret := new(LocNodeStruct) // ret is a pointer
+	ret.transport = tr
 	ret.hostname = hostname
 	ret.port = port
+	ret.end = end
 	ret.state_lock = &sync.Mutex{}
+	ret.join_leases = make(map[ring.ID]uint64)
 	ret.state = Free
 	ret.joiner = nil
+	ret.replicas = newReplicaSet()
+	ret.replication = replication
+	ret.hints = NewHintStore(hint_max_hints, hint_max_bytes, hint_max_age)
+	ret.detector = newFailureDetector()
+	ret.metrics = newNodeMetrics(ret)
+	ret.log = nodeLogger(ret)
 	if pred == nil {
-		ret.end = SSA.MaxVal()
 		ret.pred = nil
-		ret.ft = FT.New(end, func(k [K.ShaSize]byte) (string, string) { return hostname, port })
-		ret.cm = CM.New(SSA.FromInt(0), SSA.FromInt(0)) // entire hash space
+		ret.ft = FT.New(end, func(k ring.ID) (string, string) { return hostname, port })
+		ret.cm = newStore(end.Add(ring.FromInt(1)), end.Add(ring.FromInt(1))) // entire hash space, split at end+1 when a node joins
 	} else {
-		ret.pred = &HostData{Hostname: pred.Hostname, Port: pred.Port}                    // do a copy
-		err = ConnectAndCall(pred.Hostname, pred.Port, "NAPI.GetN", nil, &(ret.pred_end)) // get pred_end. Args is not used
+		ret.pred = &HostData{Hostname: pred.Hostname, Port: pred.Port} // do a copy
+		// args is not used but gob cannot encode nil
+		var none ring.ID
+		err := ret.call(*pred, "NAPI.GetN", &none, &(ret.pred_end)) // get pred_end
 		if err != nil {
 			return nil, err
 		}
-		ret.ft = FT.New(end, func(key [K.ShaSize]byte) {
-			var ret HostData
-			ConnectAndCall(pred.Hostname, pred.Port, "Napi.Find", &key, &ret) // TODO: error is not caught during failure
-			return ret.Hostname, ret.Port
+		if ret.pred_end == end {
+			return nil, NewNapiCollisionError()
+		}
+		ret.ft = FT.New(end, func(key ring.ID) (string, string) {
+			var host HostData
+			if err := tr.Call(context.Background(), *pred, "NAPI.Find", &key, &host); err != nil { // finger left empty until refreshed
+				ret.log.Warn("finger lookup through the predecessor failed", "key", key.String(), "err", err)
+			}
+			return host.Hostname, host.Port
 		})
-		ret.cm = CM.New(SSA.Add(SSA.FromInt(1), ret.pred_end), SSA.Add(SSA.FromInt(1), end)) // [start, end)
+		ret.cm = newStore(ret.pred_end.Add(ring.FromInt(1)), end.Add(ring.FromInt(1))) // [start, end)
 	}
 	return ret, nil
 }
@@ -0,0 +1,122 @@
+package nodeapi
+
+import (
+	"context"
+	"fmt"
+	"go_dht/ring"
+	"go_dht/tracing"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+)
+
+/*
+Logging. Nodes log through log/slog, every line carrying the id and address of the node. A request gets an id on the node it enters
+the ring through, and every call made on its behalf carries the id on, so one Get can be followed across the ring by its id.
+Ids travel in the envelope of a call: a field of the request header for net/rpc, the X-Request-Id header for gRPC and the HTTP
+gateway, and a field of the call for a ChanTransport. NAPI methods see the id through the NAPI value they are called on.
+Calls that arrive without an id, e.g from clients or from a node that does not send ids yet, get a new one
+*/
+
+const requestIDHeader = "X-Request-Id"
+
+// logger nodes created afterwards log to. Changed with SetLogger
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+/*
+Sets the logger of nodes created afterwards. Each node adds its id and address to the lines it logs. Must be called before
+the node starts
+*/
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+type requestIDKey struct{}
+
+/*
+Returns a copy of ctx carrying request id id. Calls made with the returned context pass id on to the node called
+*/
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+/*
+Returns the request id carried by ctx, "" if there is none
+*/
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// random id of a request entering the ring at the local node
+func newRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// returns ctx, with a new request id if it carries none
+func ensureRequestID(ctx context.Context) context.Context {
+	if RequestID(ctx) != "" {
+		return ctx
+	}
+	return WithRequestID(ctx, newRequestID())
+}
+
+// logger of a node, tagging lines with its id and address
+func nodeLogger(lns *LocNodeStruct) *slog.Logger {
+	return logger.With("node", lns.end.String(), "addr", net.JoinHostPort(lns.hostname, lns.port))
+}
+
+/*
+Returns the logger of the node, which tags lines with the id and address of the node
+*/
+func (lns *LocNodeStruct) Logger() *slog.Logger {
+	return lns.log
+}
+
+// logger of the node for ctx, tagging lines with the request id of ctx if it has one
+func (lns *LocNodeStruct) logFor(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return lns.log.With("request", id)
+	}
+	return lns.log
+}
+
+/*
+Returns a NAPI on the same node handling calls that belong to the request of ctx
+*/
+func (napi *NAPI) with(ctx context.Context) *NAPI {
+	return &NAPI{ln: napi.ln, ctx: ctx}
+}
+
+// context of the call being handled. Background outside of calls, e.g when the node calls its own methods
+func (napi *NAPI) context() context.Context {
+	if napi.ctx == nil {
+		return context.Background()
+	}
+	return napi.ctx
+}
+
+// logger of the node for the call being handled
+func (napi *NAPI) log() *slog.Logger {
+	return napi.ln.logFor(napi.context())
+}
+
+// calls method of the node at peer on behalf of the call being handled, passing its request id and span on
+func (napi *NAPI) call(peer HostData, method string, args interface{}, reply interface{}) error {
+	return napi.ln.callContext(napi.context(), peer, method, args, reply)
+}
+
+// same as call, for a request for the key with sha sha forwarded through the finger table to its owner
+func (napi *NAPI) forward(peer HostData, method string, sha ring.ID, args interface{}, reply interface{}) error {
+	ln := napi.ln
+	ln.metrics.forwarded(method)
+	napi.log().Debug("forwarding", "method", method, "sha", sha.String(), "to", net.JoinHostPort(peer.Hostname, peer.Port))
+	var attrs []tracing.Attribute
+	if tracer != nil {
+		if finger, err := ln.ft.FindIndex(sha); err == nil {
+			attrs = append(attrs, tracing.Int("dht.finger_index", int(finger)))
+		}
+	}
+	return ln.callContext(napi.context(), peer, "NAPI."+method, args, reply, attrs...)
+}
@@ -0,0 +1,131 @@
+package nodeapi
+
+import (
+	CM "go_dht/chordmap"
+	"go_dht/metrics"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Metrics of a node, served in the Prometheus text format on /metrics of the rpc port and of the HTTP gateway. Every NAPI call the
+node handles is counted by method and outcome and timed, whatever the protocol. Errors are told apart by their type for the
+errors clients act on. Store, finger table, read repair and hint counts are read from where they are kept when scraped.
+Connection counts cover the calls every node of the process makes to peers, as calls do not go through a pool of their own:
+net/rpc dials once per call, gRPC reuses the connections of an http.Transport
+*/
+
+// outcome label of the errors split out. Others are "error"
+var rpcOutcomes = map[string]string{
+	CM.NewCMRangeError().Error(): "CMRangeError",
+	CM.NewCMKeyError().Error():   "CMKeyError",
+	NewNapiBusyError().Error():   "NapiBusyError",
+}
+
+// outcome label of a call that failed with message msg, "" for success
+func outcome(msg string) string {
+	if msg == "" {
+		return "ok"
+	} else if label, ok := rpcOutcomes[msg]; ok {
+		return label
+	}
+	return "error"
+}
+
+// connections to peers of every node of the process
+var conn_stats struct {
+	dials, dial_errors atomic.Uint64
+	open               atomic.Int64
+}
+
+// counts conn as open until it is closed
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { conn_stats.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// dials addr like dialer, counting the dial and the connection
+func countedDial(dial func() (net.Conn, error)) (net.Conn, error) {
+	conn_stats.dials.Add(1)
+	conn, err := dial()
+	if err != nil {
+		conn_stats.dial_errors.Add(1)
+		return nil, err
+	}
+	conn_stats.open.Add(1)
+	return &countedConn{Conn: conn}, nil
+}
+
+type nodeMetrics struct {
+	registry *metrics.Registry
+	rpcs     metrics.CounterVec   // calls handled, by method and outcome
+	latency  metrics.HistogramVec // time taken by calls handled, by method
+	forwards metrics.CounterVec   // requests sent on to another node, by method
+	events   metrics.CounterVec   // joins and leaves the node took part in, by event
+}
+
+func newNodeMetrics(lns *LocNodeStruct) *nodeMetrics {
+	r := metrics.NewRegistry()
+	ret := &nodeMetrics{
+		registry: r,
+		rpcs:     r.Counter("napi_rpcs_total", "NAPI calls handled by the node", "method", "outcome"),
+		latency:  r.Histogram("napi_rpc_duration_seconds", "Time taken by NAPI calls handled by the node", metrics.LatencyBuckets, "method"),
+		forwards: r.Counter("napi_forwards_total", "Requests for keys of other nodes sent on through the finger table", "method"),
+		events:   r.Counter("napi_membership_events_total", "Joins and leaves the node took part in", "event")}
+	r.GaugeFunc("chordmap_keys", "Keys stored by the node", func() float64 { return float64(lns.cm.Len()) })
+	r.GaugeFunc("chordmap_bytes", "Bytes of the keys and values stored by the node", func() float64 { return float64(lns.cm.Bytes()) })
+	r.GaugeFunc("chordmap_tombstones", "Tombstones of deleted keys kept by the node", func() float64 { return float64(len(lns.cm.Tombstones())) })
+	r.CounterFunc("fingertable_changes_total", "Finger table entries that changed host", func() float64 { return float64(lns.ft.Changes()) })
+	r.CounterFunc("napi_dials_total", "Connections to peers dialed by the process", func() float64 { return float64(conn_stats.dials.Load()) })
+	r.CounterFunc("napi_dial_errors_total", "Dials to peers that failed", func() float64 { return float64(conn_stats.dial_errors.Load()) })
+	r.GaugeFunc("napi_connections_open", "Connections to peers open in the process", func() float64 { return float64(conn_stats.open.Load()) })
+	read_repair := func(field func(ReadRepairStats) int64) func() float64 {
+		return func() float64 { return float64(field(lns.ReadRepairStats())) }
+	}
+	r.CounterFunc("napi_read_repair_reads_total", "Gets that read the copies of their key", read_repair(func(s ReadRepairStats) int64 { return s.Reads }))
+	r.CounterFunc("napi_read_repair_lagging_total", "Copies found lagging by Gets", read_repair(func(s ReadRepairStats) int64 { return s.Lagging }))
+	r.CounterFunc("napi_read_repair_repaired_total", "Lagging copies fixed", read_repair(func(s ReadRepairStats) int64 { return s.Repaired }))
+	r.CounterFunc("napi_read_repair_failed_total", "Lagging copies that could not be fixed", read_repair(func(s ReadRepairStats) int64 { return s.Failed }))
+	r.CounterFunc("napi_read_repair_skipped_total", "Lagging copies of Gets that opted out", read_repair(func(s ReadRepairStats) int64 { return s.Skipped }))
+	hints := func(field func(HintStats) int) func() float64 {
+		return func() float64 { return float64(field(lns.HintStats())) }
+	}
+	r.GaugeFunc("napi_hints_pending", "Hints waiting for their replica", hints(func(s HintStats) int { return s.Pending }))
+	r.GaugeFunc("napi_hints_bytes", "Bytes of the hints waiting for their replica", hints(func(s HintStats) int { return s.Bytes }))
+	r.GaugeFunc("napi_hints_suspected", "Replicas with hints that do not answer", hints(func(s HintStats) int { return s.Suspected }))
+	r.CounterFunc("napi_hints_stored_total", "Hints accepted for replicas that could not be reached", hints(func(s HintStats) int { return s.Stored }))
+	r.CounterFunc("napi_hints_delivered_total", "Hints delivered to their replica", hints(func(s HintStats) int { return s.Delivered }))
+	r.CounterFunc("napi_hints_refused_total", "Hints refused as the hint store was full", hints(func(s HintStats) int { return s.Refused }))
+	r.CounterFunc("napi_hints_expired_total", "Hints dropped for their age or as their replica changed id", hints(func(s HintStats) int { return s.Expired }))
+	return ret
+}
+
+// records a call of method, e.g "Get", that took took and failed with message msg, "" for success
+func (m *nodeMetrics) observe(method string, took time.Duration, msg string) {
+	m.rpcs.With(method, outcome(msg)).Inc()
+	m.latency.With(method).Observe(took.Seconds())
+}
+
+// records a request for method sent on to another node
+func (m *nodeMetrics) forwarded(method string) {
+	m.forwards.With(method).Inc()
+}
+
+// records a join or leave event
+func (m *nodeMetrics) event(event string) {
+	m.events.With(event).Inc()
+}
+
+/*
+Returns the metrics of the node
+*/
+func (lns *LocNodeStruct) Metrics() *metrics.Registry {
+	return lns.metrics.registry
+}
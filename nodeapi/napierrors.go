@@ -47,3 +47,99 @@ func (r NapiBusyError) Error() string {
 func NewNapiBusyError() *NapiBusyError {
 	return &NapiBusyError{message: "Node API Busy error"}
 }
+
+type NapiCollisionError struct {
+	message string
+}
+
+func (r NapiCollisionError) Error() string {
+	return r.message
+}
+
+func NewNapiCollisionError() *NapiCollisionError {
+	return &NapiCollisionError{message: "Node API id collision error"}
+}
+
+type NapiPolicyError struct {
+	message string
+}
+
+func (r NapiPolicyError) Error() string {
+	return r.message
+}
+
+func NewNapiPolicyError() *NapiPolicyError {
+	return &NapiPolicyError{message: "Node API unknown id policy error"}
+}
+
+type NapiConfigError struct {
+	message string
+}
+
+func (r NapiConfigError) Error() string {
+	return r.message
+}
+
+func NewNapiConfigError() *NapiConfigError {
+	return &NapiConfigError{message: "Node API ring config mismatch error"}
+}
+
+type NapiConnError struct {
+	message string
+}
+
+func (r NapiConnError) Error() string {
+	return r.message
+}
+
+func NewNapiConnError() *NapiConnError {
+	return &NapiConnError{message: "Node API rpc handshake error"}
+}
+
+type NapiRingError struct {
+	message string
+}
+
+func (r NapiRingError) Error() string {
+	return r.message
+}
+
+func NewNapiRingError() *NapiRingError {
+	return &NapiRingError{message: "Node API successors do not form a ring"}
+}
+
+type NapiChecksumError struct {
+	message string
+}
+
+func (r NapiChecksumError) Error() string {
+	return r.message
+}
+
+func NewNapiChecksumError() *NapiChecksumError {
+	return &NapiChecksumError{message: "Node API transfer checksum mismatch"}
+}
+
+type NapiQuorumError struct {
+	message string
+}
+
+func (r NapiQuorumError) Error() string {
+	return r.message
+}
+
+func NewNapiQuorumError() *NapiQuorumError {
+	return &NapiQuorumError{message: "Node API too few copies answered"}
+}
+
+type NapiHintError struct {
+	message string
+}
+
+func (r NapiHintError) Error() string {
+	return r.message
+}
+
+func NewNapiHintError() *NapiHintError {
+	return &NapiHintError{message: "Node API hint store full"}
+}
@@ -1,16 +1,33 @@
 package nodeapi
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
-	SSA "go_dht/shasumarith"
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"go_dht/tracing"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 /******** Helper Functions **********/
 
 // test RPC find function helper
 func testFind(hostname string, port string, t *testing.T) {
-	key := SSA.FromInt(0)
+	key := ring.FromInt(0)
 	reply := HostData{Hostname: "", Port: ""}
 	err := ConnectAndCall(hostname, port, "NAPI.Find", &key, &reply)
 	if err != nil {
@@ -49,13 +66,39 @@ func testHashTableSimple(hostname string, port string, t *testing.T) {
 	}
 }
 
+// checks the ring snapshot of a single node chord ring holds only that node
+func testRingSnapshot(hostname string, port string, t *testing.T) {
+	var members []RingMember
+	none := false
+	err := ConnectAndCall(hostname, port, "NAPI.RingSnapshot", &none, &members)
+	if err != nil {
+		t.Errorf("RPC error on RingSnapshot. err = %s\n", err.Error())
+	} else if len(members) != 1 || members[0].Host.Port != port {
+		t.Errorf("RPC error on RingSnapshot. Got %v\n", members)
+	}
+}
+
+// listener on an ephemeral localhost port, and the port
+func listenLocal(t *testing.T) (net.Listener, string) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen. err = %s\n", err.Error())
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return l, port
+}
+
 /*************** Testing ***************/
 
 // test if rpc works on a single node chord ring and simple hashtable functions
 func TestRpcBasic(t *testing.T) {
 	hostname := "localhost"
 	port := "8080"
-	ln := LocalInit(hostname, port, SSA.FromInt(0), nil)
+	ln, err := LocalInit(hostname, port, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(0)}, nil)
+	if err != nil {
+		t.Errorf("Could not init local node in TestRpcBasic\n")
+		return
+	}
 	listener, err := NapiStart(ln)
 	if err != nil {
 		t.Errorf("Could not start RPC in TestRpcBasic\n")
@@ -63,5 +106,1232 @@ func TestRpcBasic(t *testing.T) {
 	}
 	testHashTableSimple(hostname, port, t)
 	testFind(hostname, port, t)
+	testRingSnapshot(hostname, port, t)
 	NapiStop(listener) // stop the rpc service
 }
+
+// test that every id policy derives the expected id
+func TestDeriveID(t *testing.T) {
+	hostname := "localhost"
+	port := "8080"
+	id, err := (&IDConfig{Policy: IDHostPort}).DeriveID(hostname, port)
+	sum := sha1.Sum([]byte("localhost:8080")) // default ring config is sha1 at 160 bits
+	if err != nil || id != ring.FromBytes(sum[:]) {
+		t.Errorf("IDHostPort derived wrong id = %v\n", id)
+	}
+	nil_id, err := (*IDConfig)(nil).DeriveID(hostname, port)
+	if err != nil || id != nil_id {
+		t.Errorf("nil IDConfig should derive same id as IDHostPort\n")
+	}
+	v0, _ := (&IDConfig{Policy: IDVirtual, VIndex: 0}).DeriveID(hostname, port)
+	v1, _ := (&IDConfig{Policy: IDVirtual, VIndex: 1}).DeriveID(hostname, port)
+	if v0 == v1 || v0 == id {
+		t.Errorf("IDVirtual ids should differ by virtual index\n")
+	}
+	r0, _ := (&IDConfig{Policy: IDRandom}).DeriveID(hostname, port)
+	r1, _ := (&IDConfig{Policy: IDRandom}).DeriveID(hostname, port)
+	if r0 == r1 {
+		t.Errorf("IDRandom derived the same id twice\n")
+	}
+	e, _ := (&IDConfig{Policy: IDExplicit, Explicit: ring.Pow2(7)}).DeriveID(hostname, port)
+	if e != ring.Pow2(7) {
+		t.Errorf("IDExplicit derived wrong id = %v\n", e)
+	}
+	_, err = (&IDConfig{Policy: IDPolicy(42)}).DeriveID(hostname, port)
+	if _, ok := err.(*NapiPolicyError); !ok {
+		t.Errorf("Unknown policy should give NapiPolicyError\n")
+	}
+}
+
+// test that a joiner taking the id of its successor is rejected
+func TestJoinCollision(t *testing.T) {
+	hostname := "localhost"
+	port := "8081"
+	ln, err := LocalInit(hostname, port, nil, nil)
+	if err != nil {
+		t.Errorf("Could not init local node in TestJoinCollision\n")
+		return
+	}
+	napi := &NAPI{ln: ln}
+	request := JoinRequest{Key: ln.end, Conn: &HostData{Hostname: hostname, Port: "8082"}, Config: ring.CurConfig()}
+	var reply JoinReply
+	err = napi.RegisterJoinSucc(&request, &reply)
+	if _, ok := err.(*NapiCollisionError); !ok {
+		t.Errorf("Join with id of existing node should give NapiCollisionError\n")
+	}
+	request.Key = ln.end.Add(ring.FromInt(1))
+	request.Config = ring.Config{Hash: ring.SHA256, Bits: 8}
+	err = napi.RegisterJoinSucc(&request, &reply)
+	if _, ok := err.(*NapiConfigError); !ok {
+		t.Errorf("Join with different ring config should give NapiConfigError\n")
+	}
+}
+
+// requests go through the same NAPI methods as rpc, with errors mapped to status codes
+func TestHttpGateway(t *testing.T) {
+	ln, err := LocalInit("localhost", "8082", nil, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestHttpGateway\n")
+	}
+	srv := httptest.NewServer(HttpHandler(ln))
+	defer srv.Close()
+	do := func(method string, path string, content_type string, body string, accept string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if content_type != "" {
+			req.Header.Set("Content-Type", content_type)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP error on %s %s. err = %s\n", method, path, err.Error())
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	if status, _ := do("GET", "/kv/missing", "", "", ""); status != http.StatusNotFound {
+		t.Errorf("GET of missing key should give 404 not %d\n", status)
+	}
+	if status, _ := do("PUT", "/kv/a/b", "application/json", `{"value": "v1"}`, ""); status != http.StatusNoContent {
+		t.Errorf("PUT should give 204 not %d\n", status)
+	}
+	var kv kvJSON
+	status, body := do("GET", "/kv/a/b", "", "", "")
+	if json.Unmarshal([]byte(body), &kv); status != http.StatusOK || kv.Key != "a/b" || kv.Value != "v1" {
+		t.Errorf("GET returned %d %s\n", status, body)
+	}
+	binary := "\x00\xff\xfe raw"
+	do("PUT", "/kv/bin", "application/octet-stream", binary, "")
+	if status, body = do("DELETE", "/kv/bin", "", "", "application/octet-stream"); status != http.StatusOK || body != binary {
+		t.Errorf("DELETE should return the raw value. Got %d %q\n", status, body)
+	}
+	var find findJSON
+	status, body = do("GET", "/find/a/b", "", "", "")
+	if json.Unmarshal([]byte(body), &find); status != http.StatusOK || find.Owner.Port != "8082" {
+		t.Errorf("GET /find returned %d %s\n", status, body)
+	}
+	var members []RingMember
+	status, body = do("GET", "/ring", "", "", "")
+	if json.Unmarshal([]byte(body), &members); status != http.StatusOK || len(members) != 1 {
+		t.Errorf("GET /ring returned %d %s\n", status, body)
+	}
+	var ni NodeInfo
+	status, body = do("GET", "/node", "", "", "")
+	if json.Unmarshal([]byte(body), &ni); status != http.StatusOK || ni.Keys != 1 {
+		t.Errorf("GET /node returned %d %s\n", status, body)
+	}
+	if writeErrorStatus(NewNapiBusyError()) != http.StatusServiceUnavailable {
+		t.Errorf("NapiBusyError should map to 503\n")
+	}
+}
+
+// status written by writeError for err
+func writeErrorStatus(err error) int {
+	rec := httptest.NewRecorder()
+	writeError(rec, err)
+	return rec.Code
+}
+
+// protoMarshal followed by protoUnmarshal must give back the value, including wrapped non struct values
+func TestProtoCodec(t *testing.T) {
+	info := NodeInfo{
+		Host:    HostData{Hostname: "a", Port: "1"},
+		ID:      ring.FromInt(300),
+		Pred:    &HostData{Hostname: "b", Port: "2"},
+		PredEnd: ring.MaxVal(),
+		Config:  ring.Config{Hash: ring.SHA256, Bits: 200},
+		State:   "busy",
+		Keys:    -3,
+		Bytes:   1 << 40}
+	notice := LeaveNotice{Key: ring.FromInt(7), Items: []TransferItem{{Key: "k", Value: "\x00\xffv", Version: 1 << 63}, {Key: "empty"}},
+		Tombs: []TransferItem{{Key: "gone", Deleted: true, Version: 3}}}
+	items := map[string]string{"k": "\x00\xffv", "empty": ""}
+	members := []RingMember{{ID: ring.FromInt(1)}, {ID: ring.FromInt(2), Host: HostData{Port: "3"}}}
+	key := ring.FromInt(42)
+	merkle := MerkleRequest{Owner: key, Level: 3, Indices: []uint32{0, 5, 1 << 20}}
+	hashes := []uint64{0, 1 << 63}
+	for _, v := range []interface{}{&info, &notice, &items, &members, &key, &HTArgs{Key: "k", Absent: true}, &merkle, &hashes} {
+		data, err := protoMarshal(v)
+		if err != nil {
+			t.Fatalf("Could not encode %T. err = %s\n", v, err.Error())
+		}
+		got := reflect.New(reflect.TypeOf(v).Elem())
+		if err = protoUnmarshal(data, got.Interface()); err != nil {
+			t.Fatalf("Could not decode %T. err = %s\n", v, err.Error())
+		}
+		if !reflect.DeepEqual(got.Interface(), v) {
+			t.Errorf("Decoded %+v is not %+v\n", got.Elem(), reflect.ValueOf(v).Elem())
+		}
+	}
+	// unknown fields are skipped and short ids are right aligned
+	data := appendBytes(appendBytes(nil, 1, []byte{1, 2}), 99, []byte("new field"))
+	var got RingMember
+	if err := protoUnmarshal(data, &got); err != nil || got.ID != ring.FromInt(0x0102) {
+		t.Errorf("Decoded %v, err = %v\n", got, err)
+	}
+	// packed repeated scalars, as sent by protoc generated code
+	var packed MerkleRequest
+	if err := protoUnmarshal(appendBytes(nil, 3, []byte{1, 0x80, 0x01}), &packed); err != nil || !reflect.DeepEqual(packed.Indices, []uint32{1, 128}) {
+		t.Errorf("Decoded packed %v, err = %v\n", packed.Indices, err)
+	}
+}
+
+// gRPC calls reach the NAPI methods and errors come back with the message of the error type
+func TestGrpc(t *testing.T) {
+	l, port := listenLocal(t)
+	defer l.Close()
+	ln, err := LocalInit("localhost", port, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestGrpc\n")
+	}
+	go napiServer(&NAPI{ln: ln}).Serve(l)
+	SetProtocol(ProtoGRPC)
+	defer SetProtocol(ProtoNetRPC)
+	testHashTableSimple("localhost", port, t)
+	testFind("localhost", port, t)
+	testRingSnapshot("localhost", port, t)
+	var reply HTReply
+	err = ConnectAndCall("localhost", port, "NAPI.Get", &HTArgs{Key: "missing"}, &reply)
+	if serr, ok := err.(rpc.ServerError); !ok || string(serr) != "ChordMap does not contain key" {
+		t.Errorf("Get of missing key should give the CMKeyError message. Got %v\n", err)
+	}
+	if err = ConnectAndCall("localhost", port, "NAPI.serveGRPC", &HTArgs{}, &reply); err == nil {
+		t.Errorf("Unexported methods should not be callable\n")
+	}
+}
+
+// a node joins and leaves a ring over net/rpc and over gRPC, every message of the join going through the codec of the protocol
+func TestJoinTransports(t *testing.T) {
+	defer SetProtocol(ProtoNetRPC)
+	for _, p := range []Protocol{ProtoNetRPC, ProtoGRPC} {
+		SetProtocol(p)
+		l1, port1 := listenLocal(t)
+		a, err := LocalInit("localhost", port1, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(100)}, nil)
+		if err != nil {
+			t.Fatalf("Could not init local node in TestJoinTransports\n")
+		}
+		NapiServe(a, l1)
+		var reply HTReply
+		for i := 0; i < 50; i++ {
+			if err = ConnectAndCall("localhost", port1, "NAPI.Put", &HTArgs{Key: fmt.Sprint("key", i), Value: "v"}, &reply); err != nil {
+				t.Fatalf("Put over %s failed. err = %s\n", p, err.Error())
+			}
+		}
+		l2, port2 := listenLocal(t)
+		b, err := Join("localhost", port2, &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2()}, &HostData{Hostname: "localhost", Port: port1})
+		if err != nil {
+			t.Fatalf("Join over %s failed. err = %s\n", p, err.Error())
+		}
+		NapiServe(b, l2)
+		if b.cm.Len() == 0 || a.cm.Len()+b.cm.Len() != 50 {
+			t.Errorf("Keys were not split by the join over %s: %d and %d\n", p, a.cm.Len(), b.cm.Len())
+		}
+		for i := 0; i < 50; i++ {
+			if err = ConnectAndCall("localhost", port2, "NAPI.Get", &HTArgs{Key: fmt.Sprint("key", i)}, &reply); err != nil {
+				t.Errorf("Get over %s after the join failed. err = %s\n", p, err.Error())
+			}
+		}
+		// between two nodes, so the successor notifies the predecessor
+		l3, port3 := listenLocal(t)
+		c, err := Join("localhost", port3, &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2().Div2()}, &HostData{Hostname: "localhost", Port: port1})
+		if err != nil {
+			t.Fatalf("Join between two nodes over %s failed. err = %s\n", p, err.Error())
+		}
+		NapiServe(c, l3)
+		if _, port, _ := a.ft.Find(c.end); port != port3 || a.GetState() != Free {
+			t.Errorf("Predecessor was not notified of the join over %s\n", p)
+		}
+		if err = Leave(c); err != nil {
+			t.Errorf("Leave over %s failed. err = %s\n", p, err.Error())
+		}
+		if err = Leave(b); err != nil || a.cm.Len() != 50 {
+			t.Errorf("Leave over %s gave %d keys back, err = %v\n", p, a.cm.Len(), err)
+		}
+		l3.Close()
+		l2.Close()
+		l1.Close()
+	}
+}
+
+// every NAPI method is an rpc of napi.proto and the other way around, so gRPC clients see the whole service
+func TestProtoService(t *testing.T) {
+	data, err := os.ReadFile("napi.proto")
+	if err != nil {
+		t.Fatalf("Could not read napi.proto. err = %s\n", err.Error())
+	}
+	rpcs := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`(?m)^\s*rpc (\w+)\(`).FindAllStringSubmatch(string(data), -1) {
+		rpcs[m[1]] = true
+	}
+	napi_type := reflect.TypeOf(&NAPI{})
+	for i := 0; i < napi_type.NumMethod(); i++ {
+		name := napi_type.Method(i).Name
+		if _, ok := napiMethod(name); ok && !rpcs[name] {
+			t.Errorf("NAPI.%s has no rpc in napi.proto\n", name)
+		}
+		delete(rpcs, name)
+	}
+	for name := range rpcs {
+		t.Errorf("rpc %s of napi.proto is not a NAPI method\n", name)
+	}
+}
+
+// nodes on a ChanTransport call each other inside the test binary
+func TestChanTransport(t *testing.T) {
+	tr := NewChanTransport()
+	ctx := context.Background()
+	first := HostData{Hostname: "node", Port: "1"}
+	ln, err := LocalInitWith(tr, first.Hostname, first.Port, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(100)}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestChanTransport\n")
+	}
+	closer, err := ln.Serve("")
+	if err != nil {
+		t.Fatalf("Could not serve node. err = %s\n", err.Error())
+	}
+	if _, err = ln.Serve(""); err == nil {
+		t.Errorf("Serving two nodes at the same address should fail\n")
+	}
+	var reply HTReply
+	if err = tr.Call(ctx, first, "NAPI.Put", &HTArgs{Key: "key", Value: "value"}, &reply); err != nil {
+		t.Errorf("Put failed. err = %s\n", err.Error())
+	}
+	if err = tr.Call(ctx, first, "NAPI.Get", &HTArgs{Key: "key"}, &reply); err != nil || reply.Value != "value" {
+		t.Errorf("Get returned %s, err = %v\n", reply.Value, err)
+	}
+	err = tr.Call(ctx, first, "NAPI.Get", &HTArgs{Key: "missing"}, &reply)
+	if serr, ok := err.(rpc.ServerError); !ok || string(serr) != "ChordMap does not contain key" {
+		t.Errorf("Get of missing key should give the CMKeyError message. Got %v\n", err)
+	}
+	// the second node asks the first for its id through the transport
+	ln2, err := LocalInitWith(tr, "node", "2", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(200)}, &first)
+	if err != nil || ln2.pred_end != ring.FromInt(100) {
+		t.Errorf("Second node should learn the id of its predecessor. err = %v\n", err)
+	}
+	closer.Close()
+	if err = tr.Call(ctx, first, "NAPI.Get", &HTArgs{Key: "key"}, &reply); err == nil || err.Error() != NewNapiConnError().Error() {
+		t.Errorf("Calls to a closed node should give NapiConnError. Got %v\n", err)
+	}
+}
+
+// fails every other call
+type flakyTransport struct {
+	Transport
+	calls int
+}
+
+func (f *flakyTransport) Call(ctx context.Context, peer HostData, method string, args interface{}, reply interface{}) error {
+	if f.calls++; f.calls%2 == 0 {
+		return NewNapiConnError()
+	}
+	return f.Transport.Call(ctx, peer, method, args, reply)
+}
+
+// the joiner gets every key of its range, including writes made during the transfer, even if chunks are lost
+func TestTransferRange(t *testing.T) {
+	tr := NewChanTransport()
+	succ_addr := HostData{Hostname: "node", Port: "1"}
+	succ, err := LocalInitWith(tr, succ_addr.Hostname, succ_addr.Port, &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2()}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestTransferRange\n")
+	}
+	closer, _ := succ.Serve("")
+	defer closer.Close()
+	napi := &NAPI{ln: succ}
+	var reply HTReply
+	for i := 0; i < 3000; i++ {
+		napi.Put(&HTArgs{Key: fmt.Sprint("key", i), Value: "v"}, &reply)
+	}
+	joiner_id := ring.MaxVal().Div2().Div2() // takes over about a quarter of the keys
+	request := JoinRequest{Key: joiner_id, Conn: &HostData{Hostname: "node", Port: "2"}, Config: ring.CurConfig()}
+	var jreply JoinReply
+	if err = napi.RegisterJoinSucc(&request, &jreply); err != nil {
+		t.Fatalf("RegisterJoinSucc failed. err = %s\n", err.Error())
+	}
+	in_range := func(key string) bool {
+		return CM.StrToSha(key).Between(succ.end.Add(ring.FromInt(1)), joiner_id.Add(ring.FromInt(1)), ring.ClosedOpen)
+	}
+	var chunk TransferChunk
+	if err = napi.TransferRange(&TransferRequest{Key: joiner_id, MaxItems: 100}, &chunk); err != nil {
+		t.Fatalf("TransferRange failed. err = %s\n", err.Error())
+	}
+	if len(chunk.Items) != 100 || chunk.Done || chunk.Checksum != itemsChecksum(chunk.Items) {
+		t.Errorf("Expected a checksummed chunk of 100 items, got %d items. done = %v\n", len(chunk.Items), chunk.Done)
+	}
+	// writes to the range while the transfer runs
+	updated, deleted := chunk.Items[0].Key, chunk.Items[1].Key
+	added := ""
+	for i := 0; added == ""; i++ {
+		if key := fmt.Sprint("new", i); in_range(key) {
+			added = key
+		}
+	}
+	napi.Put(&HTArgs{Key: updated, Value: "updated"}, &reply)
+	napi.Delete(&HTArgs{Key: deleted}, &reply)
+	napi.Put(&HTArgs{Key: added, Value: "added"}, &reply)
+	expected := make(map[string]string)
+	for k, v := range succ.Items() {
+		if in_range(k) {
+			expected[k] = v
+		}
+	}
+
+	jln, err := localInit(tr, "node", "2", joiner_id, &succ_addr)
+	if err != nil {
+		t.Fatalf("Could not init joiner. err = %s\n", err.Error())
+	}
+	flaky := &flakyTransport{Transport: tr}
+	if err = pullRange(flaky, jln, jreply.Succ); err != nil {
+		t.Fatalf("pullRange failed. err = %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(jln.Items(), expected) {
+		t.Errorf("Joiner holds %d keys, expected %d\n", len(jln.Items()), len(expected))
+	}
+	// prepared: the successor still serves the range and replays later writes on commit
+	if err = napi.Get(&HTArgs{Key: added}, &reply); err != nil || reply.Value != "added" {
+		t.Errorf("Get of a prepared join should be served by the successor. Got %v\n", err)
+	}
+	napi.Put(&HTArgs{Key: added, Value: "late"}, &reply)
+	napi.Delete(&HTArgs{Key: updated}, &reply)
+	expected[added] = "late"
+	delete(expected, updated)
+	// a joiner missing writes is sent them instead of the range
+	var stale TransferChunk
+	stale_request := request
+	if err = napi.JoinedSucc(&stale_request, &stale); err != nil || stale.Committed || len(stale.Items) == 0 || succ.GetState() != BusyJoin {
+		t.Errorf("JoinedSucc should not commit before the joiner caught up. err = %v\n", err)
+	}
+	if err = commitRange(flaky, jln, &request, jreply.Succ); err != nil {
+		t.Fatalf("commitRange failed. err = %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(jln.Items(), expected) {
+		t.Errorf("Joiner holds %d keys after the commit, expected %d\n", len(jln.Items()), len(expected))
+	}
+	for k := range succ.Items() {
+		if in_range(k) {
+			t.Errorf("Key %s of the joiner's range is still stored by the successor\n", k)
+			break
+		}
+	}
+	if tombs := jln.cm.Tombstones(); len(tombs) != 2 || tombs[deleted].Version == 0 || len(succ.cm.Tombstones()) != 0 {
+		t.Errorf("Tombstones of the range should move to the joiner. Got %v\n", tombs)
+	}
+	if err = napi.Get(&HTArgs{Key: added, Direct: true}, &reply); err == nil || err.Error() != NewNapiRangeError().Error() {
+		t.Errorf("Successor should not own the joiner's keys after the join. Got %v\n", err)
+	}
+	var again TransferChunk
+	if err = napi.JoinedSucc(&request, &again); err != nil || !again.Committed || again.RangeSum != rangeChecksum(expected) {
+		t.Errorf("Repeated JoinedSucc should give the same reply. err = %v\n", err)
+	}
+	if succ.GetState() != Free {
+		t.Errorf("Successor should be free after the join, is %s\n", succ.GetState())
+	}
+
+	if itemsChecksum([]TransferItem{{Key: "ab", Value: "c"}}) == itemsChecksum([]TransferItem{{Key: "a", Value: "bc"}}) {
+		t.Errorf("Checksum should depend on where keys end\n")
+	}
+}
+
+// a join that stalls is aborted and the successor keeps its range and takes new joins
+func TestJoinTimeout(t *testing.T) {
+	defer SetJoinTimeout(join_timeout)
+	SetJoinTimeout(50 * time.Millisecond)
+	tr := NewChanTransport()
+	succ, err := LocalInitWith(tr, "node", "1", &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2()}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestJoinTimeout\n")
+	}
+	napi := &NAPI{ln: succ}
+	var reply HTReply
+	napi.Put(&HTArgs{Key: "key", Value: "v"}, &reply)
+	request := JoinRequest{Key: ring.MaxVal().Div2().Div2(), Conn: &HostData{Hostname: "node", Port: "2"}, Config: ring.CurConfig()}
+	var jreply JoinReply
+	if err = napi.RegisterJoinSucc(&request, &jreply); err != nil {
+		t.Fatalf("RegisterJoinSucc failed. err = %s\n", err.Error())
+	}
+	if err = napi.RegisterJoinSucc(&request, &jreply); err == nil {
+		t.Errorf("Second join should be rejected while the first one runs\n")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if succ.GetState() != Free {
+		t.Errorf("Stalled join should be aborted. State is %s\n", succ.GetState())
+	}
+	var chunk TransferChunk
+	if err = napi.TransferRange(&TransferRequest{Key: request.Key}, &chunk); err == nil || err.Error() != NewNapiCallerError().Error() {
+		t.Errorf("TransferRange of an aborted join should give NapiCallerError. Got %v\n", err)
+	}
+	if err = napi.Get(&HTArgs{Key: "key", Direct: true}, &reply); err != nil || reply.Value != "v" {
+		t.Errorf("Successor should keep its keys after an abort. err = %v\n", err)
+	}
+
+	// the joiner gives up
+	SetJoinTimeout(time.Minute)
+	if err = napi.RegisterJoinSucc(&request, &jreply); err != nil {
+		t.Fatalf("RegisterJoinSucc after an abort failed. err = %s\n", err.Error())
+	}
+	if err = napi.TransferRange(&TransferRequest{Key: request.Key, Final: true}, &chunk); err != nil {
+		t.Fatalf("TransferRange failed. err = %s\n", err.Error())
+	}
+	ok := false
+	if err = napi.AbortJoin(&request, &ok); err != nil || succ.GetState() != Free {
+		t.Errorf("AbortJoin of a prepared join failed. err = %v\n", err)
+	}
+	if err = napi.JoinedSucc(&request, &chunk); err == nil {
+		t.Errorf("JoinedSucc of an aborted join should fail\n")
+	}
+	if len(succ.Items()) != 1 {
+		t.Errorf("Successor should keep its keys after an abort\n")
+	}
+
+	// a notice arriving after the lease of the predecessor expired leaves the lease of a later join alone
+	SetJoinTimeout(25 * time.Millisecond)
+	self := HostData{Hostname: "node", Port: "1"} // succ of a single node ring is itself
+	first := JoinNotice{Event: jeventJoining, Caller: self, Joiner: HostData{Hostname: "node", Port: "2"}, Key: ring.FromInt(2)}
+	if err = napi.NotifyPred(&first, &ok); err != nil || succ.GetState() != Busy {
+		t.Fatalf("NotifyPred of a join should make the predecessor Busy. err = %v\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	SetJoinTimeout(time.Minute)
+	second := JoinNotice{Event: jeventJoining, Caller: self, Joiner: HostData{Hostname: "node", Port: "3"}, Key: ring.FromInt(3)}
+	if err = napi.NotifyPred(&second, &ok); err != nil {
+		t.Fatalf("Predecessor should take a join once the lease of the last one expired. err = %v\n", err)
+	}
+	first.Event = jeventAborted
+	if err = napi.NotifyPred(&first, &ok); err != nil || succ.GetState() != Busy {
+		t.Errorf("A late notice should not free the lease of another join. State is %s\n", succ.GetState())
+	}
+	second.Event = jeventAborted
+	if err = napi.NotifyPred(&second, &ok); err != nil || succ.GetState() != Free {
+		t.Errorf("The notice of the join holding the lease should free it. State is %s\n", succ.GetState())
+	}
+}
+
+// two copies of the same range converge by exchanging only the entries of differing buckets, keeping the newer ones
+func TestAntiEntropy(t *testing.T) {
+	tr := NewChanTransport()
+	idcfg := &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2()}
+	a, _ := LocalInitWith(tr, "node", "1", idcfg, nil) // same id, so both keep the whole ring
+	b, _ := LocalInitWith(tr, "node", "2", idcfg, nil)
+	closer, _ := b.Serve("")
+	defer closer.Close()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprint("key", i)
+		switch {
+		case i < 5: // only on a
+			a.cm.Put(key, "v")
+		case i < 8: // only on b
+			b.cm.Put(key, "v")
+		case i < 10: // different values, the later one on b
+			a.cm.Put(key, "a")
+			b.cm.Put(key, "b")
+		case i < 12: // different values, the later one on a
+			b.cm.Put(key, "b")
+			a.cm.Put(key, "a")
+		default: // the same write on both
+			a.cm.Restore(key, "v", 1)
+			b.cm.Restore(key, "v", 1)
+		}
+	}
+	peer := HostData{Hostname: "node", Port: "2"}
+	stats, err := a.AntiEntropy([]HostData{peer})
+	if err != nil {
+		t.Fatalf("AntiEntropy failed. err = %s\n", err.Error())
+	}
+	if stats.Pulled != 5 || stats.Pushed != 7 || stats.Conflicts != 4 || stats.Buckets > 14 {
+		t.Errorf("Wrong sync stats %+v\n", stats)
+	}
+	if len(a.Items()) != 2000 || !reflect.DeepEqual(a.cm.Entries(), b.cm.Entries()) {
+		t.Errorf("Copies should hold the same entries after a sync. Got %d and %d keys\n", len(a.Items()), len(b.Items()))
+	}
+	if val, _ := a.cm.Get("key8"); val != "b" {
+		t.Errorf("The newer value should win. Got %q\n", val)
+	}
+	if val, _ := b.cm.Get("key10"); val != "a" {
+		t.Errorf("The newer value should win. Got %q\n", val)
+	}
+	if stats, err = a.SyncRange(peer); err != nil || stats != (SyncStats{}) {
+		t.Errorf("Equal copies should have nothing to sync. Got %+v, err = %v\n", stats, err)
+	}
+	var hashes []uint64
+	request := MerkleRequest{Owner: ring.FromInt(1), Indices: []uint32{0}}
+	if err = tr.Call(context.Background(), peer, "NAPI.MerkleHashes", &request, &hashes); err == nil || err.Error() != NewNapiRangeError().Error() {
+		t.Errorf("MerkleHashes of a range the node does not keep should give NapiRangeError. Got %v\n", err)
+	}
+	if succs, err := a.Successors(2); err != nil || len(succs) != 0 {
+		t.Errorf("Single node ring has no successors. Got %v\n", succs)
+	}
+}
+
+/*
+Starts a ring of nodes with the given ids on tr, node i + 1 at port i + 1, joined through the first. Returns the nodes and the
+closers serving them
+*/
+func testRing(tr *ChanTransport, t *testing.T, ids ...uint32) ([]*LocNodeStruct, []io.Closer) {
+	first := HostData{Hostname: "node", Port: "1"}
+	var nodes []*LocNodeStruct
+	var closers []io.Closer
+	for i, id := range ids {
+		idcfg := &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(id)}
+		var n *LocNodeStruct
+		var err error
+		if i == 0 {
+			n, err = LocalInitWith(tr, first.Hostname, first.Port, idcfg, nil)
+		} else {
+			n, err = JoinWith(tr, "node", fmt.Sprint(i+1), idcfg, &first)
+		}
+		if err != nil {
+			t.Fatalf("Could not start node %d. err = %v\n", id, err)
+		}
+		closer, _ := n.Serve("")
+		nodes = append(nodes, n)
+		closers = append(closers, closer)
+	}
+	nodes[0].RefreshFingers()
+	return nodes, closers
+}
+
+// returns n keys stored by ln
+func testKeys(ln *LocNodeStruct, n int) []string {
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		if key := fmt.Sprint("key", i); ln.StoresKey(CM.StrToSha(key)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// writes to the owner are copied to its replicas and acked by a quorum of the copies
+func TestReplication(t *testing.T) {
+	SetReplication(3)
+	defer SetReplication(1)
+	nodes, closers := testRing(NewChanTransport(), t, 100, 200, 300)
+	for _, closer := range closers {
+		defer closer.Close()
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	napi := &NAPI{ln: a}
+	keys := testKeys(a, 3)
+	var reply HTReply
+	for _, key := range keys {
+		if err := napi.Put(&HTArgs{Key: key, Value: "v"}, &reply); err != nil {
+			t.Fatalf("Put failed. err = %v\n", err)
+		}
+	}
+	napi.Delete(&HTArgs{Key: keys[1]}, &reply)
+	if err := napi.CAS(&HTArgs{Key: keys[2], Old: "v", Value: "w"}, &reply); err != nil {
+		t.Fatalf("CAS failed. err = %v\n", err)
+	}
+	synced := func(n *LocNodeStruct) bool {
+		copy := n.replicas.lookup(a.end)
+		return copy != nil && reflect.DeepEqual(copy.Entries(), a.cm.Entries())
+	}
+	// the reply waits for one replica only
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if synced(b) && synced(c) {
+			break
+		}
+	}
+	want := map[string]string{keys[0]: "v", keys[2]: "w"}
+	for _, n := range []*LocNodeStruct{b, c} {
+		if items := n.ReplicaItems(a.end); !synced(n) || !reflect.DeepEqual(items, want) {
+			t.Errorf("Copy of %s should hold the writes of a. Got %v\n", n.port, items)
+		}
+		if n.cm.Len() != 0 {
+			t.Errorf("Copies should be kept apart from the keys of %s\n", n.port)
+		}
+	}
+	if stats, err := a.AntiEntropy([]HostData{{"node", "2"}, {"node", "3"}}); err != nil || stats != (SyncStats{}) {
+		t.Errorf("Replicated writes should leave nothing to sync. Got %+v, err = %v\n", stats, err)
+	}
+	closers[1].Close()
+	err := napi.Put(&HTArgs{Key: keys[0], Value: "lost"}, &reply)
+	if err == nil || err.Error() != NewNapiQuorumError().Error() {
+		t.Errorf("Put reaching 1 of 3 copies should give NapiQuorumError. Got %v\n", err)
+	}
+	if val, _ := a.cm.Get(keys[0]); val != "lost" {
+		t.Errorf("Write without a quorum is not undone. Got %q\n", val)
+	}
+	single, _ := LocalInitWith(NewChanTransport(), "node", "1", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(1)}, nil)
+	if err := (&NAPI{ln: single}).Put(&HTArgs{Key: "k", Value: "v"}, &reply); err != nil {
+		t.Errorf("Put on a single node ring is a quorum of its own. err = %v\n", err)
+	}
+}
+
+// replicas with their own ids keep copies of the range of the owner apart from their own keys, and follow it as it changes
+func TestReplicaSync(t *testing.T) {
+	SetReplication(3)
+	defer SetReplication(1)
+	tr := NewChanTransport()
+	first := HostData{Hostname: "node", Port: "1"}
+	nodes, closers := testRing(tr, t, 100, 200, 300)
+	for _, closer := range closers {
+		defer closer.Close()
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	// keys of a, one of which c holds an older value of and one c missed the delete of
+	keys := testKeys(a, 50)
+	for _, key := range keys {
+		a.cm.Put(key, "v")
+	}
+	stale := c.replicas.get(a.end, a.rangeStart(), time.Now())
+	stale.Restore(keys[0], "old", 1)
+	stale.Restore(keys[1], "v", 1)
+	a.cm.Delete(keys[1])
+	replicas, err := a.Successors(2)
+	if err != nil || !reflect.DeepEqual(replicas, []HostData{{"node", "2"}, {"node", "3"}}) {
+		t.Fatalf("Replicas of a should be b and c. Got %v, err = %v\n", replicas, err)
+	}
+	stats, err := a.AntiEntropy(replicas)
+	if err != nil || stats.Pulled != 0 || stats.Pushed != 2*50 || stats.Conflicts != 2 {
+		t.Errorf("Wrong sync stats %+v, err = %v\n", stats, err)
+	}
+	for _, n := range []*LocNodeStruct{b, c} {
+		if copy := n.replicas.lookup(a.end); copy == nil || !reflect.DeepEqual(copy.Entries(), a.cm.Entries()) ||
+			copy.Tree().Hash(0, 0) != a.cm.Tree().Hash(0, 0) {
+			t.Errorf("Copy of %s should hold the entries of a\n", n.port)
+		}
+		if n.cm.Len() != 0 {
+			t.Errorf("Copies should be kept apart from the keys of %s\n", n.port)
+		}
+	}
+	if copies := b.Inspect().Replicas; len(copies) != 1 || copies[0].Owner != a.end || copies[0].Store.Keys != len(keys)-1 {
+		t.Errorf("Snapshot of b should show its copy of a. Got %+v\n", copies)
+	}
+	if stats, err = a.AntiEntropy(replicas); err != nil || stats != (SyncStats{}) {
+		t.Errorf("Equal copies should have nothing to sync. Got %+v, err = %v\n", stats, err)
+	}
+	// a write only a holds is synced by the background tasks of a
+	late := ""
+	for i := 0; late == ""; i++ {
+		if key := fmt.Sprint("late", i); a.StoresKey(CM.StrToSha(key)) {
+			late = key
+		}
+	}
+	a.cm.Put(late, "v")
+	if err = a.Start(Background{AntiEntropy: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Could not start the background tasks. err = %v\n", err)
+	}
+	if err = a.Start(Background{}); err == nil || err.Error() != NewNapiCallerError().Error() {
+		t.Errorf("Starting the background tasks twice should give NapiCallerError. Got %v\n", err)
+	}
+	for i := 0; i < 200 && (b.ReplicaItems(a.end)[late] != "v" || c.ReplicaItems(a.end)[late] != "v"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Stop()
+	a.Stop()
+	if b.ReplicaItems(a.end)[late] != "v" || c.ReplicaItems(a.end)[late] != "v" {
+		t.Errorf("Anti-entropy of the background tasks should sync the copies of a\n")
+	}
+	// a node joining before a takes part of its range, which the copies drop
+	if _, err = JoinWith(tr, "node", "4", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(50)}, &first); err != nil {
+		t.Fatalf("Could not join. err = %v\n", err)
+	}
+	if _, err = a.AntiEntropy(replicas); err != nil || !reflect.DeepEqual(b.ReplicaItems(a.end), a.Items()) ||
+		len(a.Items()) == len(keys)-1 {
+		t.Errorf("Copies should follow the range of a. Got %d keys for %d, err = %v\n", len(b.ReplicaItems(a.end)), len(a.Items()), err)
+	}
+	var hashes []uint64
+	request := MerkleRequest{Owner: ring.FromInt(150), Indices: []uint32{0}}
+	if err = tr.Call(context.Background(), replicas[0], "NAPI.MerkleHashes", &request, &hashes); err == nil || err.Error() != NewNapiRangeError().Error() {
+		t.Errorf("No copy is kept for a node in the range of b. Got %v\n", err)
+	}
+	time.Sleep(time.Millisecond)
+	if b.ExpireReplicas(time.Nanosecond) != 1 || len(b.ReplicaItems(a.end)) != 0 {
+		t.Errorf("Copies not synced for max_age should be dropped\n")
+	}
+}
+
+func TestHints(t *testing.T) {
+	hs := NewHintStore(2, 20, time.Minute)
+	now := time.Now()
+	h := Hint{Item: TransferItem{Key: "a", Value: "1"}}
+	if hs.Add(h, now) != nil || hs.Add(h, now) != nil { // the second replaces the first
+		t.Fatalf("Hints within the limits should be stored\n")
+	}
+	h.Item.Key = "b"
+	hs.Add(h, now)
+	h.Item.Key = "c"
+	if err := hs.Add(h, now); err == nil || err.Error() != NewNapiHintError().Error() {
+		t.Errorf("Full hint store should refuse with NapiHintError. Got %v\n", err)
+	}
+	if hs.Expire(now) != 0 || hs.Expire(now.Add(2*time.Minute)) != 2 {
+		t.Errorf("Hints should expire after max age\n")
+	}
+	if stats := hs.Stats(); stats != (HintStats{Stored: 3, Refused: 1, Expired: 2}) {
+		t.Errorf("Wrong hint stats %+v\n", stats)
+	}
+
+	tr := NewChanTransport()
+	id := ring.MaxVal().Div2()
+	idcfg := &IDConfig{Policy: IDExplicit, Explicit: id}
+	a, _ := LocalInitWith(tr, "node", "1", idcfg, nil)
+	b, _ := LocalInitWith(tr, "node", "2", idcfg, nil) // same id, so b keeps the range of a
+	b.cm.Put("gone", "v")
+	target := HostData{Hostname: "node", Port: "2"}
+	napi := &NAPI{ln: a}
+	ok := false
+	for _, item := range []TransferItem{{Key: "new", Value: "v"}, {Key: "gone", Deleted: true}} {
+		if err := napi.StoreHint(&Hint{Target: target, TargetID: id, Owner: id, Item: item}, &ok); err != nil {
+			t.Fatalf("StoreHint failed. err = %s\n", err.Error())
+		}
+	}
+	napi.StoreHint(&Hint{Target: target, TargetID: ring.FromInt(1), Owner: id, Item: TransferItem{Key: "k", Value: "v"}}, &ok)
+	if n, _ := a.DeliverHints(); n != 0 || a.HintStats().Pending != 3 {
+		t.Errorf("Hints of a replica that is down should be kept. Delivered %d\n", n)
+	}
+	closer, _ := b.Serve("")
+	defer closer.Close()
+	if n, _ := a.DeliverHints(); n != 0 || a.HintStats().Suspected != 1 {
+		t.Errorf("Replica that did not answer should be backed off. Delivered %d\n", n)
+	}
+	if n, err := a.deliverHints(time.Now().Add(hintBackoff)); n != 2 || err != nil {
+		t.Errorf("Hints should be delivered once the replica is back. Delivered %d, err = %v\n", n, err)
+	}
+	if _, err := b.cm.Get("new"); err != nil {
+		t.Errorf("Hinted put should be applied\n")
+	}
+	if _, err := b.cm.Get("gone"); err == nil {
+		t.Errorf("Hinted delete should be applied\n")
+	}
+	if stats := a.HintStats(); stats.Pending != 0 || stats.Delivered != 2 || stats.Expired != 1 || stats.Bytes != 0 {
+		t.Errorf("Hints of a replica that changed id should be dropped. Got %+v\n", stats)
+	}
+	if stats := a.HintStats(); stats.Suspected != 0 {
+		t.Errorf("Replica that answered should be cleared. Got %+v\n", stats)
+	}
+}
+
+// Gets read a quorum of the copies replicas with their own ids keep, and repair the lagging ones, the owner's included
+func TestReadRepair(t *testing.T) {
+	SetReplication(3)
+	defer SetReplication(1)
+	nodes, closers := testRing(NewChanTransport(), t, 100, 200, 300)
+	for _, closer := range closers {
+		defer closer.Close()
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	napi := &NAPI{ln: a}
+	keys := testKeys(a, 4)
+	now := time.Now()
+	copy_b, copy_c := b.replicas.get(a.end, a.rangeStart(), now), c.replicas.get(a.end, a.rangeStart(), now)
+	copy_b.Restore(keys[0], "old", 1) // older on b, missing on c
+	a.cm.Put(keys[0], "new")
+	copy_b.Restore(keys[1], "v", 1) // delete missed by b
+	a.cm.Restore(keys[1], "v", 1)
+	a.cm.Delete(keys[1])
+	wait := func(repaired int64) {
+		for deadline := time.Now().Add(5 * time.Second); a.ReadRepairStats().Repaired < repaired && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var reply HTReply
+	if err := napi.Get(&HTArgs{Key: keys[0]}, &reply); err != nil || reply.Value != "new" {
+		t.Fatalf("Get should return the newest value. Got %q, err = %v\n", reply.Value, err)
+	}
+	if err := napi.Get(&HTArgs{Key: keys[1]}, &reply); err == nil || err.Error() != CM.NewCMKeyError().Error() {
+		t.Errorf("Get of a key the owner deleted should give CMKeyError. Got %v\n", err)
+	}
+	wait(3)
+	if val, _ := copy_b.Get(keys[0]); val != "new" {
+		t.Errorf("Lagging copy should be repaired. Got %q\n", val)
+	}
+	if val, _ := copy_c.Get(keys[0]); val != "new" {
+		t.Errorf("Missing copy should be repaired. Got %q\n", val)
+	}
+	if _, err := copy_b.Get(keys[1]); err == nil {
+		t.Errorf("Copy of a key the owner deleted should be deleted\n")
+	}
+	copy_b.Restore(keys[2], "old", 1)
+	a.cm.Put(keys[2], "new")
+	e, _ := a.cm.Lookup(keys[2])
+	CM.Apply(copy_c, keys[2], e)
+	napi.Get(&HTArgs{Key: keys[2], NoRepair: true}, &reply)
+	for deadline := time.Now().Add(5 * time.Second); a.ReadRepairStats().Skipped == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if val, _ := copy_b.Get(keys[2]); val != "old" {
+		t.Errorf("Get opting out should not repair. Got %q\n", val)
+	}
+	if stats := a.ReadRepairStats(); stats != (ReadRepairStats{Reads: 3, Lagging: 4, Repaired: 3, Skipped: 1}) {
+		t.Errorf("Wrong read repair stats %+v\n", stats)
+	}
+	if b.cm.Len() != 0 || c.cm.Len() != 0 {
+		t.Errorf("Copies should be kept apart from the keys of the replicas\n")
+	}
+	// a copy newer than the owner's, of a write the owner did not wait for, is read
+	copy_b.Restore(keys[3], "newer", 2)
+	copy_c.Restore(keys[3], "newer", 2)
+	a.cm.Restore(keys[3], "v", 1)
+	if err := napi.Get(&HTArgs{Key: keys[3]}, &reply); err != nil || reply.Value != "newer" {
+		t.Errorf("Get should return the newest copy. Got %q, err = %v\n", reply.Value, err)
+	}
+	wait(4)
+	if e, _ := a.cm.Lookup(keys[3]); e.Value != "newer" || e.Version != 2 {
+		t.Errorf("Copy of the owner older than a replica's should be repaired. Got %+v\n", e)
+	}
+	closers[2].Close()
+	if err := napi.Get(&HTArgs{Key: keys[0]}, &reply); err != nil {
+		t.Errorf("2 of 3 copies are a quorum. err = %v\n", err)
+	}
+	closers[1].Close()
+	if err := napi.Get(&HTArgs{Key: keys[0]}, &reply); err == nil || err.Error() != NewNapiQuorumError().Error() {
+		t.Errorf("1 of 3 copies is no quorum. Got %v\n", err)
+	}
+	single, _ := LocalInitWith(NewChanTransport(), "node", "1", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(1)}, nil)
+	(&NAPI{ln: single}).Put(&HTArgs{Key: "k", Value: "v"}, &reply)
+	if err := (&NAPI{ln: single}).Get(&HTArgs{Key: "k"}, &reply); err != nil || reply.Value != "v" {
+		t.Errorf("Get on a single node ring should read the local copy. Got %q, err = %v\n", reply.Value, err)
+	}
+}
+
+// deletes are not undone by anti-entropy until their tombstones are compacted
+func TestTombstones(t *testing.T) {
+	defer SetTombstoneGrace(tomb_grace)
+	tr := NewChanTransport()
+	idcfg := &IDConfig{Policy: IDExplicit, Explicit: ring.MaxVal().Div2()}
+	a, _ := LocalInitWith(tr, "node", "1", idcfg, nil)
+	b, _ := LocalInitWith(tr, "node", "2", idcfg, nil)
+	closer, _ := b.Serve("")
+	defer closer.Close()
+	peer := HostData{Hostname: "node", Port: "2"}
+	for i := 0; i < 10; i++ {
+		a.cm.Restore(fmt.Sprint("key", i), "v", 1)
+		b.cm.Restore(fmt.Sprint("key", i), "v", 1)
+	}
+	var reply HTReply
+	(&NAPI{ln: a}).Delete(&HTArgs{Key: "key1"}, &reply)
+	if err := (&NAPI{ln: a}).Get(&HTArgs{Key: "key1"}, &reply); err == nil || err.Error() != CM.NewCMKeyError().Error() {
+		t.Errorf("Get of a deleted key should give CMKeyError. Got %v\n", err)
+	}
+	if stats, _ := a.SyncRange(peer); stats.Pulled != 0 || stats.Pushed != 1 || len(a.Items()) != 9 || len(b.Items()) != 9 {
+		t.Errorf("Anti-entropy should copy the delete, not bring back the key. Got %+v\n", stats)
+	}
+	ok := false
+	stale := RepairRequest{Owner: b.end, Items: []TransferItem{{Key: "key1", Value: "v", Version: 42}}}
+	if err := (&NAPI{ln: b}).Repair(&stale, &ok); err != nil || len(b.Items()) != 9 {
+		t.Errorf("A value older than the delete should not undo it. err = %v\n", err)
+	}
+	b.cm.Put("key2", "new")
+	late := RepairRequest{Owner: b.end, Items: []TransferItem{{Key: "key2", Deleted: true, Version: 42}}}
+	if err := (&NAPI{ln: b}).Repair(&late, &ok); err != nil || len(b.Items()) != 9 || len(b.cm.Tombstones()) != 1 {
+		t.Errorf("A delete older than the value should not erase it. err = %v\n", err)
+	}
+	// a copy b keeps as a replica of the whole ring
+	b.replicas.get(ring.FromInt(0), ring.FromInt(1), time.Now()).Bury("key2", CM.NewTombstone())
+	if a.CompactTombstones() != 0 {
+		t.Errorf("Tombstones younger than the grace period should be kept\n")
+	}
+	SetTombstoneGrace(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if a.CompactTombstones() != 1 || b.CompactTombstones() != 2 {
+		t.Errorf("Tombstones older than the grace period should be dropped, from the copies too\n")
+	}
+}
+
+// calls over net/rpc are counted by method and outcome and served on /metrics of the rpc port
+func TestMetrics(t *testing.T) {
+	l, port := listenLocal(t)
+	defer NapiStop(l)
+	ln, err := LocalInit("localhost", port, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestMetrics\n")
+	}
+	NapiServe(ln, l)
+	testHashTableSimple("localhost", port, t)
+	var reply HTReply
+	ConnectAndCall("localhost", port, "NAPI.Get", &HTArgs{Key: "missing"}, &reply)
+	ConnectAndCall("localhost", port, "NAPI.Put", &HTArgs{Key: "kept", Value: "v"}, &reply)
+	resp, err := http.Get("http://" + net.JoinHostPort("localhost", port) + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not get /metrics. err = %s\n", err.Error())
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	for _, line := range []string{
+		`napi_rpcs_total{method="Put",outcome="ok"} 2`,
+		`napi_rpcs_total{method="Get",outcome="ok"} 1`,
+		`napi_rpcs_total{method="Get",outcome="CMKeyError"} 1`,
+		`napi_rpc_duration_seconds_count{method="Delete"} 1`,
+		"chordmap_keys 1",
+		"chordmap_tombstones 1",
+		"# TYPE fingertable_changes_total counter",
+		"napi_hints_refused_total 0",
+		"napi_hints_expired_total 0",
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("/metrics is missing %q\n", line)
+		}
+	}
+	if !strings.Contains(string(data), "napi_dials_total ") {
+		t.Errorf("/metrics is missing the connection counts\n")
+	}
+}
+
+// collects log lines, safe for concurrent use
+type logBuffer struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lines = append(b.lines, string(p))
+	return len(p), nil
+}
+
+// true if a line holds every part
+func (b *logBuffer) has(parts ...string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, line := range b.lines {
+		found := true
+		for _, part := range parts {
+			found = found && strings.Contains(line, part)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// the request id of a call is logged by every node the call is forwarded to, whatever the transport
+func TestRequestID(t *testing.T) {
+	logs := &logBuffer{}
+	SetLogger(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	tr := NewChanTransport()
+	ctx := context.Background()
+	first := HostData{Hostname: "node", Port: "1"}
+	a, err := LocalInitWith(tr, first.Hostname, first.Port, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(100)}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestRequestID\n")
+	}
+	closer, _ := a.Serve("")
+	defer closer.Close()
+	b, err := JoinWith(tr, "node", "2", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(200)}, &first)
+	if err != nil {
+		t.Fatalf("Could not join. err = %v\n", err)
+	}
+	closer, _ = b.Serve("")
+	defer closer.Close()
+	// b stores only (100, 200], so the key is forwarded to a
+	var reply HTReply
+	err = tr.Call(WithRequestID(ctx, "req-1"), HostData{Hostname: "node", Port: "2"}, "NAPI.Put", &HTArgs{Key: "k", Value: "v"}, &reply)
+	if err != nil {
+		t.Fatalf("Put failed. err = %s\n", err.Error())
+	}
+	a_node, b_node := `"node":"`+a.end.String()+`"`, `"node":"`+b.end.String()+`"`
+	if !logs.has(`"msg":"forwarding"`, `"request":"req-1"`, b_node) {
+		t.Errorf("The entry node should log the forward with the request id\n")
+	}
+	if !logs.has(`"msg":"call handled"`, `"method":"Put"`, `"request":"req-1"`, a_node) {
+		t.Errorf("The owner should log the call with the request id of the entry node\n")
+	}
+	// net/rpc carries the id in the request header, and plain net/rpc clients still get answers
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen in TestRequestID\n")
+	}
+	defer l.Close()
+	NapiServe(a, l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if err = CallContext(WithRequestID(ctx, "req-2"), "localhost", port, "NAPI.Get", &HTArgs{Key: "k"}, &reply); err != nil || reply.Value != "v" {
+		t.Errorf("Get over net/rpc returned %q, err = %v\n", reply.Value, err)
+	}
+	if !logs.has(`"method":"Get"`, `"request":"req-2"`, a_node) {
+		t.Errorf("The request id should travel in the net/rpc request header\n")
+	}
+	client, err := rpc.DialHTTP("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not dial with net/rpc. err = %s\n", err.Error())
+	}
+	defer client.Close()
+	if err = client.Call("NAPI.Get", &HTArgs{Key: "k"}, &reply); err != nil || reply.Value != "v" {
+		t.Errorf("Plain net/rpc Get returned %q, err = %v\n", reply.Value, err)
+	}
+	if err = client.Call("NAPI.Missing", &HTArgs{}, &reply); err == nil {
+		t.Errorf("Unknown methods should fail\n")
+	}
+}
+
+// keeps exported spans
+type spanBuffer struct {
+	lock  sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (b *spanBuffer) Export(span *tracing.SpanData) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.spans = append(b.spans, *span)
+	return nil
+}
+
+// span named name of kind kind recorded by node, with its attributes by key
+func (b *spanBuffer) find(name string, kind tracing.SpanKind, node ring.ID) (tracing.SpanData, map[string]interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, span := range b.spans {
+		attrs := make(map[string]interface{})
+		for _, a := range span.Attributes {
+			attrs[a.Key] = a.Value
+		}
+		if span.Name == name && span.Kind == kind && attrs["dht.node_id"] == node.String() {
+			return span, attrs
+		}
+	}
+	return tracing.SpanData{}, nil
+}
+
+// a forwarded call is one trace: server span of the entry node, its client span, server span of the owner
+func TestTracing(t *testing.T) {
+	spans := &spanBuffer{}
+	tracer := tracing.NewTracer("test", spans, 1)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+	tr := NewChanTransport()
+	first := HostData{Hostname: "node", Port: "1"}
+	a, err := LocalInitWith(tr, first.Hostname, first.Port, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(100)}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestTracing\n")
+	}
+	closer, _ := a.Serve("")
+	defer closer.Close()
+	b, err := JoinWith(tr, "node", "2", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(200)}, &first)
+	if err != nil {
+		t.Fatalf("Could not join. err = %v\n", err)
+	}
+	closer, _ = b.Serve("")
+	defer closer.Close()
+	ctx, root := tracer.Start(context.Background(), "test", tracing.KindClient)
+	var reply HTReply
+	if err = tr.Call(ctx, HostData{Hostname: "node", Port: "2"}, "NAPI.Put", &HTArgs{Key: "k", Value: "v"}, &reply); err != nil {
+		t.Fatalf("Put failed. err = %s\n", err.Error())
+	}
+	root.End(nil)
+	entry, _ := spans.find("NAPI.Put", tracing.KindServer, b.end)
+	forward, fattrs := spans.find("NAPI.Put", tracing.KindClient, b.end)
+	owner, oattrs := spans.find("NAPI.Put", tracing.KindServer, a.end)
+	trace := root.SpanContext().TraceID
+	if entry.Parent != root.SpanContext().SpanID || forward.Parent != entry.SpanContext.SpanID || owner.Parent != forward.SpanContext.SpanID ||
+		owner.SpanContext.TraceID != trace {
+		t.Errorf("Spans do not form one trace: %+v %+v %+v\n", entry, forward, owner)
+	}
+	if _, ok := fattrs["dht.finger_index"]; !ok || fattrs["server.address"] != "node:1" || fattrs["dht.key_sha"] != CM.StrToSha("k").String() {
+		t.Errorf("Wrong attributes of the forward %v\n", fattrs)
+	}
+	if oattrs["dht.outcome"] != "ok" || owner.Status != tracing.StatusOK {
+		t.Errorf("Wrong outcome of the owner span %v\n", oattrs)
+	}
+	// over net/rpc the span goes in the request header
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen in TestTracing\n")
+	}
+	defer l.Close()
+	NapiServe(a, l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	ctx, root = tracer.Start(context.Background(), "test", tracing.KindClient)
+	CallContext(ctx, "localhost", port, "NAPI.Get", &HTArgs{Key: "missing"}, &reply)
+	get, gattrs := spans.find("NAPI.Get", tracing.KindServer, a.end)
+	if get.Parent != root.SpanContext().SpanID || gattrs["dht.outcome"] != "CMKeyError" || get.Status != tracing.StatusError {
+		t.Errorf("Wrong span of a net/rpc call %+v\n", get)
+	}
+}
+
+// the snapshot of a node agrees with its store, fingers and last join, over JSON too, /debug/keys lists sub-ranges, and only the
+// admin listener serves them
+func TestInspect(t *testing.T) {
+	tr := NewChanTransport()
+	first := HostData{Hostname: "node", Port: "1"}
+	a, err := LocalInitWith(tr, first.Hostname, first.Port, &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(100)}, nil)
+	if err != nil {
+		t.Fatalf("Could not init local node in TestInspect\n")
+	}
+	closer, _ := a.Serve("")
+	defer closer.Close()
+	b, err := JoinWith(tr, "node", "2", &IDConfig{Policy: IDExplicit, Explicit: ring.FromInt(200)}, &first)
+	if err != nil {
+		t.Fatalf("Could not join. err = %v\n", err)
+	}
+	closer, _ = b.Serve("")
+	defer closer.Close()
+	var reply HTReply
+	for i := 0; i < 20; i++ {
+		tr.Call(context.Background(), first, "NAPI.Put", &HTArgs{Key: fmt.Sprint("key", i), Value: "v"}, &reply)
+	}
+	snapshot := a.Inspect()
+	second := HostData{Hostname: "node", Port: "2"}
+	if snapshot.ID != a.end || snapshot.Pred == nil || *snapshot.Pred != second || snapshot.PredEnd != b.end || snapshot.Succ != second ||
+		snapshot.State != "free" || len(snapshot.Fingers) != int(ring.Bits()) {
+		t.Errorf("Wrong snapshot of the node %+v\n", snapshot)
+	}
+	if snapshot.Store.Keys != a.cm.Len() || snapshot.Store.Keys+b.cm.Len() != 20 || snapshot.Store.Start != b.end.Add(ring.FromInt(1)) {
+		t.Errorf("Wrong snapshot of the store %+v\n", snapshot.Store)
+	}
+	if snapshot.Joiner != nil || snapshot.Committed == nil || snapshot.Committed.Phase != "committed" || snapshot.Committed.Host != second {
+		t.Errorf("Wrong joins in the snapshot %+v %+v\n", snapshot.Joiner, snapshot.Committed)
+	}
+	for _, handler := range []http.Handler{HttpHandler(a), napiServer(&NAPI{ln: a}).Handler} {
+		public := httptest.NewServer(handler)
+		for _, path := range []string{"/admin/node", "/debug/keys"} {
+			if resp, err := http.Get(public.URL + path); err != nil || resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET %s should not be served on a public port. err = %v\n", path, err)
+			} else {
+				resp.Body.Close()
+			}
+		}
+		public.Close()
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not listen in TestInspect\n")
+	}
+	defer l.Close()
+	NapiServe(a, l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	var keys KeyRange
+	none := false
+	if err = CallContext(context.Background(), "localhost", port, "NAPI.KeysIn", &none, &keys); err == nil {
+		t.Errorf("NAPI.KeysIn should not be served over net/rpc\n")
+	}
+	if err = grpcCall(context.Background(), "localhost", port, "NAPI.KeysIn", &none, &keys); err == nil {
+		t.Errorf("NAPI.KeysIn should not be served over gRPC\n")
+	}
+	srv := httptest.NewServer(AdminHandler(a))
+	defer srv.Close()
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed. err = %s\n", path, err.Error())
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+		return resp.StatusCode
+	}
+	var from_json NodeSnapshot
+	if status := get("/admin/node", &from_json); status != http.StatusOK || from_json.Store != snapshot.Store ||
+		from_json.Succ != second || len(from_json.Fingers) != len(snapshot.Fingers) {
+		t.Errorf("GET /admin/node returned %d %+v\n", status, from_json)
+	}
+	if status := get("/debug/keys?limit=2", &keys); status != http.StatusOK || len(keys.Keys) != 2 || !keys.Truncated {
+		t.Fatalf("GET /debug/keys returned %d %+v\n", status, keys)
+	}
+	start := snapshot.Store.Start
+	if keys.Keys[0].Sha.Sub(start).Cmp(keys.Keys[1].Sha.Sub(start)) == ring.Greater || keys.Keys[0].Sha != CM.StrToSha(keys.Keys[0].Key) {
+		t.Errorf("Keys are not sorted clockwise %+v\n", keys.Keys)
+	}
+	var sub KeyRange
+	path := "/debug/keys?start=" + keys.Keys[0].Sha.String() + "&end=" + keys.Keys[1].Sha.String()
+	if status := get(path, &sub); status != http.StatusOK || len(sub.Keys) != 1 || sub.Keys[0] != keys.Keys[0] || sub.Truncated {
+		t.Errorf("GET %s returned %d %+v\n", path, status, sub)
+	}
+	if status := get("/debug/keys?start=zz", &sub); status != http.StatusBadRequest {
+		t.Errorf("A bad start should give 400, got %d\n", status)
+	}
+}
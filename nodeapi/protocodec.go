@@ -0,0 +1,333 @@
+package nodeapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+/*
+Protobuf (proto3) wire encoding of the NAPI args and reply structs, used by the gRPC transport. See napi.proto for the messages.
+The field number of a struct field is its position in the struct starting at 1, so fields must only ever be appended to the
+NAPI structs. Unknown fields are skipped on decode so older nodes accept messages of newer ones.
+
+	bool, ints, uints   varint
+	string, []byte      length delimited
+	[N]byte (ring.ID)   length delimited, big endian. Shorter values are right aligned
+	struct, *struct     embedded message
+	[]T                 repeated T, never packed. Packed scalars are decoded
+	map[string]string   repeated {1: key, 2: value} entries
+
+Args and replies that are not structs (e.g *bool, *ring.ID, *[]RingMember) are sent as field 1 of a wrapper message
+*/
+
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+	wire32     = 5
+)
+
+var byteType = reflect.TypeOf(byte(0))
+
+/*
+Returns the encoding of v, a struct or a pointer to one. Other values are encoded as field 1 of a wrapper message
+*/
+func protoMarshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		return appendMessage(nil, rv)
+	}
+	return appendField(nil, 1, rv, false)
+}
+
+func appendMessage(b []byte, rv reflect.Value) ([]byte, error) {
+	var err error
+	for i := 0; i < rv.NumField(); i++ {
+		if !rv.Type().Field(i).IsExported() {
+			continue
+		}
+		if b, err = appendField(b, uint64(i+1), rv.Field(i), false); err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", rv.Type().Name(), rv.Type().Field(i).Name, err.Error())
+		}
+	}
+	return b, nil
+}
+
+func appendTag(b []byte, num uint64, wire uint64) []byte {
+	return binary.AppendUvarint(b, num<<3|wire)
+}
+
+func appendBytes(b []byte, num uint64, data []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+/*
+Appends field num holding v. Zero scalars are left out as in proto3, unless always is set for elements of repeated fields
+*/
+func appendField(b []byte, num uint64, v reflect.Value, always bool) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() || always {
+			b = appendTag(b, num, wireVarint)
+			if v.Bool() {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() != 0 || always {
+			b = binary.AppendUvarint(appendTag(b, num, wireVarint), uint64(v.Int()))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() != 0 || always {
+			b = binary.AppendUvarint(appendTag(b, num, wireVarint), v.Uint())
+		}
+	case reflect.String:
+		if v.Len() > 0 || always {
+			b = appendBytes(b, num, []byte(v.String()))
+		}
+	case reflect.Array:
+		if v.Type().Elem() != byteType {
+			return nil, fmt.Errorf("unsupported array type %s", v.Type())
+		}
+		if !v.IsZero() || always {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			b = appendBytes(b, num, data)
+		}
+	case reflect.Slice:
+		if v.Type().Elem() == byteType {
+			if v.Len() > 0 || always {
+				b = appendBytes(b, num, v.Bytes())
+			}
+			break
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if b, err = appendField(b, num, v.Index(i), true); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map type %s", v.Type())
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			entry := appendBytes(nil, 1, []byte(iter.Key().String()))
+			entry = appendBytes(entry, 2, []byte(iter.Value().String()))
+			b = appendBytes(b, num, entry)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return appendField(b, num, v.Elem(), true)
+		}
+	case reflect.Struct:
+		msg, err := appendMessage(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, num, msg)
+	default:
+		return nil, fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return b, nil
+}
+
+// a single decoded field
+type protoField struct {
+	num  uint64
+	wire uint64
+	n    uint64 // value of varint and fixed fields
+	data []byte // value of length delimited fields
+}
+
+/*
+Reads the field at the start of b. Returns the field and the rest of b
+*/
+func readField(b []byte) (protoField, []byte, error) {
+	var f protoField
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return f, nil, fmt.Errorf("bad field tag")
+	}
+	b = b[n:]
+	f.num, f.wire = tag>>3, tag&7
+	switch f.wire {
+	case wireVarint:
+		f.n, n = binary.Uvarint(b)
+		if n <= 0 {
+			return f, nil, fmt.Errorf("bad varint in field %d", f.num)
+		}
+		b = b[n:]
+	case wire64, wire32:
+		size := 8
+		if f.wire == wire32 {
+			size = 4
+		}
+		if len(b) < size {
+			return f, nil, fmt.Errorf("truncated field %d", f.num)
+		}
+		b = b[size:] // no NAPI field uses fixed encodings, only skipped
+	case wireBytes:
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return f, nil, fmt.Errorf("truncated field %d", f.num)
+		}
+		f.data = b[n : n+int(size)]
+		b = b[n+int(size):]
+	default:
+		return f, nil, fmt.Errorf("unsupported wire type %d in field %d", f.wire, f.num)
+	}
+	return f, b, nil
+}
+
+/*
+Decodes data into v, which must be a pointer. Inverse of protoMarshal
+*/
+func protoUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("protoUnmarshal needs a non nil pointer, got %T", v)
+	}
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		return decodeMessage(data, rv)
+	}
+	for len(data) > 0 { // wrapper message
+		f, rest, err := readField(data)
+		if err != nil {
+			return err
+		}
+		if f.num == 1 {
+			if err = setField(rv, f); err != nil {
+				return err
+			}
+		}
+		data = rest
+	}
+	return nil
+}
+
+func decodeMessage(data []byte, rv reflect.Value) error {
+	for len(data) > 0 {
+		f, rest, err := readField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if f.num == 0 || f.num > uint64(rv.NumField()) || !rv.Type().Field(int(f.num-1)).IsExported() {
+			continue // unknown field
+		}
+		if err = setField(rv.Field(int(f.num-1)), f); err != nil {
+			return fmt.Errorf("%s.%s: %s", rv.Type().Name(), rv.Type().Field(int(f.num-1)).Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// true for the kinds encoded as varints
+func isScalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// stores f in v. Repeated fields are appended to. Repeated scalars are accepted packed too, as other proto3 encoders send them
+func setField(v reflect.Value, f protoField) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem() != byteType {
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if f.wire == wireBytes && isScalar(elem.Kind()) { // packed
+			for data := f.data; len(data) > 0; {
+				n, size := binary.Uvarint(data)
+				if size <= 0 {
+					return fmt.Errorf("bad packed varint")
+				}
+				if err := setField(elem, protoField{num: f.num, wire: wireVarint, n: n}); err != nil {
+					return err
+				}
+				v.Set(reflect.Append(v, elem))
+				data = data[size:]
+			}
+			return nil
+		}
+		if err := setField(elem, f); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+		return nil
+	}
+	scalar := isScalar(v.Kind())
+	if scalar != (f.wire == wireVarint) || (!scalar && f.wire != wireBytes) {
+		return fmt.Errorf("wire type %d does not match %s", f.wire, v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(f.n != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(f.n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(f.n)
+	case reflect.String:
+		v.SetString(string(f.data))
+	case reflect.Array:
+		if v.Type().Elem() != byteType || len(f.data) > v.Len() {
+			return fmt.Errorf("%d bytes do not fit %s", len(f.data), v.Type())
+		}
+		v.SetZero()
+		reflect.Copy(v.Slice(v.Len()-len(f.data), v.Len()), reflect.ValueOf(f.data))
+	case reflect.Slice: // []byte, other slices are handled above
+		v.SetBytes(append([]byte{}, f.data...))
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		value := reflect.New(v.Type().Elem()).Elem()
+		for data := f.data; len(data) > 0; {
+			entry, rest, err := readField(data)
+			if err != nil {
+				return err
+			}
+			if entry.num == 1 {
+				err = setField(key, entry)
+			} else if entry.num == 2 {
+				err = setField(value, entry)
+			}
+			if err != nil {
+				return err
+			}
+			data = rest
+		}
+		v.SetMapIndex(key, value)
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setField(v.Elem(), f)
+	case reflect.Struct:
+		return decodeMessage(f.data, v)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package nodeapi
+
+import (
+	"context"
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"net"
+	"sync/atomic"
+)
+
+/*
+Read repair. With keys kept on several nodes, a Get reaching the owner of a key also reads the copies the replicas of the owner
+keep in their replica stores, see replicas.go, and answers with the newest of them once a quorum of the copies, the owner's
+included, has been read. As writes are acked by a quorum too, see replicate, the copies read always include one holding the last
+acked write. In the background, without delaying the reply, the owner waits for the copies left to answer and brings every copy
+older than the newest one read, see CM.Entry.After, up to it: first its own, then the lagging replicas, which are sent the entry of
+the owner with NAPI.Repair. Entries are read again when the repair is made and applied by version, so a write made meanwhile is not
+undone. HTArgs.NoRepair leaves lagging copies alone, they are still counted. With a replication factor of 1 there are no copies to
+read
+*/
+
+// args struct for NAPI.ReadCopy
+type CopyRequest struct {
+	Owner ring.ID // id of the node owning Key
+	Key   string
+	Start ring.ID // first key of the range of Owner
+}
+
+// reply struct for NAPI.ReadCopy
+type CopyReply struct {
+	Value   string
+	Present bool   // the copy holds a value or a tombstone of the key
+	Version uint64 // version of the value or tombstone
+	Deleted bool
+}
+
+// counters of read repair
+type ReadRepairStats struct {
+	Reads    int64 // Gets that read the copies of their key
+	Lagging  int64 // copies found older than the newest one read, the owner's included
+	Repaired int64 // lagging copies fixed
+	Failed   int64 // lagging copies that could not be fixed
+	Skipped  int64 // lagging copies left alone as their Get opted out
+}
+
+type readRepairCounters struct {
+	reads, lagging, repaired, failed, skipped atomic.Int64
+}
+
+/*
+Returns the copy of request.Key kept for request.Owner. Fails with NapiRangeError if the local node keeps no copy of the range of
+request.Owner
+*/
+func (napi *NAPI) ReadCopy(request *CopyRequest, reply *CopyReply) error {
+	store, err := napi.ln.storeOf(request.Owner, request.Start)
+	if err != nil {
+		return err
+	}
+	e, err := store.Lookup(request.Key)
+	if _, absent := err.(*CM.CMKeyError); absent {
+		*reply = CopyReply{}
+		return nil
+	} else if err != nil {
+		return handoverError(err)
+	}
+	*reply = CopyReply{Value: e.Value, Present: true, Version: e.Version, Deleted: e.Deleted}
+	return nil
+}
+
+// answer of a replica to a read of its copy
+type readResult struct {
+	peer HostData
+	copy *CopyReply // nil if the copy could not be read
+}
+
+/*
+True if a copy holding e, if present, lags behind the newest entry of the copies. A copy lacking a key the newest entry is a
+tombstone of is not lagging, the tombstone is left to anti-entropy
+*/
+func lagging(newest CM.Entry, e CM.Entry, present bool) bool {
+	if newest.Deleted && !present {
+		return false
+	}
+	return !present || newest.After(e)
+}
+
+/*
+Reads key from the local store and the copies of its replicas, and returns the newest value of them once a quorum of the copies was
+read. CMKeyError if the key is absent or deleted, NapiQuorumError if too few replicas answered. Copies older than the newest one,
+the local one included, are fixed in the background unless repair is false, see readRepair. The calls to replicas carry the request
+id of ctx. Assumes the local node stores key
+*/
+func (lns *LocNodeStruct) QuorumGet(ctx context.Context, key string, repair bool) (string, error) {
+	ours, err := lns.cm.Lookup(key)
+	if _, absent := err.(*CM.CMKeyError); err != nil && !absent {
+		return "", handoverError(err)
+	}
+	present := err == nil
+	replicas, need, err := lns.replicaPeers()
+	if err != nil {
+		return "", err
+	}
+	lns.read_repair.reads.Add(1)
+	answers := make(chan readResult, len(replicas)) // buffered, so late answers never block
+	request := CopyRequest{Owner: lns.end, Key: key, Start: lns.rangeStart()}
+	for _, peer := range replicas {
+		go func(peer HostData) {
+			theirs := new(CopyReply)
+			if err := lns.callContext(ctx, peer, "NAPI.ReadCopy", &request, theirs); err != nil {
+				lns.logFor(ctx).Debug("copy could not be read", "key", key, "replica", net.JoinHostPort(peer.Hostname, peer.Port),
+					"err", err)
+				theirs = nil
+			}
+			answers <- readResult{peer: peer, copy: theirs}
+		}(peer)
+	}
+	var read []readResult
+	got := 0
+	for left := len(replicas); got < need && left > 0; left-- {
+		answer := <-answers
+		read = append(read, answer)
+		if answer.copy != nil {
+			got++
+		}
+	}
+	go lns.readRepair(context.WithoutCancel(ctx), key, ours, present, read, answers, len(replicas)-len(read), repair)
+	if got < need {
+		return "", NewNapiQuorumError()
+	}
+	newest, has := newestCopy(ours, present, read)
+	if !has || newest.Deleted {
+		return "", CM.NewCMKeyError()
+	}
+	return newest.Value, nil
+}
+
+// entry of the copy. Only meaningful if Present
+func (c *CopyReply) entry() CM.Entry {
+	return CM.Entry{Value: c.Value, Version: c.Version, Deleted: c.Deleted}
+}
+
+// newest of the local entry ours, if present, and the copies read. False if none holds the key
+func newestCopy(ours CM.Entry, present bool, read []readResult) (CM.Entry, bool) {
+	newest, has := ours, present
+	for _, answer := range read {
+		if theirs := answer.copy; theirs != nil && theirs.Present && (!has || theirs.entry().After(newest)) {
+			newest, has = theirs.entry(), true
+		}
+	}
+	return newest, has
+}
+
+/*
+Waits for the pending answers left on answers, then brings every copy of key older than the newest of the copies read up to it,
+read holding the answers already received and ours the local entry, if present. The local copy is fixed first, so the entry the
+lagging replicas are sent is at least as new. Copies that could not be read are left to anti-entropy. Lagging copies are only
+counted if repair is false
+*/
+func (lns *LocNodeStruct) readRepair(ctx context.Context, key string, ours CM.Entry, present bool, read []readResult,
+	answers <-chan readResult, pending int, repair bool) {
+	for ; pending > 0; pending-- {
+		read = append(read, <-answers)
+	}
+	newest, has := newestCopy(ours, present, read)
+	if !has {
+		return
+	}
+	counters := &lns.read_repair
+	if lagging(newest, ours, present) {
+		counters.lagging.Add(1)
+		if !repair {
+			counters.skipped.Add(1)
+		} else if _, err := lns.repair(lns.cm, []TransferItem{itemOf(key, newest)}); err != nil {
+			counters.failed.Add(1)
+			lns.logFor(ctx).Warn("lagging local copy could not be repaired", "key", key, "err", err)
+		} else {
+			counters.repaired.Add(1)
+		}
+	}
+	for _, answer := range read {
+		if theirs := answer.copy; theirs != nil && lagging(newest, theirs.entry(), theirs.Present) {
+			lns.repairCopy(ctx, answer.peer, key, repair)
+		}
+	}
+}
+
+// sends the current local entry of key to the lagging copy of peer
+func (lns *LocNodeStruct) repairCopy(ctx context.Context, peer HostData, key string, repair bool) {
+	counters := &lns.read_repair
+	counters.lagging.Add(1)
+	if !repair {
+		counters.skipped.Add(1)
+		return
+	}
+	e, err := lns.cm.Lookup(key)
+	if err != nil { // range handed over or tombstone compacted meanwhile
+		counters.failed.Add(1)
+		return
+	}
+	ok := false
+	request := RepairRequest{Owner: lns.end, Items: []TransferItem{itemOf(key, e)}, Start: lns.rangeStart()}
+	if err = lns.callContext(ctx, peer, "NAPI.Repair", &request, &ok); err != nil {
+		counters.failed.Add(1)
+		lns.logFor(ctx).Warn("lagging copy could not be repaired", "key", key, "replica", net.JoinHostPort(peer.Hostname, peer.Port),
+			"err", err)
+		return
+	}
+	counters.repaired.Add(1)
+}
+
+/*
+Returns the read repair counters of the node
+*/
+func (lns *LocNodeStruct) ReadRepairStats() ReadRepairStats {
+	counters := &lns.read_repair
+	return ReadRepairStats{Reads: counters.reads.Load(), Lagging: counters.lagging.Load(), Repaired: counters.repaired.Load(),
+		Failed: counters.failed.Load(), Skipped: counters.skipped.Load()}
+}
@@ -0,0 +1,148 @@
+package nodeapi
+
+import (
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Replica stores. With a replication factor n > 1, the next n - 1 nodes clockwise of a node keep copies of its range, see Successors.
+A replica keeps every copy in a store of its own, apart from its own keys, keyed by the id of the owner of the range. Calls about a
+copy carry the id of the owner and the first key of its range, and the store follows the range of the owner: a join before the
+owner shrinks the range and the keys left of the new start are dropped, a leave before the owner grows it.
+A copy not written or synced for a while belongs to a node that left the ring or no longer counts the local node among its replicas,
+and is dropped by ExpireReplicas
+*/
+
+type replica struct {
+	store   CM.Store
+	start   ring.ID   // first key of the range of the owner
+	touched time.Time // last call about the copy
+}
+
+/*
+Copies kept by a node for other nodes, by id of the owner. Safe for concurrent use. lock is never held while a store is written
+*/
+type replicaSet struct {
+	lock   sync.Mutex
+	stores map[ring.ID]*replica
+}
+
+func newReplicaSet() *replicaSet {
+	return &replicaSet{stores: make(map[ring.ID]*replica)}
+}
+
+/*
+Returns the copy of the range [start, owner] of owner, created empty if there is none, and moves it to start if the range of owner
+changed
+*/
+func (rs *replicaSet) get(owner ring.ID, start ring.ID, now time.Time) CM.Store {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	end := owner.Add(ring.FromInt(1))
+	r := rs.stores[owner]
+	if r == nil {
+		r = &replica{store: newStore(start, end), start: start}
+		rs.stores[owner] = r
+	} else if r.start != start {
+		if r.store.InRange(start) { // a node joined before owner
+			r.store.PartitionTable(start)
+		} else { // the predecessor of owner left
+			r.store.Extend(start, nil)
+		}
+		r.start = start
+	}
+	r.touched = now
+	return r.store
+}
+
+// copy kept for owner, nil if none
+func (rs *replicaSet) lookup(owner ring.ID) CM.Store {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if r := rs.stores[owner]; r != nil {
+		return r.store
+	}
+	return nil
+}
+
+// the copies kept
+func (rs *replicaSet) all() []CM.Store {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	ret := make([]CM.Store, 0, len(rs.stores))
+	for _, r := range rs.stores {
+		ret = append(ret, r.store)
+	}
+	return ret
+}
+
+// stats of the copies kept, by id of the owner
+func (rs *replicaSet) stats() []ReplicaInfo {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	ret := make([]ReplicaInfo, 0, len(rs.stores))
+	for owner, r := range rs.stores {
+		ret = append(ret, ReplicaInfo{Owner: owner, Store: r.store.Stats()})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Owner.Cmp(ret[j].Owner) == ring.Less })
+	return ret
+}
+
+// drops the copies untouched since before. Returns the number dropped
+func (rs *replicaSet) expire(before time.Time) int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	ret := 0
+	for owner, r := range rs.stores {
+		if r.touched.Before(before) {
+			delete(rs.stores, owner)
+			ret++
+		}
+	}
+	return ret
+}
+
+/*
+Returns the store keeping the copy of the range [start, owner] of the node with id owner: the store of the local node if it is owner,
+else its replica store for owner. NapiRangeError if the local node keeps no such copy, because keys are not replicated or owner
+is in the range of the local node
+*/
+func (lns *LocNodeStruct) storeOf(owner ring.ID, start ring.ID) (CM.Store, error) {
+	if owner == lns.end {
+		return lns.cm, nil
+	}
+	if lns.replication < 2 || lns.StoresKey(owner) {
+		return nil, NewNapiRangeError()
+	}
+	return lns.replicas.get(owner, start, time.Now()), nil
+}
+
+// first key of the range of the local node
+func (lns *LocNodeStruct) rangeStart() ring.ID {
+	pred, pred_end := lns.predecessor()
+	if pred == nil { // single node chord ring
+		return lns.end.Add(ring.FromInt(1))
+	}
+	return pred_end.Add(ring.FromInt(1))
+}
+
+/*
+Returns a copy of the (key, value)s the local node keeps for owner as a replica. Empty if it keeps no copy of the range of owner
+*/
+func (lns *LocNodeStruct) ReplicaItems(owner ring.ID) map[string]string {
+	if store := lns.replicas.lookup(owner); store != nil {
+		return store.Items()
+	}
+	return map[string]string{}
+}
+
+/*
+Drops the copies not written or synced for max_age. Returns the number dropped
+*/
+func (lns *LocNodeStruct) ExpireReplicas(max_age time.Duration) int {
+	return lns.replicas.expire(time.Now().Add(-max_age))
+}
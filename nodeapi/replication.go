@@ -0,0 +1,199 @@
+package nodeapi
+
+import (
+	"context"
+	"go_dht/ring"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+/*
+Replicated writes. With a replication factor n > 1, every write to a key is made by its owner: the owner applies the write to its
+store, then sends the entry it stored, with its version, to the n - 1 replicas of its range with NAPI.Repair, and replies once a
+majority of the copies, its own included, holds the write. Replicas keep the copies in stores of their own, see replicas.go. Copies
+apply entries by version, so writes to a key that reach a replica out of order leave the newest one.
+A write that reaches too few copies fails with NapiQuorumError but is not undone. The copies that took it keep it and pass it on
+through read repair and anti-entropy, so a failed write may still be read later.
+Replicas are found by walking the successors, see Successors. A replica that cannot be reached counts as a copy that missed the
+write, and so do the ones after it if the walk stops there. The write is then handed off as a hint for the replica that could not
+be reached, see hints.go, to a replica that took it, or kept by the owner if none did. Hints do not count towards the quorum
+*/
+
+// number of copies kept of every key by new nodes, the owner's included. Changed with SetReplication
+var replication = 1
+
+/*
+Sets the number of copies kept of every key by nodes created afterwards. Values < 1 are taken as 1. Must be called before the
+node starts
+*/
+func SetReplication(copies int) {
+	if copies < 1 {
+		copies = 1
+	}
+	replication = copies
+}
+
+// answer of a replica to a replicated write
+type copyResult struct {
+	peer HostData
+	err  error
+}
+
+// args struct for NAPI.Repair
+type RepairRequest struct {
+	Owner ring.ID        // id of the node whose range is written
+	Items []TransferItem // entries the receiver is missing or holds older versions of
+	Start ring.ID        // first key of the range of Owner
+}
+
+/*
+Stores the items of request into the copy of the range of request.Owner, for keys it holds no newer entry of, recording the
+writes for a joiner. Deletes are stored as tombstones. reply is unused
+*/
+func (napi *NAPI) Repair(request *RepairRequest, reply *bool) error {
+	ln := napi.ln
+	store, err := ln.storeOf(request.Owner, request.Start)
+	if err != nil {
+		return err
+	}
+	_, err = ln.repair(store, request.Items)
+	return err
+}
+
+/*
+Sends the entry the local node stores for key to its replicas, with the request id of ctx. Returns once a majority of the copies
+hold it, or NapiQuorumError once too many replicas failed. Assumes the local node just wrote key
+*/
+func (lns *LocNodeStruct) replicate(ctx context.Context, key string) error {
+	if lns.replication < 2 {
+		return nil
+	}
+	e, err := lns.cm.Lookup(key)
+	if err != nil { // range handed over meanwhile
+		return handoverError(err)
+	}
+	replicas, need, err := lns.replicaPeers()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx) // copies still answering after the reply was sent are made all the same
+	request := RepairRequest{Owner: lns.end, Items: []TransferItem{itemOf(key, e)}, Start: lns.rangeStart()}
+	acks := make(chan bool, len(replicas)) // buffered, so late acks never block
+	results := make(chan copyResult, len(replicas))
+	for _, peer := range replicas {
+		go func(peer HostData) {
+			ok := false
+			err := lns.callContext(ctx, peer, "NAPI.Repair", &request, &ok)
+			if err != nil {
+				lns.logFor(ctx).Debug("copy not written", "key", key, "replica", net.JoinHostPort(peer.Hostname, peer.Port), "err", err)
+			}
+			acks <- err == nil
+			results <- copyResult{peer: peer, err: err}
+		}(peer)
+	}
+	go lns.handOff(ctx, &request, results, len(replicas))
+	if !quorum(acks, len(replicas), need) {
+		return NewNapiQuorumError()
+	}
+	return nil
+}
+
+/*
+Returns the replicas of the local node and the number of them that must answer for a quorum of the copies of its range, its own
+included. The replicas past one that cannot be reached are missing from the list but still counted
+*/
+func (lns *LocNodeStruct) replicaPeers() ([]HostData, int, error) {
+	replicas, err := lns.Successors(lns.replication - 1)
+	if err != nil && len(replicas) == 0 {
+		return nil, 0, err
+	}
+	copies := len(replicas) + 1 // fewer if the ring is smaller than the replication factor
+	if err != nil {
+		copies = lns.replication
+	}
+	return replicas, copies / 2, nil // a majority of the copies, less the local one
+}
+
+/*
+Waits for need of the answers of replicas on answers to succeed. False once too many failed
+*/
+func quorum(answers <-chan bool, replicas int, need int) bool {
+	for got, left := 0, replicas; got < need; left-- {
+		if left == 0 {
+			return false
+		}
+		if <-answers {
+			got++
+		}
+	}
+	return true
+}
+
+/*
+Waits for the answers of replicas replicas to the write request, and stores a hint of the write for each replica that could not be
+reached. A replica that answered with an error keeps its copy as it is, it is left to anti-entropy
+*/
+func (lns *LocNodeStruct) handOff(ctx context.Context, request *RepairRequest, results <-chan copyResult, replicas int) {
+	var acked, missed []HostData
+	for ; replicas > 0; replicas-- {
+		result := <-results
+		if result.err == nil {
+			acked = append(acked, result.peer)
+		} else if _, answered := result.err.(rpc.ServerError); !answered {
+			missed = append(missed, result.peer)
+		}
+	}
+	for _, peer := range missed {
+		// the id of a replica that cannot be reached is not known
+		hint := Hint{Target: peer, Owner: request.Owner, Item: request.Items[0], Start: request.Start}
+		lns.storeHint(ctx, &hint, acked)
+	}
+}
+
+/*
+Stores hint on the first of stand_ins that takes it, or in the hint store of the local node if none does. A hint neither takes is
+lost, and the copy of the replica is left to anti-entropy
+*/
+func (lns *LocNodeStruct) storeHint(ctx context.Context, hint *Hint, stand_ins []HostData) {
+	target := net.JoinHostPort(hint.Target.Hostname, hint.Target.Port)
+	for _, peer := range stand_ins {
+		ok := false
+		err := lns.callContext(ctx, peer, "NAPI.StoreHint", hint, &ok)
+		if err == nil {
+			return
+		}
+		lns.logFor(ctx).Debug("hint refused", "key", hint.Item.Key, "replica", target, "stand-in",
+			net.JoinHostPort(peer.Hostname, peer.Port), "err", err)
+	}
+	if err := lns.hints.Add(*hint, time.Now()); err != nil {
+		lns.logFor(ctx).Warn("write lost for a replica, left to anti-entropy", "key", hint.Item.Key, "replica", target, "err", err)
+	}
+}
+
+/*
+Returns the next n nodes clockwise of the local node, found by walking the successors. Fewer if the ring is smaller.
+These keep the copies of the range of the local node once keys are replicated n + 1 times
+*/
+func (lns *LocNodeStruct) Successors(n int) ([]HostData, error) {
+	self := HostData{Hostname: lns.hostname, Port: lns.port}
+	var ret []HostData
+	succ_ip, succ_port, err := lns.ft.Find(lns.end.Add(ring.FromInt(1))) // get successor
+	if err != nil {
+		return nil, err
+	}
+	next := HostData{Hostname: succ_ip, Port: succ_port}
+	for next != self && len(ret) < n {
+		ret = append(ret, next)
+		if len(ret) == n {
+			break
+		}
+		var ni NodeInfo
+		none := false
+		if err = lns.call(next, "NAPI.Info", &none, &ni); err != nil {
+			return ret, err
+		}
+		next = ni.Succ
+	}
+	return ret, nil
+}
@@ -1,15 +1,17 @@
 package nodeapi
 
 import (
-	"crypto/sha1"
-	"fmt"
+	"bufio"
+	"context"
 	CM "go_dht/chordmap"
-	K "go_dht/constants"
 	FT "go_dht/fingertable"
-	SSA "go_dht/shasumarith"
+	"go_dht/ring"
+	"io"
 	"net"
 	"net/http"
 	"net/rpc"
+	"sort"
+	"time"
 )
 
 /*
@@ -18,8 +20,12 @@ Library to handle RMI calls to this node
 
 // Exported struct used to contain arguments for Hash Table functions like Put/Get/Delete for use in RMI calls
 type HTArgs struct {
-	Key   string // exported. key for the hash table
-	Value string // exported. value for the hash table
+	Key      string // exported. key for the hash table
+	Value    string // exported. value for the hash table
+	Old      string // expected current value. Only used by CAS
+	Absent   bool   // CAS only succeeds if key is not present. Only used by CAS
+	Direct   bool   // set by clients routing to the owner themselves. A node not storing Key returns NapiRangeError instead of forwarding
+	NoRepair bool   // Get only. Lagging copies of Key are not fixed, see readrepair.go
 }
 
 // Exported struct used to contain arguments for Hash Table functions like Put/Get/Delete for use in RMI calls
@@ -32,44 +38,146 @@ type HostData struct {
 	Hostname, Port string // Exported
 }
 
-//types and  args struct for notifyPred
+//types and  args struct for NotifyPred
 type jevent int
 
 const (
 	jeventJoining jevent = 0 // node is joining
 	jeventJoined  jevent = 1 // node has joined
+	jeventAborted jevent = 2 // join was aborted, nothing changes
 )
 
-type joinNotice struct {
-	event  jevent
-	caller *HostData // can be used for checking if caller is the successor
+// args struct for NotifyPred. Sent by the successor of a joiner to the joiner's predecessor
+type JoinNotice struct {
+	Event  jevent
+	Caller HostData // used for checking if caller is the successor
+	Joiner HostData
+	Key    ring.ID // id of the joiner
+}
+
+// reply struct for RegisterJoin. Everything the joiner needs to set up its local node
+type JoinReply struct {
+	Pred    HostData // predecessor of the joiner
+	PredEnd ring.ID  // id of the predecessor
+	Succ    HostData // successor of the joiner. The joiner pulls its keys from it with TransferRange
+}
+
+// args struct for PredLeaving and SuccLeaving. Sent by a node leaving the ring to its successor and predecessor
+type LeaveNotice struct {
+	Key     ring.ID        // id of the leaving node
+	Pred    HostData       // predecessor of the leaving node
+	PredEnd ring.ID        // id of the predecessor
+	Succ    HostData       // successor of the leaving node
+	Items   []TransferItem // values stored by the leaving node with their versions. Only sent to the successor
+	Tombs   []TransferItem // tombstones of the leaving node, as deleted items. Only sent to the successor
+}
+
+// reply struct for NAPI.Info. Summary of the state of a node
+type NodeInfo struct {
+	Host       HostData
+	ID         ring.ID
+	Pred       *HostData // nil for a single node chord ring
+	PredEnd    ring.ID   // id of the predecessor. Only set if Pred != nil
+	Succ       HostData
+	Config     ring.Config // ring settings of the node
+	State      string
+	Keys       int // number of keys stored
+	Bytes      int // bytes held by the stored keys and values
+	ReadRepair ReadRepairStats
+}
+
+// entry of the reply of NAPI.Fingers
+type FingerEntry struct {
+	Start ring.ID  // n + 2^i
+	Host  HostData // succ(Start) as known by the node
+}
+
+// entry of the reply of NAPI.RingSnapshot
+type RingMember struct {
+	ID   ring.ID
+	Host HostData
 }
 
 type JoinRequest struct {
-	key  [K.ShaSize]byte
-	conn *HostData
+	Key      ring.ID // id of the joiner. Derived by the joiner using its IDConfig
+	Conn     *HostData
+	Config   ring.Config // ring settings of the joiner. Must match the ring's
+	RangeSum uint32      // JoinedSucc only. Checksum of the store of the joiner, as TransferChunk.RangeSum
+	Count    int         // JoinedSucc only. Number of keys stored by the joiner
 }
 
+const maxRingSize = 4096 // upper bound on nodes visited by RingSnapshot in case the successors do not form a cycle
+
+// timeouts used by ConnectAndCall. Changed with SetTimeouts
+var dial_timeout time.Duration = 5 * time.Second
+var call_timeout time.Duration = 10 * time.Second
+
 /*********** Helper Functions ****************/
 
+/*
+Sets the timeouts used by ConnectAndCall. dial bounds connecting to the peer, call bounds the handshake and the call itself.
+A value <= 0 leaves the current timeout unchanged. Must be called before the node starts
+*/
+func SetTimeouts(dial time.Duration, call time.Duration) {
+	if dial > 0 {
+		dial_timeout = dial
+	}
+	if call > 0 {
+		call_timeout = call
+	}
+}
+
 // Convenience method to make rpc calls to srv_addr:srv_port using method
 func ConnectAndCall(srv_addr string, srv_port string, method string, args interface{}, reply interface{}) error {
-	client, err := rpc.DialHTTP("tcp", srv_addr+":"+srv_port)
+	return CallContext(context.Background(), srv_addr, srv_port, method, args, reply)
+}
+
+/*
+Same as ConnectAndCall but gives up once ctx is done, returning ctx.Err(). The call ends at the earlier of the deadline of ctx and the call timeout.
+Uses the protocol set with SetProtocol. The request id of ctx, see WithRequestID, and its span, see tracing.go, are sent along with
+the call
+*/
+func CallContext(ctx context.Context, srv_addr string, srv_port string, method string, args interface{}, reply interface{}) error {
+	if protocol == ProtoGRPC {
+		return grpcCall(ctx, srv_addr, srv_port, method, args, reply)
+	}
+	dialer := net.Dialer{Timeout: dial_timeout}
+	conn, err := countedDial(func() (net.Conn, error) { return dialer.DialContext(ctx, "tcp", srv_addr+":"+srv_port) })
 	if err != nil {
 		return err
 	}
+	deadline := time.Now().Add(call_timeout)
+	if ctx_deadline, ok := ctx.Deadline(); ok && ctx_deadline.Before(deadline) {
+		deadline = ctx_deadline
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) }) // unblock the call on cancel
+	defer stop()
+	// same handshake as rpc.DialHTTP, which has no timeouts
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil || resp.Status != "200 Connected to Go RPC" {
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return NewNapiConnError()
+	}
+	client := rpc.NewClientWithCodec(newRPCClientCodec(conn, ctx))
+	defer client.Close()
 	err = client.Call(method, args, reply) // make rpc call
-	if err != nil {
-		return err
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
-	return nil // no error
+	return err
 }
 
 /************ End Helper *************/
 
 // Node api struct to contain methods for use in RMI Register method
 type NAPI struct {
-	ln *LocNodeStruct // information about the local node. Must not be nil
+	ln  *LocNodeStruct  // information about the local node. Must not be nil
+	ctx context.Context // request the call being handled belongs to, see logging.go. nil outside of calls
 }
 
 /******** RMI Methods for NAPIStruct **********/
@@ -78,18 +186,25 @@ type NAPI struct {
 Hash Table get method used by client. Assumes ln != nil
 */
 func (napi *NAPI) Get(args *HTArgs, reply *HTReply) error {
+	napi = napi.bind(args)
 	ln := napi.ln
-	shakey := sha1.Sum([]byte(args.Key))
-	if ln.StoresKey(shakey) { // store locally and return the error
-		val, err := ln.cm.Get(args.Key)
+	shakey := CM.StrToSha(args.Key)
+	if ln.StoresKey(shakey) && ln.replication > 1 { // read the copies too
+		val, err := ln.QuorumGet(napi.context(), args.Key, !args.NoRepair)
 		reply.Value = val
 		return err
+	} else if ln.StoresKey(shakey) { // store locally and return the error
+		val, err := ln.cm.Get(args.Key)
+		reply.Value = val
+		return handoverError(err)
+	} else if args.Direct { // client's view of the ring is stale
+		return NewNapiRangeError()
 	} else { // must find in chord ring
 		srv_addr, srv_port, err := ln.ft.Find(shakey) // seearch in fingertable
 		if err != nil {
 			return err
 		}
-		return ConnectAndCall(srv_addr, srv_port, "NAPI.Get", args, reply)
+		return napi.forward(HostData{Hostname: srv_addr, Port: srv_port}, "Get", shakey, args, reply)
 	}
 }
 
@@ -97,18 +212,24 @@ func (napi *NAPI) Get(args *HTArgs, reply *HTReply) error {
 Hash Table Put method used by client. reply is overwritten to containe empty string
 */
 func (napi *NAPI) Put(args *HTArgs, reply *HTReply) error {
+	napi = napi.bind(args)
 	ln := napi.ln
-	shakey := sha1.Sum([]byte(args.Key))
+	shakey := CM.StrToSha(args.Key)
 	if ln.StoresKey(shakey) { // store locally and return the error
-		err := ln.cm.Put(args.Key, args.Value)
+		err := ln.write(args.Key, shakey, func() error { return ln.cm.Put(args.Key, args.Value) })
 		reply.Value = ""
-		return err
+		if err != nil {
+			return err
+		}
+		return ln.replicate(napi.context(), args.Key)
+	} else if args.Direct { // client's view of the ring is stale
+		return NewNapiRangeError()
 	} else { // must find in chord ring
 		srv_addr, srv_port, err := ln.ft.Find(shakey) // seearch in fingertable
 		if err != nil {
 			return err
 		}
-		return ConnectAndCall(srv_addr, srv_port, "NAPI.Put", args, reply)
+		return napi.forward(HostData{Hostname: srv_addr, Port: srv_port}, "Put", shakey, args, reply)
 	}
 }
 
@@ -116,37 +237,69 @@ func (napi *NAPI) Put(args *HTArgs, reply *HTReply) error {
 Hash Table Delete method used by client
 */
 func (napi *NAPI) Delete(args *HTArgs, reply *HTReply) error {
+	napi = napi.bind(args)
 	ln := napi.ln
-	shakey := sha1.Sum([]byte(args.Key))
+	shakey := CM.StrToSha(args.Key)
 	if ln.StoresKey(shakey) { // store locally and return the error
-		val, err := ln.cm.Delete(args.Key)
+		var val string
+		err := ln.write(args.Key, shakey, func() (err error) {
+			val, err = ln.cm.Delete(args.Key)
+			return err
+		})
 		reply.Value = val
-		return err
+		if err != nil {
+			return err
+		}
+		return ln.replicate(napi.context(), args.Key)
+	} else if args.Direct { // client's view of the ring is stale
+		return NewNapiRangeError()
 	} else { // must find in chord ring
 		srv_addr, srv_port, err := ln.ft.Find(shakey) // seearch in fingertable
 		if err != nil {
 			return err
 		}
-		return ConnectAndCall(srv_addr, srv_port, "NAPI.Delete", args, reply)
+		return napi.forward(HostData{Hostname: srv_addr, Port: srv_port}, "Delete", shakey, args, reply)
 	}
 }
 
-/*retrieve the id/sha-key associated with this node. Assumes ln != nil
-args is not used
+/*
+Hash Table compare and swap used by client. Sets args.Key to args.Value if it currently maps to args.Old, or if args.Absent is set
+and args.Key is not present. Returns CMCASError if the current value does not match. reply is overwritten to contain empty string
 */
-func (napi *NAPI) GetN(args *[K.ShaSize]byte, reply *[K.ShaSize]byte) error {
+func (napi *NAPI) CAS(args *HTArgs, reply *HTReply) error {
+	napi = napi.bind(args)
 	ln := napi.ln
-	if ln.pred == nil { // single node chord ring
-		*reply = SSA.MaxVal() // entire key space
-		return nil
+	shakey := CM.StrToSha(args.Key)
+	if ln.StoresKey(shakey) { // store locally and return the error
+		reply.Value = ""
+		err := ln.write(args.Key, shakey, func() error { return ln.cm.CAS(args.Key, args.Old, args.Value, args.Absent) })
+		if err != nil {
+			return err
+		}
+		return ln.replicate(napi.context(), args.Key)
+	} else if args.Direct { // client's view of the ring is stale
+		return NewNapiRangeError()
+	} else { // must find in chord ring
+		srv_addr, srv_port, err := ln.ft.Find(shakey) // seearch in fingertable
+		if err != nil {
+			return err
+		}
+		return napi.forward(HostData{Hostname: srv_addr, Port: srv_port}, "CAS", shakey, args, reply)
 	}
-	*reply = ln.pred_end
+}
+
+/*retrieve the id/sha-key associated with this node. Assumes ln != nil
+args is not used
+*/
+func (napi *NAPI) GetN(args *ring.ID, reply *ring.ID) error {
+	*reply = napi.ln.end
 	return nil
 }
 
 /*Find the node that is in charge of key
  */
-func (napi *NAPI) Find(key *[K.ShaSize]byte, reply *HostData) error {
+func (napi *NAPI) Find(key *ring.ID, reply *HostData) error {
+	napi = napi.bind(key)
 	ln := napi.ln
 	if ln.StoresKey(*key) {
 		reply.Hostname = ln.hostname
@@ -158,178 +311,426 @@ func (napi *NAPI) Find(key *[K.ShaSize]byte, reply *HostData) error {
 	if err != nil {
 		return err
 	}
-	return ConnectAndCall(srv_addr, srv_port, "NAPI.Find", key, reply)
+	return napi.forward(HostData{Hostname: srv_addr, Port: srv_port}, "Find", *key, key, reply)
 }
 
 /*
-Unexposed function for internal api use
-CallerError if notifyPred was not invoked by this node's successor
-Else returns the error thrown by ln.SetState
+Internal api used by RegisterJoinSucc, JoinedSucc and abortJoin
+CallerError if NotifyPred was not invoked by this node's successor
+Else returns the error thrown by ln.leaseJoin. The Busy state set for a joining node expires after twice the join timeout. The notice
+that the join ended only frees the lease taken for that joiner, so a late notice leaves a newer lease alone
 reply is unsued
 */
-func (napi *NAPI) notifyPred(notice *joinNotice, reply *bool) error {
+func (napi *NAPI) NotifyPred(notice *JoinNotice, reply *bool) error {
 	ln := napi.ln
-	succ_ip, succ_port, err := ln.ft.Find(SSA.Add(ln.end, SSA.FromInt(1))) // get successor
+	succ_ip, succ_port, err := ln.ft.Find(ln.end.Add(ring.FromInt(1))) // get successor
 	if err != nil {
 		return err
 	}
-	if (notice.caller.Hostname != succ_ip) || (notice.caller.Port != succ_port) {
+	if (notice.Caller.Hostname != succ_ip) || (notice.Caller.Port != succ_port) {
 		// if not invoked by succ
 		return NewNapiCallerError()
 	}
-	var new_state nodestate
-	if notice.event == jeventJoining {
-		new_state = Busy
-	} else if notice.event == jeventJoined {
-		new_state = Free
+	if notice.Event == jeventJoining {
+		return ln.leaseJoin(notice.Key, 2*join_timeout)
+	} else if notice.Event == jeventJoined {
 		// update fingertable
-		ln.ft.UpdateRange(SSA.Add(SSA.FromInt(1), ln.end), SSA.Add(SSA.FromInt(1), ln.joiner.N), &FT.HostStruct{Hostname: ln.joiner.Conn.Hostname,
-			Port: ln.joiner.Conn.Port})
+		ln.ft.UpdateRange(ln.end.Add(ring.FromInt(1)), notice.Key.Add(ring.FromInt(1)), &FT.HostStruct{Hostname: notice.Joiner.Hostname,
+			Port: notice.Joiner.Port})
 	}
-	return ln.SetState(new_state)
+	ln.releaseJoin(notice.Key)
+	return nil
 
 }
 
 /*
-Unexposed
-Submodule of RegisterJoin. Must be called on succ(key) to ensure correctness. No error if can join else JoinError. Else returns first caught error
-Ensures both succ and pred are not locked, then initialize the loc node struct and returns it to
-caller for use.
+Internal api used by RegisterJoin
+Must be called on succ(key) to ensure correctness. No error if can join else JoinError. Else returns first caught error
+Ensures both succ and pred are not locked, then registers the joiner, which pulls the keys of its range with TransferRange.
+The local node stays BusyJoin until JoinedSucc is called or the join is aborted. See handoff.go
 */
-func (napi *NAPI) registerJoinSucc(request *JoinRequest, reply **LocNodeStruct) error {
+func (napi *NAPI) RegisterJoinSucc(request *JoinRequest, reply *JoinReply) error {
+	napi = napi.bind(request)
 	ln := napi.ln
-	var pred *HostData = ln.pred
-	var err error = ln.SetState(BusyJoin)
+	if request.Config != ring.CurConfig() { // joiner hashes keys differently
+		return NewNapiConfigError()
+	}
+	if request.Key == ln.end { // joiner would take over the id of this node
+		return NewNapiCollisionError()
+	}
+	if !ln.StoresKey(request.Key) { // not the successor of the joiner
+		return NewNapiRangeError()
+	}
+	j := newJoiner(request.Key, request.Conn, ln.end.Add(ring.FromInt(1)))
+	epoch, err := ln.lockState(BusyJoin, join_timeout, func(epoch uint64) { ln.abortJoin(j, epoch) })
 	if err != nil { // local node is busy
 		return err
 	}
-	var jln *LocNodeStruct
-	var jcm *CM.ChordMapStruct
-	if pred == nil { // single node chord ring, skip predecessor stages
-		// joiner's predecessor is also its successor
-		jln, err = LocalInit(request.conn.Hostname, request.conn.Port, request.key, &HostData{Hostname: ln.hostname, Port: ln.port}) // joiners local node struct
+	j.epoch = epoch
+	pred := HostData{Hostname: ln.hostname, Port: ln.port} // single node chord ring: joiner's predecessor is also its successor
+	pred_end := ln.end
+	if cur_pred, cur_pred_end := ln.predecessor(); cur_pred != nil { //not single node chord ring, lock the predecessor too
+		pred = *cur_pred
+		pred_end = cur_pred_end
+		args := JoinNotice{Event: jeventJoining, Caller: HostData{Hostname: ln.hostname, Port: ln.port}, Joiner: *request.Conn, Key: request.Key}
+		ok := true
+		err := napi.call(pred, "NAPI.NotifyPred", &args, &ok)
 		if err != nil {
-			ln.SetState(Free) // release local node
-			return err
+			ln.releaseState(epoch) // release local node
+			return err             // error with setting state or wrong predecessor
 		}
-		jcm, err = ln.cm.PartitionTable(SSA.Add(request.key, SSA.FromInt(1)))
-	} else { //not single node chord ring i.e pred != nil
-		args := joinNotice{event: jeventJoining, caller: &HostData{Hostname: ln.hostname, Port: ln.port}}
-		reply := true
-		err := ConnectAndCall(pred.Hostname, pred.Port, "NAPI.notifyPred", &args, &reply)
-		if err != nil {
-			ln.SetState(Free) // release local node
-			return err        // error with setting state or wrong predecessor
-		}
-		jln, err = LocalInit(request.conn.Hostname, request.conn.Port, request.key, pred)
-		if err != nil {
-			ln.SetState(Free) // release local node
-			return err
-		}
-		jcm, err = ln.cm.PartitionTable(SSA.Add(request.key, SSA.FromInt(1)))
 	}
-	// setup joiner struct, fill the jln and fill the reply value
-	if err != nil {
-		ln.SetState(Free) // release the node
+	// setup joiner struct and fill the reply value
+	j.xfer.start = pred_end.Add(ring.FromInt(1))
+	if err = ln.registerJoiner(j); err != nil {
 		return err
 	}
-	joiner := Joiner{
-		Table: jcm,
-		N:     request.key,
-		Conn:  request.conn}
-	ln.joiner = &joiner // set the joiner container
-	jln.cm = jcm        // set the cm for the reply
-	*reply = jln
+	reply.Pred = pred
+	reply.PredEnd = pred_end
+	reply.Succ = HostData{Hostname: ln.hostname, Port: ln.port}
 	return nil
 }
 
 /*
-Helper method for Joined
-Must be called on succ(request.key)
-Requires Joiner to complete setup and RegisterJoin to be previously called successfully. Alerts pred and succ of new node
-Does not try until success. Returns err on first error caught
-Fingertables of only the succ and pred(done in notifyPred) are updated.
+Internal api used by Joined
+Must be called on succ(request.Key)
+Requires RegisterJoinSucc to be previously called successfully for the same joiner, and the join to be prepared by the final
+TransferRange. Commits the join if request.RangeSum and request.Count match the range, i.e the joiner holds every key as the local
+node does, then alerts pred of the new node. A pred that cannot be reached frees itself when its Busy state expires, and routes
+through the local node until its fingers are refreshed.
+reply is filled with the writes made to the range of the joiner since it registered, and reply.Committed tells whether the join
+committed. If not, the joiner applies the writes and calls again. Repeating the call after the join committed gives the same reply.
+Fingertables of only the succ and pred(done in NotifyPred) are updated.
 */
-func (napi *NAPI) joinedSucc(request *JoinRequest, reply *bool) error {
+func (napi *NAPI) JoinedSucc(request *JoinRequest, reply *TransferChunk) error {
+	napi = napi.bind(request)
 	ln := napi.ln
-	var err error = nil
-	if ln.pred != nil { // alert predecessor
-		jn := joinNotice{event: jeventJoined, caller: &HostData{Hostname: ln.hostname, Port: ln.port}}
-		err = ConnectAndCall(ln.pred.Hostname, ln.pred.Port, "NAPI.notifyPred", &jn, reply)
-		if err != nil { // if error raised by pred, then abort atomic transaction
-			return err
+	ln.lock.RLock()
+	joiner, committed := ln.joiner, ln.committed
+	ln.lock.RUnlock()
+	if joiner == nil && committed != nil && committed.N == request.Key { // reply was lost
+		committed.xfer.lock.Lock()
+		*reply = *committed.xfer.commit
+		committed.xfer.lock.Unlock()
+		return nil
+	}
+	if joiner == nil || joiner.N != request.Key {
+		return NewNapiCallerError()
+	}
+	if err := joiner.setPhase(phasePrepared, phaseCommitting); err != nil {
+		if joiner.phase() == phaseCommitting { // concurrent JoinedSucc
+			return NewNapiBusyError()
+		}
+		return err
+	}
+	pred, _ := ln.predecessor()
+	switched, err := ln.commitJoin(joiner, request, reply)
+	if err != nil { // range is no longer stored, should not happen
+		joiner.setPhase(phaseCommitting, phasePrepared)
+		ln.abortJoin(joiner, joiner.epoch)
+		return err
+	}
+	if !switched { // written since the joiner last synced
+		joiner.setPhase(phaseCommitting, phasePrepared)
+		ln.extendState(joiner.epoch, join_timeout)
+		return nil
+	}
+	if pred != nil { // alert predecessor
+		jn := JoinNotice{Event: jeventJoined, Caller: HostData{Hostname: ln.hostname, Port: ln.port}, Joiner: *request.Conn, Key: request.Key}
+		ok := false
+		if err := napi.call(*pred, "NAPI.NotifyPred", &jn, &ok); err != nil {
+			napi.log().Warn("predecessor not told of the join, it routes through the local node until refreshed", "joiner",
+				request.Key.String(), "err", err)
 		}
 	}
-	// update fingertable, change pred, clear joiner, set state
-	ln.ft.UpdateRange(SSA.Add(SSA.FromInt(1), ln.pred_end), SSA.Add(SSA.FromInt(1), ln.end), &FT.HostStruct{Hostname: request.conn.Hostname,
-		Port: request.conn.Port})
-	*(ln.pred) = *(request.conn) // copy the struct
-	ln.pred_end = request.key
-	ln.joiner = nil
-	err = ln.SetState(Free) // should never return an err
+	ln.releaseState(joiner.epoch)
 	return nil
 }
 
 /*
 Can be invoked on any node
-Success message on successful joining by new node after calling registerJoinedSucc
+Success message on successful joining by new node after calling RegisterJoin
 Requires Joiner to complete setup and RegisterJoin to be previously called successfully. Alerts pred and succ of new node
-Does not try until success. Returns err on first error caught
+Does not try until success. Returns err on first error caught. reply is filled as by JoinedSucc
 Fingertables are not updated here. Fingertables are periodically refreshed
 */
-func (napi *NAPI) Joined(request *JoinRequest, reply *bool) error {
+func (napi *NAPI) Joined(request *JoinRequest, reply *TransferChunk) error {
+	napi = napi.bind(request)
 	var succ HostData
-	err := napi.Find(&(request.key), &succ)
+	err := napi.Find(&(request.Key), &succ)
 	if err != nil {
 		return err
 	}
-	err = napi.joinedSucc(request, reply)
-	return err
+	return napi.call(succ, "NAPI.JoinedSucc", request, reply)
 }
 
 /*
 request: contains joiner's key and ip info
 reply: necessary info for init. Untouched if error raised
 Called by a joiner wanting id = key. No error if can join else JoinError. Else returns first caught error
-First finds succ, then ensures both are not locked, then initialize the loc node struct and returns it to
-client for use.
+First finds succ, then ensures both are not locked, then returns the predecessor and keys of the joiner
 */
-func (napi *NAPI) RegisterJoin(request *JoinRequest, reply **LocNodeStruct) error {
+func (napi *NAPI) RegisterJoin(request *JoinRequest, reply *JoinReply) error {
+	napi = napi.bind(request)
 	var succ HostData
-	err := napi.Find(&(request.key), &succ)
+	err := napi.Find(&(request.Key), &succ)
 	if err != nil {
 		return err
 	}
-	err = ConnectAndCall(succ.Hostname, succ.Port, "NAPI.registerJoinSucc", request, reply)
-	return err
+	return napi.call(succ, "NAPI.RegisterJoinSucc", request, reply)
+}
+
+/*
+Called by the predecessor on leaving the ring. The local node takes over the keys and the range of the leaver.
+CallerError if the notice does not come from the predecessor. reply is unused
+*/
+func (napi *NAPI) PredLeaving(notice *LeaveNotice, reply *bool) error {
+	napi = napi.bind(notice)
+	ln := napi.ln
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	if ln.pred == nil || notice.Key != ln.pred_end {
+		return NewNapiCallerError()
+	}
+	if ln.GetState() != Free {
+		return NewNapiBusyError()
+	}
+	entries := make(map[string]CM.Entry, len(notice.Items)+len(notice.Tombs))
+	for _, items := range [][]TransferItem{notice.Items, notice.Tombs} {
+		for _, item := range items {
+			entries[item.Key] = entryOf(item)
+		}
+	}
+	err := ln.cm.Extend(notice.PredEnd.Add(ring.FromInt(1)), entries)
+	if err != nil {
+		return err
+	}
+	// keys in (pred_end, leaver] are now stored locally
+	ln.ft.UpdateRange(notice.PredEnd.Add(ring.FromInt(1)), notice.Key.Add(ring.FromInt(1)), &FT.HostStruct{Hostname: ln.hostname,
+		Port: ln.port})
+	if notice.Pred.Hostname == ln.hostname && notice.Pred.Port == ln.port { // local node is the last one left
+		ln.pred = nil
+		ln.metrics.event("pred_left")
+		napi.log().Info("predecessor left, last node of the ring", "leaver", notice.Key.String(), "keys", len(notice.Items))
+		return nil
+	}
+	ln.pred = &HostData{Hostname: notice.Pred.Hostname, Port: notice.Pred.Port}
+	ln.pred_end = notice.PredEnd
+	ln.metrics.event("pred_left")
+	napi.log().Info("predecessor left, took over its range", "leaver", notice.Key.String(), "keys", len(notice.Items))
+	return nil
+}
+
+/*
+Called by the successor on leaving the ring. Fingers pointing to the leaver are pointed to the leaver's successor.
+reply is unused
+*/
+func (napi *NAPI) SuccLeaving(notice *LeaveNotice, reply *bool) error {
+	napi = napi.bind(notice)
+	ln := napi.ln
+	// keys in (end, leaver] are now stored by the leaver's successor
+	ln.ft.UpdateRange(ln.end.Add(ring.FromInt(1)), notice.Key.Add(ring.FromInt(1)), &FT.HostStruct{Hostname: notice.Succ.Hostname,
+		Port: notice.Succ.Port})
+	ln.metrics.event("succ_left")
+	napi.log().Info("successor left", "leaver", notice.Key.String(), "succ", net.JoinHostPort(notice.Succ.Hostname, notice.Succ.Port))
+	return nil
+}
+
+/*
+Returns a summary of the local node. args is unused
+*/
+func (napi *NAPI) Info(args *bool, reply *NodeInfo) error {
+	info, err := napi.ln.Info()
+	if err != nil {
+		return err
+	}
+	*reply = info
+	return nil
+}
+
+/*
+Returns the finger table of the local node. args is unused
+*/
+func (napi *NAPI) Fingers(args *bool, reply *[]FingerEntry) error {
+	ln := napi.ln
+	entries := ln.ft.Entries()
+	*reply = make([]FingerEntry, len(entries))
+	for i, e := range entries {
+		(*reply)[i] = FingerEntry{Start: ln.end.Add(ring.Pow2(uint32(i))), Host: HostData{Hostname: e.Hostname, Port: e.Port}}
+	}
+	return nil
+}
+
+/*
+Returns every node of the ring sorted by id, found by walking the successors starting at the local node. args is unused.
+Used by clients to route requests straight to the owner of a key
+*/
+func (napi *NAPI) RingSnapshot(args *bool, reply *[]RingMember) error {
+	napi = napi.bind(args)
+	ln := napi.ln
+	self := HostData{Hostname: ln.hostname, Port: ln.port}
+	members := []RingMember{{ID: ln.end, Host: self}}
+	succ_ip, succ_port, err := ln.ft.Find(ln.end.Add(ring.FromInt(1))) // get successor
+	if err != nil {
+		return err
+	}
+	next := HostData{Hostname: succ_ip, Port: succ_port}
+	for next != self {
+		if len(members) >= maxRingSize {
+			return NewNapiRingError()
+		}
+		var ni NodeInfo
+		none := false
+		if err = napi.call(next, "NAPI.Info", &none, &ni); err != nil {
+			return err
+		}
+		members = append(members, RingMember{ID: ni.ID, Host: ni.Host})
+		next = ni.Succ
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID.Cmp(members[j].ID) == ring.Less })
+	*reply = members
+	return nil
 }
 
 /********* RMI end *************/
 
+/*
+Gracefully removes the local node from the ring. The keys of the local node are handed to its successor, then the predecessor is told to
+route around the local node. The rpc service should be stopped after. Does nothing for a single node chord ring.
+Returns the first error caught, in which case the local node may still be part of the ring
+*/
+func Leave(ln *LocNodeStruct) error {
+	pred, pred_end := ln.predecessor()
+	if pred == nil {
+		return nil // single node chord ring, nothing to hand over
+	}
+	succ_ip, succ_port, err := ln.ft.Find(ln.end.Add(ring.FromInt(1))) // get successor
+	if err != nil {
+		return err
+	}
+	notice := LeaveNotice{
+		Key:     ln.end,
+		Pred:    *pred,
+		PredEnd: pred_end,
+		Succ:    HostData{Hostname: succ_ip, Port: succ_port}}
+	for k, e := range ln.cm.Entries() {
+		if e.Deleted {
+			notice.Tombs = append(notice.Tombs, itemOf(k, e))
+		} else {
+			notice.Items = append(notice.Items, itemOf(k, e))
+		}
+	}
+	ok := false
+	err = ln.call(HostData{Hostname: succ_ip, Port: succ_port}, "NAPI.PredLeaving", &notice, &ok)
+	if err != nil {
+		return err
+	}
+	ln.metrics.event("left")
+	ln.log.Info("left the ring", "keys", len(notice.Items))
+	notice.Items, notice.Tombs = nil, nil // pred only needs the successor
+	return ln.call(*pred, "NAPI.SuccLeaving", &notice, &ok)
+}
+
+/*
+Recomputes every finger of the node from a snapshot of the ring taken by walking the successors. Joins and leaves only update the
+fingers of the nodes next to them, so the fingers of other nodes must be refreshed this way
+*/
+func (lns *LocNodeStruct) RefreshFingers() error {
+	var members []RingMember
+	none := false
+	if err := (&NAPI{ln: lns}).RingSnapshot(&none, &members); err != nil {
+		return err
+	}
+	lns.ft.Update(func(key ring.ID) (string, string) { // succ(key) among members
+		i := sort.Search(len(members), func(i int) bool { return members[i].ID.Cmp(key) != ring.Less })
+		if i == len(members) {
+			i = 0
+		}
+		return members[i].Host.Hostname, members[i].Host.Port
+	})
+	return nil
+}
+
+/*
+Called by a node wanting to join the chord ring that boot is a member of. The id of the joiner is derived from idcfg the same way
+LocalInit derives it, so a restarted node gets back the same id. Its predecessor and successor route to it once Join returns,
+so the returned node must be served right away. Calls routed to it before it is served fail and are retried by clients.
+If the join fails before it commits, it is aborted and the ring is left as it was.
+Returns the initialized local node struct of the joiner. Returns NapiCollisionError if the id is already taken by a node in the ring and
+NapiConfigError if the ring uses different ring.Config settings
+*/
+func Join(hostname string, port string, idcfg *IDConfig, boot *HostData) (*LocNodeStruct, error) {
+	return JoinWith(DefaultTransport, hostname, port, idcfg, boot)
+}
+
+/*
+Same as Join but the joiner makes its calls to other nodes through tr
+*/
+func JoinWith(tr Transport, hostname string, port string, idcfg *IDConfig, boot *HostData) (*LocNodeStruct, error) {
+	key, err := idcfg.DeriveID(hostname, port)
+	if err != nil {
+		return nil, err
+	}
+	request := JoinRequest{Key: key, Conn: &HostData{Hostname: hostname, Port: port}, Config: ring.CurConfig()}
+	var jreply JoinReply
+	err = tr.Call(context.Background(), *boot, "NAPI.RegisterJoin", &request, &jreply)
+	if err != nil {
+		return nil, err
+	}
+	jln, err := localInit(tr, hostname, port, key, &jreply.Pred)
+	if err == nil {
+		err = pullRange(tr, jln, jreply.Succ)
+	}
+	if err == nil {
+		err = commitRange(tr, jln, &request, jreply.Succ)
+	}
+	if err != nil { // the successor keeps the range unless the join committed
+		ok := false
+		if aerr := tr.Call(context.Background(), jreply.Succ, "NAPI.AbortJoin", &request, &ok); aerr != nil {
+			logger.Warn("join could not be aborted, the lease of the successor expires instead", "id", key.String(), "err", aerr)
+		}
+		return nil, err
+	}
+	jln.metrics.event("joined")
+	jln.log.Info("joined the ring", "succ", net.JoinHostPort(jreply.Succ.Hostname, jreply.Succ.Port), "keys", jln.cm.Len())
+	return jln, nil
+}
+
 /*
 Call this method to register the rpc service and start the listener/service in a go routine
 */
 func NapiStart(loc_node *LocNodeStruct) (net.Listener, error) {
-	napi := new(NAPI)
-	napi.ln = loc_node
-	rpc.Register(napi)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", loc_node.hostname+":"+loc_node.port)
+	return NapiStartOn(loc_node, loc_node.hostname+":"+loc_node.port)
+}
+
+/*
+Same as NapiStart but listens on listen_addr i.e "host:port" instead of the hostname and port other nodes reach loc_node on.
+Used when the node binds to all interfaces or sits behind a NAT
+*/
+func NapiStartOn(loc_node *LocNodeStruct, listen_addr string) (net.Listener, error) {
+	l, e := net.Listen("tcp", listen_addr)
 	if e != nil {
 		// detected error
-		fmt.Printf("Cannot start RPC service. %s \n", e.Error())
+		loc_node.log.Error("cannot start rpc service", "listen", listen_addr, "err", e)
 		return l, e
 	}
-	go http.Serve(l, nil) // accepts connections on listener l and handles them using default handler dispatcher
-	fmt.Println("RPC service started successfully")
+	NapiServe(loc_node, l)
+	loc_node.log.Info("rpc service started", "listen", l.Addr().String())
 	return l, nil
 }
 
+/*
+Serves the NAPI methods of loc_node on an existing listener in a go routine, e.g one on an ephemeral port.
+Closing l stops the service
+*/
+func NapiServe(loc_node *LocNodeStruct, l net.Listener) {
+	go napiServer(&NAPI{ln: loc_node}).Serve(l) // accepts net/rpc and gRPC connections on listener l
+}
+
 /*
 Call this method to stop the rpc service
 */
 func NapiStop(listener net.Listener) {
-	fmt.Println("Shutting down RPC service ...")
 	listener.Close()
-	fmt.Println("RPC service successfully shutdown")
+	logger.Info("rpc service stopped", "listen", listener.Addr().String())
 }
@@ -0,0 +1,187 @@
+package nodeapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+net/rpc protocol of the NAPI service. Same wire format as rpc.Server and rpc.Client with the gob codec, except the request header
+also carries the request id and the span of the call, see logging.go and tracing.go. Gob skips fields the receiver does not
+know, so plain net/rpc clients and servers still interoperate with nodes, their calls just arrive without an id
+*/
+
+// rpc.Request with the request id and span. Field names must match rpc.Request
+type rpcRequestHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	RequestID     string
+	Traceparent   string // W3C traceparent of the span of the caller
+}
+
+/******** Client **********/
+
+// rpc.ClientCodec sending the request id and span of its call along with every request
+type rpcClientCodec struct {
+	rwc         io.ReadWriteCloser
+	dec         *gob.Decoder
+	enc         *gob.Encoder
+	buf         *bufio.Writer
+	request_id  string
+	traceparent string
+}
+
+func newRPCClientCodec(conn io.ReadWriteCloser, ctx context.Context) *rpcClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &rpcClientCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), buf: buf, request_id: RequestID(ctx),
+		traceparent: traceparent(ctx)}
+}
+
+func (c *rpcClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	header := rpcRequestHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq, RequestID: c.request_id, Traceparent: c.traceparent}
+	if err := c.enc.Encode(&header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *rpcClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *rpcClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *rpcClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+/******** Server **********/
+
+/*
+Returns the handler serving net/rpc connections to napi. It answers the CONNECT of rpc.DialHTTP like rpc.Server.ServeHTTP, then
+serves the calls of the connection with an rpc.Server of the node, through rpcServerCodec
+*/
+func (napi *NAPI) rpcHandler() http.Handler {
+	server := rpc.NewServer()
+	server.Register(napi)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			io.WriteString(w, "405 must CONNECT\n")
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+			return
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+		server.ServeCodec(newRPCServerCodec(conn, napi))
+	})
+}
+
+/*
+rpc.ServerCodec reading the request id and span of every call from its header. A call begins once its args are read, see
+NAPI.begin, and ends when its response is written. Meanwhile the call is found by its args in the rpc_calls of the node, which the
+method looks it up in with bind
+*/
+type rpcServerCodec struct {
+	napi   *NAPI
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	buf    *bufio.Writer
+	header rpcRequestHeader       // of the request being read
+	lock   sync.Mutex             // guards args
+	args   map[uint64]interface{} // args of the calls being served, by seq
+}
+
+func newRPCServerCodec(conn io.ReadWriteCloser, napi *NAPI) *rpcServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &rpcServerCodec{napi: napi, rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), buf: buf,
+		args: make(map[uint64]interface{})}
+}
+
+func (c *rpcServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.header = rpcRequestHeader{}
+	if err := c.dec.Decode(&c.header); err != nil {
+		return err
+	}
+	r.ServiceMethod, r.Seq = c.header.ServiceMethod, c.header.Seq
+	return nil
+}
+
+func (c *rpcServerCodec) ReadRequestBody(body interface{}) error {
+	if body == nil { // unknown method, the args are skipped
+		return c.dec.DecodeValue(reflect.Value{})
+	}
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	ctx := withTraceparent(WithRequestID(context.Background(), c.header.RequestID), c.header.Traceparent)
+	call := c.napi.begin(ctx, strings.TrimPrefix(c.header.ServiceMethod, "NAPI."), body)
+	c.napi.ln.rpc_calls.Store(body, call)
+	c.lock.Lock()
+	c.args[c.header.Seq] = body
+	c.lock.Unlock()
+	return nil
+}
+
+// called by rpc.Server one response at a time
+func (c *rpcServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.lock.Lock()
+	args, ok := c.args[r.Seq]
+	delete(c.args, r.Seq)
+	c.lock.Unlock()
+	if ok {
+		if call, found := c.napi.ln.rpc_calls.LoadAndDelete(args); found {
+			var err error
+			if r.Error != "" {
+				err = rpc.ServerError(r.Error)
+			}
+			call.(*serverCall).end(err)
+		}
+	}
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *rpcServerCodec) Close() error {
+	return c.rwc.Close()
+}
+
+/*
+Returns a NAPI handling the call with args on behalf of its request. napi itself unless it was called by rpc.Server, which calls
+the methods of the NAPI it serves for every request. Methods that log or call other nodes bind their args first
+*/
+func (napi *NAPI) bind(args interface{}) *NAPI {
+	if napi.ctx != nil {
+		return napi
+	}
+	if call, ok := napi.ln.rpc_calls.Load(args); ok {
+		return call.(*serverCall).napi
+	}
+	return napi
+}
@@ -0,0 +1,95 @@
+package nodeapi
+
+import (
+	"context"
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"go_dht/tracing"
+	"net"
+)
+
+/*
+Tracing of NAPI calls, see package tracing. Every call a node handles is a server span, and every call it makes to a peer is a client
+span, the child of the span of the call it is made for, so a request forwarded across the ring is one trace. The span context goes
+with each call in the same envelope as the request id, see logging.go: a field of the net/rpc request header, the traceparent header
+of gRPC, a field of the calls of a ChanTransport. Spans carry the method, the node, the sha of the key of the call, the target of
+peer calls, the finger forwarded through and the outcome, see outcome in metrics.go
+*/
+
+// tracer of every node of the process. nil records nothing. Changed with SetTracer
+var tracer *tracing.Tracer
+
+/*
+Sets the tracer of the NAPI calls of every node of the process. nil disables tracing. Must be called before the node starts
+*/
+func SetTracer(t *tracing.Tracer) {
+	tracer = t
+}
+
+const traceparentHeader = "Traceparent"
+
+// span context of ctx in the traceparent format, "" if ctx holds none
+func traceparent(ctx context.Context) string {
+	sc := tracing.SpanContextFrom(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// copy of ctx holding the span context sent by the caller as traceparent. ctx if there is none or it is malformed
+func withTraceparent(ctx context.Context, traceparent string) context.Context {
+	sc, err := tracing.ParseTraceparent(traceparent)
+	if traceparent == "" || err != nil {
+		return ctx
+	}
+	return tracing.WithSpanContext(ctx, sc)
+}
+
+// attributes of the spans of a call of method made or handled by lns with args
+func callAttrs(lns *LocNodeStruct, ctx context.Context, method string, args interface{}) []tracing.Attribute {
+	ret := []tracing.Attribute{
+		tracing.String("rpc.system", "napi"),
+		tracing.String("rpc.method", method),
+		tracing.String("dht.node_id", lns.end.String()),
+		tracing.String("dht.request_id", RequestID(ctx))}
+	switch args := args.(type) {
+	case *HTArgs:
+		ret = append(ret, tracing.String("dht.key_sha", CM.StrToSha(args.Key).String()))
+	case *CopyRequest:
+		ret = append(ret, tracing.String("dht.key_sha", CM.StrToSha(args.Key).String()))
+	case *ring.ID: // Find
+		ret = append(ret, tracing.String("dht.key_sha", args.String()))
+	}
+	return ret
+}
+
+/*
+Calls method of the node at peer through the transport of the node, on behalf of the request of ctx. The call is a client span
+with attrs, passed on to the peer along with the request id
+*/
+func (lns *LocNodeStruct) callContext(ctx context.Context, peer HostData, method string, args interface{}, reply interface{},
+	attrs ...tracing.Attribute) error {
+	ctx, span := tracer.Start(ctx, method, tracing.KindClient)
+	if span != nil {
+		span.SetAttributes(callAttrs(lns, ctx, method, args)...)
+		span.SetAttributes(tracing.String("server.address", net.JoinHostPort(peer.Hostname, peer.Port)))
+		span.SetAttributes(attrs...)
+	}
+	err := lns.transport.Call(ctx, peer, method, args, reply)
+	endSpan(span, err)
+	return err
+}
+
+// records the outcome of the call of span, err if it failed, and ends span. Does nothing if the call is not traced
+func endSpan(span *tracing.Span, err error) {
+	if span == nil {
+		return
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	span.SetAttributes(tracing.String("dht.outcome", outcome(msg)))
+	span.End(err)
+}
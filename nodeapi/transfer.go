@@ -0,0 +1,428 @@
+package nodeapi
+
+import (
+	"context"
+	CM "go_dht/chordmap"
+	"go_dht/ring"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Transfer of the keys of a joiner from its successor. The joiner pulls its range with NAPI.TransferRange one chunk at a time
+and asks for the next chunk only once it stored the last, so a slow joiner slows the transfer down instead of piling up
+chunks. Chunks are bounded in items and bytes and carry a checksum. A failed chunk is asked for again from the same cursor.
+
+The successor keeps serving the range during the transfer and records the keys written meanwhile. The final request
+prepares the join: the successor replies with the current state of the keys written so far, the tombstones of the range and a
+checksum of the whole range, which the joiner checks its store against. JoinedSucc commits the join only once the joiner
+holds the range as the successor does, else it replies with the keys written so far again and holds writes to the range back
+until the join commits or aborts, so the joiner catches up even if the range is written all the time. See handoff.go
+*/
+
+// args struct for NAPI.TransferRange
+type TransferRequest struct {
+	Key      ring.ID // id of the joiner
+	Cursor   int     // Next of the previous chunk. 0 for the first chunk
+	MaxItems int     // bound on the items of the chunk. Capped by the sender
+	MaxBytes int     // bound on the bytes of the chunk. Capped by the sender, a chunk always holds at least one item
+	Final    bool    // every chunk was received. The sender prepares the join and replies with the keys written during the transfer
+}
+
+type TransferItem struct {
+	Key     string
+	Value   string
+	Deleted bool   // key was deleted. Stored as a tombstone
+	Version uint64 // version of the write or delete, see chordmap/version.go. 0 if unknown
+}
+
+// reply struct for NAPI.TransferRange
+type TransferChunk struct {
+	Items     []TransferItem
+	Next      int    // cursor of the next chunk
+	Done      bool   // no chunks left, the next request must be Final
+	Checksum  uint32 // checksum of Items
+	RangeSum  uint32 // final chunk only. Checksum of every (key, value) of the range, sorted by key
+	Count     int    // final chunk only. Number of keys of the range
+	Committed bool   // JoinedSucc only. The join committed, else the joiner applies Items and calls JoinedSucc again
+}
+
+const (
+	maxChunkItems      = 4096    // cap on TransferRequest.MaxItems
+	maxChunkBytes      = 4 << 20 // cap on TransferRequest.MaxBytes
+	chunkItems         = 512     // asked for by joiners
+	chunkBytes         = 1 << 20 // asked for by joiners
+	maxTransferRetries = 5       // attempts of a chunk before the join is given up
+	transferBackoff    = 100 * time.Millisecond
+)
+
+var crc_table = crc32.MakeTable(crc32.Castagnoli)
+
+func appendString(b []byte, s string) []byte {
+	n := len(s)
+	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(b, s...)
+}
+
+// CRC-32C of items in order. Lengths are included so (key, value) boundaries count
+func itemsChecksum(items []TransferItem) uint32 {
+	var sum uint32
+	var buf []byte
+	for _, item := range items {
+		buf = appendString(appendString(buf[:0], item.Key), item.Value)
+		if item.Deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		v := item.Version
+		buf = append(buf, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		sum = crc32.Update(sum, crc_table, buf)
+	}
+	return sum
+}
+
+// CRC-32C of the (key, value)s of items sorted by key
+func rangeChecksum(items map[string]string) uint32 {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]TransferItem, len(keys))
+	for i, k := range keys {
+		list[i] = TransferItem{Key: k, Value: items[k]}
+	}
+	return itemsChecksum(list)
+}
+
+/*
+State of a join kept by the successor of the joiner. keys is set once and never changed. lock guards dirty, phase, commit, frozen
+and the Table of the joiner
+*/
+type transfer struct {
+	start  ring.ID  // first key of the range i.e the id of the joiner's predecessor + 1
+	keys   []string // keys of the range when the join was registered, sorted
+	lock   sync.Mutex
+	dirty  map[string]bool // keys of the range written since the join was registered
+	phase  joinphase       // see handoff.go
+	commit *TransferChunk  // reply of JoinedSucc once committed, sent again if JoinedSucc is repeated
+	frozen chan struct{}   // set once JoinedSucc found the joiner behind, writes to the range wait for it to be closed
+}
+
+// joiner with id key reached at conn, taking over the range [start, key]
+func newJoiner(key ring.ID, conn *HostData, start ring.ID) *Joiner {
+	return &Joiner{N: key, Conn: conn, xfer: &transfer{start: start, keys: []string{}, dirty: make(map[string]bool)}}
+}
+
+// True if key with sha sha is in the range of joiner j
+func (j *Joiner) inRange(sha ring.ID) bool {
+	return sha.Between(j.xfer.start, j.N.Add(ring.FromInt(1)), ring.ClosedOpen)
+}
+
+/*
+Records a write to key, which is resent by the final chunk. Returns the channel to wait on instead if writes to the range of j are
+frozen, nil otherwise
+*/
+func (j *Joiner) mark(key string, sha ring.ID) <-chan struct{} {
+	if !j.inRange(sha) {
+		return nil
+	}
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	if j.xfer.frozen != nil {
+		return j.xfer.frozen
+	}
+	j.xfer.dirty[key] = true
+	return nil
+}
+
+// Lets the writes waiting for the join through, once it committed or aborted. Assumes lock is held
+func (x *transfer) thaw() {
+	if x.frozen != nil {
+		close(x.frozen)
+		x.frozen = nil
+	}
+}
+
+// current phase of the join of j
+func (j *Joiner) phase() joinphase {
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	return j.xfer.phase
+}
+
+/*
+Applies the local write fn to key. If a join is registered, the write is recorded for the joiner first. The record and the write
+happen under lock, so a write is either seen by the key snapshot of a join registered later or recorded for it.
+A write to the range of a join being committed waits until the join commits or aborts, without lock
+*/
+func (lns *LocNodeStruct) write(key string, sha ring.ID, fn func() error) error {
+	lns.lock.RLock()
+	for lns.joiner != nil {
+		frozen := lns.joiner.mark(key, sha)
+		if frozen == nil {
+			break
+		}
+		lns.lock.RUnlock()
+		<-frozen
+		lns.lock.RLock()
+	}
+	defer lns.lock.RUnlock()
+	return handoverError(fn())
+}
+
+/*
+A request that checked the local node stores its key right before a join committed finds the key moved out of the store.
+It fails with NapiBusyError so the caller retries and reaches the joiner
+*/
+func handoverError(err error) error {
+	if _, ok := err.(*CM.CMRangeError); ok {
+		return NewNapiBusyError()
+	}
+	return err
+}
+
+/*
+Registers joiner j and snapshots the keys of its range. Writes wait for the snapshot, later ones are recorded.
+Assumes the local node is BusyJoin. NapiBusyError if the join was aborted meanwhile
+*/
+func (lns *LocNodeStruct) registerJoiner(j *Joiner) error {
+	lns.lock.Lock()
+	defer lns.lock.Unlock()
+	if j.phase() != phaseTransfer { // lease expired
+		return NewNapiBusyError()
+	}
+	for _, k := range lns.cm.GetKeys() {
+		if j.inRange(CM.StrToSha(k)) {
+			j.xfer.keys = append(j.xfer.keys, k)
+		}
+	}
+	sort.Strings(j.xfer.keys)
+	lns.joiner = j
+	return nil
+}
+
+/*
+Sends a chunk of the range of a registered joiner, or prepares the join if request.Final is set. Only called by the joiner
+pulling its range. CallerError if no join of request.Key is registered or it is committing. Pushes back the timeout of the join
+*/
+func (napi *NAPI) TransferRange(request *TransferRequest, reply *TransferChunk) error {
+	ln := napi.ln
+	ln.lock.RLock()
+	j := ln.joiner
+	ln.lock.RUnlock()
+	if j == nil || j.N != request.Key {
+		return NewNapiCallerError()
+	}
+	ln.extendState(j.epoch, join_timeout)
+	if request.Final {
+		return ln.prepareJoin(j, reply)
+	}
+	if phase := j.phase(); phase != phaseTransfer && phase != phasePrepared {
+		return NewNapiCallerError()
+	}
+	max_items, max_bytes := request.MaxItems, request.MaxBytes
+	if max_items <= 0 || max_items > maxChunkItems {
+		max_items = maxChunkItems
+	}
+	if max_bytes <= 0 || max_bytes > maxChunkBytes {
+		max_bytes = maxChunkBytes
+	}
+	keys := j.xfer.keys
+	i := request.Cursor
+	if i < 0 || i > len(keys) {
+		return NewNapiRangeError()
+	}
+	items := []TransferItem{}
+	size := 0
+	for ; i < len(keys) && len(items) < max_items && size < max_bytes; i++ {
+		e, err := ln.cm.Lookup(keys[i])
+		if err != nil || e.Deleted { // deleted since the snapshot, recorded as dirty
+			continue
+		}
+		items = append(items, itemOf(keys[i], e))
+		size += len(keys[i]) + len(e.Value)
+	}
+	reply.Items = items
+	reply.Next = i
+	reply.Done = i == len(keys)
+	reply.Checksum = itemsChecksum(items)
+	return nil
+}
+
+/*
+Fills reply with the final chunk of joiner j and moves the join to prepared. The range is read while no write is made, so the
+chunk matches the range. Can be repeated if the reply is lost
+*/
+func (lns *LocNodeStruct) prepareJoin(j *Joiner, reply *TransferChunk) error {
+	lns.lock.Lock()
+	defer lns.lock.Unlock()
+	j.xfer.lock.Lock()
+	defer j.xfer.lock.Unlock()
+	if j.xfer.phase != phaseTransfer && j.xfer.phase != phasePrepared {
+		return NewNapiCallerError()
+	}
+	j.finalChunk(j.entries(lns.cm), reply)
+	j.xfer.phase = phasePrepared
+	return nil
+}
+
+// values and tombstones of the range of joiner j in store
+func (j *Joiner) entries(store CM.Store) map[string]CM.Entry {
+	entries := store.Entries()
+	for k := range entries {
+		if !j.inRange(CM.StrToSha(k)) {
+			delete(entries, k)
+		}
+	}
+	return entries
+}
+
+/*
+Fills reply with the state of the keys written since the join was registered, the tombstones and the checksum of the range of
+joiner j, whose values and tombstones are entries. Assumes j.xfer.lock is held
+*/
+func (j *Joiner) finalChunk(entries map[string]CM.Entry, reply *TransferChunk) {
+	keys := make([]string, 0, len(j.xfer.dirty))
+	items := make(map[string]string, len(entries))
+	for k, e := range entries {
+		if !e.Deleted {
+			items[k] = e.Value
+		} else if !j.xfer.dirty[k] {
+			keys = append(keys, k)
+		}
+	}
+	for k := range j.xfer.dirty {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	reply.Items = make([]TransferItem, len(keys))
+	for i, k := range keys {
+		e, present := entries[k]
+		if !present { // deleted and compacted meanwhile
+			e = CM.Entry{Deleted: true}
+		}
+		reply.Items[i] = itemOf(k, e)
+	}
+	reply.Next = len(j.xfer.keys)
+	reply.Done = true
+	reply.Checksum = itemsChecksum(reply.Items)
+	reply.RangeSum = rangeChecksum(items)
+	reply.Count = len(items)
+}
+
+// item of the entry e of key
+func itemOf(key string, e CM.Entry) TransferItem {
+	return TransferItem{Key: key, Value: e.Value, Deleted: e.Deleted, Version: e.Version}
+}
+
+// entry of item. A tombstone of unknown version is taken as made now
+func entryOf(item TransferItem) CM.Entry {
+	if item.Deleted && item.Version == 0 {
+		return CM.Entry{Version: CM.NewTombstone().Version, Deleted: true}
+	}
+	return CM.Entry{Value: item.Value, Version: item.Version, Deleted: item.Deleted}
+}
+
+/*
+Stores item into store unless store holds an entry of its key at least as new, see CM.Apply. Returns whether it was stored, and the
+error of store if it is not CMCASError
+*/
+func applyItem(store CM.Store, item TransferItem) (bool, error) {
+	err := CM.Apply(store, item.Key, entryOf(item))
+	if _, stale := err.(*CM.CMCASError); stale {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/*
+Calls method of succ until the chunk it replies passes its checksum. Failed calls are made again after a backoff, up to
+maxTransferRetries times
+*/
+func callChunk(tr Transport, succ HostData, method string, args interface{}, chunk *TransferChunk) error {
+	var err error
+	for failures := 0; failures < maxTransferRetries; failures++ {
+		if failures > 0 {
+			time.Sleep(transferBackoff)
+		}
+		*chunk = TransferChunk{}
+		err = tr.Call(context.Background(), succ, method, args, chunk)
+		if err == nil && chunk.Checksum != itemsChecksum(chunk.Items) {
+			err = NewNapiChecksumError()
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/*
+Stores the items of chunk on joiner jln. For a final chunk, also checks the store of jln against the range of the chunk.
+Returns NapiChecksumError if they do not match
+*/
+func applyChunk(jln *LocNodeStruct, chunk *TransferChunk, final bool) error {
+	for _, item := range chunk.Items {
+		if _, err := applyItem(jln.cm, item); err != nil {
+			return err
+		}
+	}
+	if final {
+		items := jln.cm.Items()
+		if len(items) != chunk.Count || rangeChecksum(items) != chunk.RangeSum {
+			return NewNapiChecksumError()
+		}
+	}
+	return nil
+}
+
+/*
+Pulls the range of joiner jln from its successor succ, ending with the final chunk which prepares the join. Returns
+NapiChecksumError if the store of jln does not match the range
+*/
+func pullRange(tr Transport, jln *LocNodeStruct, succ HostData) error {
+	request := TransferRequest{Key: jln.end, MaxItems: chunkItems, MaxBytes: chunkBytes}
+	for {
+		var chunk TransferChunk
+		if err := callChunk(tr, succ, "NAPI.TransferRange", &request, &chunk); err != nil {
+			return err
+		}
+		if err := applyChunk(jln, &chunk, request.Final); err != nil || request.Final {
+			return err
+		}
+		request.Cursor = chunk.Next
+		request.Final = chunk.Done
+	}
+}
+
+/*
+Commits the prepared join of jln on its successor succ. JoinedSucc is sent the checksum of the store of jln and commits only if it
+matches the range, else jln stores the writes the successor replies with, checks them like a final chunk and asks again, up to
+maxTransferRetries times. The successor holds writes to the range back from the first mismatch on, so the second JoinedSucc
+commits unless a reply was lost. So jln holds its whole range before it owns it and nothing left to do can fail the join once
+committed. JoinedSucc is repeated if its reply is lost. NapiChecksumError if jln does not catch up with the range
+*/
+func commitRange(tr Transport, jln *LocNodeStruct, request *JoinRequest, succ HostData) error {
+	for tries := 0; tries < maxTransferRetries; tries++ {
+		items := jln.cm.Items()
+		request.RangeSum, request.Count = rangeChecksum(items), len(items)
+		var chunk TransferChunk
+		if err := callChunk(tr, succ, "NAPI.JoinedSucc", request, &chunk); err != nil {
+			return err
+		}
+		if chunk.Committed { // the values match, only tombstones of keys written and deleted meanwhile may be missing
+			for _, item := range chunk.Items {
+				applyItem(jln.cm, item) // every item is in the range of jln
+			}
+			return nil
+		}
+		if err := applyChunk(jln, &chunk, true); err != nil {
+			return err
+		}
+	}
+	return NewNapiChecksumError()
+}
@@ -0,0 +1,265 @@
+package nodeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"go_dht/tracing"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Transport carries the NAPI calls of a node to its peers and serves the NAPI methods of the node. Every peer call of a
+LocNodeStruct goes through the Transport it was created with
+*/
+type Transport interface {
+	/*
+		Calls method, e.g "NAPI.Get", of the node at peer. Errors returned by the method arrive as rpc.ServerError holding the
+		error message. Gives up once ctx is done
+	*/
+	Call(ctx context.Context, peer HostData, method string, args interface{}, reply interface{}) error
+	/*
+		Serves the NAPI methods of ln until the returned Closer is closed. listen_addr is the address to bind to, if the
+		transport binds to one
+	*/
+	Serve(ln *LocNodeStruct, listen_addr string) (io.Closer, error)
+}
+
+// Transport of nodes created by LocalInit and Join
+var DefaultTransport Transport = RPCTransport{}
+
+/*
+Transport over the network. Calls use the protocol set with SetProtocol and Serve runs NapiStartOn, which serves both
+net/rpc and gRPC
+*/
+type RPCTransport struct{}
+
+func (RPCTransport) Call(ctx context.Context, peer HostData, method string, args interface{}, reply interface{}) error {
+	return CallContext(ctx, peer.Hostname, peer.Port, method, args, reply)
+}
+
+func (RPCTransport) Serve(ln *LocNodeStruct, listen_addr string) (io.Closer, error) {
+	return NapiStartOn(ln, listen_addr)
+}
+
+/*
+Returns the NAPI method net/rpc would export under name, e.g "Get". false if there is none
+*/
+func napiMethod(name string) (reflect.Method, bool) {
+	method, ok := reflect.TypeOf(&NAPI{}).MethodByName(name)
+	if !ok {
+		return method, false
+	}
+	mtype := method.Type
+	ok = mtype.NumIn() == 3 && mtype.In(1).Kind() == reflect.Ptr && mtype.In(2).Kind() == reflect.Ptr && mtype.NumOut() == 1
+	return method, ok
+}
+
+/*
+Calls method with args, decoded by the transport serving napi, for a call of the request of ctx. ctx holds the span of the caller
+if it sent one. The gRPC and in process transports serve their calls through invoke, net/rpc through rpc.Server, see rpcserver.go.
+Returns the reply of the method and its error
+*/
+func (napi *NAPI) invoke(ctx context.Context, method reflect.Method, args reflect.Value) (reflect.Value, error) {
+	call := napi.begin(ctx, method.Name, args.Interface())
+	reply := reflect.New(method.Type.In(2).Elem())
+	var err error
+	if errv := method.Func.Call([]reflect.Value{reflect.ValueOf(call.napi), args, reply})[0]; !errv.IsNil() {
+		err = errv.Interface().(error)
+	}
+	call.end(err)
+	return reply, err
+}
+
+// a NAPI call being served, from begin to end
+type serverCall struct {
+	napi   *NAPI // handles the call, on behalf of its request
+	method string
+	span   *tracing.Span
+	start  time.Time
+}
+
+/*
+Starts serving a call of method, e.g "Get", with args for the request of ctx. A call without a request id entered the ring at the
+local node and gets a new one. The call is a server span of the node, the child of the span of ctx
+*/
+func (napi *NAPI) begin(ctx context.Context, method string, args interface{}) *serverCall {
+	ctx = ensureRequestID(ctx)
+	ctx, span := tracer.Start(ctx, "NAPI."+method, tracing.KindServer)
+	if span != nil {
+		span.SetAttributes(callAttrs(napi.ln, ctx, method, args)...)
+	}
+	return &serverCall{napi: napi.with(ctx), method: method, span: span, start: time.Now()}
+}
+
+/*
+Ends the call, which failed with err if it is not nil. The call is recorded in the metrics, the log and the span of the node
+*/
+func (call *serverCall) end(err error) {
+	took := time.Since(call.start)
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	call.napi.ln.metrics.observe(call.method, took, msg)
+	endSpan(call.span, err)
+	if outcome := outcome(msg); outcome == "error" { // errors clients act on are not worth a warning
+		call.napi.log().Warn("call failed", "method", call.method, "took", took, "err", msg)
+	} else {
+		call.napi.log().Debug("call handled", "method", call.method, "outcome", outcome, "took", took)
+	}
+}
+
+// wraps a func as an io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+/******** In process transport **********/
+
+// a call sent to a node served by a ChanTransport. args and the reply are gob encoded as on the wire
+type chanCall struct {
+	method      string
+	request_id  string
+	traceparent string
+	args        []byte
+	reply       chan chanReply
+}
+
+type chanReply struct {
+	data []byte
+	err  error
+}
+
+type chanNode struct {
+	calls chan chanCall
+	done  chan struct{} // closed when the node stops serving
+}
+
+/*
+Transport connecting nodes of the same process through channels. Nodes are reached by the hostname and port they were
+created with, so many nodes can run inside a single test binary. Args and replies are gob encoded like net/rpc does,
+so callers and methods never share memory. Calls to nodes that are not served fail with NapiConnError
+*/
+type ChanTransport struct {
+	lock  sync.RWMutex
+	nodes map[HostData]*chanNode
+}
+
+func NewChanTransport() *ChanTransport {
+	return &ChanTransport{nodes: make(map[HostData]*chanNode)}
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (ct *ChanTransport) Call(ctx context.Context, peer HostData, method string, args interface{}, reply interface{}) error {
+	ct.lock.RLock()
+	node := ct.nodes[peer]
+	ct.lock.RUnlock()
+	if node == nil {
+		return NewNapiConnError()
+	}
+	data, err := gobEncode(args)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, call_timeout)
+	defer cancel()
+	call := chanCall{method: method, request_id: RequestID(ctx), traceparent: traceparent(ctx), args: data,
+		reply: make(chan chanReply, 1)}
+	select {
+	case node.calls <- call:
+	case <-node.done:
+		return NewNapiConnError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case r := <-call.reply:
+		if r.err != nil {
+			return r.err
+		}
+		return gobDecode(r.data, reply)
+	case <-node.done:
+		return NewNapiConnError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Serves ln at its hostname and port. listen_addr is not used. Fails if another node is served at the same address
+*/
+func (ct *ChanTransport) Serve(ln *LocNodeStruct, listen_addr string) (io.Closer, error) {
+	addr := HostData{Hostname: ln.hostname, Port: ln.port}
+	node := &chanNode{calls: make(chan chanCall), done: make(chan struct{})}
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if ct.nodes[addr] != nil {
+		return nil, fmt.Errorf("%s:%s is already served", addr.Hostname, addr.Port)
+	}
+	ct.nodes[addr] = node
+	go node.serve(&NAPI{ln: ln})
+	var once sync.Once
+	return closerFunc(func() error {
+		once.Do(func() {
+			ct.lock.Lock()
+			delete(ct.nodes, addr)
+			ct.lock.Unlock()
+			close(node.done)
+		})
+		return nil
+	}), nil
+}
+
+// handles calls until the node is closed. Calls run concurrently like with net/rpc
+func (node *chanNode) serve(napi *NAPI) {
+	for {
+		select {
+		case call := <-node.calls:
+			go func() { call.reply <- napi.dispatch(call) }()
+		case <-node.done:
+			return
+		}
+	}
+}
+
+// decodes args, calls the method and encodes its reply. Errors of the method are returned as rpc.ServerError
+func (napi *NAPI) dispatch(call chanCall) chanReply {
+	method, ok := napiMethod(strings.TrimPrefix(call.method, "NAPI."))
+	if !ok || !strings.HasPrefix(call.method, "NAPI.") {
+		return chanReply{err: rpc.ServerError("rpc: can't find method " + call.method)}
+	}
+	args := reflect.New(method.Type.In(1).Elem())
+	if err := gobDecode(call.args, args.Interface()); err != nil {
+		return chanReply{err: rpc.ServerError(err.Error())}
+	}
+	ctx := withTraceparent(WithRequestID(context.Background(), call.request_id), call.traceparent)
+	reply, err := napi.invoke(ctx, method, args)
+	if err != nil {
+		return chanReply{err: rpc.ServerError(err.Error())}
+	}
+	data, err := gobEncode(reply.Interface())
+	if err != nil {
+		return chanReply{err: rpc.ServerError(err.Error())}
+	}
+	return chanReply{data: data}
+}
+
+/******** In process transport end **********/
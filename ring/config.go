@@ -0,0 +1,120 @@
+package ring
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"sync/atomic"
+)
+
+// hash function used to map keys and node addresses onto the ring
+type HashKind int
+
+const (
+	SHA1   HashKind = 0
+	SHA256 HashKind = 1
+)
+
+/*
+Ring level settings. Every node of a chord ring must use the same Config, joiners with a different one are refused.
+Bits is the identifier width m i.e ids are in [0, 2^m). The hash output is truncated to its low Bits bits
+*/
+type Config struct {
+	Hash HashKind
+	Bits uint32
+}
+
+// settings used by this process, see current. nil until set, meaning SHA-1 at 160 bits
+var cur atomic.Pointer[Config]
+
+// settings used by this process. Read once per call, so a call never mixes two settings
+func current() Config {
+	if cfg := cur.Load(); cfg != nil {
+		return *cfg
+	}
+	return Config{Hash: SHA1, Bits: 160}
+}
+
+/*
+Returns the number of bits in the digest of the hash function. 0 if unknown
+*/
+func (h HashKind) Size() uint32 {
+	switch h {
+	case SHA1:
+		return sha1.Size * 8
+	case SHA256:
+		return sha256.Size * 8
+	}
+	return 0
+}
+
+func (h HashKind) String() string {
+	switch h {
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
+
+/*
+Returns the HashKind named by s i.e "sha1" or "sha256". RingConfigError if unknown
+*/
+func ParseHash(s string) (HashKind, error) {
+	switch s {
+	case "sha1":
+		return SHA1, nil
+	case "sha256":
+		return SHA256, nil
+	}
+	return SHA1, NewRingConfigError()
+}
+
+/*
+Checks that cfg is usable i.e known hash and 0 < Bits <= digest size of the hash. Returns RingConfigError if not
+*/
+func (cfg Config) Validate() error {
+	if cfg.Bits == 0 || cfg.Bits > cfg.Hash.Size() {
+		return NewRingConfigError()
+	}
+	return nil
+}
+
+/*
+Sets the ring settings for this process. Must be called before any id is created as ids made under
+different settings cannot be mixed. Safe for concurrent use with the functions reading the settings. Returns RingConfigError if
+cfg is not valid
+*/
+func SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cur.Store(&cfg)
+	return nil
+}
+
+/*
+Returns the ring settings of this process
+*/
+func CurConfig() Config {
+	return current()
+}
+
+/*
+Returns the identifier width m of the ring
+*/
+func Bits() uint32 {
+	return current().Bits
+}
+
+/*
+Hashes data with the configured hash function and returns the id it maps to
+*/
+func Hash(data []byte) ID {
+	if current().Hash == SHA256 {
+		sum := sha256.Sum256(data)
+		return FromBytes(sum[:])
+	}
+	sum := sha1.Sum(data)
+	return FromBytes(sum[:])
+}
@@ -0,0 +1,262 @@
+package ring
+
+import (
+	"encoding/hex"
+	"go_dht/constants"
+)
+
+/*
+Identifier on the chord ring. Treated as an unsigned big endian number and all arithmetic is done modulo 2^Bits().
+Bits above Bits() are always 0 so ids can be compared with ==
+*/
+type ID [constants.MaxShaSize]byte
+
+type Ord int
+
+const (
+	Less    Ord = -1
+	Equal   Ord = 0
+	Greater Ord = 1
+)
+
+// Kind of interval used by Between. Names give the (start, end) bounds
+type Interval int
+
+const (
+	OpenOpen     Interval = 0 // (a, b)
+	OpenClosed   Interval = 1 // (a, b]
+	ClosedOpen   Interval = 2 // [a, b)
+	ClosedClosed Interval = 3 // [a, b]
+)
+
+/*
+Convert an unsigned int n into the ID representing the int
+*/
+func FromInt(n uint32) ID {
+	var ret ID
+	const size_int = 4 // num bytes in an uint32
+	for i := uint32(1); i <= size_int; i++ {
+		ret[constants.MaxShaSize-i] = byte(n & 255) // extract the last 8 bits in n
+		n = n >> 8                                  // 8 bits in a byte
+	}
+	return ret.mask()
+}
+
+/*
+Converts a big endian byte slice into an ID. Only the low Bits() bits of b are kept
+*/
+func FromBytes(b []byte) ID {
+	var ret ID
+	if len(b) > len(ret) {
+		b = b[len(b)-len(ret):]
+	}
+	copy(ret[len(ret)-len(b):], b) // right align
+	return ret.mask()
+}
+
+/*
+Returns the highest id possible i.e 2^Bits() - 1
+*/
+func MaxVal() ID {
+	var ret ID
+	for i := range ret {
+		ret[i] = 0xff
+	}
+	return ret.mask()
+}
+
+/*
+Calculates 2^i and returns the result as an ID. If i >= than Bits(), returns 0
+*/
+func Pow2(i uint32) ID {
+	var ret ID
+	if i >= Bits() {
+		return ret
+	}
+	size_byte := uint32(8)
+	byte_i := (constants.MaxShaNumBits - 1 - i) / size_byte // index of the byte to set
+	bit_i := i % size_byte                                  // bit within the byte to set
+	ret[byte_i] = byte(1) << bit_i
+	return ret
+}
+
+/*
+Parses a hex string of exactly 2*ceil(Bits()/8) characters into an ID. Values >= 2^Bits() are rejected
+*/
+func FromHex(s string) (ID, error) {
+	return current().FromHex(s)
+}
+
+/*
+Same as FromHex for a ring with the settings cfg instead of the settings of this process, which are left alone. Used to read ids
+before the settings of the process are set
+*/
+func (cfg Config) FromHex(s string) (ID, error) {
+	var ret ID
+	n := int((cfg.Bits + 7) / 8)
+	if len(s) != 2*n {
+		return ret, NewRingHexError()
+	}
+	if _, err := hex.Decode(ret[len(ret)-n:], []byte(s)); err != nil {
+		return ret, NewRingHexError()
+	}
+	if ret.maskTo(cfg.Bits) != ret {
+		return ret, NewRingHexError()
+	}
+	return ret, nil
+}
+
+// number of bytes needed to hold Bits() bits
+func numBytes() int {
+	return int((Bits() + 7) / 8)
+}
+
+/*
+Clears every bit at position >= Bits(). Ensures the result is in [0, 2^Bits())
+*/
+func (a ID) mask() ID {
+	return a.maskTo(Bits())
+}
+
+// same as mask for a ring of bits bits
+func (a ID) maskTo(bits uint32) ID {
+	keep := bits / 8 // number of low bytes kept whole
+	rem := bits % 8  // number of bits kept in the next byte
+	top := len(a) - int(keep) - 1
+	for i := 0; i < top; i++ {
+		a[i] = 0
+	}
+	if top >= 0 {
+		a[top] &= byte(1)<<rem - 1
+	}
+	return a
+}
+
+/*
+Returns a + b modulo 2^Bits() i.e ignores the carry out bit
+*/
+func (a ID) Add(b ID) ID {
+	var c_out uint32 = 0
+	var temp uint32 // holds temp sum
+	var ret ID
+	for i := len(a) - 1; i >= 0; i-- {
+		temp = uint32(a[i]) + uint32(b[i]) + c_out
+		c_out = temp >> 8
+		ret[i] = byte(temp & 0xff) // get the last 8 bits
+	}
+	return ret.mask()
+}
+
+/*
+Returns a - b modulo 2^Bits(). Wraps around if b > a
+*/
+func (a ID) Sub(b ID) ID {
+	return a.Add(b.Not().Add(FromInt(1))) // a + 2's complement of b
+}
+
+/*
+Returns the bitwise not of a within the low Bits() bits
+*/
+func (a ID) Not() ID {
+	var ret ID
+	for i, x := range a {
+		ret[i] = ^x
+	}
+	return ret.mask()
+}
+
+/*
+Returns a/2. Simply does a right shift on the array.
+*/
+func (a ID) Div2() ID {
+	var shift_out bool = false // true if a bit was shifted out
+	var ret ID
+	for i, x := range a {
+		if shift_out {
+			ret[i] = 0x80 | (x >> 1)
+		} else {
+			ret[i] = x >> 1
+		}
+		shift_out = (x & 1) > 0 // true if lsb of x is set
+	}
+	return ret
+}
+
+/*
+Compares 2 ids as unsigned numbers. Returns Less if a < b, Equal if a == b ...
+*/
+func (a ID) Cmp(b ID) Ord {
+	for i := range a {
+		if a[i] < b[i] {
+			return Less
+		} else if a[i] > b[i] {
+			return Greater
+		}
+	}
+	return Equal
+}
+
+/*
+Returns the top n bits of a, i.e a / 2^(Bits() - n), for n <= 32. If n > Bits(), the Bits() bits of a are shifted up to n bits.
+Ids in the same arc of 2^(Bits() - n) ids starting at a multiple of it share their prefix
+*/
+func (a ID) Prefix(n uint32) uint32 {
+	var ret uint32
+	for i := uint32(0); i < n; i++ {
+		ret <<= 1
+		if i >= Bits() {
+			continue
+		}
+		bit := Bits() - 1 - i // position of the i'th bit from the top
+		ret |= uint32(a[len(a)-1-int(bit/8)]>>(bit%8)) & 1
+	}
+	return ret
+}
+
+/*
+Checks if x lies on the clockwise arc from a to b with the bounds given by iv. Wrap arounds where b < a are handled.
+If a == b the arc is the whole ring, so only (a, a) excludes anything and it excludes a itself
+*/
+func (x ID) Between(a ID, b ID, iv Interval) bool {
+	dist := x.Sub(a) // clockwise distance from a to x
+	if a == b {
+		return iv != OpenOpen || dist != ID{}
+	}
+	span := b.Sub(a) // clockwise distance from a to b. Never 0 here
+	switch iv {
+	case OpenOpen:
+		return dist != ID{} && dist.Cmp(span) == Less
+	case OpenClosed:
+		return dist != ID{} && dist.Cmp(span) != Greater
+	case ClosedOpen:
+		return dist.Cmp(span) == Less
+	default: // ClosedClosed
+		return dist.Cmp(span) != Greater
+	}
+}
+
+/*
+Returns the id as a lower case hex string of 2*ceil(Bits()/8) characters
+*/
+func (a ID) String() string {
+	return hex.EncodeToString(a[len(a)-numBytes():])
+}
+
+/*
+Implements encoding.TextMarshaler. Also used by encoding/json
+*/
+func (a ID) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+/*
+Implements encoding.TextUnmarshaler. Also used by encoding/json
+*/
+func (a *ID) UnmarshalText(text []byte) error {
+	id, err := FromHex(string(text))
+	if err != nil {
+		return err
+	}
+	*a = id
+	return nil
+}
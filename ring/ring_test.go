@@ -0,0 +1,267 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"go_dht/constants"
+	"math/big"
+	"testing"
+)
+
+/******** Helper Functions **********/
+
+// widths the fuzzers check every input against. Covers the default, tiny test rings, unaligned widths and sha256
+var fuzzWidths = []Config{{SHA1, 160}, {SHA1, 8}, {SHA1, 13}, {SHA256, 256}}
+
+// 2^Bits()
+func modulus() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(Bits()))
+}
+
+// runs fn once under every config in fuzzWidths then restores the default
+func forWidths(t *testing.T, fn func()) {
+	defer SetConfig(Config{SHA1, 160})
+	for _, cfg := range fuzzWidths {
+		if err := SetConfig(cfg); err != nil {
+			t.Fatalf("SetConfig(%v) failed\n", cfg)
+		}
+		fn()
+	}
+}
+
+func toBig(a ID) *big.Int {
+	return new(big.Int).SetBytes(a[:])
+}
+
+// reference implementation of Between comparing x with a and b as integers, without the distances Between works with
+func bigBetween(x ID, a ID, b ID, iv Interval) bool {
+	xb, ab, bb := toBig(x), toBig(a), toBig(b)
+	past_a := xb.Cmp(ab) > 0
+	if iv == ClosedOpen || iv == ClosedClosed {
+		past_a = xb.Cmp(ab) >= 0
+	}
+	before_b := xb.Cmp(bb) < 0
+	if iv == OpenClosed || iv == ClosedClosed {
+		before_b = xb.Cmp(bb) <= 0
+	}
+	if ab.Cmp(bb) < 0 {
+		return past_a && before_b
+	}
+	return past_a || before_b // wraps past 0. a == b is the full ring, (a, a) only excludes a
+}
+
+/*************** Testing ***************/
+
+func TestFromInt(t *testing.T) {
+	var n uint32 = 255 << 8
+	ret := FromInt(n)
+	if ret[constants.MaxShaSize-2] != 255 || ret[constants.MaxShaSize-1] != 0 {
+		t.Errorf("From Int not correct\n")
+	}
+}
+
+func TestArith(t *testing.T) {
+	a := Pow2(Bits() - 1) // MSB set
+	b := a.Div2()
+	c := a.Sub(b)
+	if b.Cmp(c) != Equal {
+		t.Errorf("Test 1 failed in TestArith")
+	}
+	if MaxVal().Add(FromInt(1)) != FromInt(0) {
+		t.Errorf("MaxVal + 1 should wrap around to 0")
+	}
+	if FromInt(0).Sub(FromInt(1)) != MaxVal() {
+		t.Errorf("0 - 1 should wrap around to MaxVal")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	if Pow2(Bits()-1).Prefix(1) != 1 || MaxVal().Prefix(10) != 1023 || FromInt(1).Prefix(10) != 0 {
+		t.Errorf("Prefix should give the top bits\n")
+	}
+	if MaxVal().Div2().Prefix(2) != 1 || MaxVal().Div2().Add(FromInt(1)).Prefix(2) != 2 {
+		t.Errorf("Prefix should split the ring into equal arcs\n")
+	}
+	saved := CurConfig()
+	defer SetConfig(saved)
+	SetConfig(Config{Hash: SHA256, Bits: 8})
+	if FromInt(0x81).Prefix(10) != 0x81<<2 {
+		t.Errorf("Prefix wider than the ring should shift the id up\n")
+	}
+}
+
+func TestBetween(t *testing.T) {
+	start := MaxVal()
+	end := FromInt(0)
+	if !start.Between(start, end, ClosedOpen) {
+		t.Error("Range test 1 failed")
+	}
+	if end.Between(start, end, ClosedOpen) {
+		t.Error("Range test 2 failed")
+	}
+	start = MaxVal().Sub(FromInt(1))
+	end = FromInt(2)
+	if !FromInt(1).Between(start, end, ClosedOpen) {
+		t.Error("Range test 3 failed")
+	}
+	if !MaxVal().Between(start, end, OpenOpen) {
+		t.Error("Range test 4 failed")
+	}
+	if start.Between(start, end, OpenClosed) || !end.Between(start, end, OpenClosed) {
+		t.Error("Range test 5 failed")
+	}
+	start = FromInt(0)
+	end = MaxVal().Sub(FromInt(1))
+	if !Pow2(159).Between(start, end, ClosedClosed) {
+		t.Error("Range test 6 failed")
+	}
+	if MaxVal().Between(start, end, ClosedClosed) {
+		t.Error("Range test 7 failed")
+	}
+	// a == b is the full ring
+	if !start.Between(start, start, OpenClosed) || start.Between(start, start, OpenOpen) || !end.Between(start, start, OpenOpen) {
+		t.Error("Range test 8 failed")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	a := Pow2(100).Add(FromInt(0xabcdef))
+	b, err := FromHex(a.String())
+	if err != nil || a != b {
+		t.Errorf("Hex round trip failed for %s\n", a)
+	}
+	if _, err = FromHex("xyz"); err == nil {
+		t.Errorf("FromHex should fail on bad input\n")
+	}
+	data, err := json.Marshal(map[string]ID{"id": a})
+	if err != nil {
+		t.Errorf("json marshal failed. err = %s\n", err.Error())
+	}
+	var out map[string]ID
+	if err = json.Unmarshal(data, &out); err != nil || out["id"] != a {
+		t.Errorf("json round trip failed. got %s\n", data)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer SetConfig(Config{SHA1, 160})
+	if SetConfig(Config{SHA1, 161}) == nil || SetConfig(Config{SHA256, 0}) == nil || SetConfig(Config{HashKind(7), 8}) == nil {
+		t.Errorf("SetConfig should reject invalid configs\n")
+	}
+	if CurConfig() != (Config{SHA1, 160}) {
+		t.Errorf("Invalid config should not be applied\n")
+	}
+	if err := SetConfig(Config{SHA256, 8}); err != nil {
+		t.Errorf("SetConfig failed on a valid config\n")
+	}
+	if MaxVal() != FromInt(255) || MaxVal().Add(FromInt(1)) != FromInt(0) || Pow2(8) != FromInt(0) {
+		t.Errorf("8 bit ring arithmetic wrong\n")
+	}
+	if Hash([]byte("key")) != FromInt(uint32(sha256.Sum256([]byte("key"))[31])) {
+		t.Errorf("Hash should keep the low 8 bits of sha256\n")
+	}
+	if FromInt(0xab).String() != "ab" {
+		t.Errorf("8 bit id should print as 2 hex chars. Got %s\n", FromInt(0xab))
+	}
+	if _, err := FromHex("abcd"); err == nil {
+		t.Errorf("FromHex should reject ids wider than the ring\n")
+	}
+	// ids of another ring are read without touching the settings of the process
+	var wide ID
+	wide[len(wide)-2], wide[len(wide)-1] = 0xab, 0xcd
+	if id, err := (Config{SHA1, 16}).FromHex("abcd"); err != nil || id != wide || CurConfig() != (Config{SHA256, 8}) {
+		t.Errorf("Config.FromHex gave %v, err = %v\n", id, err)
+	}
+	if _, err := (Config{SHA1, 12}).FromHex("ffff"); err == nil {
+		t.Errorf("Config.FromHex should reject ids wider than its ring\n")
+	}
+}
+
+// settings changed while ids are hashed are seen whole, never half of each. Run with -race
+func TestConfigConcurrent(t *testing.T) {
+	defer SetConfig(Config{SHA1, 160})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			SetConfig(fuzzWidths[i%len(fuzzWidths)])
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if cfg := CurConfig(); cfg.Validate() != nil {
+			t.Fatalf("Read a config that was never set %v\n", cfg)
+		}
+		Hash([]byte("key"))
+	}
+}
+
+/*************** Fuzzing ***************/
+
+func FuzzArith(f *testing.F) {
+	f.Add([]byte{0xff}, []byte{0x01})
+	f.Add([]byte{}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x80, 0x00, 0x01}, []byte{0x7f, 0xff})
+	f.Fuzz(func(t *testing.T, ab []byte, bb []byte) {
+		forWidths(t, func() {
+			a, b := FromBytes(ab), FromBytes(bb)
+			sum := new(big.Int).Add(toBig(a), toBig(b))
+			if toBig(a.Add(b)).Cmp(sum.Mod(sum, modulus())) != 0 {
+				t.Errorf("Add(%s, %s) = %s\n", a, b, a.Add(b))
+			}
+			diff := new(big.Int).Sub(toBig(a), toBig(b))
+			if toBig(a.Sub(b)).Cmp(diff.Mod(diff, modulus())) != 0 {
+				t.Errorf("Sub(%s, %s) = %s\n", a, b, a.Sub(b))
+			}
+			if toBig(a.Div2()).Cmp(new(big.Int).Rsh(toBig(a), 1)) != 0 {
+				t.Errorf("Div2(%s) = %s\n", a, a.Div2())
+			}
+			if int(a.Cmp(b)) != toBig(a).Cmp(toBig(b)) {
+				t.Errorf("Cmp(%s, %s) = %d\n", a, b, a.Cmp(b))
+			}
+			if c, err := FromHex(a.String()); err != nil || c != a {
+				t.Errorf("Hex round trip failed for %s\n", a)
+			}
+		})
+	})
+}
+
+func FuzzBetween(f *testing.F) {
+	f.Add([]byte{0x00}, []byte{0xff}, []byte{0x01})
+	f.Add([]byte{0x10}, []byte{0x10}, []byte{0x10})
+	f.Add([]byte{0x01}, []byte{0xff}, []byte{0x00})
+	f.Add([]byte{0x20}, []byte{0x10}, []byte{0x10}) // full ring
+	f.Add([]byte{0x05}, []byte{0xf0}, []byte{0x05}) // end of a wrapping interval
+	f.Add([]byte{0xf0}, []byte{0xf0}, []byte{0x05}) // start of a wrapping interval
+	f.Fuzz(func(t *testing.T, xb []byte, ab []byte, bb []byte) {
+		forWidths(t, func() {
+			x, a, b := FromBytes(xb), FromBytes(ab), FromBytes(bb)
+			for _, iv := range []Interval{OpenOpen, OpenClosed, ClosedOpen, ClosedClosed} {
+				if x.Between(a, b, iv) != bigBetween(x, a, b, iv) {
+					t.Errorf("Between(%s, %s, %s, %d) = %t\n", x, a, b, iv, x.Between(a, b, iv))
+				}
+			}
+		})
+	})
+}
+
+func FuzzPow2(f *testing.F) {
+	f.Add(uint32(0))
+	f.Add(uint32(159))
+	f.Add(uint32(160))
+	f.Fuzz(func(t *testing.T, i uint32) {
+		forWidths(t, func() {
+			exp := big.NewInt(0) // 2^i is out of range for i >= Bits()
+			if i < Bits() {
+				exp.Lsh(big.NewInt(1), uint(i))
+			}
+			if toBig(Pow2(i)).Cmp(exp) != 0 {
+				t.Errorf("Pow2(%d) = %s\n", i, Pow2(i))
+			}
+		})
+	})
+}
@@ -0,0 +1,25 @@
+package ring
+
+type RingHexError struct {
+	message string
+}
+
+func (r RingHexError) Error() string {
+	return r.message
+}
+
+func NewRingHexError() *RingHexError {
+	return &RingHexError{message: "Ring id hex conversion error"}
+}
+
+type RingConfigError struct {
+	message string
+}
+
+func (r RingConfigError) Error() string {
+	return r.message
+}
+
+func NewRingConfigError() *RingConfigError {
+	return &RingConfigError{message: "Ring config error"}
+}
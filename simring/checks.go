@@ -0,0 +1,119 @@
+package simring
+
+import (
+	"errors"
+	"fmt"
+	CM "go_dht/chordmap"
+	NA "go_dht/nodeapi"
+	"go_dht/ring"
+	"sort"
+)
+
+/*
+Invariant checkers of the ring. They read the state of the live nodes directly, so they work while the ring is partitioned
+*/
+
+func addrStr(h NA.HostData) string {
+	return h.Hostname + ":" + h.Port
+}
+
+// live nodes sorted by id
+func (r *Ring) sorted() []*Node {
+	live := r.Live()
+	sort.Slice(live, func(i, j int) bool { return live[i].ID.Cmp(live[j].ID) == ring.Less })
+	return live
+}
+
+/*
+Checks that the successor pointers of the live nodes form a single cycle through every live node in id order, and that
+the predecessor of every node is the node whose successor it is
+*/
+func (r *Ring) CheckCycle() error {
+	live := r.sorted()
+	if len(live) == 0 {
+		return nil
+	}
+	infos := make(map[NA.HostData]NA.NodeInfo)
+	for _, node := range live {
+		info, err := r.Inspect(node)
+		if err != nil {
+			return err
+		}
+		infos[node.Addr] = info
+	}
+	for i, node := range live {
+		info := infos[node.Addr]
+		next := live[(i+1)%len(live)]
+		if info.Succ != next.Addr {
+			if _, ok := infos[info.Succ]; !ok {
+				return fmt.Errorf("successor of %s is %s, which is not a live node", addrStr(node.Addr), addrStr(info.Succ))
+			}
+			return fmt.Errorf("successor of %s is %s, expected %s", addrStr(node.Addr), addrStr(info.Succ), addrStr(next.Addr))
+		}
+		next_info := infos[next.Addr]
+		if len(live) == 1 {
+			if next_info.Pred != nil {
+				return fmt.Errorf("single node %s has predecessor %s", addrStr(node.Addr), addrStr(*next_info.Pred))
+			}
+		} else if next_info.Pred == nil || *next_info.Pred != node.Addr || next_info.PredEnd != node.ID {
+			return fmt.Errorf("predecessor of %s is not %s", addrStr(next.Addr), addrStr(node.Addr))
+		}
+	}
+	return nil
+}
+
+/*
+Checks that every key is stored by exactly one live node and that the node is the owner of the key, i.e the first live
+node at or after the hash of the key
+*/
+func (r *Ring) CheckOwnership() error {
+	live := r.sorted()
+	stored := make(map[string]*Node)
+	for _, node := range live {
+		for key := range node.LN.Items() {
+			if other, ok := stored[key]; ok {
+				return fmt.Errorf("key %q is stored by %s and %s", key, addrStr(other.Addr), addrStr(node.Addr))
+			}
+			stored[key] = node
+		}
+	}
+	for key, node := range stored {
+		sha := CM.StrToSha(key)
+		i := sort.Search(len(live), func(i int) bool { return live[i].ID.Cmp(sha) != ring.Less })
+		if i == len(live) {
+			i = 0
+		}
+		if live[i] != node {
+			return fmt.Errorf("key %q is stored by %s but owned by %s", key, addrStr(node.Addr), addrStr(live[i].Addr))
+		}
+	}
+	return nil
+}
+
+/*
+Checks that every key of expected is stored by a live node with its value. Used to find lost writes
+*/
+func (r *Ring) CheckKeys(expected map[string]string) error {
+	found := make(map[string]string)
+	for _, node := range r.Live() {
+		for key, value := range node.LN.Items() {
+			found[key] = value
+		}
+	}
+	var errs []error
+	for key, value := range expected {
+		if got, ok := found[key]; !ok {
+			errs = append(errs, fmt.Errorf("key %q is lost", key))
+		} else if got != value {
+			errs = append(errs, fmt.Errorf("key %q has value %q, expected %q", key, got, value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/*
+Runs every invariant checker. Returns the errors of all failed checks
+*/
+func (r *Ring) Check() error {
+	return errors.Join(r.CheckCycle(), r.CheckOwnership())
+}
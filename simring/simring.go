@@ -0,0 +1,303 @@
+/*
+Package simring runs a chord ring of many nodes inside one test binary. Nodes talk through an in-memory transport, or through
+net/rpc on ephemeral ports of 127.0.0.1, each node with an rpc server of its own. The harness joins, kills and partitions nodes,
+and checks ring invariants such as every key having exactly one owner. See checks.go for the invariants.
+*/
+package simring
+
+import (
+	"context"
+	"fmt"
+	"go_dht/faultnet"
+	NA "go_dht/nodeapi"
+	"go_dht/ring"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type Options struct {
+	Network         bool              // serve nodes with net/rpc on ephemeral ports instead of the in-memory transport
+	ManualStabilize bool              // joins and leaves do not refresh the fingers of every node, tests call Stabilize themselves
+	Faults          *faultnet.Network // injects faults into the calls between nodes if set. Calls of Ring.Call are not affected
+}
+
+// a node of the simulated ring
+type Node struct {
+	Addr   NA.HostData
+	ID     ring.ID
+	LN     *NA.LocNodeStruct
+	closer io.Closer
+	alive  bool
+}
+
+type Ring struct {
+	t      testing.TB
+	opts   Options
+	chans  *NA.ChanTransport // shared by the nodes unless opts.Network
+	lock   sync.Mutex
+	nodes  []*Node
+	groups map[NA.HostData]int // partition group of each node. nil if the ring is not partitioned
+}
+
+/*
+Creates an empty ring. Nodes still running when the test ends are stopped
+*/
+func New(t testing.TB, opts Options) *Ring {
+	r := &Ring{t: t, opts: opts, chans: NA.NewChanTransport()}
+	t.Cleanup(r.Close)
+	return r
+}
+
+/*
+Transport of a node. Calls crossing a partition fail like calls to a dead node, others go to the shared transport
+*/
+type linkTransport struct {
+	r     *Ring
+	self  NA.HostData
+	inner NA.Transport
+}
+
+func (lt *linkTransport) Call(ctx context.Context, peer NA.HostData, method string, args interface{}, reply interface{}) error {
+	if !lt.r.Reachable(lt.self, peer) {
+		return NA.NewNapiConnError()
+	}
+	return lt.inner.Call(ctx, peer, method, args, reply)
+}
+
+func (lt *linkTransport) Serve(ln *NA.LocNodeStruct, listen_addr string) (io.Closer, error) {
+	return lt.inner.Serve(ln, listen_addr)
+}
+
+func (r *Ring) inner() NA.Transport {
+	if r.opts.Network {
+		return NA.RPCTransport{}
+	}
+	return r.chans
+}
+
+/*
+Adds a node with an id derived from its address like IDHostPort does
+*/
+func (r *Ring) Add() (*Node, error) {
+	return r.add(nil)
+}
+
+/*
+Adds a node with id
+*/
+func (r *Ring) AddWithID(id ring.ID) (*Node, error) {
+	return r.add(&id)
+}
+
+/*
+Adds n nodes with derived ids. Fails the test on the first error
+*/
+func (r *Ring) Grow(n int) []*Node {
+	ret := make([]*Node, n)
+	for i := range ret {
+		node, err := r.Add()
+		if err != nil {
+			r.t.Fatalf("Could not add node %d. err = %s\n", i, err.Error())
+		}
+		ret[i] = node
+	}
+	return ret
+}
+
+/*
+Creates the ring if no node is alive, else joins through the first live node. The node is served once it is set up.
+Lookups loop on stale fingers, so the fingers of every node are refreshed afterwards unless opts.ManualStabilize
+*/
+func (r *Ring) add(id *ring.ID) (*Node, error) {
+	var listener net.Listener
+	r.lock.Lock()
+	addr := NA.HostData{Hostname: "sim", Port: fmt.Sprint(len(r.nodes) + 1)}
+	r.lock.Unlock()
+	if r.opts.Network {
+		var err error
+		if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, err
+		}
+		addr.Hostname, addr.Port, _ = net.SplitHostPort(listener.Addr().String())
+	}
+	idcfg := &NA.IDConfig{Policy: NA.IDHostPort}
+	if id != nil {
+		idcfg = &NA.IDConfig{Policy: NA.IDExplicit, Explicit: *id}
+	}
+	var tr NA.Transport = &linkTransport{r: r, self: addr, inner: r.inner()}
+	if r.opts.Faults != nil {
+		tr = r.opts.Faults.Wrap(addr, tr)
+	}
+	var ln *NA.LocNodeStruct
+	var err error
+	if live := r.Live(); len(live) == 0 {
+		ln, err = NA.LocalInitWith(tr, addr.Hostname, addr.Port, idcfg, nil)
+	} else {
+		ln, err = NA.JoinWith(tr, addr.Hostname, addr.Port, idcfg, &live[0].Addr)
+	}
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, err
+	}
+	node := &Node{Addr: addr, LN: ln, alive: true}
+	info, _ := ln.Info()
+	node.ID = info.ID
+	if listener != nil {
+		NA.NapiServe(ln, listener)
+		node.closer = listener
+	} else if node.closer, err = ln.Serve(""); err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	r.nodes = append(r.nodes, node)
+	r.lock.Unlock()
+	if !r.opts.ManualStabilize {
+		return node, r.Stabilize()
+	}
+	return node, nil
+}
+
+/*
+Stops node after it hands its keys to its successor
+*/
+func (r *Ring) Leave(node *Node) error {
+	if err := NA.Leave(node.LN); err != nil {
+		return err
+	}
+	r.Kill(node)
+	if !r.opts.ManualStabilize {
+		return r.Stabilize()
+	}
+	return nil
+}
+
+/*
+Stops node without telling the ring. Its keys are lost and its neighbours keep pointing at it
+*/
+func (r *Ring) Kill(node *Node) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if node.alive {
+		node.alive = false
+		node.closer.Close()
+	}
+}
+
+/*
+Splits the ring into groups. Nodes can only reach nodes of their own group. Nodes in no group form one more group
+*/
+func (r *Ring) Partition(groups ...[]*Node) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.groups = make(map[NA.HostData]int)
+	for i, group := range groups {
+		for _, node := range group {
+			r.groups[node.Addr] = i + 1
+		}
+	}
+}
+
+/*
+Removes the partition
+*/
+func (r *Ring) Heal() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.groups = nil
+}
+
+/*
+True if calls from a to b are not cut by a partition
+*/
+func (r *Ring) Reachable(a NA.HostData, b NA.HostData) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.groups == nil || r.groups[a] == r.groups[b]
+}
+
+/*
+Returns every node added, dead or alive, in the order they were added
+*/
+func (r *Ring) Nodes() []*Node {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*Node{}, r.nodes...)
+}
+
+/*
+Returns the nodes that were not killed or left, in the order they were added
+*/
+func (r *Ring) Live() []*Node {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []*Node
+	for _, node := range r.nodes {
+		if node.alive {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+/*
+Returns the state of node. Works on dead nodes too, showing their state when they died
+*/
+func (r *Ring) Inspect(node *Node) (NA.NodeInfo, error) {
+	return node.LN.Info()
+}
+
+/*
+Refreshes the fingers of every live node. Joins and leaves only fix the fingers of the nodes next to them
+*/
+func (r *Ring) Stabilize() error {
+	for _, node := range r.Live() {
+		if err := node.LN.RefreshFingers(); err != nil {
+			return fmt.Errorf("refreshing fingers of %s:%s: %w", node.Addr.Hostname, node.Addr.Port, err)
+		}
+	}
+	return nil
+}
+
+/*
+Returns the transport clients outside the ring call nodes through. It ignores partitions
+*/
+func (r *Ring) Transport() NA.Transport {
+	return r.inner()
+}
+
+/*
+Calls method on node as a client outside of any partition would
+*/
+func (r *Ring) Call(node *Node, method string, args interface{}, reply interface{}) error {
+	return r.inner().Call(context.Background(), node.Addr, method, args, reply)
+}
+
+/*
+Puts key through node, which forwards it to the owner
+*/
+func (r *Ring) Put(node *Node, key string, value string) error {
+	var reply NA.HTReply
+	return r.Call(node, "NAPI.Put", &NA.HTArgs{Key: key, Value: value}, &reply)
+}
+
+/*
+Gets key through node, which forwards it to the owner
+*/
+func (r *Ring) Get(node *Node, key string) (string, error) {
+	var reply NA.HTReply
+	err := r.Call(node, "NAPI.Get", &NA.HTArgs{Key: key}, &reply)
+	return reply.Value, err
+}
+
+/*
+Stops every live node
+*/
+func (r *Ring) Close() {
+	for _, node := range r.Live() {
+		r.Kill(node)
+	}
+}
@@ -0,0 +1,373 @@
+package simring
+
+import (
+	"fmt"
+	CM "go_dht/chordmap"
+	"go_dht/faultnet"
+	NA "go_dht/nodeapi"
+	"sync"
+	"testing"
+	"time"
+)
+
+// puts n keys round robin through the live nodes and returns them
+func putKeys(t *testing.T, r *Ring, n int) map[string]string {
+	live := r.Live()
+	ret := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key, value := fmt.Sprint("key", i), fmt.Sprint("value", i)
+		if err := r.Put(live[i%len(live)], key, value); err != nil {
+			t.Fatalf("Put of %s failed. err = %s\n", key, err.Error())
+		}
+		ret[key] = value
+	}
+	return ret
+}
+
+func TestJoinLeave(t *testing.T) {
+	r := New(t, Options{})
+	r.Grow(8)
+	if err := r.Check(); err != nil {
+		t.Fatalf("Ring broken after joins. %s\n", err.Error())
+	}
+	if err := r.Stabilize(); err != nil {
+		t.Fatalf("Stabilize failed. err = %s\n", err.Error())
+	}
+	keys := putKeys(t, r, 200)
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken after puts. %s\n", err.Error())
+	}
+	// joins move keys to the new owners
+	r.Grow(4)
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken after joins with keys. %s\n", err.Error())
+	}
+	if err := r.CheckKeys(keys); err != nil {
+		t.Errorf("Keys lost in joins. %s\n", err.Error())
+	}
+	// leaves hand keys to the successors
+	for _, node := range r.Live()[:5] {
+		if err := r.Leave(node); err != nil {
+			t.Fatalf("Leave failed. err = %s\n", err.Error())
+		}
+	}
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken after leaves. %s\n", err.Error())
+	}
+	if err := r.CheckKeys(keys); err != nil {
+		t.Errorf("Keys lost in leaves. %s\n", err.Error())
+	}
+	r.Stabilize()
+	for _, node := range r.Live() {
+		if value, err := r.Get(node, "key7"); err != nil || value != keys["key7"] {
+			t.Errorf("Get through %s gave %s, err = %v\n", addrStr(node.Addr), value, err)
+		}
+	}
+}
+
+// checkers must notice a node that died without leaving
+func TestKill(t *testing.T) {
+	r := New(t, Options{})
+	nodes := r.Grow(4)
+	keys := putKeys(t, r, 50)
+	r.Kill(nodes[2])
+	if err := r.CheckCycle(); err == nil {
+		t.Errorf("CheckCycle should fail after a node is killed\n")
+	}
+	if len(nodes[2].LN.Items()) > 0 && r.CheckKeys(keys) == nil {
+		t.Errorf("CheckKeys should report the keys of the killed node\n")
+	}
+	if _, err := r.Get(nodes[2], "key1"); err == nil {
+		t.Errorf("Calls to a killed node should fail\n")
+	}
+}
+
+// index of the owner of key among the live nodes sorted by id
+func ownerOf(r *Ring, key string) int {
+	for i, node := range r.sorted() {
+		if CM.StrToSha(key).Cmp(node.ID) <= 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// nodes cannot forward requests across a partition
+func TestPartition(t *testing.T) {
+	r := New(t, Options{})
+	nodes := r.Grow(4)
+	r.Stabilize()
+	key := "partitioned"
+	owner := r.sorted()[ownerOf(r, key)]
+	var other *Node
+	for _, node := range nodes {
+		if node != owner {
+			other = node
+			break
+		}
+	}
+	r.Partition([]*Node{owner})
+	if r.Reachable(other.Addr, owner.Addr) {
+		t.Fatalf("Nodes in different groups should not reach each other\n")
+	}
+	if err := r.Put(other, key, "value"); err == nil {
+		t.Errorf("Put across the partition should fail\n")
+	}
+	if err := r.Put(owner, key, "value"); err != nil {
+		t.Errorf("Put on the owner should work in a partition. err = %s\n", err.Error())
+	}
+	r.Heal()
+	if value, err := r.Get(other, key); err != nil || value != "value" {
+		t.Errorf("Get after heal gave %s, err = %v\n", value, err)
+	}
+}
+
+// the same ring over net/rpc on ephemeral ports
+func TestNetwork(t *testing.T) {
+	r := New(t, Options{Network: true})
+	r.Grow(3)
+	r.Stabilize()
+	keys := putKeys(t, r, 30)
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken. %s\n", err.Error())
+	}
+	if err := r.CheckKeys(keys); err != nil {
+		t.Errorf("Keys lost. %s\n", err.Error())
+	}
+}
+
+// puts through one node of a ring with lossy links and returns which puts failed
+func lossyPuts(t *testing.T, seed int64) string {
+	net := faultnet.New(seed)
+	r := New(t, Options{Faults: net})
+	nodes := r.Grow(4)
+	net.SetDefault(faultnet.Rule{Drop: 0.2})
+	ret := ""
+	for i := 0; i < 40; i++ {
+		if r.Put(nodes[0], fmt.Sprint("key", i), "value") != nil {
+			ret += "1"
+		} else {
+			ret += "0"
+		}
+	}
+	if net.Stats().Dropped == 0 {
+		t.Errorf("Expected dropped calls\n")
+	}
+	return ret
+}
+
+// the same seed must fail the same puts
+func TestFaults(t *testing.T) {
+	first, second := lossyPuts(t, 42), lossyPuts(t, 42)
+	if first != second {
+		t.Errorf("Same seed gave different failures\n%s\n%s\n", first, second)
+	}
+}
+
+// clients keep calling while nodes join and leave. Calls may fail with busy or range errors but must not race or deadlock.
+// Run with -race
+func TestConcurrentLoad(t *testing.T) {
+	r := New(t, Options{})
+	r.Grow(4)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				live := r.Live()
+				node := live[i%len(live)]
+				key := fmt.Sprint("key", c, "-", i%20)
+				r.Put(node, key, "value")
+				r.Get(node, key)
+				var info NA.NodeInfo
+				none := false
+				r.Call(node, "NAPI.Info", &none, &info)
+			}
+		}(c)
+	}
+	r.Grow(4)
+	for _, node := range r.Live()[:3] {
+		if err := r.Leave(node); err != nil {
+			t.Errorf("Leave under load failed. err = %s\n", err.Error())
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken after load. %s\n", err.Error())
+	}
+}
+
+// joins and leaves split and merge sharded stores without losing keys
+func TestShardedStore(t *testing.T) {
+	NA.SetStoreShards(8)
+	defer NA.SetStoreShards(1)
+	r := New(t, Options{})
+	r.Grow(3)
+	keys := putKeys(t, r, 100)
+	r.Grow(3)
+	if err := r.Leave(r.Live()[0]); err != nil {
+		t.Fatalf("Leave failed. err = %s\n", err.Error())
+	}
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken. %s\n", err.Error())
+	}
+	if err := r.CheckKeys(keys); err != nil {
+		t.Errorf("Keys lost. %s\n", err.Error())
+	}
+}
+
+// every acknowledged write survives joins that run while it is made
+func TestJoinWrites(t *testing.T) {
+	r := New(t, Options{})
+	r.Grow(2)
+	stop := make(chan struct{})
+	var lock sync.Mutex
+	acked := make(map[string]string)
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key, value := fmt.Sprint("key", c, "-", i%50), fmt.Sprint(i)
+				for try := 0; ; try++ { // retried until acknowledged so no write is left in doubt
+					live := r.Live()
+					if r.Put(live[try%len(live)], key, value) == nil {
+						break
+					}
+					if try == 1000 {
+						t.Errorf("Put of %s never acknowledged\n", key)
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+				lock.Lock()
+				acked[key] = value
+				lock.Unlock()
+			}
+		}(c)
+	}
+	r.Grow(4)
+	close(stop)
+	wg.Wait()
+	if err := r.Check(); err != nil {
+		t.Errorf("Ring broken. %s\n", err.Error())
+	}
+	if err := r.CheckKeys(acked); err != nil {
+		t.Errorf("Writes lost during joins. %s\n", err.Error())
+	}
+}
+
+// writes are copied to the next nodes of the owner, and reads and writes need a quorum of the copies
+func TestReplication(t *testing.T) {
+	NA.SetReplication(3)
+	defer NA.SetReplication(1)
+	r := New(t, Options{})
+	r.Grow(4)
+	r.Stabilize()
+	keys := putKeys(t, r, 40)
+	sorted := r.sorted()
+	for key, value := range keys {
+		i := ownerOf(r, key)
+		owner := sorted[i]
+		for _, replica := range []*Node{sorted[(i+1)%4], sorted[(i+2)%4]} {
+			// the reply of a Put waits for one replica only
+			for deadline := time.Now().Add(5 * time.Second); replica.LN.ReplicaItems(owner.ID)[key] != value; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s should keep a copy of %s of %s\n", addrStr(replica.Addr), key, addrStr(owner.Addr))
+				}
+			}
+		}
+		if len(sorted[(i+3)%4].LN.ReplicaItems(owner.ID)) != 0 {
+			t.Errorf("Only the next 2 nodes should keep copies of %s\n", addrStr(owner.Addr))
+		}
+	}
+	for _, node := range r.Live() {
+		if value, err := r.Get(node, "key7"); err != nil || value != keys["key7"] {
+			t.Errorf("Get through %s gave %s, err = %v\n", addrStr(node.Addr), value, err)
+		}
+	}
+	// cut from its replicas, the owner has no quorum
+	key := "key7"
+	i := ownerOf(r, key)
+	owner, next := sorted[i], sorted[(i+1)%4]
+	r.Partition([]*Node{owner})
+	quorum := NA.NewNapiQuorumError().Error()
+	if err := r.Put(owner, key, "lost"); err == nil || err.Error() != quorum {
+		t.Errorf("Put without a quorum should give NapiQuorumError. Got %v\n", err)
+	}
+	if _, err := r.Get(owner, key); err == nil || err.Error() != quorum {
+		t.Errorf("Get without a quorum should give NapiQuorumError. Got %v\n", err)
+	}
+	// 2 of 3 copies are a quorum
+	r.Partition([]*Node{owner, next})
+	if err := r.Put(owner, key, "new"); err != nil {
+		t.Errorf("Put reaching 2 of 3 copies failed. err = %v\n", err)
+	}
+	if value, err := r.Get(owner, key); err != nil || value != "new" {
+		t.Errorf("Get reading 2 of 3 copies gave %s, err = %v\n", value, err)
+	}
+	if value := next.LN.ReplicaItems(owner.ID)[key]; value != "new" {
+		t.Errorf("Replica in the partition of the owner should keep the write. Got %s\n", value)
+	}
+}
+
+// a write missed by a partitioned replica is handed to a replica that took it, and delivered once the partition heals
+func TestHintedHandoff(t *testing.T) {
+	NA.SetReplication(3)
+	defer NA.SetReplication(1)
+	r := New(t, Options{})
+	r.Grow(4)
+	r.Stabilize()
+	sorted := r.sorted()
+	key := "hinted"
+	i := ownerOf(r, key)
+	owner, stand_in, replica := sorted[i], sorted[(i+1)%4], sorted[(i+2)%4]
+	r.Partition([]*Node{replica})
+	if err := r.Put(owner, key, "value"); err != nil {
+		t.Fatalf("Put reaching 2 of 3 copies failed. err = %v\n", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); stand_in.LN.HintStats().Pending != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Write missed by %s should be hinted to %s\n", addrStr(replica.Addr), addrStr(stand_in.Addr))
+		}
+	}
+	if owner.LN.HintStats().Stored != 0 || len(replica.LN.ReplicaItems(owner.ID)) != 0 {
+		t.Errorf("Hint should be kept by the stand-in only\n")
+	}
+	if n, _ := stand_in.LN.DeliverHints(); n != 0 {
+		t.Errorf("Hints should be kept while the replica cannot be reached. Delivered %d\n", n)
+	}
+	r.Heal()
+	if n, _ := stand_in.LN.DeliverHints(); n != 0 || stand_in.LN.HintStats().Suspected != 1 {
+		t.Errorf("Replica that could not be reached should be backed off. Delivered %d\n", n)
+	}
+	if err := stand_in.LN.Start(NA.Background{Hints: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Could not start the background tasks. err = %v\n", err)
+	}
+	defer stand_in.LN.Stop()
+	for deadline := time.Now().Add(5 * time.Second); stand_in.LN.HintStats().Pending != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Hint should be delivered once the partition heals and the backoff is over\n")
+		}
+	}
+	if value := replica.LN.ReplicaItems(owner.ID)[key]; value != "value" {
+		t.Errorf("Replica should keep the hinted write in its copy of the range of the owner. Got %q\n", value)
+	}
+	if stats := stand_in.LN.HintStats(); stats != (NA.HintStats{Stored: 1, Delivered: 1}) {
+		t.Errorf("Wrong hint stats %+v\n", stats)
+	}
+}
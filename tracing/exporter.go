@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+Exporter writing every span as a line of OTLP/JSON, an ExportTraceServiceRequest holding the single span. Lines can be read by the
+otlpjsonfile receiver of the OpenTelemetry collector. Safe for concurrent use
+*/
+type WriterExporter struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer // nil if the writer is not owned by the exporter
+}
+
+/*
+Returns an exporter writing to w, e.g os.Stdout
+*/
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+/*
+Returns an exporter appending to the file at path, created if missing. Close closes the file
+*/
+func OpenFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{w: f, closer: f}, nil
+}
+
+// OTLP/JSON messages. Ids are hex, 64 bit integers decimal strings and enums numbers, as the OTLP JSON mapping asks
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Flags             uint32          `json:"flags"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(a Attribute) otlpAttribute {
+	ret := otlpAttribute{Key: a.Key}
+	switch v := a.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		ret.Value.IntValue = &s
+	case float64:
+		ret.Value.DoubleValue = &v
+	case bool:
+		ret.Value.BoolValue = &v
+	case string:
+		ret.Value.StringValue = &v
+	default: // not a valid attribute type, kept as text
+		s := fmt.Sprint(v)
+		ret.Value.StringValue = &s
+	}
+	return ret
+}
+
+func otlpAttrs(attrs []Attribute) []otlpAttribute {
+	ret := make([]otlpAttribute, len(attrs))
+	for i, a := range attrs {
+		ret[i] = otlpAttr(a)
+	}
+	return ret
+}
+
+// OTLP/JSON request holding span
+func otlpOf(span *SpanData) otlpRequest {
+	sc := span.SpanContext
+	s := otlpSpan{
+		TraceID:           sc.TraceID.String(),
+		SpanID:            sc.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        otlpAttrs(span.Attributes),
+		Status:            otlpStatus{Code: span.Status, Message: span.StatusMessage}}
+	if span.Parent != (SpanID{}) {
+		s.ParentSpanID = span.Parent.String()
+	}
+	if sc.Sampled {
+		s.Flags = 1
+	}
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = otlpAttrs([]Attribute{String("service.name", span.Service)})
+	ss := otlpScopeSpans{Spans: []otlpSpan{s}}
+	ss.Scope.Name = "go_dht/tracing"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func (e *WriterExporter) Export(span *SpanData) error {
+	data, err := json.Marshal(otlpOf(span))
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+/*
+Closes the file of an exporter made by OpenFileExporter. Does nothing for other writers
+*/
+func (e *WriterExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
@@ -0,0 +1,271 @@
+/*
+Package tracing records traces in the OpenTelemetry model without linking the OpenTelemetry SDK. A trace is a tree of spans, each a
+timed operation with attributes and a status. A span started from a context holding a span is its child. Span contexts cross
+process boundaries in the W3C traceparent format, so a trace goes on through any node or tracer speaking it. Ended spans are handed
+to an Exporter. WriterExporter writes them as OTLP/JSON lines, the format of the file exporter of the OpenTelemetry collector,
+which the collector can read back and send on to any tracing backend.
+A nil *Tracer records nothing, and the methods of a nil *Span do nothing, so code can trace unconditionally.
+*/
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+/*
+Identifies a span across processes. Sampled tells if the trace is recorded. Children follow the choice of their parent, so traces
+are recorded whole or not at all
+*/
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+/*
+True unless the trace or span id is all zeros, which the W3C format reserves for invalid contexts
+*/
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+/*
+Returns sc in the W3C traceparent format, e.g "00-<trace id>-<span id>-01"
+*/
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+/*
+Parses a W3C traceparent. Versions above 00 are read as 00, as the W3C spec asks
+*/
+func ParseTraceparent(s string) (SpanContext, error) {
+	var ret SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return ret, fmt.Errorf("malformed traceparent %q", s)
+	}
+	var flags [1]byte
+	_, err1 := hex.Decode(ret.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(ret.SpanID[:], []byte(parts[2]))
+	_, err3 := hex.Decode(flags[:], []byte(parts[3]))
+	if err1 != nil || err2 != nil || err3 != nil || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		!ret.IsValid() {
+		return SpanContext{}, fmt.Errorf("malformed traceparent %q", s)
+	}
+	ret.Sampled = flags[0]&1 == 1
+	return ret, nil
+}
+
+// values of the OTLP span kind enum
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2 // handling a call from another process
+	KindClient   SpanKind = 3 // calling another process
+)
+
+// values of the OTLP status code enum
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+/*
+Attribute of a span. Value is a string, int64, float64 or bool
+*/
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+/*
+An ended span, as handed to exporters
+*/
+type SpanData struct {
+	Service       string // service.name of the tracer that recorded the span
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanID // zero for the root of a trace
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+}
+
+/*
+Receives ended spans. Export is called by the goroutine ending the span, so it must be safe for concurrent use and should be quick
+*/
+type Exporter interface {
+	Export(span *SpanData) error
+}
+
+/*
+Starts spans and hands them to an exporter once they end
+*/
+type Tracer struct {
+	service  string
+	exporter Exporter
+	sample   float64
+}
+
+/*
+Returns a tracer exporting to exporter. service is the service.name of the spans. Traces started by the tracer are recorded with
+probability sample in [0, 1]. Traces continued from a remote parent follow the choice of the parent
+*/
+func NewTracer(service string, exporter Exporter, sample float64) *Tracer {
+	return &Tracer{service: service, exporter: exporter, sample: sample}
+}
+
+/*
+Span being recorded. Safe for concurrent use
+*/
+type Span struct {
+	tracer *Tracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+type spanKey struct{}
+
+/*
+Returns the span context held by ctx, that of the current span or a remote parent. The zero SpanContext if there is none
+*/
+func SpanContextFrom(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanKey{}).(SpanContext)
+	return sc
+}
+
+/*
+Returns a copy of ctx holding sc, e.g the span context sent by the caller. Spans started from the returned context are children
+of sc
+*/
+func WithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+func randomID(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		x := rand.Uint64()
+		for j := i; j < len(b) && j < i+8; j++ {
+			b[j] = byte(x)
+			x >>= 8
+		}
+	}
+}
+
+/*
+Starts a span named name, the child of the span held by ctx if any. Returns a copy of ctx holding the new span, to start children
+from and to pass to calls to other processes. A nil tracer returns ctx and a nil span
+*/
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFrom(ctx)
+	span := &Span{tracer: t, data: SpanData{Service: t.service, Name: name, Kind: kind, Start: time.Now(),
+		Attributes: append([]Attribute(nil), attrs...)}}
+	sc := &span.data.SpanContext
+	if parent.IsValid() {
+		sc.TraceID, sc.Sampled = parent.TraceID, parent.Sampled
+		span.data.Parent = parent.SpanID
+	} else {
+		for sc.TraceID == (TraceID{}) {
+			randomID(sc.TraceID[:])
+		}
+		sc.Sampled = rand.Float64() < t.sample
+	}
+	for sc.SpanID == (SpanID{}) {
+		randomID(sc.SpanID[:])
+	}
+	return WithSpanContext(ctx, *sc), span
+}
+
+/*
+Adds attributes to the span
+*/
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+/*
+Returns the span context of the span. The zero SpanContext for a nil span
+*/
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+/*
+Ends the span with the status of err, ok if nil, and exports it if its trace is sampled. Later calls do nothing. Returns the error of
+the exporter
+*/
+func (s *Span) End(err error) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return nil
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.Status = StatusOK
+	if err != nil {
+		s.data.Status, s.data.StatusMessage = StatusError, err.Error()
+	}
+	data := s.data
+	s.lock.Unlock()
+	if !data.SpanContext.Sampled || s.tracer.exporter == nil {
+		return nil
+	}
+	return s.tracer.exporter.Export(&data)
+}
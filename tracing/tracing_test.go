@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// keeps exported spans
+type memExporter struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+func (m *memExporter) Export(span *SpanData) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.spans = append(m.spans, *span)
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	sc := SpanContext{Sampled: true}
+	sc.TraceID[0], sc.TraceID[15], sc.SpanID[7] = 0x4b, 0x36, 0xf7
+	text := sc.Traceparent()
+	if text != "00-4b000000000000000000000000000036-00000000000000f7-01" {
+		t.Errorf("Wrong traceparent %s\n", text)
+	}
+	if got, err := ParseTraceparent(text); err != nil || got != sc {
+		t.Errorf("Parsed %+v, err = %v\n", got, err)
+	}
+	if got, err := ParseTraceparent("01-4b000000000000000000000000000036-00000000000000f7-00-future"); err != nil || got.Sampled {
+		t.Errorf("Later versions should be read as 00. Got %+v, err = %v\n", got, err)
+	}
+	for _, bad := range []string{"", "00-4b-f7-01", "00-00000000000000000000000000000000-00000000000000f7-01",
+		"ff-4b000000000000000000000000000036-00000000000000f7-01", "00-4b000000000000000000000000000036-00000000000000f7-01-x",
+		"00-4b00000000000000000000000000003g-00000000000000f7-01"} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("%q should not parse\n", bad)
+		}
+	}
+}
+
+// children share the trace of their parent, remote parents included, and follow its sampling
+func TestSpans(t *testing.T) {
+	exp := &memExporter{}
+	tracer := NewTracer("test", exp, 1)
+	ctx, root := tracer.Start(context.Background(), "root", KindServer, String("k", "v"))
+	_, child := tracer.Start(ctx, "child", KindClient)
+	child.SetAttributes(Int("n", 3))
+	child.End(errors.New("failed"))
+	child.End(nil) // ignored
+	root.End(nil)
+	if len(exp.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d\n", len(exp.spans))
+	}
+	c, r := exp.spans[0], exp.spans[1]
+	if c.SpanContext.TraceID != r.SpanContext.TraceID || c.Parent != r.SpanContext.SpanID || r.Parent != (SpanID{}) {
+		t.Errorf("Child %+v is not in the trace of root %+v\n", c.SpanContext, r.SpanContext)
+	}
+	if c.Status != StatusError || c.StatusMessage != "failed" || r.Status != StatusOK || len(c.Attributes) != 1 || len(r.Attributes) != 1 {
+		t.Errorf("Wrong status or attributes %+v %+v\n", c, r)
+	}
+	remote := r.SpanContext
+	remote.Sampled = false
+	_, unsampled := NewTracer("test", exp, 1).Start(WithSpanContext(context.Background(), remote), "remote", KindServer)
+	unsampled.End(nil)
+	_, none := NewTracer("test", exp, 0).Start(context.Background(), "dropped", KindServer)
+	none.End(nil)
+	var nil_tracer *Tracer
+	_, nil_span := nil_tracer.Start(context.Background(), "nothing", KindServer)
+	nil_span.SetAttributes(Bool("b", true))
+	nil_span.End(nil)
+	if len(exp.spans) != 2 || unsampled.SpanContext().TraceID != remote.TraceID {
+		t.Errorf("Unsampled traces should not be exported\n")
+	}
+}
+
+// spans are written as OTLP/JSON lines
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer("dht", NewWriterExporter(&buf), 1)
+	ctx, root := tracer.Start(context.Background(), "NAPI.Get", KindServer, String("key", "k"), Int("finger", 4), Bool("ok", true))
+	_, child := tracer.Start(ctx, "NAPI.Find", KindClient)
+	child.End(nil)
+	root.End(errors.New("boom"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q\n", buf.String())
+	}
+	var request otlpRequest
+	if err := json.Unmarshal([]byte(lines[1]), &request); err != nil {
+		t.Fatalf("Line is not JSON. err = %s\n", err.Error())
+	}
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.Name != "NAPI.Get" || span.Kind != KindServer || span.TraceID != root.SpanContext().TraceID.String() || span.ParentSpanID != "" ||
+		span.Status.Code != StatusError || span.Status.Message != "boom" || span.Flags != 1 {
+		t.Errorf("Wrong span %+v\n", span)
+	}
+	if *request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != "dht" || *span.Attributes[1].Value.IntValue != "4" ||
+		!*span.Attributes[2].Value.BoolValue {
+		t.Errorf("Wrong attributes in %s\n", lines[1])
+	}
+	if !strings.Contains(lines[0], `"parentSpanId":"`+root.SpanContext().SpanID.String()+`"`) {
+		t.Errorf("Child should name its parent: %s\n", lines[0])
+	}
+}